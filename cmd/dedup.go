@@ -2,11 +2,22 @@ package main
 
 
 import (
+    "context"
+    "encoding/json"
     "fmt"
     "flag"
+    "log/slog"
     "os"
+    "os/signal"
+    "sort"
+    "strconv"
+    "strings"
+    "syscall"
+    "time"
     "github.com/IGVF-DACC/go-sqs-deduplication/internal/sqs"
     "github.com/IGVF-DACC/go-sqs-deduplication/internal/dedup"
+    "github.com/IGVF-DACC/go-sqs-deduplication/internal/disk"
+    "github.com/IGVF-DACC/go-sqs-deduplication/internal/metrics"
 )
 
 
@@ -17,38 +28,173 @@ type CommandLineOptions struct {
     QueueURL string
     StorageQueueURL string
     ProfileName string
+    EndpointURL string
     NumWorkers int
     MaxInflight int
     TimeLimitInSeconds int
     RunForever bool
     SecondsToSleepBetweenRuns int
     ShowVersion bool
+    ReportJSON bool
+    MaxRetryAttempts int
+    RetryBaseDelay time.Duration
+    RetryMaxDelay time.Duration
+    RetryJitter float64
+    DryRun bool
+    DryRunRecordIDs bool
+    Parser string
+    ParserOptions parserOptionsFlag
+    ListParsers bool
+    Envelope string
+    UniqueKeyPaths string
+    UniqueKeySeparator string
+    LowerCaseKeys bool
+    TrimKeys bool
+    ResolutionPolicy string
+    ResolutionField string
+    VisibilityTimeout time.Duration
+    VisibilityExtensionWindow time.Duration
+    PoisonMessageAction string
+    DeadLetterQueueURL string
+    MetricsAddr string
+    LogFormat string
+    LogLevel string
+    ExpectedStoredMessages int
+    StoredFalsePositiveRate float64
+    Storage string
+    StorageDir string
+    JournalPath string
+}
+
+
+// Repeatable -parserOption flag, each name=value.
+type parserOptionsFlag sqs.ParserOptions
+
+
+func (f *parserOptionsFlag) String() string {
+    var options []string
+    for name, value := range *f {
+        options = append(options, name + "=" + value)
+    }
+    return strings.Join(options, ",")
+}
+
+
+func (f *parserOptionsFlag) Set(option string) error {
+    name, value, err := sqs.ParseParserOption(option)
+    if err != nil {
+        return err
+    }
+    if *f == nil {
+        *f = make(parserOptionsFlag)
+    }
+    (*f)[name] = value
+    return nil
+}
+
+
+func printParsers() {
+    for _, definition := range sqs.Parsers() {
+        fmt.Printf("  %s\n    \t%s\n", definition.Name, definition.Description)
+        var names []string
+        for name := range definition.Options {
+            names = append(names, name)
+        }
+        sort.Strings(names)
+        for _, name := range names {
+            fmt.Printf("    -parserOption %s=...\n      \t%s\n", name, definition.Options[name])
+        }
+    }
 }
 
 
 func parseCommandLineOptions() CommandLineOptions {
     var opts CommandLineOptions
     flag.StringVar(&opts.QueueURL, "queueURL", "", "SQS URL (required)")
-    flag.StringVar(&opts.StorageQueueURL, "storageQueueURL", "", "SQS URL used for storage (required)")
+    flag.StringVar(&opts.StorageQueueURL, "storageQueueURL", "", "SQS URL used for storage (required for queue storage)")
+    flag.StringVar(&opts.Storage, "storage", "queue", "Where messages are flushed when max inflight is reached: queue or file")
+    flag.StringVar(&opts.StorageDir, "storageDir", "", "Directory messages are flushed to (required for file storage)")
+    flag.StringVar(&opts.JournalPath, "journalPath", "", "File every run journals its moves to, so a run that died midway is reconciled by the next (disabled if empty)")
     flag.StringVar(&opts.ProfileName, "profileName", "", "AWS profile to use")
+    flag.StringVar(&opts.EndpointURL, "endpointURL", "", "Endpoint of SQS-compatible service to use instead of AWS (defaults to LOCALSTACK_ENDPOINT_URL if set)")
     flag.IntVar(&opts.NumWorkers, "numWorkers", 20, "Number of concurrent workers to use")
     flag.IntVar(&opts.MaxInflight, "maxInflight", 100000, "Maximum number of inflight messages allowed by queue")
     flag.IntVar(&opts.TimeLimitInSeconds, "timeLimitInSeconds", 600, "Time limit for pullers to run even if messages still exist on queue")
     flag.BoolVar(&opts.RunForever, "runForever", false, "Runs in a loop with secondsToSleepBetweenRuns")
     flag.IntVar(&opts.SecondsToSleepBetweenRuns,"secondsToSleepBetweenRuns", 60, "Time to sleep between runs if running forever")
     flag.BoolVar(&opts.ShowVersion, "version", false, "Show version")
+    flag.IntVar(&opts.MaxRetryAttempts, "maxRetryAttempts", 5, "Maximum attempts for each SQS request, including the first")
+    flag.DurationVar(&opts.RetryBaseDelay, "retryBaseDelay", 100 * time.Millisecond, "Delay before first retry, doubles every attempt")
+    flag.DurationVar(&opts.RetryMaxDelay, "retryMaxDelay", 5 * time.Second, "Maximum delay between retries")
+    flag.Float64Var(&opts.RetryJitter, "retryJitter", 0.5, "Fraction of retry delay that is randomized, between 0 and 1")
+    flag.BoolVar(&opts.DryRun, "dryRun", false, "Find duplicates without deleting or moving messages, all pulled messages are reset")
+    flag.BoolVar(&opts.DryRunRecordIDs, "dryRunRecordIDs", false, "Include receipt handles and message IDs in dry run report")
+    flag.StringVar(&opts.Parser, "parser", sqs.InvalidationParserName, "Message parser working out unique IDs, see -listParsers")
+    flag.Var(&opts.ParserOptions, "parserOption", "Option of the message parser as name=value, can be repeated")
+    flag.BoolVar(&opts.ListParsers, "listParsers", false, "List message parsers and their options")
+    flag.StringVar(&opts.Envelope, "envelope", "none", "Envelope unwrapped from bodies before parsing: none, sns, eventbridge, auto, or a comma separated chain, e.g. sns,eventbridge")
+    flag.StringVar(&opts.UniqueKeyPaths, "uniqueKeyPaths", "", "JSON paths combined into unique ID, comma separated, with | separated fallbacks, e.g. '$.data.uuid|$.uuid,$.metadata.tid' (shorthand for the json-path parser)")
+    flag.StringVar(&opts.UniqueKeySeparator, "uniqueKeySeparator", ":", "Separator used to join values of uniqueKeyPaths")
+    flag.BoolVar(&opts.LowerCaseKeys, "lowerCaseKeys", false, "Lower-case values of uniqueKeyPaths")
+    flag.BoolVar(&opts.TrimKeys, "trimKeys", false, "Trim whitespace from values of uniqueKeyPaths")
+    flag.StringVar(&opts.ResolutionPolicy, "resolutionPolicy", "first-seen", "Which duplicate to keep: first-seen, oldest-sent, newest-sent, or highest-field")
+    flag.StringVar(&opts.ResolutionField, "resolutionField", "$.metadata.xid", "JSON path of numeric field used by highest-field resolution policy")
+    flag.DurationVar(&opts.VisibilityTimeout, "visibilityTimeout", 15 * time.Minute, "Visibility timeout of pulled messages, extended while messages are held")
+    flag.DurationVar(&opts.VisibilityExtensionWindow, "visibilityExtensionWindow", 0, "Extend visibility of held messages when less than this is left, below visibilityTimeout (defaults to a third of visibilityTimeout)")
+    flag.StringVar(&opts.PoisonMessageAction, "poisonMessageAction", "ignore", "What to do with messages that can't be parsed: ignore, reset, or dead-letter")
+    flag.StringVar(&opts.DeadLetterQueueURL, "deadLetterQueueURL", "", "SQS URL that unparseable messages are moved to (required for dead-letter poisonMessageAction)")
+    flag.StringVar(&opts.LogFormat, "logFormat", "text", "Log output format: text or json")
+    flag.StringVar(&opts.LogLevel, "logLevel", "info", "Minimum log level: debug, info, warn, or error (debug includes per-batch lines)")
+    flag.StringVar(&opts.MetricsAddr, "metricsAddr", "", "Address to serve Prometheus metrics on at /metrics, e.g. ':9090' (disabled if empty)")
+    flag.IntVar(&opts.ExpectedStoredMessages, "expectedStoredMessages", 0, "Track messages flushed to storage in Bloom filters sized for this many instead of exactly (disabled if 0)")
+    flag.Float64Var(&opts.StoredFalsePositiveRate, "storedFalsePositiveRate", dedup.DefaultStoredFalsePositiveRate, "False positive rate of expectedStoredMessages filters, false positives are kept, never deleted")
+    flag.BoolVar(&opts.ReportJSON, "reportJSON", false, "Print run report as a single line of JSON after every run")
     flag.Parse()
     if opts.ShowVersion {
         fmt.Println(Version)
         os.Exit(0)
     }
+    if opts.ListParsers {
+        printParsers()
+        os.Exit(0)
+    }
     if opts.QueueURL == "" {
         fmt.Println("The 'queueURL' flag is required")
         flag.PrintDefaults()
         os.Exit(1)
     }
-    if opts.StorageQueueURL == "" {
-        fmt.Println("The 'storageQueueURL' flag is required")
+    switch opts.Storage {
+    case "queue":
+        if opts.StorageQueueURL == "" {
+            fmt.Println("The 'storageQueueURL' flag is required for queue storage")
+            flag.PrintDefaults()
+            os.Exit(1)
+        }
+    case "file":
+        if opts.StorageDir == "" {
+            fmt.Println("The 'storageDir' flag is required for file storage")
+            flag.PrintDefaults()
+            os.Exit(1)
+        }
+    default:
+        fmt.Printf("Unknown storage %q, expected queue or file\n", opts.Storage)
+        flag.PrintDefaults()
+        os.Exit(1)
+    }
+    if opts.PoisonMessageAction == string(sqs.PoisonDeadLetter) && opts.DeadLetterQueueURL == "" {
+        fmt.Println("The 'deadLetterQueueURL' flag is required for dead-letter poisonMessageAction")
+        flag.PrintDefaults()
+        os.Exit(1)
+    }
+    if opts.VisibilityExtensionWindow != 0 {
+        if err := dedup.ValidateVisibilityExtensionWindow(opts.VisibilityTimeout, opts.VisibilityExtensionWindow); err != nil {
+            fmt.Println("The 'visibilityExtensionWindow' flag is invalid:", err)
+            flag.PrintDefaults()
+            os.Exit(1)
+        }
+    }
+    if opts.StoredFalsePositiveRate <= 0 || opts.StoredFalsePositiveRate >= 1 {
+        fmt.Println("The 'storedFalsePositiveRate' flag must be between 0 and 1")
         flag.PrintDefaults()
         os.Exit(1)
     }
@@ -56,32 +202,233 @@ func parseCommandLineOptions() CommandLineOptions {
 }
 
 
+func getMessageParser(opts CommandLineOptions) (sqs.MessageParser, error) {
+    options := make(sqs.ParserOptions)
+    for name, value := range opts.ParserOptions {
+        options[name] = value
+    }
+    parser := opts.Parser
+    if opts.UniqueKeyPaths != "" {
+        // Flags of the json-path parser from before parsers could be selected.
+        if parser != sqs.InvalidationParserName && parser != sqs.JSONPathParserName {
+            return nil, fmt.Errorf("uniqueKeyPaths only applies to the %s parser", sqs.JSONPathParserName)
+        }
+        parser = sqs.JSONPathParserName
+        for _, name := range []string{"keys", "separator", "lowerCase", "trimSpace"} {
+            if _, ok := options[name]; ok {
+                return nil, fmt.Errorf("parserOption %s can't be combined with uniqueKeyPaths, which sets it", name)
+            }
+        }
+        options["keys"] = opts.UniqueKeyPaths
+        options["separator"] = opts.UniqueKeySeparator
+        options["lowerCase"] = strconv.FormatBool(opts.LowerCaseKeys)
+        options["trimSpace"] = strconv.FormatBool(opts.TrimKeys)
+    }
+    return sqs.NewParser(parser, options)
+}
+
+
+func getResolutionPolicy(opts CommandLineOptions, envelopes sqs.Envelopes) (dedup.ResolutionPolicy, error) {
+    switch opts.ResolutionPolicy {
+    case "first-seen":
+        return dedup.FirstSeenPolicy{}, nil
+    case "oldest-sent":
+        return dedup.OldestSentPolicy{}, nil
+    case "newest-sent":
+        return dedup.NewestSentPolicy{}, nil
+    case "highest-field":
+        path, err := sqs.ParseJSONPath(opts.ResolutionField)
+        if err != nil {
+            return nil, err
+        }
+        return dedup.HighestNumericFieldPolicy{Value: sqs.EnvelopedNumericFieldValue(path, envelopes)}, nil
+    }
+    return nil, fmt.Errorf("unknown resolution policy %q", opts.ResolutionPolicy)
+}
+
+
+func getLogger(opts CommandLineOptions) (*slog.Logger, error) {
+    var level slog.Level
+    if err := level.UnmarshalText([]byte(opts.LogLevel)); err != nil {
+        return nil, fmt.Errorf("unknown log level %q", opts.LogLevel)
+    }
+    handlerOptions := &slog.HandlerOptions{Level: level}
+    switch opts.LogFormat {
+    case "text":
+        return dedup.WithRunID(slog.New(slog.NewTextHandler(os.Stderr, handlerOptions))), nil
+    case "json":
+        return dedup.WithRunID(slog.New(slog.NewJSONHandler(os.Stderr, handlerOptions))), nil
+    }
+    return nil, fmt.Errorf("unknown log format %q", opts.LogFormat)
+}
+
+
+// Reports are the only output on stdout, logs go to stderr.
+func printReport(report dedup.RunReport, err error) {
+    if err != nil {
+        fmt.Fprintln(os.Stderr, "Run stopped early:", err)
+    }
+    reportJSON, err := json.Marshal(report)
+    if err != nil {
+        fmt.Fprintln(os.Stderr, "Error marshaling run report to JSON", err)
+        return
+    }
+    fmt.Println(string(reportJSON))
+}
+
+
 func main() {
     opts := parseCommandLineOptions()
-    fmt.Printf("Got command-line arguments: %+v\n", opts)
+    logger, err := getLogger(opts)
+    if err != nil {
+        fmt.Fprintln(os.Stderr, "Error creating logger", err)
+        os.Exit(1)
+    }
+    slog.SetDefault(logger)
+    logger.Info("Got command-line arguments", "options", fmt.Sprintf("%+v", opts))
+    envelopes, err := sqs.ParseEnvelopes(opts.Envelope)
+    if err != nil {
+        logger.Error("Error parsing envelope", "error", err)
+        os.Exit(1)
+    }
+    resolutionPolicy, err := getResolutionPolicy(opts, envelopes)
+    if err != nil {
+        logger.Error("Error creating resolution policy", "error", err)
+        os.Exit(1)
+    }
+    retryPolicy := &sqs.RetryPolicy{
+        MaxAttempts: opts.MaxRetryAttempts,
+        BaseDelay: opts.RetryBaseDelay,
+        MaxDelay: opts.RetryMaxDelay,
+        Jitter: opts.RetryJitter,
+        IsRetryable: sqs.IsRetryableError,
+    }
+    messageParser, err := getMessageParser(opts)
+    if err != nil {
+        logger.Error("Error creating message parser", "error", err)
+        os.Exit(1)
+    }
+    poisonMessageAction, err := sqs.ParsePoisonAction(opts.PoisonMessageAction)
+    if err != nil {
+        logger.Error("Error parsing poison message action", "error", err)
+        os.Exit(1)
+    }
+    if opts.DryRun && poisonMessageAction == sqs.PoisonDeadLetter {
+        logger.Warn("Dry run, unparseable messages will be reset instead of dead-lettered")
+        poisonMessageAction = sqs.PoisonReset
+    }
+    var deadLetterQueueURL *string
+    if opts.DeadLetterQueueURL != "" {
+        deadLetterQueueURL = &opts.DeadLetterQueueURL
+    }
     config := &sqs.QueueConfig{
         QueueUrl: &opts.QueueURL,
         ProfileName: opts.ProfileName,
-        MessageParser: sqs.InvalidationQueueMessageParser, // Use custom parser for other message formats.
+        EndpointURL: opts.EndpointURL,
+        MessageParser: messageParser,
+        Envelopes: envelopes,
+        RetryPolicy: retryPolicy,
+        VisibilityTimeout: opts.VisibilityTimeout,
+        PoisonMessageAction: poisonMessageAction,
+        DeadLetterQueueUrl: deadLetterQueueURL,
+        Logger: logger,
     }
-    queue := sqs.NewQueue(config) // Use different queue implementation for other queue types.
-    storageConfig := &sqs.QueueConfig{
-        QueueUrl: &opts.StorageQueueURL,
-        ProfileName: opts.ProfileName,
-        MessageParser: sqs.InvalidationQueueMessageParser,
-    }
-    storageQueue := sqs.NewQueue(storageConfig)
-    deduplicator := dedup.NewDeduplicator(
-        &dedup.DeduplicatorConfig{
-            Queue: queue,
-            StorageQueue: storageQueue,
-            NumWorkers: opts.NumWorkers,
-            MaxInflight: opts.MaxInflight,
-            TimeLimitInSeconds: opts.TimeLimitInSeconds,
+    var queue dedup.Queue = sqs.NewQueue(config) // Use different queue implementation for other queue types.
+    var storageQueue dedup.Queue
+    var storage dedup.Storage
+    if opts.Storage == "file" {
+        diskStorage, err := disk.NewStorage(&disk.StorageConfig{
+            Dir: opts.StorageDir,
+            VisibilityTimeout: opts.VisibilityTimeout,
+            Logger: logger,
         })
+        if err != nil {
+            logger.Error("Error opening file storage", "error", err)
+            os.Exit(1)
+        }
+        defer diskStorage.Close()
+        storage = diskStorage
+    } else {
+        storageConfig := &sqs.QueueConfig{
+            QueueUrl: &opts.StorageQueueURL,
+            ProfileName: opts.ProfileName,
+            EndpointURL: opts.EndpointURL,
+            MessageParser: messageParser,
+            // Stored messages keep their full body, envelope included.
+            Envelopes: envelopes,
+            RetryPolicy: retryPolicy,
+            VisibilityTimeout: opts.VisibilityTimeout,
+            PoisonMessageAction: poisonMessageAction,
+            DeadLetterQueueUrl: deadLetterQueueURL,
+            Logger: logger,
+        }
+        storageQueue = sqs.NewQueue(storageConfig)
+    }
+    var journal *dedup.Journal
+    if opts.JournalPath != "" {
+        var err error
+        journal, err = dedup.OpenJournal(opts.JournalPath)
+        if err != nil {
+            logger.Error("Error opening journal", "error", err)
+            os.Exit(1)
+        }
+        defer journal.Close()
+    }
+    var runReportHandlers []func(dedup.RunReport, error)
+    if opts.ReportJSON {
+        runReportHandlers = append(runReportHandlers, printReport)
+    }
+    var deduplicatorMetrics *metrics.Metrics
+    if opts.MetricsAddr != "" {
+        deduplicatorMetrics = metrics.NewMetrics()
+        queue = deduplicatorMetrics.InstrumentQueue("queue", queue)
+        if storageQueue != nil {
+            storageQueue = deduplicatorMetrics.InstrumentQueue("storage", storageQueue)
+        }
+        runReportHandlers = append(runReportHandlers, deduplicatorMetrics.ObserveRun)
+    }
+    deduplicatorConfig := &dedup.DeduplicatorConfig{
+        Queue: queue,
+        StorageQueue: storageQueue,
+        Storage: storage,
+        NumWorkers: opts.NumWorkers,
+        MaxInflight: opts.MaxInflight,
+        TimeLimitInSeconds: opts.TimeLimitInSeconds,
+        DryRun: opts.DryRun,
+        DryRunRecordIDs: opts.DryRunRecordIDs,
+        ResolutionPolicy: resolutionPolicy,
+        VisibilityTimeout: opts.VisibilityTimeout,
+        VisibilityExtensionWindow: opts.VisibilityExtensionWindow,
+        Logger: logger,
+        ExpectedStoredMessages: opts.ExpectedStoredMessages,
+        StoredFalsePositiveRate: opts.StoredFalsePositiveRate,
+        Journal: journal,
+    }
+    if len(runReportHandlers) > 0 {
+        deduplicatorConfig.RunReportHandler = func(report dedup.RunReport, err error) {
+            for _, handler := range runReportHandlers {
+                handler(report, err)
+            }
+        }
+    }
+    deduplicator := dedup.NewDeduplicator(deduplicatorConfig)
+    // Stop pulling on SIGTERM/SIGINT, deduplicator still restores and resets messages before exiting.
+    ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+    defer stop()
+    if deduplicatorMetrics != nil {
+        deduplicatorMetrics.ObserveState(deduplicator.State())
+        go func() {
+            if err := deduplicatorMetrics.Serve(ctx, opts.MetricsAddr); err != nil {
+                logger.Error("Error serving metrics", "error", err)
+            }
+        }()
+    }
     if opts.RunForever {
-        deduplicator.RunForever(opts.SecondsToSleepBetweenRuns)
+        deduplicator.RunForever(ctx, opts.SecondsToSleepBetweenRuns)
     } else {
-        deduplicator.Run()
+        report, err := deduplicator.Run(ctx)
+        if opts.ReportJSON || opts.DryRun {
+            printReport(report, err)
+        }
     }
 }
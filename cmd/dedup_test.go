@@ -0,0 +1,259 @@
+package main
+
+
+import (
+    "bytes"
+    "encoding/json"
+    "flag"
+    "fmt"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+    "github.com/IGVF-DACC/go-sqs-deduplication/internal/dedup"
+    "github.com/IGVF-DACC/go-sqs-deduplication/internal/memory"
+    "github.com/IGVF-DACC/go-sqs-deduplication/internal/sqs"
+    "github.com/IGVF-DACC/go-sqs-deduplication/internal/sqsfake"
+)
+
+
+// Deduplicator binary built by TestMain, empty with -short.
+var binary string
+
+
+func TestMain(m *testing.M) {
+    flag.Parse()
+    if testing.Short() {
+        os.Exit(m.Run())
+    }
+    dir, err := os.MkdirTemp("", "dedup")
+    if err != nil {
+        fmt.Println("Error creating directory for binary", err)
+        os.Exit(1)
+    }
+    binary = filepath.Join(dir, "dedup")
+    output, err := exec.Command("go", "build", "-o", binary, ".").CombinedOutput()
+    if err != nil {
+        fmt.Printf("Error building binary: %v\n%s", err, output)
+        os.RemoveAll(dir)
+        os.Exit(1)
+    }
+    code := m.Run()
+    os.RemoveAll(dir)
+    os.Exit(code)
+}
+
+
+func skipWithoutBinary(t *testing.T) {
+    if binary == "" {
+        t.Skip("Binary isn't built with -short")
+    }
+}
+
+
+// Runs binary against server with fake credentials, returns its run report.
+func runBinary(t *testing.T, server *sqsfake.Server, args ...string) dedup.RunReport {
+    command := exec.Command(binary, append([]string{"-endpointURL=" + server.URL(), "-reportJSON"}, args...)...)
+    command.Env = append(
+        os.Environ(),
+        "AWS_ACCESS_KEY_ID=test",
+        "AWS_SECRET_ACCESS_KEY=test",
+        "AWS_REGION=" + sqsfake.Region,
+        "AWS_CONFIG_FILE=" + filepath.Join(t.TempDir(), "config"),
+        "AWS_SHARED_CREDENTIALS_FILE=" + filepath.Join(t.TempDir(), "credentials"),
+    )
+    var logs bytes.Buffer
+    command.Stderr = &logs
+    output, err := command.Output()
+    if err != nil {
+        t.Fatalf("Error running binary: %v\n%s%s", err, output, logs.Bytes())
+    }
+    // Logs go to stderr, the report is the only line on stdout.
+    lines := strings.Split(strings.TrimSuffix(string(output), "\n"), "\n")
+    if len(lines) != 1 {
+        t.Fatalf("Expected only the run report on stdout, got %d lines\n%s", len(lines), output)
+    }
+    var report dedup.RunReport
+    if err := json.Unmarshal([]byte(lines[0]), &report); err != nil {
+        t.Fatalf("Error parsing run report: %v\n%s", err, output)
+    }
+    return report
+}
+
+
+func TestBinaryDeduplicatesQueueOfFakeSQS(t *testing.T) {
+    skipWithoutBinary(t)
+    clock := memory.NewManualClock(time.Now())
+    server := sqsfake.NewServer(&sqsfake.ServerConfig{Clock: clock})
+    defer server.Close()
+    queueURL := server.CreateQueue("queue")
+    storageQueueURL := server.CreateQueue("storage")
+    for i := 0; i < 50; i++ {
+        server.SendMessage(queueURL, fmt.Sprintf(`{"data": {"uuid": "uuid-%d"}}`, i), nil)
+    }
+    for i := 0; i < 20; i++ {
+        server.SendMessage(queueURL, `{"data": {"uuid": "abc"}}`, map[string]dedup.MessageAttribute{
+            "copy": {DataType: "Number", StringValue: fmt.Sprint(i)},
+        })
+    }
+    report := runBinary(
+        t,
+        server,
+        "-queueURL=" + queueURL,
+        "-storageQueueURL=" + storageQueueURL,
+        "-numWorkers=2",
+        "-maxInflight=20",
+        "-logLevel=warn",
+    )
+    if report.MessagesPulled != 70 || report.UniqueKept != 51 || report.DuplicatesDeleted != 19 {
+        t.Errorf("Expected 70 pulled, 51 kept, and 19 deleted, got %+v", report)
+    }
+    if report.MessagesFlushedToStorage == 0 || report.MessagesRestoredFromStorage != report.MessagesFlushedToStorage {
+        t.Errorf("Expected messages flushed to storage and restored, got %+v", report)
+    }
+    if len(server.Messages(storageQueueURL)) != 0 {
+        t.Errorf("Expected storage queue to be empty, got %d messages", len(server.Messages(storageQueueURL)))
+    }
+    // Kept messages are reset to become visible a few seconds later.
+    clock.Advance(time.Minute)
+    bodies := make(map[string]int)
+    for _, message := range server.Messages(queueURL) {
+        if !message.Visible {
+            t.Errorf("Expected %s visible", message.MessageID)
+        }
+        bodies[message.Body]++
+    }
+    if len(bodies) != 51 {
+        t.Errorf("Expected 51 unique messages left on queue, got %d", len(bodies))
+    }
+    for body, count := range bodies {
+        if count != 1 {
+            t.Errorf("Expected one copy of %s, got %d", body, count)
+        }
+    }
+    if server.Requests("ReceiveMessage") == 0 || server.Requests("SendMessageBatch") == 0 {
+        t.Error("Expected binary to receive from and send to fake SQS")
+    }
+}
+
+
+func TestBinaryPullsPastBatchOfPoisonMessages(t *testing.T) {
+    skipWithoutBinary(t)
+    server := sqsfake.NewServer(&sqsfake.ServerConfig{})
+    defer server.Close()
+    queueURL := server.CreateQueue("queue")
+    // Received first, so the first batch has nothing to parse.
+    for i := 0; i < 10; i++ {
+        server.SendMessage(queueURL, "not json", nil)
+    }
+    for i := 0; i < 20; i++ {
+        server.SendMessage(queueURL, fmt.Sprintf(`{"data": {"uuid": "uuid-%d"}}`, i % 5), nil)
+    }
+    report := runBinary(
+        t,
+        server,
+        "-queueURL=" + queueURL,
+        "-storageQueueURL=" + server.CreateQueue("storage"),
+        "-poisonMessageAction=ignore",
+        "-numWorkers=1",
+        "-logLevel=error",
+    )
+    if report.MessagesPulled != 20 || report.UniqueKept != 5 || report.DuplicatesDeleted != 15 {
+        t.Errorf("Expected 20 pulled past poison messages, got %+v", report)
+    }
+    if report.PoisonMessages.Ignored != 10 {
+        t.Errorf("Expected 10 ignored poison messages, got %+v", report.PoisonMessages)
+    }
+}
+
+
+func TestGetMessageParserRejectsParserOptionsOfUniqueKeyPaths(t *testing.T) {
+    opts := CommandLineOptions{
+        Parser: sqs.JSONPathParserName,
+        ParserOptions: parserOptionsFlag{"keys": "$.uuid"},
+        UniqueKeyPaths: "$.data.uuid",
+        UniqueKeySeparator: ":",
+    }
+    if _, err := getMessageParser(opts); err == nil {
+        t.Error("Expected keys parserOption combined with uniqueKeyPaths to be rejected")
+    }
+    opts.ParserOptions = nil
+    if _, err := getMessageParser(opts); err != nil {
+        t.Errorf("Expected uniqueKeyPaths alone to be accepted, got %v", err)
+    }
+}
+
+
+func TestBinarySelectsParser(t *testing.T) {
+    skipWithoutBinary(t)
+    server := sqsfake.NewServer(&sqsfake.ServerConfig{})
+    defer server.Close()
+    queueURL := server.CreateQueue("queue")
+    for i := 0; i < 30; i++ {
+        // Same body, unique by message attribute.
+        server.SendMessage(queueURL, "not json", map[string]dedup.MessageAttribute{
+            "key": {DataType: "String", StringValue: fmt.Sprintf("KEY-%d", i % 10)},
+        })
+    }
+    report := runBinary(
+        t,
+        server,
+        "-queueURL=" + queueURL,
+        "-storageQueueURL=" + server.CreateQueue("storage"),
+        "-parser=message-attribute",
+        "-parserOption=name=key",
+        "-parserOption=lowerCase=true",
+        "-logLevel=warn",
+    )
+    if report.MessagesPulled != 30 || report.UniqueKept != 10 || report.DuplicatesDeleted != 20 {
+        t.Errorf("Expected 10 kept and 20 deleted by message attribute, got %+v", report)
+    }
+    if len(server.Messages(queueURL)) != 10 {
+        t.Errorf("Expected 10 messages left on queue, got %d", len(server.Messages(queueURL)))
+    }
+}
+
+
+func TestBinaryUnwrapsSNSEnvelopes(t *testing.T) {
+    skipWithoutBinary(t)
+    server := sqsfake.NewServer(&sqsfake.ServerConfig{})
+    defer server.Close()
+    queueURL := server.CreateQueue("queue")
+    sent := make(map[string]bool)
+    for i := 0; i < 40; i++ {
+        notification, _ := json.Marshal(map[string]string{
+            "Type": "Notification",
+            "MessageId": fmt.Sprintf("sns-%d", i),
+            "TopicArn": "arn:aws:sns:us-west-2:000000000000:invalidations",
+            "Message": fmt.Sprintf(`{"data": {"uuid": "uuid-%d"}}`, i % 10),
+        })
+        server.SendMessage(queueURL, string(notification), nil)
+        sent[string(notification)] = true
+    }
+    report := runBinary(
+        t,
+        server,
+        "-queueURL=" + queueURL,
+        "-storageQueueURL=" + server.CreateQueue("storage"),
+        "-envelope=sns",
+        "-maxInflight=5",
+        "-logLevel=warn",
+    )
+    if report.MessagesPulled != 40 || report.UniqueKept != 10 || report.DuplicatesDeleted != 30 {
+        t.Errorf("Expected 10 kept and 30 deleted by payload, got %+v", report)
+    }
+    if report.MessagesFlushedToStorage == 0 {
+        t.Errorf("Expected messages moved through storage, got %+v", report)
+    }
+    messages := server.Messages(queueURL)
+    if len(messages) != 10 {
+        t.Errorf("Expected 10 messages left on queue, got %d", len(messages))
+    }
+    for _, message := range messages {
+        if !sent[message.Body] {
+            t.Errorf("Expected envelope kept byte for byte, got %s", message.Body)
+        }
+    }
+}
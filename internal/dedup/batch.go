@@ -0,0 +1,50 @@
+package dedup
+
+
+type FailedEntry struct {
+    Operation string `json:"operation"`
+    BatchEntryFailure
+}
+
+
+func failedBatchResult(receiptHandles []string, err error) BatchResult {
+    var result BatchResult
+    for _, receiptHandle := range receiptHandles {
+        result.Failed = append(result.Failed, BatchEntryFailure{
+            ReceiptHandle: receiptHandle,
+            Code: "RequestFailed",
+            Message: err.Error(),
+        })
+    }
+    return result
+}
+
+
+func withOperation(operation string, failures []BatchEntryFailure) []FailedEntry {
+    var failedEntries []FailedEntry
+    for _, failure := range failures {
+        failedEntries = append(failedEntries, FailedEntry{Operation: operation, BatchEntryFailure: failure})
+    }
+    return failedEntries
+}
+
+
+// Calls send once with entries, turning an error of the whole request into
+// failed entries. Retrying is up to the queue, e.g. sqs.Queue backs off
+// under its RetryPolicy, so entries aren't retried again on top of that.
+func sendBatch[T any](entries []T, receiptHandle func(T) string, send func([]T) (BatchResult, error)) BatchResult {
+    result, err := send(entries)
+    if err != nil {
+        var receiptHandles []string
+        for _, entry := range entries {
+            receiptHandles = append(receiptHandles, receiptHandle(entry))
+        }
+        return failedBatchResult(receiptHandles, err)
+    }
+    return result
+}
+
+
+func identity(receiptHandle string) string {
+    return receiptHandle
+}
@@ -2,36 +2,52 @@ package dedup
 
 
 import (
-    "fmt"
+    "context"
+    "log/slog"
     "sync"
     "time"
 )
 
 
 type Startable interface {
-    Start()
+    Start(ctx context.Context)
 }
 
 
-func startAll[T Startable](actors []T) {
+func startAll[T Startable](ctx context.Context, actors []T) {
     for _, actor := range actors {
-        actor.Start()
+        actor.Start(ctx)
     }
 }
 
 
 type DeduplicatorConfig struct {
     Queue Queue
-    StorageQueue Queue
+    StorageQueue Queue // Used as storage if Storage is nil.
+    Storage Storage
     NumWorkers int
     MaxInflight int
     TimeLimitInSeconds int
+    RunReportHandler func(RunReport, error) // Called after every run by RunForever if not nil.
+    DryRun bool // Classify messages but only reset visibility, never delete or move.
+    DryRunRecordIDs bool // Include receipt handles and message IDs in DryRunReport.
+    ResolutionPolicy ResolutionPolicy // Decides which duplicate to keep, keeps first seen if nil.
+    VisibilityTimeout time.Duration // Of messages pulled from Queue, enables visibility heartbeat if not zero.
+    VisibilityExtensionWindow time.Duration // Heartbeat extends messages with less visibility left, below VisibilityTimeout, defaults to a third of it if zero.
+    Logger *slog.Logger // Uses slog.Default if nil, every line logged during a run gets run_id.
+    StateShards int // Independently locked partitions of SharedState, uses DefaultStateShards if zero.
+    ExpectedStoredMessages int // Tracks stored messages in Bloom filters sized for this many if not zero, instead of exactly.
+    StoredFalsePositiveRate float64 // Of Bloom filters, uses DefaultStoredFalsePositiveRate if zero.
+    Journal *Journal // Records moves of every run so the next one can reconcile a run that died, if not nil.
 }
 
 
 type Deduplicator struct {
     config *DeduplicatorConfig
-    wg *sync.WaitGroup
+    wg *sync.WaitGroup // Restore movers and reseters.
+    pullWg *sync.WaitGroup
+    deleteWg *sync.WaitGroup
+    flushWg *sync.WaitGroup
     state *SharedState
     pullers []*Puller
     deleters []*Deleter
@@ -41,7 +57,19 @@ type Deduplicator struct {
     keepChannel chan string
     deleteChannel chan string
     moveChannel chan QueueMessage
-    startedFlushToStorage bool
+    report *RunReport
+    deleteRecorder *recordingQueue // Used instead of Queue by deleters in dry run.
+    flushRecorder *recordingQueue // Used instead of Queue and StorageQueue by flush movers in dry run.
+    heartbeat *Heartbeat
+    logger *slog.Logger
+}
+
+
+func newState(config *DeduplicatorConfig) *SharedState {
+    if config.ExpectedStoredMessages > 0 {
+        return NewFilteredSharedState(config.StateShards, config.ExpectedStoredMessages, config.StoredFalsePositiveRate)
+    }
+    return NewShardedSharedState(config.StateShards)
 }
 
 
@@ -49,12 +77,17 @@ func NewDeduplicator(config *DeduplicatorConfig) *Deduplicator {
     return &Deduplicator{
         config: config,
         wg: &sync.WaitGroup{},
-        state: &SharedState{
-            keepMessages: make(map[string]QueueMessage),
-            deleteMessages: make(map[string]struct{}),
-            storedMessages: make(map[string]QueueMessage),
-            startTime: time.Now(),
-        }}
+        pullWg: &sync.WaitGroup{},
+        deleteWg: &sync.WaitGroup{},
+        flushWg: &sync.WaitGroup{},
+        logger: WithRunID(config.Logger),
+        state: newState(config),
+    }
+}
+
+
+func (d *Deduplicator) State() *SharedState {
+    return d.state
 }
 
 
@@ -65,11 +98,16 @@ func (d *Deduplicator) initPullers() {
         puller := &Puller{
             queue: d.config.Queue,
             state: d.state,
-            wg: d.wg,
+            wg: d.pullWg,
             messagesExist: true,
             timedOut: false,
             maxInflight: d.config.MaxInflight,
             timeLimitInSeconds: d.config.TimeLimitInSeconds,
+            resolutionPolicy: d.config.ResolutionPolicy,
+            heartbeat: d.heartbeat,
+            logger: d.logger,
+            deleteChannel: d.deleteChannel,
+            moveChannel: d.moveChannel,
         }
         pullers = append(pullers, puller)
     }
@@ -77,15 +115,24 @@ func (d *Deduplicator) initPullers() {
 }
 
 
+func (d *Deduplicator) deleteQueue() Queue {
+    if d.config.DryRun {
+        return d.deleteRecorder
+    }
+    return d.config.Queue
+}
+
+
 func (d *Deduplicator) initDeleters() {
     d.initDeleteChannel()
     numWorkers := d.config.NumWorkers
     deleters := make([]*Deleter, 0, numWorkers)
     for i := 0; i < numWorkers; i++ {
         deleter := &Deleter{
-            queue: d.config.Queue,
+            queue: d.deleteQueue(),
             deleteChannel: d.deleteChannel,
-            wg: d.wg,
+            state: d.state,
+            wg: d.deleteWg,
         }
         deleters = append(deleters, deleter)
     }
@@ -109,18 +156,48 @@ func (d *Deduplicator) initReseters() {
 }
 
 
+func (d *Deduplicator) storage() Storage {
+    if d.config.Storage != nil {
+        return d.config.Storage
+    }
+    return NewQueueStorage(d.config.StorageQueue)
+}
+
+
+// Nothing is moved in dry run so there is nothing to journal.
+func (d *Deduplicator) journal() *Journal {
+    if d.config.DryRun {
+        return nil
+    }
+    return d.config.Journal
+}
+
+
+func (d *Deduplicator) recordPhase(ctx context.Context, phase string) {
+    if err := d.journal().recordPhase(phase); err != nil {
+        d.logger.ErrorContext(ctx, "Error journaling phase", "phase", phase, "error", err)
+    }
+}
+
+
 func (d *Deduplicator) initFlushToStorageMovers() {
     d.initMoveChannel()
+    queue, storage := d.config.Queue, d.storage()
+    if d.config.DryRun {
+        queue, storage = d.flushRecorder, NewQueueStorage(d.flushRecorder)
+    }
     numWorkers := d.config.NumWorkers
     movers := make([]*Mover, 0, numWorkers)
     for i := 0; i < numWorkers; i++ {
         mover := &Mover{
-            fromQueue: d.config.Queue,
-            toQueue: d.config.StorageQueue,
+            queue: queue,
+            storage: storage,
             moveChannel: d.moveChannel,
             state: d.state,
             flushToStorage: true,
-            wg: d.wg,
+            wg: d.flushWg,
+            journal: d.journal(),
+            logger: d.logger,
         }
         movers = append(movers, mover)
     }
@@ -133,12 +210,14 @@ func (d *Deduplicator) initRestoreFromStorageMovers() {
     movers := make([]*Mover, 0, numWorkers)
     for i := 0; i < numWorkers; i++ {
         mover := &Mover{
-            fromQueue: d.config.StorageQueue,
-            toQueue: d.config.Queue,
+            queue: d.config.Queue,
+            storage: d.storage(),
             moveChannel: nil,
             state: d.state,
             flushToStorage: false,
             wg: d.wg,
+            journal: d.journal(),
+            logger: d.logger,
         }
         movers = append(movers, mover)
     }
@@ -146,28 +225,29 @@ func (d *Deduplicator) initRestoreFromStorageMovers() {
 }
 
 
-func (d *Deduplicator) startPullers() {
-      startAll(d.pullers)
+func (d *Deduplicator) startPullers(ctx context.Context) {
+    startAll(ctx, d.pullers)
 }
 
 
-func (d *Deduplicator) startDeleters() {
-      startAll(d.deleters)
+func (d *Deduplicator) startDeleters(ctx context.Context) {
+    startAll(ctx, d.deleters)
 }
 
 
-func (d *Deduplicator) startReseters() {
-      startAll(d.reseters)
+func (d *Deduplicator) startReseters(ctx context.Context) {
+    startAll(ctx, d.reseters)
 }
 
 
-func (d *Deduplicator) startFlushToStorageMovers() {
-    startAll(d.flushToStorageMovers)
+func (d *Deduplicator) startFlushToStorageMovers(ctx context.Context) {
+    startAll(ctx, d.flushToStorageMovers)
 }
 
 
-func (d *Deduplicator) startRestoreFromStorageMovers() {
-    startAll(d.restoreFromStorageMovers)
+func (d *Deduplicator) startRestoreFromStorageMovers(ctx context.Context) {
+    d.state.forgetRestored()
+    startAll(ctx, d.restoreFromStorageMovers)
 }
 
 
@@ -176,39 +256,18 @@ func (d *Deduplicator) initKeepChannel() {
 }
 
 
-func (d *Deduplicator) initDeleteChannel() {
-    d.deleteChannel = make(chan string, 10000)
-}
+// Pullers block once this many duplicates or overflow keep messages
+// are waiting for deleters or flush movers.
+const streamBufferSize = 1000
 
 
-func (d *Deduplicator) initMoveChannel() {
-    d.moveChannel = make(chan QueueMessage, 10000)
-}
-
-
-func (d *Deduplicator) resetDeleteChannel() {
-    d.initDeleteChannel()
-    for _, deleter := range d.deleters {
-        deleter.SetDeleteChannel(d.deleteChannel)
-    }
-}
-
-
-func (d *Deduplicator) resetMoveChannel() {
-    d.initMoveChannel()
-    for _, mover := range d.flushToStorageMovers {
-        mover.SetMoveChannel(d.moveChannel)
-    }
+func (d *Deduplicator) initDeleteChannel() {
+    d.deleteChannel = make(chan string, streamBufferSize)
 }
 
 
-func (d *Deduplicator) queueEmpty() bool {
-    for _, puller := range d.pullers {
-        if puller.messagesExist {
-            return false
-        }
-    }
-    return true
+func (d *Deduplicator) initMoveChannel() {
+    d.moveChannel = make(chan QueueMessage, streamBufferSize)
 }
 
 
@@ -222,18 +281,13 @@ func (d *Deduplicator) timedOut() bool {
 }
 
 
-func (d *Deduplicator) sendMessagesForDeletion() {
-    d.wg.Add(1)
-    go func() {
-        defer d.wg.Done()
-        d.state.mu.Lock()
-        defer d.state.mu.Unlock()
-        for receiptHandle := range d.state.deleteMessages {
-            d.deleteChannel <- receiptHandle
+func (d *Deduplicator) pullFailed() bool {
+    for _, puller := range d.pullers {
+        if puller.pullFailed {
+            return true
         }
-        d.state.deleteMessages = make(map[string]struct{})
-        close(d.deleteChannel)
-    }()
+    }
+    return false
 }
 
 
@@ -241,53 +295,74 @@ func (d *Deduplicator) sendMessagesForVisibilityReset() {
     d.wg.Add(1)
     go func() {
         defer d.wg.Done()
-        d.state.mu.Lock()
-        defer d.state.mu.Unlock()
-        for _, message := range d.state.keepMessages {
+        for _, message := range d.state.takeKeepMessages() {
             d.keepChannel <- message.ReceiptHandle()
         }
-        d.state.keepMessages = make(map[string]QueueMessage)
+        if d.config.DryRun {
+            // Nothing was deleted or moved so all pulled messages are still inflight.
+            for _, receiptHandle := range d.deleteRecorder.deletedReceiptHandles() {
+                d.keepChannel <- receiptHandle
+            }
+            for _, message := range d.flushRecorder.putMessages() {
+                d.keepChannel <- message.ReceiptHandle()
+            }
+        }
         close(d.keepChannel)
     }()
 }
 
 
-func (d *Deduplicator) sendMessagesForFlushingToStorage() {
-    d.wg.Add(1)
-    go func() {
-        defer d.wg.Done()
-        var keepMessages []QueueMessage
-        d.state.mu.Lock()
-        // Make local copy so can release lock.
-        for _, value := range d.state.keepMessages {
-            keepMessages = append(keepMessages, value)
+// Receipt handles of messages pulled from Queue that are still inflight.
+func (d *Deduplicator) heldReceiptHandles() []string {
+    receiptHandles := d.state.heldReceiptHandles()
+    if d.config.DryRun {
+        receiptHandles = append(receiptHandles, d.deleteRecorder.deletedReceiptHandles()...)
+        for _, message := range d.flushRecorder.putMessages() {
+            receiptHandles = append(receiptHandles, message.ReceiptHandle())
         }
-        d.state.mu.Unlock()
-        for _, message := range keepMessages {
-            d.moveChannel <- message
-        }
-        close(d.moveChannel)
-    }()
+    }
+    return receiptHandles
+}
+
+
+func (d *Deduplicator) visibilityExtensionWindow() time.Duration {
+    if d.config.VisibilityExtensionWindow == 0 {
+        return DefaultVisibilityExtensionWindow(d.config.VisibilityTimeout)
+    }
+    return d.config.VisibilityExtensionWindow
 }
 
 
-func (d *Deduplicator) printInfo() {
-    d.state.mu.Lock()
-    fmt.Println("Keep messages:", len(d.state.keepMessages))
-    fmt.Println("Delete messages:", len(d.state.deleteMessages))
-    fmt.Println("Stored messages:", len(d.state.storedMessages))
-    fmt.Println("Unique messages (keep + stored):", len(d.state.keepMessages) + len(d.state.storedMessages))
-    d.state.mu.Unlock()
+func (d *Deduplicator) startHeartbeat(ctx context.Context) {
+    d.heartbeat = NewHeartbeat(d.config.Queue, d.heldReceiptHandles, d.config.VisibilityTimeout, d.visibilityExtensionWindow())
+    d.heartbeat.SetLogger(d.logger)
+    d.heartbeat.Start(ctx)
 }
 
 
-func (d *Deduplicator) atMaxInflight() bool {
-    d.state.mu.Lock()
-    defer d.state.mu.Unlock()
-    if len(d.state.keepMessages) >= d.config.MaxInflight {
-       return true
+func (d *Deduplicator) stopHeartbeat(ctx context.Context) {
+    d.heartbeat.CheckExpired()
+    d.heartbeat.Stop()
+    d.report.MessagesExtended = d.heartbeat.MessagesExtended()
+    d.report.addFailures(d.heartbeat.Failures())
+    expired := d.heartbeat.ExpiredReceiptHandles()
+    if len(expired) > 0 {
+        d.logger.WarnContext(ctx, "Visibility expired on held messages before it could be extended", "count", len(expired))
     }
-    return false
+    d.report.ExpiredReceiptHandles = len(expired)
+}
+
+
+func (d *Deduplicator) printInfo(ctx context.Context) {
+    d.logger.InfoContext(
+        ctx,
+        "Pulled messages",
+        "keep", d.state.KeepMessagesLen(),
+        "delete", d.state.DeleteMessagesLen(),
+        "stored", d.state.StoredMessagesLen(),
+        "unique", d.uniqueMessagesLen(),
+        "state_bytes", d.state.EstimatedBytes(),
+    )
 }
 
 
@@ -296,86 +371,289 @@ func (d *Deduplicator) waitForWorkToFinish() {
 }
 
 
-func (d *Deduplicator) shouldFlushToStorage() bool {
-    return d.atMaxInflight() || d.startedFlushToStorage
+func (d *Deduplicator) reachedMaxInflight() bool {
+    for _, puller := range d.pullers {
+        if puller.ReachedMaxInflight() {
+            return true
+        }
+    }
+    return false
 }
 
 
-func (d *Deduplicator) pullMessagesAndDeleteDuplicates() {
-    d.initPullers()
+// Pullers stream duplicates to deleters and, once keep messages reach max
+// inflight, stream keep messages to flush movers, so pulling, deleting and
+// flushing all run at the same time. Work that must complete once messages
+// are inflight, such as deleting duplicates already pulled, restoring from
+// storage and resetting visibility, runs with cleanupCtx so that cancellation
+// of ctx doesn't strand messages.
+func (d *Deduplicator) pullMessagesAndDeleteDuplicates(ctx context.Context, cleanupCtx context.Context) {
     d.initDeleters()
     d.initFlushToStorageMovers()
+    d.initPullers()
     d.initRestoreFromStorageMovers()
+    durations := &d.report.Durations
     // Try restoring messages from storage queue in case
     // messages exist from previous run.
-    fmt.Println("Restoring messages from storage queue (pre)")
-    d.startRestoreFromStorageMovers()
-    d.waitForWorkToFinish()
-    // Run pull message/delete duplicates loop until no more
-    // messages in queue, or max inflight of unique messages reached.
-    for {
-        fmt.Println("Pulling messages")
-        d.startPullers() // Pulls messages until max inflight reached, or no more messages. Determines duplicates.
-        d.waitForWorkToFinish()
-        d.printInfo()
-        fmt.Println("Deleting duplicate messages")
-        d.sendMessagesForDeletion()
-        d.startDeleters() // Processes messages for deletion.
-        d.waitForWorkToFinish()
-        if d.queueEmpty() {
-            fmt.Println("Pulled all messages from queue")
-            break
-        }
-        if d.shouldFlushToStorage() {
-            fmt.Println("Max inflight for keep messages or already flushing to storage")
-            fmt.Println("Flushing keep messages to storage")
-            d.startedFlushToStorage = true
-            d.sendMessagesForFlushingToStorage()
-            d.startFlushToStorageMovers()
+    if d.config.DryRun {
+        d.logger.InfoContext(ctx, "Skipping restoring messages from storage queue in dry run")
+    } else {
+        d.logger.InfoContext(ctx, "Restoring messages from storage queue", "phase", "pre")
+        d.recordPhase(ctx, "pre-restore")
+        timePhase(&durations.PreRestore, func() {
+            d.startRestoreFromStorageMovers(ctx)
             d.waitForWorkToFinish()
-            d.resetMoveChannel()
-        }
-        if d.timedOut() {
-            fmt.Println("Stopping because of time limit")
-            break
-        }
-        d.resetDeleteChannel() // Give deleters new channel since old one closed.
+        })
     }
-    // Restore all the messages to keep from storage queue.
-    fmt.Println("Restoring messages from storage queue (post)")
-    d.startRestoreFromStorageMovers()
-    d.waitForWorkToFinish()
+    d.report.Iterations = 1
+    d.logger.InfoContext(ctx, "Pulling messages and deleting duplicates")
+    d.recordPhase(ctx, "pull")
+    start := time.Now()
+    d.startDeleters(cleanupCtx)
+    d.startFlushToStorageMovers(ctx)
+    d.startPullers(ctx) // Pulls messages until no more messages, time limit, or inflight messages can't drain.
+    d.pullWg.Wait()
+    durations.Pull = time.Since(start)
+    close(d.deleteChannel)
+    close(d.moveChannel)
+    d.deleteWg.Wait()
+    durations.Delete = time.Since(start)
+    d.flushWg.Wait()
+    // Messages handed to flush movers that stopped early are reset instead.
+    d.state.returnAllMovingToKeep()
+    d.report.Memory = d.state.memoryReport()
+    if d.flushing() {
+        durations.Flush = time.Since(start)
+        d.report.MaxInflightReached = true
+        d.logger.InfoContext(ctx, "Flushed keep messages to storage, max inflight reached")
+    }
+    d.printInfo(ctx)
+    switch {
+    case ctx.Err() != nil:
+        d.logger.WarnContext(ctx, "Stopping because of cancellation")
+    case d.pullFailed():
+        d.logger.ErrorContext(ctx, "Stopping because of errors pulling messages")
+        d.report.PullFailed = true
+    case d.timedOut():
+        d.logger.InfoContext(ctx, "Stopping because of time limit")
+    case d.reachedMaxInflight():
+        d.logger.WarnContext(ctx, "Stopping because inflight messages couldn't drain below max inflight")
+    default:
+        d.logger.InfoContext(ctx, "Pulled all messages from queue")
+    }
+    if !d.config.DryRun {
+        // Restore all the messages to keep from storage queue.
+        d.logger.InfoContext(cleanupCtx, "Restoring messages from storage queue", "phase", "post")
+        d.recordPhase(cleanupCtx, "post-restore")
+        timePhase(&durations.PostRestore, func() {
+            d.startRestoreFromStorageMovers(cleanupCtx)
+            d.waitForWorkToFinish()
+        })
+        d.deleteConfirmedSuspects(cleanupCtx)
+    }
+    d.report.UnconfirmedSuspects = d.state.returnSuspectsToKeep()
+}
+
+
+// Deletes suspect messages confirmed by restoring from storage,
+// deleters are added to the ones that ran while pulling.
+func (d *Deduplicator) deleteConfirmedSuspects(ctx context.Context) {
+    receiptHandles := d.state.pendingDeletes()
+    if len(receiptHandles) == 0 {
+        return
+    }
+    d.logger.InfoContext(ctx, "Deleting copies of stored messages confirmed by restoring", "confirmed", len(receiptHandles))
+    deleters := d.deleters
+    d.initDeleters()
+    d.startDeleters(ctx)
+    for _, receiptHandle := range receiptHandles {
+        d.deleteChannel <- receiptHandle
+    }
+    close(d.deleteChannel)
+    d.deleteWg.Wait()
+    d.deleters = append(deleters, d.deleters...)
 }
 
 
-func (d *Deduplicator) resetVisibilityOnMessagesToKeep() {
+func (d *Deduplicator) flushing() bool {
+    return d.state.flushing.Load()
+}
+
+
+func (d *Deduplicator) resetVisibilityOnMessagesToKeep(ctx context.Context) {
     d.initReseters()
     d.sendMessagesForVisibilityReset()
-    d.startReseters() // Processes messages for visibility reset.
+    d.startReseters(ctx) // Processes messages for visibility reset.
     d.waitForWorkToFinish()
 }
 
 
-func (d *Deduplicator) Run() {
-    fmt.Println("Running deduplicator")
-    d.pullMessagesAndDeleteDuplicates()
-    fmt.Println("Resetting visibility on messages to keep")
-    d.resetVisibilityOnMessagesToKeep()
-    fmt.Println("All done")
+// Only call once workers have finished.
+func (d *Deduplicator) collectWorkerStats() {
+    for _, puller := range d.pullers {
+        d.report.MessagesPulled += puller.MessagesPulled()
+        d.report.SuspectedDuplicates += puller.MessagesSuspected()
+        d.report.OrphansReconciled += puller.OrphansFound()
+        d.report.UnresolvedDuplicates += puller.DuplicatesUnresolved()
+        if puller.ReachedMaxInflight() {
+            d.report.MaxInflightReached = true
+        }
+    }
+    for _, deleter := range d.deleters {
+        d.report.DuplicatesDeleted += deleter.MessagesDeleted()
+        d.report.addFailures(deleter.Failures())
+    }
+    for _, mover := range d.flushToStorageMovers {
+        d.report.MessagesFlushedToStorage += mover.MessagesMoved()
+        d.report.UntokenedMoves += mover.MessagesUntokened()
+        d.report.addFailures(mover.Failures())
+    }
+    for _, mover := range d.restoreFromStorageMovers {
+        d.report.MessagesRestoredFromStorage += mover.MessagesMoved()
+        d.report.OrphansReconciled += mover.OrphansDropped()
+        d.report.StorageDuplicatesRemoved += mover.DuplicatesRemoved()
+        d.report.UntokenedMoves += mover.MessagesUntokened()
+        d.report.addFailures(mover.Failures())
+    }
+    for _, reseter := range d.reseters {
+        d.report.MessagesReset += reseter.MessagesReset()
+        d.report.addFailures(reseter.Failures())
+    }
+    d.report.TimeLimitReached = d.timedOut()
+}
+
+
+// Only call once workers have finished. Moves counts of recorded
+// deletes and flushes into DryRunReport since nothing was changed.
+func (d *Deduplicator) collectDryRunStats() {
+    dryRunReport := &DryRunReport{
+        WouldDelete: d.report.DuplicatesDeleted,
+        WouldFlushToStorage: d.report.MessagesFlushedToStorage,
+    }
+    d.report.DuplicatesDeleted = 0
+    d.report.MessagesFlushedToStorage = 0
+    if d.config.DryRunRecordIDs {
+        dryRunReport.DuplicateReceiptHandles = d.deleteRecorder.deletedReceiptHandles()
+        for _, message := range d.flushRecorder.putMessages() {
+            dryRunReport.FlushedMessageIDs = append(dryRunReport.FlushedMessageIDs, message.MessageID())
+        }
+    }
+    d.report.DryRun = dryRunReport
+}
+
+
+func retryStats(queue Queue) RetryStats {
+    if reporter, ok := queue.(RetryStatsReporter); ok {
+        return reporter.RetryStats()
+    }
+    return RetryStats{}
+}
+
+
+func poisonStats(queue Queue) PoisonStats {
+    if reporter, ok := queue.(PoisonStatsReporter); ok {
+        return reporter.PoisonStats()
+    }
+    return PoisonStats{}
+}
+
+
+func (d *Deduplicator) uniqueMessagesLen() int {
+    return d.state.KeepMessagesLen() + d.state.StoredMessagesLen()
+}
+
+
+// Run stops pulling when ctx is cancelled but still finishes inflight
+// batches, restores messages from storage and resets visibility before returning.
+// The returned error is non-nil only if ctx was cancelled, the report is always complete.
+func (d *Deduplicator) Run(ctx context.Context) (RunReport, error) {
+    runID := newRunID()
+    ctx = ContextWithRunID(ctx, runID)
+    d.logger.InfoContext(ctx, "Running deduplicator", "dry_run", d.config.DryRun)
+    d.report = &RunReport{RunID: runID}
+    if d.config.VisibilityTimeout > 0 {
+        if err := ValidateVisibilityExtensionWindow(d.config.VisibilityTimeout, d.visibilityExtensionWindow()); err != nil {
+            d.logger.ErrorContext(ctx, "Error starting heartbeat", "error", err)
+            return *d.report, err
+        }
+    }
+    if d.config.DryRun {
+        d.logger.InfoContext(ctx, "Dry run, no messages will be deleted or moved")
+        d.deleteRecorder = &recordingQueue{}
+        d.flushRecorder = &recordingQueue{}
+    }
+    start := time.Now()
+    queueRetryStats := retryStats(d.config.Queue)
+    storageQueueRetryStats := retryStats(d.config.StorageQueue)
+    queuePoisonStats := poisonStats(d.config.Queue)
+    storageQueuePoisonStats := poisonStats(d.config.StorageQueue)
+    cleanupCtx := context.WithoutCancel(ctx)
+    d.reconcileUnfinishedRun(cleanupCtx)
+    if err := d.journal().begin(runID); err != nil {
+        d.logger.ErrorContext(ctx, "Error starting journal", "error", err)
+    }
+    d.heartbeat = nil
+    if d.config.VisibilityTimeout > 0 {
+        d.startHeartbeat(cleanupCtx)
+    }
+    d.pullMessagesAndDeleteDuplicates(ctx, cleanupCtx)
+    d.report.UniqueKept = d.uniqueMessagesLen()
+    if d.heartbeat != nil {
+        d.stopHeartbeat(cleanupCtx)
+    }
+    d.logger.InfoContext(cleanupCtx, "Resetting visibility on messages to keep")
+    d.recordPhase(cleanupCtx, "reset")
+    timePhase(&d.report.Durations.Reset, func() {
+        d.resetVisibilityOnMessagesToKeep(cleanupCtx)
+    })
+    d.collectWorkerStats()
+    if d.config.DryRun {
+        d.collectDryRunStats()
+    }
+    d.report.QueueRetries = retryStats(d.config.Queue).Sub(queueRetryStats)
+    d.report.StorageQueueRetries = retryStats(d.config.StorageQueue).Sub(storageQueueRetryStats)
+    d.report.PoisonMessages = poisonStats(d.config.Queue).Sub(queuePoisonStats).Add(
+        poisonStats(d.config.StorageQueue).Sub(storageQueuePoisonStats),
+    )
+    if err := d.journal().finish(); err != nil {
+        d.logger.ErrorContext(cleanupCtx, "Error finishing journal", "error", err)
+    }
+    d.report.Durations.Total = time.Since(start)
+    d.report.Cancelled = ctx.Err() != nil
+    d.logger.InfoContext(
+        cleanupCtx,
+        "All done",
+        "pulled", d.report.MessagesPulled,
+        "kept", d.report.UniqueKept,
+        "deleted", d.report.DuplicatesDeleted,
+        "duration", d.report.Durations.Total,
+    )
+    return *d.report, ctx.Err()
 }
 
 
 func (d *Deduplicator) Reset() {
     d.state.Reset()
-    d.startedFlushToStorage = false
 }
 
 
-func (d *Deduplicator) RunForever(secondsToSleepBetweenRuns int) {
+func (d *Deduplicator) RunForever(ctx context.Context, secondsToSleepBetweenRuns int) {
     for {
-        d.Run()
-        fmt.Println("Sleeping seconds", secondsToSleepBetweenRuns)
-        time.Sleep(time.Duration(secondsToSleepBetweenRuns) * time.Second)
+        report, err := d.Run(ctx)
+        if d.config.RunReportHandler != nil {
+            d.config.RunReportHandler(report, err)
+        }
+        if ctx.Err() != nil {
+            d.logger.InfoContext(ctx, "Stopping run forever because of cancellation")
+            return
+        }
+        d.logger.InfoContext(ctx, "Sleeping between runs", "seconds", secondsToSleepBetweenRuns)
+        select {
+        case <-ctx.Done():
+            d.logger.InfoContext(ctx, "Stopping run forever because of cancellation")
+            return
+        case <-time.After(time.Duration(secondsToSleepBetweenRuns) * time.Second):
+        }
         d.Reset()
     }
 }
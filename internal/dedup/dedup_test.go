@@ -1,167 +1,381 @@
 package dedup_test
 
 import (
+    "context"
     "testing"
+    "time"
     "github.com/IGVF-DACC/go-sqs-deduplication/internal/memory"
     "github.com/IGVF-DACC/go-sqs-deduplication/internal/dedup"
 )
 
 
+func newSimulatedQueue() *memory.SimulatedQueue {
+    return memory.NewSimulatedQueue(&memory.SimulatedQueueConfig{
+        Clock: memory.NewManualClock(time.Now()),
+    })
+}
+
+
+// Every message left on queue should be visible to consumers again.
+func expectAllVisible(t *testing.T, queue *memory.SimulatedQueue, expected int) {
+    t.Helper()
+    if queue.MessagesLen() != expected {
+        t.Errorf("Expected %d messages on queue, got %d", expected, queue.MessagesLen())
+    }
+    if queue.InflightLen() != 0 {
+        t.Errorf("Expected no messages left inflight, got %d", queue.InflightLen())
+    }
+}
+
+
 func TestDeduplicatorHalfDuplicate(t *testing.T) {
-    inMemoryQueue := memory.NewInMemoryQueue(10)
+    queue := newSimulatedQueue()
     generatedMessages := memory.GenerateInMemoryMessages(1000)
-    inMemoryQueue.AddMessages(generatedMessages)
+    queue.AddMessages(generatedMessages)
     generatedMessages = memory.GenerateInMemoryMessages(1000)
-    inMemoryQueue.AddMessages(generatedMessages)
-    storageInMemoryQueue := memory.NewInMemoryQueue(10)
+    queue.AddMessages(generatedMessages)
+    storageQueue := newSimulatedQueue()
     config := &dedup.DeduplicatorConfig{
-        Queue: inMemoryQueue,
-        StorageQueue: storageInMemoryQueue,
+        Queue: queue,
+        StorageQueue: storageQueue,
         NumWorkers: 20,
         MaxInflight: 1500,
         TimeLimitInSeconds: 240,
     }
     deduplicator := dedup.NewDeduplicator(config)
-    deduplicator.Run()
-    if len(inMemoryQueue.GetDeletedMessages()) != 1000 {
-        t.Errorf("Expected 1000 messages to be deleted, got %d", len(inMemoryQueue.GetDeletedMessages()))
-    }
-    if len(inMemoryQueue.GetResetMessages()) != 1000 {
-        t.Errorf("Expected 1000 messages to be reset, got %d", len(inMemoryQueue.GetResetMessages()))
+    deduplicator.Run(context.Background())
+    if len(queue.GetDeletedMessages()) != 1000 {
+        t.Errorf("Expected 1000 messages to be deleted, got %d", len(queue.GetDeletedMessages()))
     }
-    if inMemoryQueue.MessagesLen() != 0 {
-        t.Error("Queue should be empty")
+    if len(queue.GetResetMessages()) != 1000 {
+        t.Errorf("Expected 1000 messages to be reset, got %d", len(queue.GetResetMessages()))
     }
+    expectAllVisible(t, queue, 1000)
 }
 
 
 func TestDeduplicatorAllUnique(t *testing.T) {
-    inMemoryQueue := memory.NewInMemoryQueue(10)
+    queue := newSimulatedQueue()
     generatedMessages := memory.GenerateInMemoryMessages(3000)
-    inMemoryQueue.AddMessages(generatedMessages)
-    storageInMemoryQueue := memory.NewInMemoryQueue(10)
+    queue.AddMessages(generatedMessages)
+    storageQueue := newSimulatedQueue()
     config := &dedup.DeduplicatorConfig{
-        Queue: inMemoryQueue,
-        StorageQueue: storageInMemoryQueue,
+        Queue: queue,
+        StorageQueue: storageQueue,
         NumWorkers: 5,
         MaxInflight: 10000,
         TimeLimitInSeconds: 240,
     }
     deduplicator := dedup.NewDeduplicator(config)
-    deduplicator.Run()
-    if len(inMemoryQueue.GetDeletedMessages()) != 0 {
-        t.Errorf("Expected 0 messages to be deleted, got %d", len(inMemoryQueue.GetDeletedMessages()))
+    deduplicator.Run(context.Background())
+    if len(queue.GetDeletedMessages()) != 0 {
+        t.Errorf("Expected 0 messages to be deleted, got %d", len(queue.GetDeletedMessages()))
     }
-    if len(inMemoryQueue.GetResetMessages()) != 3000 {
-        t.Errorf("Expected 3000 messages to be reset, got %d", len(inMemoryQueue.GetResetMessages()))
-    }
-    if inMemoryQueue.MessagesLen() != 0 {
-        t.Error("Queue should be empty")
+    if len(queue.GetResetMessages()) != 3000 {
+        t.Errorf("Expected 3000 messages to be reset, got %d", len(queue.GetResetMessages()))
     }
+    expectAllVisible(t, queue, 3000)
 }
 
 
 func TestDeduplicatorAllDuplicate(t *testing.T) {
-    inMemoryQueue := memory.NewInMemoryQueue(10)
+    queue := newSimulatedQueue()
     duplicateMessages := memory.MakeDuplicateInMemoryMessages("abc", 4000)
-    inMemoryQueue.AddMessages(duplicateMessages)
-    storageInMemoryQueue := memory.NewInMemoryQueue(10)
+    queue.AddMessages(duplicateMessages)
+    storageQueue := newSimulatedQueue()
     config := &dedup.DeduplicatorConfig{
-        Queue: inMemoryQueue,
-        StorageQueue: storageInMemoryQueue,
+        Queue: queue,
+        StorageQueue: storageQueue,
         NumWorkers: 10,
         MaxInflight: 10000,
         TimeLimitInSeconds: 240,
     }
     deduplicator := dedup.NewDeduplicator(config)
-    deduplicator.Run()
-    if len(inMemoryQueue.GetDeletedMessages()) != 3999 {
-        t.Errorf("Expected 3999 messages to be deleted, got %d", len(inMemoryQueue.GetDeletedMessages()))
-    }
-    if len(inMemoryQueue.GetResetMessages()) != 1 {
-        t.Errorf("Expected 1 messages to be reset, got %d", len(inMemoryQueue.GetResetMessages()))
+    deduplicator.Run(context.Background())
+    if len(queue.GetDeletedMessages()) != 3999 {
+        t.Errorf("Expected 3999 messages to be deleted, got %d", len(queue.GetDeletedMessages()))
     }
-    if inMemoryQueue.MessagesLen() != 0 {
-        t.Error("Queue should be empty")
+    if len(queue.GetResetMessages()) != 1 {
+        t.Errorf("Expected 1 messages to be reset, got %d", len(queue.GetResetMessages()))
     }
+    expectAllVisible(t, queue, 1)
 }
 
 
 
 func TestDeduplicatorPartialProcessingBecauseOfMaxInflight(t *testing.T) {
     // MaxInflight over total
-    inMemoryQueue := memory.NewInMemoryQueue(10)
+    queue := newSimulatedQueue()
     generatedMessages := memory.GenerateInMemoryMessages(3000)
-    inMemoryQueue.AddMessages(generatedMessages)
+    queue.AddMessages(generatedMessages)
     duplicateMessages := memory.MakeDuplicateInMemoryMessages("abc", 5000)
-    inMemoryQueue.AddMessages(duplicateMessages)
-    storageInMemoryQueue := memory.NewInMemoryQueue(10)
+    queue.AddMessages(duplicateMessages)
+    storageQueue := newSimulatedQueue()
     config := &dedup.DeduplicatorConfig{
-        Queue: inMemoryQueue,
-        StorageQueue: storageInMemoryQueue,
+        Queue: queue,
+        StorageQueue: storageQueue,
         NumWorkers: 30,
         MaxInflight: 100000,
         TimeLimitInSeconds: 240,
     }
     deduplicator := dedup.NewDeduplicator(config)
-    deduplicator.Run()
-    if len(inMemoryQueue.GetDeletedMessages()) != 4999 {
-        t.Errorf("Expected 4999 messages to be deleted, got %d", len(inMemoryQueue.GetDeletedMessages()))
-    }
-    if len(inMemoryQueue.GetResetMessages()) != 3001 {
-        t.Errorf("Expected 3001 messages to be reset, got %d", len(inMemoryQueue.GetResetMessages()))
+    deduplicator.Run(context.Background())
+    if len(queue.GetDeletedMessages()) != 4999 {
+        t.Errorf("Expected 4999 messages to be deleted, got %d", len(queue.GetDeletedMessages()))
     }
-    if inMemoryQueue.MessagesLen() != 0 {
-        t.Error("Queue should be empty")
+    if len(queue.GetResetMessages()) != 3001 {
+        t.Errorf("Expected 3001 messages to be reset, got %d", len(queue.GetResetMessages()))
     }
+    expectAllVisible(t, queue, 3001)
     // MaxInflight under total unique
-    inMemoryQueue = memory.NewInMemoryQueue(10)
+    queue = newSimulatedQueue()
     generatedMessages = memory.GenerateInMemoryMessages(3000)
-    inMemoryQueue.AddMessages(generatedMessages)
+    queue.AddMessages(generatedMessages)
     duplicateMessages = memory.MakeDuplicateInMemoryMessages("abc", 5000)
-    inMemoryQueue.AddMessages(duplicateMessages)
-    storageInMemoryQueue = memory.NewInMemoryQueue(10)
+    queue.AddMessages(duplicateMessages)
+    storageQueue = newSimulatedQueue()
     config = &dedup.DeduplicatorConfig{
-        Queue: inMemoryQueue,
-        StorageQueue: storageInMemoryQueue,
+        Queue: queue,
+        StorageQueue: storageQueue,
         NumWorkers: 30,
         MaxInflight: 500,
         TimeLimitInSeconds: 240,
     }
     deduplicator = dedup.NewDeduplicator(config)
-    deduplicator.Run()
-    if len(inMemoryQueue.GetDeletedMessages()) != 8000 {
-        t.Errorf("Expected 8000 messages to be deleted, got %d", len(inMemoryQueue.GetDeletedMessages()))
+    deduplicator.Run(context.Background())
+    if len(queue.GetDeletedMessages()) != 8000 {
+        t.Errorf("Expected 8000 messages to be deleted, got %d", len(queue.GetDeletedMessages()))
     }
-    if len(inMemoryQueue.GetResetMessages()) != 0 {
-        t.Errorf("Expected 0 messages to be reset, got %d", len(inMemoryQueue.GetResetMessages()))
-    }
-    if inMemoryQueue.MessagesLen() != 3001 {
-        t.Errorf("Expected 3001 messages to be on queue, got %d", inMemoryQueue.MessagesLen())
+    if len(queue.GetResetMessages()) != 0 {
+        t.Errorf("Expected 0 messages to be reset, got %d", len(queue.GetResetMessages()))
     }
+    // Flushed messages are back on queue under new message IDs.
+    expectAllVisible(t, queue, 3001)
     // MaxInflight under total, over total unique
-    inMemoryQueue = memory.NewInMemoryQueue(10)
+    queue = newSimulatedQueue()
     generatedMessages = memory.GenerateInMemoryMessages(3000)
-    inMemoryQueue.AddMessages(generatedMessages)
+    queue.AddMessages(generatedMessages)
     duplicateMessages = memory.MakeDuplicateInMemoryMessages("abc", 5000)
-    inMemoryQueue.AddMessages(duplicateMessages)
-    storageInMemoryQueue = memory.NewInMemoryQueue(10)
+    queue.AddMessages(duplicateMessages)
+    storageQueue = newSimulatedQueue()
     config = &dedup.DeduplicatorConfig{
-        Queue: inMemoryQueue,
-        StorageQueue: storageInMemoryQueue,
+        Queue: queue,
+        StorageQueue: storageQueue,
         NumWorkers: 5,
         MaxInflight: 3003,
         TimeLimitInSeconds: 240,
     }
     deduplicator = dedup.NewDeduplicator(config)
-    deduplicator.Run()
-    if len(inMemoryQueue.GetDeletedMessages()) != 4999 {
-        t.Errorf("Got %d deleted messages", len(inMemoryQueue.GetDeletedMessages()))
+    deduplicator.Run(context.Background())
+    if len(queue.GetDeletedMessages()) != 4999 {
+        t.Errorf("Got %d deleted messages", len(queue.GetDeletedMessages()))
+    }
+    if len(queue.GetResetMessages()) != 3001 {
+        t.Errorf("Got %d reset messages", len(queue.GetResetMessages()))
+    }
+    expectAllVisible(t, queue, 3001)
+}
+
+
+func TestDeduplicatorCancelledStillRestoresFromStorage(t *testing.T) {
+    queue := newSimulatedQueue()
+    generatedMessages := memory.GenerateInMemoryMessages(100)
+    queue.AddMessages(generatedMessages)
+    storageQueue := newSimulatedQueue()
+    storageQueue.AddMessages(memory.GenerateInMemoryMessages(50))
+    config := &dedup.DeduplicatorConfig{
+        Queue: queue,
+        StorageQueue: storageQueue,
+        NumWorkers: 5,
+        MaxInflight: 10000,
+        TimeLimitInSeconds: 240,
+    }
+    ctx, cancel := context.WithCancel(context.Background())
+    cancel()
+    deduplicator := dedup.NewDeduplicator(config)
+    report, err := deduplicator.Run(ctx)
+    if err != context.Canceled {
+        t.Errorf("Expected context.Canceled error, got %v", err)
+    }
+    if !report.Cancelled {
+        t.Error("Expected report to be marked cancelled")
+    }
+    if report.MessagesRestoredFromStorage != 50 {
+        t.Errorf("Expected 50 messages restored from storage, got %d", report.MessagesRestoredFromStorage)
+    }
+    if storageQueue.MessagesLen() != 0 {
+        t.Errorf("Expected storage queue to be empty, got %d", storageQueue.MessagesLen())
+    }
+    expectAllVisible(t, queue, 150)
+    if len(queue.GetDeletedMessages()) != 0 {
+        t.Errorf("Expected 0 messages to be deleted, got %d", len(queue.GetDeletedMessages()))
+    }
+}
+
+
+func TestDeduplicatorRunReport(t *testing.T) {
+    queue := newSimulatedQueue()
+    generatedMessages := memory.GenerateInMemoryMessages(1000)
+    queue.AddMessages(generatedMessages)
+    generatedMessages = memory.GenerateInMemoryMessages(1000)
+    queue.AddMessages(generatedMessages)
+    storageQueue := newSimulatedQueue()
+    config := &dedup.DeduplicatorConfig{
+        Queue: queue,
+        StorageQueue: storageQueue,
+        NumWorkers: 20,
+        MaxInflight: 10000,
+        TimeLimitInSeconds: 240,
+    }
+    deduplicator := dedup.NewDeduplicator(config)
+    report, err := deduplicator.Run(context.Background())
+    if err != nil {
+        t.Errorf("Unexpected error %v", err)
+    }
+    if report.MessagesPulled != 2000 {
+        t.Errorf("Expected 2000 messages pulled, got %d", report.MessagesPulled)
+    }
+    if report.UniqueKept != 1000 {
+        t.Errorf("Expected 1000 unique messages kept, got %d", report.UniqueKept)
+    }
+    if report.DuplicatesDeleted != 1000 {
+        t.Errorf("Expected 1000 duplicates deleted, got %d", report.DuplicatesDeleted)
+    }
+    if report.MessagesReset != 1000 {
+        t.Errorf("Expected 1000 messages reset, got %d", report.MessagesReset)
+    }
+    if report.MessagesFlushedToStorage != 0 || report.MessagesRestoredFromStorage != 0 {
+        t.Errorf("Expected no storage moves, got %d flushed and %d restored", report.MessagesFlushedToStorage, report.MessagesRestoredFromStorage)
+    }
+    if report.Iterations != 1 {
+        t.Errorf("Expected 1 iteration, got %d", report.Iterations)
+    }
+    if report.TimeLimitReached || report.MaxInflightReached || report.Cancelled {
+        t.Errorf("Unexpected flags in report %+v", report)
+    }
+    if report.Durations.Total <= 0 {
+        t.Error("Expected total duration to be set")
+    }
+}
+
+
+func TestDeduplicatorDryRun(t *testing.T) {
+    queue := newSimulatedQueue()
+    generatedMessages := memory.GenerateInMemoryMessages(3000)
+    queue.AddMessages(generatedMessages)
+    duplicateMessages := memory.MakeDuplicateInMemoryMessages("abc", 5000)
+    queue.AddMessages(duplicateMessages)
+    storageQueue := newSimulatedQueue()
+    config := &dedup.DeduplicatorConfig{
+        Queue: queue,
+        StorageQueue: storageQueue,
+        NumWorkers: 5,
+        MaxInflight: 3003,
+        TimeLimitInSeconds: 240,
+        DryRun: true,
+        DryRunRecordIDs: true,
+    }
+    deduplicator := dedup.NewDeduplicator(config)
+    report, err := deduplicator.Run(context.Background())
+    if err != nil {
+        t.Errorf("Unexpected error %v", err)
+    }
+    if len(queue.GetDeletedMessages()) != 0 {
+        t.Errorf("Expected 0 messages to be deleted, got %d", len(queue.GetDeletedMessages()))
+    }
+    if storageQueue.MessagesLen() != 0 {
+        t.Errorf("Expected 0 messages on storage queue, got %d", storageQueue.MessagesLen())
+    }
+    if len(queue.GetResetMessages()) != 8000 {
+        t.Errorf("Expected all 8000 pulled messages to be reset, got %d", len(queue.GetResetMessages()))
+    }
+    expectAllVisible(t, queue, 8000)
+    if report.DryRun == nil {
+        t.Fatal("Expected dry run report")
+    }
+    if report.DryRun.WouldDelete != 4999 {
+        t.Errorf("Expected 4999 messages that would be deleted, got %d", report.DryRun.WouldDelete)
+    }
+    if len(report.DryRun.DuplicateReceiptHandles) != 4999 {
+        t.Errorf("Expected 4999 recorded receipt handles, got %d", len(report.DryRun.DuplicateReceiptHandles))
+    }
+    if report.DryRun.WouldFlushToStorage != len(report.DryRun.FlushedMessageIDs) {
+        t.Errorf("Expected %d flushed message IDs, got %d", report.DryRun.WouldFlushToStorage, len(report.DryRun.FlushedMessageIDs))
+    }
+    if report.DuplicatesDeleted != 0 || report.MessagesFlushedToStorage != 0 {
+        t.Errorf("Expected nothing deleted or flushed in report %+v", report)
+    }
+}
+
+
+func TestDeduplicatorStreamsDeletesWhilePulling(t *testing.T) {
+    queue := newSimulatedQueue()
+    queue.AddMessages(memory.GenerateInMemoryMessages(20))
+    queue.AddMessages(memory.MakeDuplicateInMemoryMessages("abc", 2000))
+    storageQueue := newSimulatedQueue()
+    config := &dedup.DeduplicatorConfig{
+        Queue: queue,
+        StorageQueue: storageQueue,
+        NumWorkers: 4,
+        MaxInflight: 100,
+        TimeLimitInSeconds: 240,
+    }
+    deduplicator := dedup.NewDeduplicator(config)
+    report, err := deduplicator.Run(context.Background())
+    if err != nil {
+        t.Errorf("Unexpected error %v", err)
+    }
+    if report.DuplicatesDeleted != 1999 {
+        t.Errorf("Expected 1999 duplicates deleted, got %d", report.DuplicatesDeleted)
+    }
+    if report.MessagesReset != 21 {
+        t.Errorf("Expected 21 messages reset, got %d", report.MessagesReset)
+    }
+    // Duplicates don't hold inflight slots so kept messages never reach max inflight.
+    if report.MaxInflightReached || report.MessagesFlushedToStorage != 0 {
+        t.Errorf("Expected no flush to storage, got %d flushed", report.MessagesFlushedToStorage)
+    }
+    if report.Iterations != 1 {
+        t.Errorf("Expected 1 iteration, got %d", report.Iterations)
+    }
+    // Each puller may pull one batch over max inflight before waiting.
+    if queue.PeakInflight() > config.MaxInflight + 10 * config.NumWorkers {
+        t.Errorf("Expected at most %d inflight messages, got %d", config.MaxInflight + 10 * config.NumWorkers, queue.PeakInflight())
+    }
+}
+
+
+func TestDeduplicatorNeverLosesMessagesOnRedelivery(t *testing.T) {
+    clock := memory.NewManualClock(time.Now())
+    queue := memory.NewSimulatedQueue(&memory.SimulatedQueueConfig{
+        Clock: clock,
+        RedeliveryRate: 0.2,
+        Seed: 1,
+    })
+    queue.AddMessages(memory.GenerateInMemoryMessages(500))
+    queue.AddMessages(memory.GenerateInMemoryMessages(500))
+    config := &dedup.DeduplicatorConfig{
+        Queue: queue,
+        StorageQueue: newSimulatedQueue(),
+        NumWorkers: 5,
+        MaxInflight: 200,
+        TimeLimitInSeconds: 240,
+    }
+    report, err := dedup.NewDeduplicator(config).Run(context.Background())
+    if err != nil {
+        t.Fatal(err)
+    }
+    if report.MessagesPulled <= 1000 {
+        t.Errorf("Expected some messages to be delivered more than once, pulled %d", report.MessagesPulled)
     }
-    if len(inMemoryQueue.GetResetMessages()) != 3001 {
-        t.Errorf("Got %d reset messages", len(inMemoryQueue.GetResetMessages()))
+    // Stale receipt handles may leave duplicates, but never the last copy of a message.
+    counts := queue.UniqueIDCounts()
+    if len(counts) != 500 {
+        t.Errorf("Expected all 500 unique messages left on queue, got %d", len(counts))
     }
-    if inMemoryQueue.MessagesLen() != 0 {
-        t.Error("Queue has messages")
+    // Once visibility of redelivered copies expires everything is visible again.
+    clock.Advance(memory.DefaultSimulatedVisibilityTimeout)
+    if queue.InflightLen() != 0 {
+        t.Errorf("Expected no messages inflight after visibility timeout, got %d", queue.InflightLen())
     }
 }
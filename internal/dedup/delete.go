@@ -2,6 +2,7 @@ package dedup
 
 
 import (
+    "context"
     "sync"
 )
 
@@ -9,7 +10,10 @@ import (
 type Deleter struct {
     queue Queue
     deleteChannel chan string
+    state *SharedState // Receipt handles are removed from deleteMessages once handled if not nil.
     wg *sync.WaitGroup
+    deleted int
+    failures []FailedEntry
 }
 
 
@@ -18,38 +22,65 @@ func (d *Deleter) SetDeleteChannel(deleteChannel chan string) {
 }
 
 
+// Waits for one receipt handle, then takes up to a full batch of what's
+// already on the channel, so streamed duplicates don't wait for a full batch.
 func (d *Deleter) getBatchOfMessagesToDelete() []string {
     maxMessages := 10
-    var messages []string
-    for i := 0; i < maxMessages; i++ {
-        message, ok := <- d.deleteChannel
-        if !ok {
+    message, ok := <- d.deleteChannel
+    if !ok {
+        return nil
+    }
+    messages := []string{message}
+    for len(messages) < maxMessages {
+        select {
+        case message, ok := <- d.deleteChannel:
+            if !ok {
+                return messages
+            }
+            messages = append(messages, message)
+        default:
             return messages
         }
-        messages = append(messages, message)
     }
     return messages
 }
 
 
-func (d *Deleter) deleteMessages() {
+func (d *Deleter) deleteMessages(ctx context.Context) {
     receiptHandles := d.getBatchOfMessagesToDelete()
     for len(receiptHandles) > 0 {
-        d.queue.DeleteMessagesBatch(receiptHandles)
+        result := sendBatch(receiptHandles, identity, func(receiptHandles []string) (BatchResult, error) {
+            return d.queue.DeleteMessagesBatch(ctx, receiptHandles)
+        })
+        d.deleted += len(result.Succeeded)
+        d.failures = append(d.failures, withOperation("delete", result.Failed)...)
+        if d.state != nil {
+            d.state.markDeleted(receiptHandles)
+        }
         receiptHandles = d.getBatchOfMessagesToDelete()
     }
 }
 
 
-func (d *Deleter) Start() {
+func (d *Deleter) Start(ctx context.Context) {
     d.wg.Add(1)
     go func() {
         defer d.wg.Done()
-        d.deleteMessages()
+        d.deleteMessages(ctx)
     }()
 }
 
 
+func (d *Deleter) MessagesDeleted() int {
+    return d.deleted
+}
+
+
+func (d *Deleter) Failures() []FailedEntry {
+    return d.failures
+}
+
+
 func NewDeleter(queue Queue, deleteChannel chan string, wg *sync.WaitGroup) *Deleter {
     return &Deleter{
         queue: queue,
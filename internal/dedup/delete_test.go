@@ -2,6 +2,7 @@ package dedup_test
 
 
 import (
+    "context"
     "sync"
     "testing"
     "github.com/IGVF-DACC/go-sqs-deduplication/internal/memory"
@@ -14,14 +15,14 @@ func TestDeleter(t *testing.T) {
     generatedMessages := memory.GenerateInMemoryMessages(100)
     inMemoryQueue.AddMessages(generatedMessages)
     deleteChannel := make(chan string, 20)
-    pulledMessages, _ := inMemoryQueue.PullMessagesBatch()
+    pulledMessages, _ := inMemoryQueue.PullMessagesBatch(context.Background())
     for _, pulledMessage := range pulledMessages {
         deleteChannel <- pulledMessage.ReceiptHandle()
     }
     close(deleteChannel)
     wg := &sync.WaitGroup{}
     deleter := dedup.NewDeleter(inMemoryQueue, deleteChannel, wg)
-    deleter.Start()
+    deleter.Start(context.Background())
     wg.Wait()
     if len(inMemoryQueue.GetDeletedMessages()) != 10 {
         t.Errorf("Expected 10 messages to be deleted, got %d", len(inMemoryQueue.GetDeletedMessages()))
@@ -30,3 +31,67 @@ func TestDeleter(t *testing.T) {
         t.Error("Unexpected number of messages in queue")
     }
 }
+
+
+// Fails every entry on the first attempt and entries in senderFaults on every attempt.
+type flakyDeleteQueue struct {
+    *memory.InMemoryQueue
+    attempts int
+    senderFaults map[string]struct{}
+}
+
+
+func (q *flakyDeleteQueue) DeleteMessagesBatch(ctx context.Context, receiptHandles []string) (dedup.BatchResult, error) {
+    q.attempts++
+    var result dedup.BatchResult
+    var toDelete []string
+    for _, receiptHandle := range receiptHandles {
+        if _, ok := q.senderFaults[receiptHandle]; ok {
+            result.Failed = append(result.Failed, dedup.BatchEntryFailure{ReceiptHandle: receiptHandle, Code: "ReceiptHandleIsInvalid", SenderFault: true})
+        } else if q.attempts == 1 {
+            result.Failed = append(result.Failed, dedup.BatchEntryFailure{ReceiptHandle: receiptHandle, Code: "InternalError"})
+        } else {
+            toDelete = append(toDelete, receiptHandle)
+        }
+    }
+    deleted, err := q.InMemoryQueue.DeleteMessagesBatch(ctx, toDelete)
+    result.Succeeded = deleted.Succeeded
+    return result, err
+}
+
+
+// Retries are up to the queue, the deleter reports what's still failed.
+func TestDeleterReportsFailedEntries(t *testing.T) {
+    inMemoryQueue := memory.NewInMemoryQueue(10)
+    generatedMessages := memory.GenerateInMemoryMessages(100)
+    inMemoryQueue.AddMessages(generatedMessages)
+    pulledMessages, _ := inMemoryQueue.PullMessagesBatch(context.Background())
+    flakyQueue := &flakyDeleteQueue{
+        InMemoryQueue: inMemoryQueue,
+        senderFaults: map[string]struct{}{pulledMessages[0].ReceiptHandle(): {}},
+    }
+    deleteChannel := make(chan string, 20)
+    for _, pulledMessage := range pulledMessages {
+        deleteChannel <- pulledMessage.ReceiptHandle()
+    }
+    close(deleteChannel)
+    wg := &sync.WaitGroup{}
+    deleter := dedup.NewDeleter(flakyQueue, deleteChannel, wg)
+    deleter.Start(context.Background())
+    wg.Wait()
+    if flakyQueue.attempts != 1 {
+        t.Errorf("Expected 1 delete attempt, got %d", flakyQueue.attempts)
+    }
+    if deleter.MessagesDeleted() != 0 {
+        t.Errorf("Expected no messages to be deleted, got %d", deleter.MessagesDeleted())
+    }
+    senderFaults := 0
+    for _, failure := range deleter.Failures() {
+        if failure.SenderFault {
+            senderFaults++
+        }
+    }
+    if len(deleter.Failures()) != 10 || senderFaults != 1 {
+        t.Errorf("Expected 10 failures, 1 of them sender fault, got %+v", deleter.Failures())
+    }
+}
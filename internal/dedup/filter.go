@@ -0,0 +1,70 @@
+package dedup
+
+
+import (
+    "math"
+    "math/bits"
+)
+
+
+const DefaultStoredFalsePositiveRate = 0.001
+
+
+// Bloom filter of key fingerprints. Only ever answers maybe or no,
+// so a hit has to be confirmed before acting on it.
+type bloomFilter struct {
+    bits []uint64
+    numBits uint64
+    numHashes uint64
+}
+
+
+// Sized so that expected keys give at most falsePositiveRate.
+func newBloomFilter(expected int, falsePositiveRate float64) *bloomFilter {
+    if expected < 1 {
+        expected = 1
+    }
+    if falsePositiveRate <= 0 || falsePositiveRate >= 1 {
+        falsePositiveRate = DefaultStoredFalsePositiveRate
+    }
+    numBits := math.Ceil(-float64(expected) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2))
+    numHashes := math.Max(1, math.Round(numBits / float64(expected) * math.Ln2))
+    words := (uint64(numBits) + 63) / 64
+    return &bloomFilter{
+        bits: make([]uint64, words),
+        numBits: words * 64,
+        numHashes: uint64(numHashes),
+    }
+}
+
+
+// Double hashing. Low bits of hi pick the shard, so the step
+// starts from its high bits, and is forced odd so it's never zero.
+func (f *bloomFilter) bit(key keyFingerprint, i uint64) (uint64, uint64) {
+    position := (key.lo + i * (bits.RotateLeft64(key.hi, 32) | 1)) % f.numBits
+    return position / 64, 1 << (position % 64)
+}
+
+
+func (f *bloomFilter) add(key keyFingerprint) {
+    for i := uint64(0); i < f.numHashes; i++ {
+        word, mask := f.bit(key, i)
+        f.bits[word] |= mask
+    }
+}
+
+
+func (f *bloomFilter) mayContain(key keyFingerprint) bool {
+    for i := uint64(0); i < f.numHashes; i++ {
+        word, mask := f.bit(key, i)
+        if f.bits[word] & mask == 0 {
+            return false
+        }
+    }
+    return true
+}
+
+
+func (f *bloomFilter) size() int64 {
+    return int64(len(f.bits) * 8)
+}
@@ -0,0 +1,78 @@
+package dedup_test
+
+
+import (
+    "context"
+    "testing"
+    "github.com/IGVF-DACC/go-sqs-deduplication/internal/memory"
+    "github.com/IGVF-DACC/go-sqs-deduplication/internal/dedup"
+)
+
+
+func TestDeduplicatorStoredFilterMatchesExact(t *testing.T) {
+    inMemoryQueue := memory.NewInMemoryQueue(10)
+    inMemoryQueue.AddMessages(memory.GenerateInMemoryMessages(3000))
+    inMemoryQueue.AddMessages(memory.MakeDuplicateInMemoryMessages("abc", 5000))
+    config := &dedup.DeduplicatorConfig{
+        Queue: inMemoryQueue,
+        StorageQueue: memory.NewInMemoryQueue(10),
+        NumWorkers: 30,
+        MaxInflight: 500,
+        TimeLimitInSeconds: 240,
+        ExpectedStoredMessages: 10000,
+        StoredFalsePositiveRate: 1e-9,
+    }
+    report, _ := dedup.NewDeduplicator(config).Run(context.Background())
+    if len(inMemoryQueue.GetDeletedMessages()) != 8000 {
+        t.Errorf("Expected 8000 messages to be deleted, got %d", len(inMemoryQueue.GetDeletedMessages()))
+    }
+    if inMemoryQueue.MessagesLen() != 3001 {
+        t.Errorf("Expected 3001 messages to be on queue, got %d", inMemoryQueue.MessagesLen())
+    }
+    // Copies of abc are only suspects if pulled after abc made it to storage.
+    if report.SuspectedDuplicates > 1 || report.UnconfirmedSuspects != 0 {
+        t.Errorf("Expected only copy of abc to be suspected and confirmed, got %d suspected and %d unconfirmed", report.SuspectedDuplicates, report.UnconfirmedSuspects)
+    }
+}
+
+
+func TestDeduplicatorStoredFilterNeverDeletesUnique(t *testing.T) {
+    inMemoryQueue := memory.NewInMemoryQueue(10)
+    generatedMessages := memory.GenerateInMemoryMessages(2000)
+    generatedMessages = append(generatedMessages, memory.GenerateInMemoryMessages(2000)...)
+    inMemoryQueue.AddMessages(generatedMessages)
+    uniqueIDs := make(map[string]string)
+    for _, message := range generatedMessages {
+        uniqueIDs[message.ReceiptHandle()] = message.UniqueID()
+    }
+    // Far too small, the filters report almost everything as stored.
+    config := &dedup.DeduplicatorConfig{
+        Queue: inMemoryQueue,
+        StorageQueue: memory.NewInMemoryQueue(10),
+        NumWorkers: 10,
+        MaxInflight: 300,
+        TimeLimitInSeconds: 240,
+        ExpectedStoredMessages: 1,
+        StoredFalsePositiveRate: 0.5,
+    }
+    report, _ := dedup.NewDeduplicator(config).Run(context.Background())
+    if report.UnconfirmedSuspects == 0 {
+        t.Error("Expected false positives to be kept")
+    }
+    remaining := make(map[string]struct{})
+    for _, receiptHandle := range inMemoryQueue.GetResetMessages() {
+        remaining[uniqueIDs[receiptHandle]] = struct{}{}
+    }
+    for len(remaining) < 2000 {
+        messages, _ := inMemoryQueue.PullMessagesBatch(context.Background())
+        if len(messages) == 0 {
+            break
+        }
+        for _, message := range messages {
+            remaining[message.UniqueID()] = struct{}{}
+        }
+    }
+    if len(remaining) != 2000 {
+        t.Errorf("Expected all 2000 unique messages to remain, got %d", len(remaining))
+    }
+}
@@ -0,0 +1,226 @@
+package dedup
+
+
+import (
+    "context"
+    "fmt"
+    "log/slog"
+    "sync"
+    "time"
+)
+
+
+// Error codes returned by SQS when a receipt handle is no longer inflight.
+var expiredReceiptHandleCodes = map[string]struct{}{
+    "MessageNotInflight": {},
+    "AWS.SimpleQueueService.MessageNotInflight": {},
+    "ReceiptHandleIsInvalid": {},
+}
+
+
+// Beats of the heartbeat per visibility timeout.
+const beatsPerVisibilityTimeout = 6
+
+
+const minBeatInterval = time.Millisecond
+
+
+func DefaultVisibilityExtensionWindow(visibilityTimeout time.Duration) time.Duration {
+    return visibilityTimeout / 3
+}
+
+
+// Messages must be extended with some visibility left, and not as soon as they're received.
+func ValidateVisibilityExtensionWindow(visibilityTimeout time.Duration, extensionWindow time.Duration) error {
+    if extensionWindow <= 0 || extensionWindow >= visibilityTimeout {
+        return fmt.Errorf("visibility extension window %v must be above 0 and below visibility timeout %v", extensionWindow, visibilityTimeout)
+    }
+    return nil
+}
+
+
+// Heartbeat extends visibility of held messages before it expires, so
+// kept messages don't reappear on the queue during long runs.
+type Heartbeat struct {
+    queue Queue
+    heldReceiptHandles func() []string // Receipt handles of messages still inflight.
+    visibilityTimeout time.Duration
+    extensionWindow time.Duration // Extend messages with less than this left.
+    mu sync.Mutex
+    deadlines map[string]time.Time
+    expired map[string]struct{}
+    extended int
+    failures []FailedEntry
+    stop chan struct{}
+    done chan struct{}
+    logger *slog.Logger
+}
+
+
+func (h *Heartbeat) Received(messages []QueueMessage) {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    deadline := time.Now().Add(h.visibilityTimeout)
+    for _, message := range messages {
+        h.deadlines[message.ReceiptHandle()] = deadline
+    }
+}
+
+
+// Returns held receipt handles due for extension, and marks
+// ones past their deadline as expired.
+func (h *Heartbeat) dueForExtension(held []string) []string {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    now := time.Now()
+    deadlines := make(map[string]time.Time, len(held))
+    var due []string
+    for _, receiptHandle := range held {
+        deadline, ok := h.deadlines[receiptHandle]
+        if ok {
+            deadlines[receiptHandle] = deadline
+        }
+        if ok && now.After(deadline) {
+            h.expired[receiptHandle] = struct{}{}
+            continue
+        }
+        // Unknown deadlines are extended to be safe. Messages that would be
+        // under the window by the next beat are extended now.
+        if !ok || deadline.Sub(now) < h.extensionWindow + h.interval() {
+            due = append(due, receiptHandle)
+        }
+    }
+    // Drop receipt handles that are no longer held.
+    h.deadlines = deadlines
+    return due
+}
+
+
+func (h *Heartbeat) recordExtension(result BatchResult, extendedAt time.Time, stillHeld map[string]struct{}) {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    deadline := extendedAt.Add(h.visibilityTimeout)
+    for _, receiptHandle := range result.Succeeded {
+        h.deadlines[receiptHandle] = deadline
+    }
+    h.extended += len(result.Succeeded)
+    for _, failure := range result.Failed {
+        _, isExpired := expiredReceiptHandleCodes[failure.Code]
+        _, isHeld := stillHeld[failure.ReceiptHandle]
+        if isExpired && isHeld {
+            h.expired[failure.ReceiptHandle] = struct{}{}
+            continue
+        }
+        if isHeld {
+            h.failures = append(h.failures, FailedEntry{Operation: "extend", BatchEntryFailure: failure})
+        }
+    }
+}
+
+
+func (h *Heartbeat) beat(ctx context.Context) {
+    due := h.dueForExtension(h.heldReceiptHandles())
+    if len(due) == 0 {
+        return
+    }
+    h.logger.DebugContext(ctx, "Extending visibility of held messages", "count", len(due))
+    maxMessages := 10
+    for start := 0; start < len(due); start += maxMessages {
+        end := min(start + maxMessages, len(due))
+        extendedAt := time.Now()
+        result := sendBatch(due[start:end], identity, func(receiptHandles []string) (BatchResult, error) {
+            return h.queue.ChangeVisibilityBatch(ctx, receiptHandles, h.visibilityTimeout)
+        })
+        var stillHeld map[string]struct{}
+        if len(result.Failed) > 0 {
+            // Receipt handles deleted or moved since snapshot aren't expired.
+            stillHeld = make(map[string]struct{})
+            for _, receiptHandle := range h.heldReceiptHandles() {
+                stillHeld[receiptHandle] = struct{}{}
+            }
+        }
+        h.recordExtension(result, extendedAt, stillHeld)
+    }
+}
+
+
+func (h *Heartbeat) SetLogger(logger *slog.Logger) {
+    h.logger = WithRunID(logger)
+}
+
+
+// Beats go by the visibility timeout, so any extension window is met.
+func (h *Heartbeat) interval() time.Duration {
+    return max(h.visibilityTimeout / beatsPerVisibilityTimeout, minBeatInterval)
+}
+
+
+func (h *Heartbeat) Start(ctx context.Context) {
+    go func() {
+        defer close(h.done)
+        ticker := time.NewTicker(h.interval())
+        defer ticker.Stop()
+        for {
+            select {
+            case <-h.stop:
+                return
+            case <-ticker.C:
+                h.beat(ctx)
+            }
+        }
+    }()
+}
+
+
+// Stop must be called before resetting visibility, otherwise
+// a late beat could hide a message that was just reset.
+func (h *Heartbeat) Stop() {
+    close(h.stop)
+    <-h.done
+}
+
+
+// Marks held receipt handles past their deadline as expired.
+func (h *Heartbeat) CheckExpired() {
+    h.dueForExtension(h.heldReceiptHandles())
+}
+
+
+func (h *Heartbeat) ExpiredReceiptHandles() []string {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    var expired []string
+    for receiptHandle := range h.expired {
+        expired = append(expired, receiptHandle)
+    }
+    return expired
+}
+
+
+func (h *Heartbeat) MessagesExtended() int {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    return h.extended
+}
+
+
+func (h *Heartbeat) Failures() []FailedEntry {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    return h.failures
+}
+
+
+func NewHeartbeat(queue Queue, heldReceiptHandles func() []string, visibilityTimeout time.Duration, extensionWindow time.Duration) *Heartbeat {
+    return &Heartbeat{
+        queue: queue,
+        heldReceiptHandles: heldReceiptHandles,
+        visibilityTimeout: visibilityTimeout,
+        extensionWindow: extensionWindow,
+        deadlines: make(map[string]time.Time),
+        expired: make(map[string]struct{}),
+        stop: make(chan struct{}),
+        done: make(chan struct{}),
+        logger: WithRunID(nil),
+    }
+}
@@ -0,0 +1,153 @@
+package dedup_test
+
+
+import (
+    "context"
+    "testing"
+    "time"
+    "github.com/IGVF-DACC/go-sqs-deduplication/internal/memory"
+    "github.com/IGVF-DACC/go-sqs-deduplication/internal/dedup"
+)
+
+
+func pullHeldMessages(t *testing.T, inMemoryQueue *memory.InMemoryQueue) ([]dedup.QueueMessage, func() []string) {
+    pulledMessages, _ := inMemoryQueue.PullMessagesBatch(context.Background())
+    if len(pulledMessages) != 10 {
+        t.Fatalf("Expected to pull 10 messages, got %d", len(pulledMessages))
+    }
+    held := func() []string {
+        var receiptHandles []string
+        for _, message := range pulledMessages {
+            receiptHandles = append(receiptHandles, message.ReceiptHandle())
+        }
+        return receiptHandles
+    }
+    return pulledMessages, held
+}
+
+
+func TestHeartbeatExtendsHeldMessages(t *testing.T) {
+    inMemoryQueue := memory.NewInMemoryQueue(10)
+    inMemoryQueue.AddMessages(memory.GenerateInMemoryMessages(10))
+    pulledMessages, held := pullHeldMessages(t, inMemoryQueue)
+    heartbeat := dedup.NewHeartbeat(inMemoryQueue, held, 300 * time.Millisecond, 200 * time.Millisecond)
+    heartbeat.Received(pulledMessages)
+    heartbeat.Start(context.Background())
+    time.Sleep(500 * time.Millisecond)
+    heartbeat.CheckExpired()
+    heartbeat.Stop()
+    if heartbeat.MessagesExtended() < 10 {
+        t.Errorf("Expected at least 10 messages to be extended, got %d", heartbeat.MessagesExtended())
+    }
+    if len(inMemoryQueue.GetExtendedMessages()) != heartbeat.MessagesExtended() {
+        t.Errorf("Expected %d extended messages on queue, got %d", heartbeat.MessagesExtended(), len(inMemoryQueue.GetExtendedMessages()))
+    }
+    if len(heartbeat.ExpiredReceiptHandles()) != 0 {
+        t.Errorf("Expected no expired receipt handles, got %d", len(heartbeat.ExpiredReceiptHandles()))
+    }
+}
+
+
+type failingExtendQueue struct {
+    *memory.InMemoryQueue
+}
+
+
+func (q *failingExtendQueue) ChangeVisibilityBatch(ctx context.Context, receiptHandles []string, visibilityTimeout time.Duration) (dedup.BatchResult, error) {
+    var result dedup.BatchResult
+    for _, receiptHandle := range receiptHandles {
+        result.Failed = append(result.Failed, dedup.BatchEntryFailure{ReceiptHandle: receiptHandle, Code: "MessageNotInflight", SenderFault: true})
+    }
+    return result, nil
+}
+
+
+func TestHeartbeatDetectsExpiredMessages(t *testing.T) {
+    inMemoryQueue := memory.NewInMemoryQueue(10)
+    inMemoryQueue.AddMessages(memory.GenerateInMemoryMessages(10))
+    pulledMessages, held := pullHeldMessages(t, inMemoryQueue)
+    heartbeat := dedup.NewHeartbeat(&failingExtendQueue{inMemoryQueue}, held, 100 * time.Millisecond, 60 * time.Millisecond)
+    heartbeat.Received(pulledMessages)
+    heartbeat.Start(context.Background())
+    time.Sleep(200 * time.Millisecond)
+    heartbeat.CheckExpired()
+    heartbeat.Stop()
+    if len(heartbeat.ExpiredReceiptHandles()) != 10 {
+        t.Errorf("Expected 10 expired receipt handles, got %d", len(heartbeat.ExpiredReceiptHandles()))
+    }
+    if heartbeat.MessagesExtended() != 0 {
+        t.Errorf("Expected no messages to be extended, got %d", heartbeat.MessagesExtended())
+    }
+    if len(heartbeat.Failures()) != 0 {
+        t.Errorf("Expected expired messages not to be counted as failures, got %d", len(heartbeat.Failures()))
+    }
+}
+
+
+func TestDeduplicatorWithHeartbeat(t *testing.T) {
+    inMemoryQueue := memory.NewInMemoryQueue(10)
+    inMemoryQueue.AddMessages(memory.GenerateInMemoryMessages(1000))
+    inMemoryQueue.AddMessages(memory.GenerateInMemoryMessages(1000))
+    config := &dedup.DeduplicatorConfig{
+        Queue: inMemoryQueue,
+        StorageQueue: memory.NewInMemoryQueue(10),
+        NumWorkers: 20,
+        MaxInflight: 10000,
+        TimeLimitInSeconds: 240,
+        VisibilityTimeout: 900 * time.Second,
+    }
+    report, err := dedup.NewDeduplicator(config).Run(context.Background())
+    if err != nil {
+        t.Errorf("Unexpected error %v", err)
+    }
+    if report.ExpiredReceiptHandles != 0 {
+        t.Errorf("Expected no expired receipt handles, got %d", report.ExpiredReceiptHandles)
+    }
+    if len(inMemoryQueue.GetResetMessages()) != 1000 {
+        t.Errorf("Expected 1000 messages to be reset, got %d", len(inMemoryQueue.GetResetMessages()))
+    }
+}
+
+
+func TestHeartbeatMeetsSmallExtensionWindow(t *testing.T) {
+    inMemoryQueue := memory.NewInMemoryQueue(10)
+    inMemoryQueue.AddMessages(memory.GenerateInMemoryMessages(10))
+    pulledMessages, held := pullHeldMessages(t, inMemoryQueue)
+    // Beats go by the visibility timeout, not the window.
+    heartbeat := dedup.NewHeartbeat(inMemoryQueue, held, 300 * time.Millisecond, time.Nanosecond)
+    heartbeat.Received(pulledMessages)
+    heartbeat.Start(context.Background())
+    time.Sleep(500 * time.Millisecond)
+    heartbeat.CheckExpired()
+    heartbeat.Stop()
+    if heartbeat.MessagesExtended() < 10 {
+        t.Errorf("Expected at least 10 messages to be extended, got %d", heartbeat.MessagesExtended())
+    }
+    if len(heartbeat.ExpiredReceiptHandles()) != 0 {
+        t.Errorf("Expected no expired receipt handles, got %d", len(heartbeat.ExpiredReceiptHandles()))
+    }
+}
+
+
+func TestValidateVisibilityExtensionWindow(t *testing.T) {
+    if err := dedup.ValidateVisibilityExtensionWindow(15 * time.Minute, dedup.DefaultVisibilityExtensionWindow(15 * time.Minute)); err != nil {
+        t.Errorf("Expected default window to be valid, got %v", err)
+    }
+    for _, window := range []time.Duration{0, -time.Second, 2 * time.Minute, 5 * time.Minute} {
+        if err := dedup.ValidateVisibilityExtensionWindow(2 * time.Minute, window); err == nil {
+            t.Errorf("Expected window %v of 2m timeout to be invalid", window)
+        }
+    }
+    config := &dedup.DeduplicatorConfig{
+        Queue: memory.NewInMemoryQueue(10),
+        StorageQueue: memory.NewInMemoryQueue(10),
+        NumWorkers: 1,
+        MaxInflight: 100,
+        TimeLimitInSeconds: 240,
+        VisibilityTimeout: 2 * time.Minute,
+        VisibilityExtensionWindow: 5 * time.Minute,
+    }
+    if _, err := dedup.NewDeduplicator(config).Run(context.Background()); err == nil {
+        t.Error("Expected run to fail with window above visibility timeout")
+    }
+}
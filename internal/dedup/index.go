@@ -0,0 +1,158 @@
+package dedup
+
+
+import (
+    "hash/maphash"
+    "time"
+)
+
+
+// System attributes the flush path forwards to storage queue, all others
+// are dropped from kept messages unless a resolution policy may read them.
+var FlushedAttributes = []string{"AWSTraceHeader"}
+
+
+// Rough per-entry cost of a Go map slot, used to estimate memory of state.
+const mapEntryOverhead = 48
+
+
+// Estimated size of a stored entry, a key fingerprint and a message ID hash.
+const storedEntryBytes = 16 + 8 + mapEntryOverhead
+
+
+// 128-bit hash of a unique ID, collisions are negligible
+// even across hundreds of millions of unique IDs.
+type keyFingerprint struct {
+    hi uint64
+    lo uint64
+}
+
+
+type keyHasher struct {
+    hiSeed maphash.Seed
+    loSeed maphash.Seed
+}
+
+
+func newKeyHasher() keyHasher {
+    return keyHasher{
+        hiSeed: maphash.MakeSeed(),
+        loSeed: maphash.MakeSeed(),
+    }
+}
+
+
+func (h keyHasher) key(uniqueID string) keyFingerprint {
+    return keyFingerprint{
+        hi: maphash.String(h.hiSeed, uniqueID),
+        lo: maphash.String(h.loSeed, uniqueID),
+    }
+}
+
+
+// Only compared against messages with the same key,
+// so 64 bits are plenty to tell redeliveries from copies.
+func (h keyHasher) messageID(messageID string) uint64 {
+    return maphash.String(h.loSeed, messageID)
+}
+
+
+// Copy of a kept message holding only what resolution policies and the
+// reset and flush paths read, without anything a parser hangs on to.
+type keptMessage struct {
+    uniqueID string
+    messageID string
+    receiptHandle string
+    rawBody string
+    sentTime time.Time
+    attributes map[string]string
+    messageAttributes map[string]MessageAttribute
+}
+
+
+func (m *keptMessage) UniqueID() string {
+    return m.uniqueID
+}
+
+
+func (m *keptMessage) MessageID() string {
+    return m.messageID
+}
+
+
+func (m *keptMessage) ReceiptHandle() string {
+    return m.receiptHandle
+}
+
+
+func (m *keptMessage) RawBody() string {
+    return m.rawBody
+}
+
+
+func (m *keptMessage) SentTime() time.Time {
+    return m.sentTime
+}
+
+
+func (m *keptMessage) Attributes() map[string]string {
+    return m.attributes
+}
+
+
+func (m *keptMessage) MessageAttributes() map[string]MessageAttribute {
+    return m.messageAttributes
+}
+
+
+// Estimated bytes held by message and its map slot.
+func (m *keptMessage) size() int64 {
+    size := 16 + 16 * 4 + 24 + 8 * 2 + mapEntryOverhead
+    size += len(m.uniqueID) + len(m.messageID) + len(m.receiptHandle) + len(m.rawBody)
+    for name, value := range m.attributes {
+        size += len(name) + len(value) + mapEntryOverhead
+    }
+    for name, value := range m.messageAttributes {
+        size += len(name) + len(value.DataType) + len(value.StringValue) + len(value.BinaryValue) + mapEntryOverhead
+    }
+    return int64(size)
+}
+
+
+func compactMessage(message QueueMessage, allAttributes bool) *keptMessage {
+    if kept, ok := message.(*keptMessage); ok {
+        return kept
+    }
+    attributes := message.Attributes()
+    if !allAttributes {
+        attributes = flushedAttributes(attributes)
+    }
+    return &keptMessage{
+        uniqueID: message.UniqueID(),
+        messageID: message.MessageID(),
+        receiptHandle: message.ReceiptHandle(),
+        rawBody: message.RawBody(),
+        sentTime: message.SentTime(),
+        attributes: attributes,
+        messageAttributes: message.MessageAttributes(),
+    }
+}
+
+
+func flushedAttributes(all map[string]string) map[string]string {
+    var attributes map[string]string
+    for _, name := range FlushedAttributes {
+        if value, ok := all[name]; ok {
+            if attributes == nil {
+                attributes = make(map[string]string)
+            }
+            attributes[name] = value
+        }
+    }
+    return attributes
+}
+
+
+func deleteEntryBytes(receiptHandle string) int64 {
+    return int64(16 + len(receiptHandle) + mapEntryOverhead)
+}
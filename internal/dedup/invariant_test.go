@@ -0,0 +1,116 @@
+package dedup_test
+
+
+import (
+    "context"
+    "fmt"
+    "testing"
+    "time"
+    "github.com/IGVF-DACC/go-sqs-deduplication/internal/fault"
+    "github.com/IGVF-DACC/go-sqs-deduplication/internal/memory"
+    "github.com/IGVF-DACC/go-sqs-deduplication/internal/dedup"
+)
+
+
+var faultConfigs = map[string]fault.Config{
+    "receive errors": {ReceiveErrorRate: 0.05},
+    "empty receives": {EmptyReceiveRate: 0.05},
+    "duplicate deliveries": {DuplicateDeliveryRate: 0.3},
+    "partial failures": {EntryFailureRate: 0.2},
+    "latency": {MaxLatency: time.Millisecond},
+    "everything": {
+        ReceiveErrorRate: 0.02,
+        EmptyReceiveRate: 0.02,
+        DuplicateDeliveryRate: 0.2,
+        EntryFailureRate: 0.1,
+        MaxLatency: 100 * time.Microsecond,
+    },
+    "scripted": {
+        Script: []fault.Fault{
+            {Operation: fault.Receive, Call: 3, Duplicate: true},
+            {Operation: fault.Delete, Call: 1, FailEntries: 10},
+            {Operation: fault.Put, Call: 2, Error: fault.ErrInjected},
+            {Operation: fault.Reset, Call: 1, FailEntries: 5},
+            {Operation: fault.Receive, Call: 50, Error: fault.ErrInjected},
+        },
+    },
+}
+
+
+// Unique IDs left on queue and storage, by number of copies.
+func uniqueIDCounts(queues ...*memory.SimulatedQueue) map[string]int {
+    counts := make(map[string]int)
+    for _, queue := range queues {
+        for uniqueID, count := range queue.UniqueIDCounts() {
+            counts[uniqueID] += count
+        }
+    }
+    return counts
+}
+
+
+// However SQS misbehaves, a run never loses the last copy of a unique ID,
+// and nothing stays invisible unless the run reports failing to delete,
+// reset or move it. Once visibility of those has expired, a run without
+// faults leaves exactly one visible copy of every unique ID on queue and
+// nothing in storage.
+func TestDeduplicatorInvariantsUnderFaults(t *testing.T) {
+    for name, faultConfig := range faultConfigs {
+        for seed := int64(1); seed <= 3; seed++ {
+            t.Run(fmt.Sprintf("%s/%d", name, seed), func(t *testing.T) {
+                clock := memory.NewManualClock(time.Now())
+                queue := memory.NewSimulatedQueue(&memory.SimulatedQueueConfig{Clock: clock, Seed: seed})
+                storageQueue := memory.NewSimulatedQueue(&memory.SimulatedQueueConfig{Clock: clock, Seed: seed})
+                queue.AddMessages(memory.GenerateInMemoryMessages(300))
+                queue.AddMessages(memory.GenerateInMemoryMessages(200))
+                queue.AddMessages(memory.MakeDuplicateInMemoryMessages("abc", 100))
+                faultConfig.Seed = seed
+                config := &dedup.DeduplicatorConfig{
+                    Queue: fault.NewQueue(queue, &faultConfig),
+                    StorageQueue: fault.NewQueue(storageQueue, &faultConfig),
+                    NumWorkers: 4,
+                    MaxInflight: 100,
+                    TimeLimitInSeconds: 240,
+                }
+                report, err := dedup.NewDeduplicator(config).Run(context.Background())
+                if err != nil {
+                    t.Fatal(err)
+                }
+                counts := uniqueIDCounts(queue, storageQueue)
+                if len(counts) != 301 {
+                    t.Fatalf("Expected all 301 unique IDs on queue or in storage, got %d, report %+v", len(counts), report)
+                }
+                failed := make(map[string]struct{})
+                for _, failure := range report.FailedEntries {
+                    failed[failure.ReceiptHandle] = struct{}{}
+                }
+                for _, receiptHandle := range append(queue.InflightReceiptHandles(), storageQueue.InflightReceiptHandles()...) {
+                    if _, ok := failed[receiptHandle]; !ok {
+                        t.Errorf("Expected %s left invisible to be reported as failed", receiptHandle)
+                    }
+                }
+                clock.Advance(memory.DefaultSimulatedVisibilityTimeout)
+                config.Queue = queue
+                config.StorageQueue = storageQueue
+                if _, err := dedup.NewDeduplicator(config).Run(context.Background()); err != nil {
+                    t.Fatal(err)
+                }
+                if storageQueue.MessagesLen() != 0 {
+                    t.Errorf("Expected nothing left in storage, got %d", storageQueue.MessagesLen())
+                }
+                if queue.InflightLen() != 0 {
+                    t.Errorf("Expected nothing left invisible, got %d", queue.InflightLen())
+                }
+                counts = uniqueIDCounts(queue)
+                if len(counts) != 301 {
+                    t.Errorf("Expected all 301 unique IDs on queue, got %d", len(counts))
+                }
+                for uniqueID, count := range counts {
+                    if count != 1 {
+                        t.Errorf("Expected one copy of %s, got %d", uniqueID, count)
+                    }
+                }
+            })
+        }
+    }
+}
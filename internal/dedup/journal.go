@@ -0,0 +1,253 @@
+package dedup
+
+
+import (
+    "bufio"
+    "encoding/json"
+    "errors"
+    "os"
+    "sync"
+    "time"
+)
+
+
+// Longest journal line read back, a batch of receipt handles is far shorter.
+const maxJournalLineLength = 1 << 20
+
+
+// Write-ahead journal of the current run, kept in a local file as JSON
+// lines. Every entry is synced before the put or delete it announces, so
+// the next run can tell which moves a run that died left half done.
+// Only the last run is kept. Methods of a nil Journal do nothing.
+type Journal struct {
+    mu sync.Mutex
+    file *os.File
+    nextBatch int64
+}
+
+
+type journalEntry struct {
+    Type string `json:"type"` // run, phase, move, put, delete or done.
+    RunID string `json:"runID,omitempty"`
+    Phase string `json:"phase,omitempty"`
+    Batch int64 `json:"batch,omitempty"`
+    Flush bool `json:"flush,omitempty"` // Batch moves from queue to storage, otherwise from storage to queue.
+    ReceiptHandles []string `json:"receiptHandles,omitempty"`
+    MessageIDs []string `json:"messageIDs,omitempty"`
+    Time time.Time `json:"time"`
+}
+
+
+// Batch of an unfinished run, receipt handles are of the source of the move.
+type journaledBatch struct {
+    id int64
+    flush bool
+    receiptHandles []string
+    messageIDs map[string]string // By receipt handle.
+    put map[string]struct{} // Nil if the run died before put returned.
+    deleted map[string]struct{}
+}
+
+
+// Put on target but not deleted from source, so on both.
+func (b *journaledBatch) onBoth() []string {
+    var receiptHandles []string
+    for _, receiptHandle := range b.receiptHandles {
+        _, put := b.put[receiptHandle]
+        _, deleted := b.deleted[receiptHandle]
+        if put && !deleted {
+            receiptHandles = append(receiptHandles, receiptHandle)
+        }
+    }
+    return receiptHandles
+}
+
+
+func (b *journaledBatch) messageIDsOf(receiptHandles []string) []string {
+    messageIDs := make([]string, 0, len(receiptHandles))
+    for _, receiptHandle := range receiptHandles {
+        messageIDs = append(messageIDs, b.messageIDs[receiptHandle])
+    }
+    return messageIDs
+}
+
+
+type journaledRun struct {
+    runID string
+    phase string // Last phase started.
+    batches []*journaledBatch
+}
+
+
+func OpenJournal(path string) (*Journal, error) {
+    file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+    if err != nil {
+        return nil, err
+    }
+    return &Journal{file: file}, nil
+}
+
+
+func (j *Journal) Close() error {
+    if j == nil {
+        return nil
+    }
+    return j.file.Close()
+}
+
+
+// Run left in the journal without a done entry, nil if there is none.
+// A torn last line is where the run died, so reading stops there.
+func (j *Journal) unfinishedRun() (*journaledRun, error) {
+    if j == nil {
+        return nil, nil
+    }
+    j.mu.Lock()
+    defer j.mu.Unlock()
+    if _, err := j.file.Seek(0, 0); err != nil {
+        return nil, err
+    }
+    var run *journaledRun
+    batches := make(map[int64]*journaledBatch)
+    scanner := bufio.NewScanner(j.file)
+    scanner.Buffer(make([]byte, 0, 64 * 1024), maxJournalLineLength)
+    for scanner.Scan() {
+        var entry journalEntry
+        if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+            break
+        }
+        switch entry.Type {
+        case "run":
+            run = &journaledRun{runID: entry.RunID}
+            batches = make(map[int64]*journaledBatch)
+        case "phase":
+            if run != nil {
+                run.phase = entry.Phase
+            }
+        case "move":
+            if run == nil {
+                continue
+            }
+            batch := &journaledBatch{
+                id: entry.Batch,
+                flush: entry.Flush,
+                receiptHandles: entry.ReceiptHandles,
+                messageIDs: make(map[string]string),
+            }
+            for i, receiptHandle := range entry.ReceiptHandles {
+                if i < len(entry.MessageIDs) {
+                    batch.messageIDs[receiptHandle] = entry.MessageIDs[i]
+                }
+            }
+            batches[entry.Batch] = batch
+            run.batches = append(run.batches, batch)
+        case "put", "delete":
+            batch, ok := batches[entry.Batch]
+            if !ok {
+                continue
+            }
+            receiptHandles := make(map[string]struct{})
+            for _, receiptHandle := range entry.ReceiptHandles {
+                receiptHandles[receiptHandle] = struct{}{}
+            }
+            if entry.Type == "put" {
+                batch.put = receiptHandles
+            } else {
+                batch.deleted = receiptHandles
+            }
+        case "done":
+            run = nil
+        }
+    }
+    if err := scanner.Err(); err != nil && !errors.Is(err, bufio.ErrTooLong) {
+        return nil, err
+    }
+    return run, nil
+}
+
+
+func (j *Journal) append(entry journalEntry) error {
+    entry.Time = time.Now().UTC()
+    line, err := json.Marshal(entry)
+    if err != nil {
+        return err
+    }
+    line = append(line, '\n')
+    if _, err := j.file.Write(line); err != nil {
+        return err
+    }
+    return j.file.Sync()
+}
+
+
+// Starts journaling a new run, dropping whatever the last run left.
+func (j *Journal) begin(runID string) error {
+    if j == nil {
+        return nil
+    }
+    j.mu.Lock()
+    defer j.mu.Unlock()
+    if err := j.file.Truncate(0); err != nil {
+        return err
+    }
+    j.nextBatch = 0
+    return j.append(journalEntry{Type: "run", RunID: runID})
+}
+
+
+func (j *Journal) recordPhase(phase string) error {
+    if j == nil {
+        return nil
+    }
+    j.mu.Lock()
+    defer j.mu.Unlock()
+    return j.append(journalEntry{Type: "phase", Phase: phase})
+}
+
+
+// Announces a batch about to be moved and returns its ID.
+func (j *Journal) recordMove(flush bool, messages []QueueMessage) (int64, error) {
+    if j == nil {
+        return 0, nil
+    }
+    entry := journalEntry{Type: "move", Flush: flush}
+    for _, message := range messages {
+        entry.ReceiptHandles = append(entry.ReceiptHandles, message.ReceiptHandle())
+        entry.MessageIDs = append(entry.MessageIDs, message.MessageID())
+    }
+    j.mu.Lock()
+    defer j.mu.Unlock()
+    j.nextBatch++
+    entry.Batch = j.nextBatch
+    return entry.Batch, j.append(entry)
+}
+
+
+func (j *Journal) recordPut(batch int64, succeeded []string) error {
+    if j == nil {
+        return nil
+    }
+    j.mu.Lock()
+    defer j.mu.Unlock()
+    return j.append(journalEntry{Type: "put", Batch: batch, ReceiptHandles: succeeded})
+}
+
+
+func (j *Journal) recordDelete(batch int64, succeeded []string) error {
+    if j == nil {
+        return nil
+    }
+    j.mu.Lock()
+    defer j.mu.Unlock()
+    return j.append(journalEntry{Type: "delete", Batch: batch, ReceiptHandles: succeeded})
+}
+
+
+func (j *Journal) finish() error {
+    if j == nil {
+        return nil
+    }
+    j.mu.Lock()
+    defer j.mu.Unlock()
+    return j.append(journalEntry{Type: "done"})
+}
@@ -0,0 +1,171 @@
+package dedup_test
+
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "fmt"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+    "github.com/IGVF-DACC/go-sqs-deduplication/internal/memory"
+    "github.com/IGVF-DACC/go-sqs-deduplication/internal/dedup"
+)
+
+
+func receiptHandlesOf(messages []dedup.QueueMessage) []string {
+    var receiptHandles []string
+    for _, message := range messages {
+        receiptHandles = append(receiptHandles, message.ReceiptHandle())
+    }
+    return receiptHandles
+}
+
+
+func messagesWithPrefix(prefix string, numMessages int) []dedup.QueueMessage {
+    var messages []dedup.QueueMessage
+    for i := 0; i < numMessages; i++ {
+        messages = append(messages, memory.NewInMemoryMessage(fmt.Sprintf("%s-%d", prefix, i), "", time.Now(), nil, nil))
+    }
+    return messages
+}
+
+
+func writeJournal(t *testing.T, path string, entries []map[string]any) {
+    file, err := os.Create(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer file.Close()
+    encoder := json.NewEncoder(file)
+    for _, entry := range entries {
+        if err := encoder.Encode(entry); err != nil {
+            t.Fatal(err)
+        }
+    }
+    // Torn line left by the crash.
+    if _, err := file.WriteString(`{"type":"del`); err != nil {
+        t.Fatal(err)
+    }
+}
+
+
+func TestDeduplicatorReconcilesUnfinishedRun(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "journal")
+    // Run died with a flushed batch on both queue and storage, a restored
+    // batch on both, and a batch it was still putting.
+    flushed := messagesWithPrefix("flushed", 5)
+    restored := messagesWithPrefix("restored", 5)
+    putting := messagesWithPrefix("putting", 3)
+    queue := memory.NewInMemoryQueue(10)
+    queue.AddMessages(memory.GenerateInMemoryMessages(20))
+    queue.AddMessages(flushed)
+    queue.AddMessages(restored)
+    storageQueue := memory.NewInMemoryQueue(10)
+    storageQueue.AddMessages(flushed)
+    storageQueue.AddMessages(restored)
+    storageQueue.AddMessages(putting)
+    writeJournal(t, path, []map[string]any{
+        {"type": "run", "runID": "crashed"},
+        {"type": "phase", "phase": "pull"},
+        {"type": "move", "batch": 1, "flush": true, "receiptHandles": receiptHandlesOf(flushed)},
+        {"type": "put", "batch": 1, "receiptHandles": receiptHandlesOf(flushed)},
+        {"type": "phase", "phase": "post-restore"},
+        {"type": "move", "batch": 2, "receiptHandles": receiptHandlesOf(restored)},
+        {"type": "put", "batch": 2, "receiptHandles": receiptHandlesOf(restored)},
+        {"type": "move", "batch": 3, "receiptHandles": receiptHandlesOf(putting)},
+    })
+    journal, err := dedup.OpenJournal(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer journal.Close()
+    config := &dedup.DeduplicatorConfig{
+        Queue: queue,
+        StorageQueue: storageQueue,
+        NumWorkers: 2,
+        MaxInflight: 100,
+        TimeLimitInSeconds: 240,
+        Journal: journal,
+    }
+    deduplicator := dedup.NewDeduplicator(config)
+    report, _ := deduplicator.Run(context.Background())
+    if report.Recovery == nil {
+        t.Fatal("Expected recovery report")
+    }
+    if report.Recovery.RunID != "crashed" || report.Recovery.Phase != "post-restore" {
+        t.Errorf("Expected unfinished run crashed in post-restore, got %+v", report.Recovery)
+    }
+    if report.Recovery.DeletedFromQueue != 5 {
+        t.Errorf("Expected 5 flushed messages deleted from queue, got %d", report.Recovery.DeletedFromQueue)
+    }
+    if report.Recovery.RemovedFromStorage != 5 {
+        t.Errorf("Expected 5 restored messages removed from storage, got %d", report.Recovery.RemovedFromStorage)
+    }
+    if report.Recovery.Unknown != 3 {
+        t.Errorf("Expected 3 unknown messages, got %d", report.Recovery.Unknown)
+    }
+    // Flushed and putting batches restored once, restored batch already on queue.
+    if report.MessagesRestoredFromStorage != 8 {
+        t.Errorf("Expected 8 messages restored from storage, got %d", report.MessagesRestoredFromStorage)
+    }
+    if report.DuplicatesDeleted != 0 || report.UniqueKept != 33 {
+        t.Errorf("Expected 33 unique messages and no duplicates, got %d and %d", report.UniqueKept, report.DuplicatesDeleted)
+    }
+    deduplicator.Reset()
+    secondReport, _ := deduplicator.Run(context.Background())
+    if secondReport.Recovery != nil {
+        t.Errorf("Expected finished run to need no recovery, got %+v", secondReport.Recovery)
+    }
+}
+
+
+func TestDeduplicatorJournalsMoves(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "journal")
+    journal, err := dedup.OpenJournal(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer journal.Close()
+    queue := memory.NewInMemoryQueue(10)
+    queue.AddMessages(memory.GenerateInMemoryMessages(100))
+    config := &dedup.DeduplicatorConfig{
+        Queue: queue,
+        StorageQueue: memory.NewInMemoryQueue(10),
+        NumWorkers: 2,
+        MaxInflight: 50,
+        TimeLimitInSeconds: 240,
+        Journal: journal,
+    }
+    report, _ := dedup.NewDeduplicator(config).Run(context.Background())
+    if report.MessagesFlushedToStorage == 0 {
+        t.Fatal("Expected messages flushed to storage")
+    }
+    data, err := os.ReadFile(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    counts := make(map[string]int)
+    decoder := json.NewDecoder(bytes.NewReader(data))
+    for decoder.More() {
+        var entry struct {
+            Type string `json:"type"`
+            RunID string `json:"runID"`
+        }
+        if err := decoder.Decode(&entry); err != nil {
+            t.Fatal(err)
+        }
+        if entry.Type == "run" && entry.RunID != report.RunID {
+            t.Errorf("Expected journal of run %s, got %s", report.RunID, entry.RunID)
+        }
+        counts[entry.Type]++
+    }
+    if counts["run"] != 1 || counts["done"] != 1 {
+        t.Errorf("Expected one run and done entry, got %v", counts)
+    }
+    if counts["move"] == 0 || counts["move"] != counts["put"] || counts["move"] != counts["delete"] {
+        t.Errorf("Expected every move to be put and deleted, got %v", counts)
+    }
+}
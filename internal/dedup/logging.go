@@ -0,0 +1,70 @@
+package dedup
+
+
+import (
+    "context"
+    "crypto/rand"
+    "encoding/hex"
+    "log/slog"
+)
+
+
+type runIDKey struct{}
+
+
+func ContextWithRunID(ctx context.Context, runID string) context.Context {
+    return context.WithValue(ctx, runIDKey{}, runID)
+}
+
+
+func RunIDFromContext(ctx context.Context) string {
+    if ctx == nil {
+        return ""
+    }
+    runID, _ := ctx.Value(runIDKey{}).(string)
+    return runID
+}
+
+
+// Adds run_id from context to every record, so lines logged by
+// queues during a run can be correlated with the run report.
+type runIDHandler struct {
+    slog.Handler
+}
+
+
+func (h runIDHandler) Handle(ctx context.Context, record slog.Record) error {
+    if runID := RunIDFromContext(ctx); runID != "" {
+        record.AddAttrs(slog.String("run_id", runID))
+    }
+    return h.Handler.Handle(ctx, record)
+}
+
+
+func (h runIDHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+    return runIDHandler{h.Handler.WithAttrs(attrs)}
+}
+
+
+func (h runIDHandler) WithGroup(name string) slog.Handler {
+    return runIDHandler{h.Handler.WithGroup(name)}
+}
+
+
+// Returns logger that adds run ID from context, uses slog.Default if logger is nil.
+func WithRunID(logger *slog.Logger) *slog.Logger {
+    if logger == nil {
+        logger = slog.Default()
+    }
+    if _, ok := logger.Handler().(runIDHandler); ok {
+        return logger
+    }
+    return slog.New(runIDHandler{logger.Handler()})
+}
+
+
+func newRunID() string {
+    b := make([]byte, 8)
+    rand.Read(b)
+    return hex.EncodeToString(b)
+}
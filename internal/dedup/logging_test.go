@@ -0,0 +1,68 @@
+package dedup_test
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "log/slog"
+    "strings"
+    "testing"
+    "github.com/IGVF-DACC/go-sqs-deduplication/internal/memory"
+    "github.com/IGVF-DACC/go-sqs-deduplication/internal/dedup"
+)
+
+
+func TestDeduplicatorLogsRunID(t *testing.T) {
+    var buf bytes.Buffer
+    logger := slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+    inMemoryQueue := memory.NewInMemoryQueue(10)
+    inMemoryQueue.AddMessages(memory.GenerateInMemoryMessages(100))
+    config := &dedup.DeduplicatorConfig{
+        Queue: inMemoryQueue,
+        StorageQueue: memory.NewInMemoryQueue(10),
+        NumWorkers: 5,
+        MaxInflight: 50,
+        TimeLimitInSeconds: 240,
+        Logger: logger,
+    }
+    deduplicator := dedup.NewDeduplicator(config)
+    report, _ := deduplicator.Run(context.Background())
+    if report.RunID == "" {
+        t.Fatal("Expected run ID in report")
+    }
+    lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+    if len(lines) < 2 {
+        t.Fatalf("Expected several log lines, got %d", len(lines))
+    }
+    for _, line := range lines {
+        var record map[string]any
+        if err := json.Unmarshal([]byte(line), &record); err != nil {
+            t.Fatal(err)
+        }
+        if record["run_id"] != report.RunID {
+            t.Errorf("Expected run_id %s on every line, got %s", report.RunID, line)
+        }
+    }
+    secondReport, _ := deduplicator.Run(context.Background())
+    if secondReport.RunID == report.RunID {
+        t.Error("Expected new run ID for every run")
+    }
+}
+
+
+func TestWithRunIDAddsRunIDFromContext(t *testing.T) {
+    var buf bytes.Buffer
+    logger := dedup.WithRunID(slog.New(slog.NewTextHandler(&buf, nil))).With("queue", "q")
+    if dedup.WithRunID(logger) != logger {
+        t.Error("Expected logger that already adds run ID to be returned as is")
+    }
+    logger.InfoContext(dedup.ContextWithRunID(context.Background(), "abc"), "hello")
+    logger.Info("no run")
+    lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+    if !strings.Contains(lines[0], "queue=q") || !strings.Contains(lines[0], "run_id=abc") {
+        t.Errorf("Expected queue and run_id attributes, got %s", lines[0])
+    }
+    if strings.Contains(lines[1], "run_id") {
+        t.Errorf("Expected no run_id without context, got %s", lines[1])
+    }
+}
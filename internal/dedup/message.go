@@ -1,9 +1,26 @@
 package dedup
 
 
+import (
+    "time"
+)
+
+
+// Mirrors an SQS message attribute. DataType is String, Number or
+// Binary, optionally followed by a custom type, e.g. Number.int
+type MessageAttribute struct {
+    DataType string
+    StringValue string
+    BinaryValue []byte
+}
+
+
 type QueueMessage interface {
     UniqueID() string
     MessageID() string
     ReceiptHandle() string
     RawBody() string
+    SentTime() time.Time // Zero if unknown.
+    Attributes() map[string]string // System attributes such as SentTimestamp.
+    MessageAttributes() map[string]MessageAttribute
 }
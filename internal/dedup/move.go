@@ -1,18 +1,28 @@
 package dedup
 
 import (
-    "fmt"
+    "context"
+    "errors"
+    "log/slog"
     "sync"
 )
 
 
+// Flushes messages from queue to storage, or restores them from storage to queue.
 type Mover struct {
-    fromQueue Queue
-    toQueue Queue
-    moveChannel chan QueueMessage // Messages pulled from here if not nil, otherwise uses fromQueue.
+    queue Queue
+    storage Storage
+    moveChannel chan QueueMessage // Messages pulled from here if not nil, otherwise loaded from storage.
     state *SharedState
     wg *sync.WaitGroup
     flushToStorage bool // Is this move part of flushing memory to storage?
+    moved int
+    orphans int // Copies left by half-completed moves removed from storage instead of restored, or confirmed as suspects.
+    duplicates int // Duplicates of messages already on queue removed from storage instead of restored.
+    untokened int // Put without a move token, no room for the attribute.
+    failures []FailedEntry
+    journal *Journal
+    logger *slog.Logger
 }
 
 
@@ -21,91 +31,250 @@ func (m *Mover) SetMoveChannel(moveChannel chan QueueMessage) {
 }
 
 
-func (m *Mover) getBatchOfMessages() []QueueMessage {
+func (m *Mover) getBatchOfMessages(ctx context.Context) []QueueMessage {
     if m.moveChannel != nil {
-        var messages []QueueMessage
+        // Take what's already on the channel rather than waiting for a full batch.
         maxMessages := 10
-        for i := 0; i < maxMessages; i++ {
-            message, ok := <- m.moveChannel
-            if !ok {
+        message, ok := <- m.moveChannel
+        if !ok {
+            return nil
+        }
+        messages := []QueueMessage{message}
+        for len(messages) < maxMessages {
+            select {
+            case message, ok := <- m.moveChannel:
+                if !ok {
+                    return messages
+                }
+                messages = append(messages, message)
+            default:
                 return messages
             }
-            messages = append(messages, message)
         }
         return messages
     } else {
-        messages, err := m.fromQueue.PullMessagesBatch()
-        if err != nil {
-            fmt.Println("Error pulling messages in mover", err)
+        messages, err := m.storage.LoadMessagesBatch(ctx)
+        for errors.Is(err, ErrOnlyPoisonMessages) && ctx.Err() == nil {
+            messages, err = m.storage.LoadMessagesBatch(ctx)
+        }
+        if err != nil && ctx.Err() == nil {
+            m.logger.ErrorContext(ctx, "Error loading messages from storage in mover", "error", err)
         }
         return messages
     }
 }
 
 
-func (m *Mover) putBatchOfMessages(messages []QueueMessage) error {
-    return m.toQueue.PutMessagesBatch(messages)
+// Stores messages when flushing, puts them back on queue when restoring,
+// either way tagged with a move token.
+func (m *Mover) putBatchOfMessages(ctx context.Context, messages []QueueMessage) BatchResult {
+    runID := RunIDFromContext(ctx)
+    tokened := make([]QueueMessage, 0, len(messages))
+    untokened := 0
+    for _, message := range messages {
+        message, ok := withMoveToken(message, runID)
+        if !ok {
+            untokened++
+        }
+        tokened = append(tokened, message)
+    }
+    if untokened > 0 {
+        // Copies these leave behind can't be told apart from duplicates.
+        m.logger.WarnContext(ctx, "No room for move token on messages", "count", untokened)
+        m.untokened += untokened
+    }
+    return sendBatch(tokened, QueueMessage.ReceiptHandle, func(messages []QueueMessage) (BatchResult, error) {
+        if m.flushToStorage {
+            return m.storage.StoreMessagesBatch(ctx, messages)
+        }
+        return m.queue.PutMessagesBatch(ctx, messages)
+    })
 }
 
 
-func (m *Mover) deleteBatchOfMessages(messages []QueueMessage) {
+// Deletes messages from queue when flushing, removes them from storage when restoring.
+func (m *Mover) deleteBatchOfMessages(ctx context.Context, messages []QueueMessage) BatchResult {
     var receiptHandles []string
     for _, message := range messages {
         receiptHandles = append(receiptHandles, message.ReceiptHandle())
     }
-    m.fromQueue.DeleteMessagesBatch(receiptHandles)
+    return sendBatch(receiptHandles, identity, func(receiptHandles []string) (BatchResult, error) {
+        if m.flushToStorage {
+            return m.queue.DeleteMessagesBatch(ctx, receiptHandles)
+        }
+        return m.storage.RemoveMessagesBatch(ctx, receiptHandles)
+    })
+}
+
+
+func succeededMessages(messages []QueueMessage, result BatchResult) []QueueMessage {
+    succeeded := make(map[string]struct{})
+    for _, receiptHandle := range result.Succeeded {
+        succeeded[receiptHandle] = struct{}{}
+    }
+    var filtered []QueueMessage
+    for _, message := range messages {
+        if _, ok := succeeded[message.ReceiptHandle()]; ok {
+            filtered = append(filtered, message)
+        }
+    }
+    return filtered
 }
 
 
 func (m *Mover) updateState(messages []QueueMessage) {
-    m.state.mu.Lock()
-    defer m.state.mu.Unlock()
+    m.state.markStored(messages)
+}
+
+
+func failedMessages(messages []QueueMessage, result BatchResult) []QueueMessage {
+    succeeded := make(map[string]struct{})
+    for _, receiptHandle := range result.Succeeded {
+        succeeded[receiptHandle] = struct{}{}
+    }
+    var failed []QueueMessage
     for _, message := range messages {
-        // Add to storedMessages
-        m.state.storedMessages[message.UniqueID()] = message
-        // Delete from keepMessages
-        if _, ok := m.state.keepMessages[message.UniqueID()]; ok {
-            delete(m.state.keepMessages, message.UniqueID())
+        if _, ok := succeeded[message.ReceiptHandle()]; !ok {
+            failed = append(failed, message)
         }
     }
+    return failed
 }
 
 
-func (m *Mover) moveMessages() {
-    for {
-        messages := m.getBatchOfMessages()
+// Removes copies and duplicates of messages already on queue from
+// storage instead of restoring them, and returns the rest.
+func (m *Mover) removeStorageDuplicates(ctx context.Context, messages []QueueMessage) []QueueMessage {
+    if m.flushToStorage || m.state == nil {
+        return messages
+    }
+    messages, orphans, duplicates := m.state.classifyRestored(messages)
+    if len(orphans) == 0 && len(duplicates) == 0 {
+        return messages
+    }
+    result := m.deleteBatchOfMessages(ctx, append(orphans, duplicates...))
+    m.failures = append(m.failures, withOperation("delete", result.Failed)...)
+    removedOrphans := len(succeededMessages(orphans, result))
+    removedDuplicates := len(succeededMessages(duplicates, result))
+    m.orphans += removedOrphans
+    m.duplicates += removedDuplicates
+    m.logger.DebugContext(ctx, "Removed messages already on queue from storage", "orphans", removedOrphans, "duplicates", removedDuplicates)
+    return messages
+}
+
+
+func (m *Mover) moveMessages(ctx context.Context) {
+    // Once a batch is taken it is always put and deleted, even if ctx
+    // is cancelled, so a message never ends up on both queues.
+    batchCtx := context.WithoutCancel(ctx)
+    for ctx.Err() == nil {
+        messages := m.getBatchOfMessages(ctx)
         if len(messages) == 0 {
             break
         }
-        err := m.putBatchOfMessages(messages)
+        messages = m.removeStorageDuplicates(batchCtx, messages)
+        if len(messages) == 0 {
+            continue
+        }
+        batch, err := m.journal.recordMove(m.flushToStorage, messages)
         if err != nil {
-            fmt.Println("Error putting messages in mover, breaking", err)
+            m.logger.ErrorContext(ctx, "Error journaling move in mover", "error", err)
+        }
+        putResult := m.putBatchOfMessages(batchCtx, messages)
+        if err := m.journal.recordPut(batch, putResult.Succeeded); err != nil {
+            m.logger.ErrorContext(ctx, "Error journaling put in mover", "error", err)
+        }
+        m.failures = append(m.failures, withOperation("put", putResult.Failed)...)
+        if m.flushToStorage {
+            // Messages that didn't make it to storage are kept and reset instead.
+            m.state.returnToKeep(failedMessages(messages, putResult))
+        } else if m.state != nil {
+            m.state.returnToStorage(failedMessages(messages, putResult))
+        }
+        if len(putResult.Succeeded) == 0 && m.moveChannel == nil {
+            m.logger.ErrorContext(ctx, "Error putting messages in mover, breaking", "failed", len(putResult.Failed))
             break
         }
-        m.deleteBatchOfMessages(messages)
+        if len(putResult.Succeeded) == 0 {
+            // Keep draining moveChannel so senders don't block.
+            m.logger.ErrorContext(ctx, "Error putting messages in mover", "failed", len(putResult.Failed))
+            continue
+        }
+        // Only delete messages from source that made it to target.
+        putMessages := succeededMessages(messages, putResult)
+        deleteResult := m.deleteBatchOfMessages(batchCtx, putMessages)
+        if err := m.journal.recordDelete(batch, deleteResult.Succeeded); err != nil {
+            m.logger.ErrorContext(ctx, "Error journaling delete in mover", "error", err)
+        }
+        m.failures = append(m.failures, withOperation("delete", deleteResult.Failed)...)
+        m.moved += len(putMessages)
         if m.flushToStorage {
-            m.updateState(messages)
+            m.updateState(putMessages)
+        } else if m.state != nil {
+            // Restored copies confirm suspects held by pullers.
+            m.orphans += m.state.confirmSuspects(putMessages)
         }
     }
 }
 
 
-func (m *Mover) Start() {
+func (m *Mover) Start(ctx context.Context) {
     m.wg.Add(1)
     go func() {
         defer m.wg.Done()
-        m.moveMessages()
+        m.moveMessages(ctx)
     }()
 }
 
 
+func (m *Mover) SetLogger(logger *slog.Logger) {
+    m.logger = WithRunID(logger)
+}
+
+
+func (m *Mover) MessagesMoved() int {
+    return m.moved
+}
+
+
+func (m *Mover) OrphansDropped() int {
+    return m.orphans
+}
+
+
+func (m *Mover) DuplicatesRemoved() int {
+    return m.duplicates
+}
+
+
+func (m *Mover) MessagesUntokened() int {
+    return m.untokened
+}
+
+
+func (m *Mover) Failures() []FailedEntry {
+    return m.failures
+}
+
+
+// Moves messages between two queues, toQueue is used as storage when
+// flushing to storage, fromQueue when restoring.
 func NewMover(fromQueue Queue, toQueue Queue, moveChannel chan QueueMessage, state *SharedState, flushToStorage bool, wg *sync.WaitGroup) *Mover {
+    if flushToStorage {
+        return NewStorageMover(fromQueue, NewQueueStorage(toQueue), moveChannel, state, true, wg)
+    }
+    return NewStorageMover(toQueue, NewQueueStorage(fromQueue), moveChannel, state, false, wg)
+}
+
+
+func NewStorageMover(queue Queue, storage Storage, moveChannel chan QueueMessage, state *SharedState, flushToStorage bool, wg *sync.WaitGroup) *Mover {
     return &Mover{
-        fromQueue: fromQueue,
-        toQueue: toQueue,
+        queue: queue,
+        storage: storage,
         moveChannel: moveChannel,
         state: state,
         flushToStorage: flushToStorage,
         wg: wg,
+        logger: WithRunID(nil),
     }
 }
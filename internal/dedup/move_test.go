@@ -3,8 +3,10 @@ package dedup_test
 
 
 import (
+    "context"
     "sync"
     "testing"
+    "github.com/IGVF-DACC/go-sqs-deduplication/internal/fault"
     "github.com/IGVF-DACC/go-sqs-deduplication/internal/memory"
     "github.com/IGVF-DACC/go-sqs-deduplication/internal/dedup"
 )
@@ -22,7 +24,7 @@ func TestMover(t *testing.T) {
     )
     wg := &sync.WaitGroup{}
     mover := dedup.NewMover(fromQueue, toQueue, nil, state, false, wg)
-    mover.Start()
+    mover.Start(context.Background())
     wg.Wait()
     if fromQueue.MessagesLen() != 0 {
         t.Errorf("Expected 0 messages to be on fromQueue, got %d", fromQueue.MessagesLen())
@@ -79,7 +81,7 @@ func TestMoverFlushToStorage(t *testing.T) {
         close(moveChannel)
     }()
     mover := dedup.NewMover(fromQueue, toQueue, moveChannel, state, true, wg)
-    mover.Start()
+    mover.Start(context.Background())
     wg.Wait()
     if state.KeepMessagesLen() != 0 {
         t.Error("Expected 0 messages in keepMessages")
@@ -141,7 +143,7 @@ func TestMoverFlushToStorageWithDuplicates(t *testing.T) {
         close(moveChannel)
     }()
     mover := dedup.NewMover(fromQueue, toQueue, moveChannel, state, true, wg)
-    mover.Start()
+    mover.Start(context.Background())
     wg.Wait()
     if state.KeepMessagesLen() != 0 {
         t.Error("Expected 0 messages in keepMessages")
@@ -162,3 +164,74 @@ func TestMoverFlushToStorageWithDuplicates(t *testing.T) {
         t.Errorf("Expected 1000 messages to be on to Queue, got %d", toQueue.MessagesLen())
     }
 }
+
+
+func TestDeduplicatorRemovesStorageDuplicates(t *testing.T) {
+    queue := memory.NewInMemoryQueue(10)
+    storageQueue := memory.NewInMemoryQueue(10)
+    // Left in storage by crashed runs, three separately sent copies of each message.
+    for i := 0; i < 3; i++ {
+        storageQueue.AddMessages(memory.GenerateInMemoryMessages(20))
+    }
+    config := &dedup.DeduplicatorConfig{
+        Queue: queue,
+        StorageQueue: storageQueue,
+        NumWorkers: 4,
+        MaxInflight: 100,
+        TimeLimitInSeconds: 240,
+    }
+    report, _ := dedup.NewDeduplicator(config).Run(context.Background())
+    if report.MessagesRestoredFromStorage != 20 {
+        t.Errorf("Expected 20 messages restored from storage, got %d", report.MessagesRestoredFromStorage)
+    }
+    if report.StorageDuplicatesRemoved != 40 {
+        t.Errorf("Expected 40 storage duplicates removed, got %d", report.StorageDuplicatesRemoved)
+    }
+    if report.DuplicatesDeleted != 0 {
+        t.Errorf("Expected no duplicates re-inserted into queue, got %d deleted", report.DuplicatesDeleted)
+    }
+    if storageQueue.MessagesLen() != 0 {
+        t.Errorf("Expected storage to be empty, got %d", storageQueue.MessagesLen())
+    }
+    if report.UniqueKept != 20 {
+        t.Errorf("Expected 20 unique messages kept, got %d", report.UniqueKept)
+    }
+}
+
+
+// Delivers every received message twice in the same batch.
+type redeliveringQueue struct {
+    *memory.SimulatedQueue
+}
+
+
+func (q redeliveringQueue) PullMessagesBatch(ctx context.Context) ([]dedup.QueueMessage, error) {
+    messages, err := q.SimulatedQueue.PullMessagesBatch(ctx)
+    return append(messages, messages...), err
+}
+
+
+func TestDeduplicatorKeepsRedeliveredStorageMessageUntilRestored(t *testing.T) {
+    queue := newSimulatedQueue()
+    storageQueue := newSimulatedQueue()
+    storageQueue.AddMessages(memory.GenerateInMemoryMessages(1))
+    config := &dedup.DeduplicatorConfig{
+        Queue: fault.NewQueue(queue, &fault.Config{
+            Script: []fault.Fault{{Operation: fault.Put, Call: 1, FailEntries: 1}},
+        }),
+        StorageQueue: redeliveringQueue{storageQueue},
+        NumWorkers: 1,
+        MaxInflight: 100,
+        TimeLimitInSeconds: 240,
+    }
+    report, err := dedup.NewDeduplicator(config).Run(context.Background())
+    if err != nil {
+        t.Fatal(err)
+    }
+    if report.MessagesRestoredFromStorage != 0 || report.OrphansReconciled != 0 {
+        t.Errorf("Expected failed restore and nothing reconciled, got %+v", report)
+    }
+    if storageQueue.MessagesLen() != 1 {
+        t.Errorf("Expected message still in storage after its restore failed, got %d", storageQueue.MessagesLen())
+    }
+}
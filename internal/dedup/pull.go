@@ -2,7 +2,9 @@ package dedup
 
 
 import (
-    "fmt"
+    "context"
+    "errors"
+    "log/slog"
     "sync"
     "time"
 )
@@ -16,50 +18,208 @@ type Puller struct {
     maxInflight int
     timeLimitInSeconds int
     wg *sync.WaitGroup
+    pulled int
+    suspected int // Probable copies of stored messages held for confirmation.
+    orphans int // Copies left by half-completed moves, deleted like duplicates.
+    unresolved int // Duplicates deleted without applying the resolution policy, the kept copy was flushed.
+    reachedMaxInflight bool
+    pullFailed bool
+    resolutionPolicy ResolutionPolicy // Keeps first seen if nil.
+    heartbeat *Heartbeat // Tracks visibility deadlines of pulled messages if not nil.
+    logger *slog.Logger
+    deleteChannel chan string // Duplicates are streamed here if not nil, otherwise left in state.
+    moveChannel chan QueueMessage // Keep messages over max inflight are streamed here if not nil.
 }
 
 
-// Only call with mutex locked.
-func (p *Puller) checkIfMessageAlreadyExists(uniqueID string) (QueueMessage, bool) {
+// Only call with shard locked. Returns kept or moving copy of message, stored
+// copies are only known by hash of their source message ID.
+func (p *Puller) checkIfMessageAlreadyExists(shard *stateShard, key keyFingerprint) (*keptMessage, uint64, bool) {
     // Message already seen in this round of pulling.
-    if keepMessage, exists := p.state.keepMessages[uniqueID]; exists {
-        return keepMessage, true
+    if keepMessage, exists := shard.keepMessages[key]; exists {
+        return keepMessage, 0, true
+    }
+    // Message already seen and on its way to storage queue.
+    if movingMessage, exists := shard.movingMessages[key]; exists {
+        return movingMessage, 0, true
+    }
+    // Message probably seen and persisted to storage queue, waiting for confirmation.
+    if suspectMessage, exists := shard.suspectMessages[key]; exists {
+        return suspectMessage, 0, true
     }
     // Message already seen and persisted to storage queue.
-    if storedMessage, exists := p.state.storedMessages[uniqueID]; exists {
-        return storedMessage, true
+    if storedMessageID, exists := shard.storedMessages[key]; exists {
+        return nil, storedMessageID, true
     }
-    return nil, false
+    return nil, 0, false
 }
 
 
-// Only call with mutex locked.
-func (p *Puller) processMessages(messages []QueueMessage) {
-    for _, message := range messages {
-        existingMessage, alreadyExists := p.checkIfMessageAlreadyExists(message.UniqueID())
-        if alreadyExists {
-            if existingMessage.MessageID() != message.MessageID() {
-                // Already seen the UUID, mark message for deletion.
-                p.state.deleteMessages[message.ReceiptHandle()] = struct{}{}
-            } else {
-                // If for some reason the same message is delivered more than once from the queue.
-                continue
+// Returns compact copy of message if it was kept, and receipt handle to delete if any.
+func (p *Puller) processMessage(message QueueMessage) (*keptMessage, string) {
+    key := p.state.hasher.key(message.UniqueID())
+    shard := p.state.shardFor(key)
+    shard.mu.Lock()
+    defer shard.mu.Unlock()
+    existingMessage, storedMessageID, alreadyExists := p.checkIfMessageAlreadyExists(shard, key)
+    if !alreadyExists && shard.storedFilter != nil && shard.storedFilter.mayContain(key) {
+        // Held instead of deleted, the filter may be wrong.
+        suspect := compactMessage(message, false)
+        shard.suspectMessages[key] = suspect
+        shard.suspectCount.Add(1)
+        shard.keepBytes.Add(suspect.size())
+        p.suspected++
+        return nil, ""
+    }
+    if !alreadyExists {
+        // Haven't seen it before, add to messages to keep.
+        kept := compactMessage(message, replacesKept(p.resolutionPolicy))
+        shard.keepMessages[key] = kept
+        shard.keepCount.Add(1)
+        shard.keepBytes.Add(kept.size())
+        return kept, ""
+    }
+    source := sourceMessageID(message)
+    if existingMessage == nil {
+        if storedMessageID == p.state.hasher.messageID(source) {
+            if source != message.MessageID() {
+                // Copy of the stored message left by a half-completed move.
+                p.orphans++
             }
-        } else {
-            // Haven't seen it before, add to messages to keep.
-            p.state.keepMessages[message.UniqueID()] = message
+            // Otherwise the stored message delivered again, or the original
+            // of a stored copy. Either way storage has it, so it's deleted.
+        } else if replacesKept(p.resolutionPolicy) {
+            p.unresolved++
         }
+        // Messages already persisted to storage queue are never replaced.
+        return nil, message.ReceiptHandle()
+    }
+    if existingMessage.MessageID() == message.MessageID() {
+        // If for some reason the same message is delivered more than once from the queue.
+        return nil, ""
     }
+    if sourceMessageID(existingMessage) == source {
+        // Copy left by a half-completed move, not a separate duplicate,
+        // so it's dropped whatever the resolution policy.
+        p.orphans++
+        return nil, message.ReceiptHandle()
+    }
+    if p.shouldReplaceKeepMessage(shard, key, message, existingMessage) {
+        // Keep new message and mark displaced one for deletion.
+        kept := compactMessage(message, replacesKept(p.resolutionPolicy))
+        shard.keepMessages[key] = kept
+        shard.keepBytes.Add(kept.size() - existingMessage.size())
+        return kept, existingMessage.ReceiptHandle()
+    }
+    if _, isKeepMessage := shard.keepMessages[key]; !isKeepMessage && replacesKept(p.resolutionPolicy) {
+        p.unresolved++
+    }
+    // Already seen the UUID, mark message for deletion.
+    return nil, message.ReceiptHandle()
+}
+
+
+// Returns messages newly added to keepMessages and
+// receipt handles newly marked for deletion.
+func (p *Puller) processMessages(messages []QueueMessage) ([]QueueMessage, []string) {
+    var kept []QueueMessage
+    var duplicates []string
+    for _, message := range messages {
+        keptMessage, duplicate := p.processMessage(message)
+        if keptMessage != nil {
+            kept = append(kept, keptMessage)
+        }
+        if duplicate != "" {
+            duplicates = append(duplicates, duplicate)
+        }
+    }
+    p.state.addDeletes(duplicates)
+    return kept, duplicates
+}
+
+
+// Once keep messages reach max inflight, moves every kept
+// message to movingMessages and returns them for flush movers.
+func (p *Puller) takeOverflow(ctx context.Context, kept []QueueMessage) []QueueMessage {
+    if p.moveChannel == nil {
+        return nil
+    }
+    if !p.state.flushing.Load() {
+        if p.state.KeepMessagesLen() < p.maxInflight {
+            return nil
+        }
+        if p.state.flushing.CompareAndSwap(false, true) {
+            // Only first puller to reach max inflight takes messages kept by others.
+            p.logger.DebugContext(ctx, "Reaching max inflight keep messages, streaming them to storage")
+            kept = p.state.keepMessagesSnapshot()
+        }
+    }
+    var overflow []QueueMessage
+    for _, message := range kept {
+        // Skips messages replaced since, or already taken by another puller.
+        if p.state.startMoving(message) {
+            overflow = append(overflow, message)
+        }
+    }
+    return overflow
+}
+
+
+func (p *Puller) streaming() bool {
+    return p.deleteChannel != nil
+}
+
+
+// Blocks until inflight messages are under max inflight. Returns false
+// if nothing pending can bring them under, or ctx is cancelled.
+func (p *Puller) waitForInflightToDrain(ctx context.Context) bool {
+    drained := false
+    p.state.waitUntil(func() bool {
+        if p.state.inflight() < p.maxInflight {
+            drained = true
+            return true
+        }
+        return ctx.Err() != nil || p.state.DeleteMessagesLen() == 0 && p.state.MovingMessagesLen() == 0
+    })
+    return drained
+}
+
+
+// Sends duplicates to deleters and overflow to flush movers. Deleters
+// always drain, overflow not sent before ctx is cancelled goes back to keep.
+func (p *Puller) stream(ctx context.Context, duplicates []string, overflow []QueueMessage) {
+    for _, receiptHandle := range duplicates {
+        p.deleteChannel <- receiptHandle
+    }
+    for i, message := range overflow {
+        select {
+        case p.moveChannel <- message:
+        case <-ctx.Done():
+            p.state.returnToKeep(overflow[i:])
+            return
+        }
+    }
+}
+
+
+// Only call with shard locked. Messages already on their
+// way to storage queue are never replaced.
+func (p *Puller) shouldReplaceKeepMessage(shard *stateShard, key keyFingerprint, message QueueMessage, existingMessage QueueMessage) bool {
+    if p.resolutionPolicy == nil {
+        return false
+    }
+    if _, isKeepMessage := shard.keepMessages[key]; !isKeepMessage {
+        return false
+    }
+    return p.resolutionPolicy.Replace(message, existingMessage)
 }
 
 
-// Only call with mutex locked.
 func (p *Puller) atMaxInflight() bool {
-    return len(p.state.keepMessages) + len(p.state.deleteMessages) >= p.maxInflight
+    return p.state.held() >= p.maxInflight
 }
 
 
-// Only call with mutex locked.
 func (p *Puller) atTimeout() bool {
     if time.Since(p.state.startTime) > time.Duration(p.timeLimitInSeconds) * time.Second {
         return true
@@ -68,41 +228,79 @@ func (p *Puller) atTimeout() bool {
 }
 
 
-func (p *Puller) getMessagesUntilMaxInflight() {
+func (p *Puller) getMessagesUntilMaxInflight(ctx context.Context) {
+    p.pullFailed = false
+    if p.streaming() {
+        // Wake up pullers waiting for inflight messages to drain.
+        stopWaking := context.AfterFunc(ctx, p.state.signalDrained)
+        defer stopWaking()
+    }
     for {
-        messages, err := p.queue.PullMessagesBatch()
+        if ctx.Err() != nil {
+            // Cancelled, leave messagesExist as is since queue may not be empty.
+            return
+        }
+        if p.streaming() && !p.waitForInflightToDrain(ctx) {
+            if ctx.Err() == nil {
+                p.logger.DebugContext(ctx, "Reaching max inflight messages from puller")
+                p.reachedMaxInflight = true
+            }
+            return
+        }
+        messages, err := p.queue.PullMessagesBatch(ctx)
+        if errors.Is(err, ErrOnlyPoisonMessages) {
+            // Queue handled them, there may be parseable messages behind them.
+            if p.atTimeout() {
+                p.logger.DebugContext(ctx, "Reaching time limit from puller")
+                p.timedOut = true
+                break
+            }
+            continue
+        }
         if err != nil {
-            fmt.Println("Error pulling messages", err)
-            p.messagesExist = false
+            if ctx.Err() != nil {
+                return
+            }
+            // Queue isn't known to be empty, leave messagesExist as is.
+            p.logger.ErrorContext(ctx, "Error pulling messages", "error", err)
+            p.pullFailed = true
             return
         }
         if len(messages) == 0 {
             p.messagesExist = false
             break
         }
-        p.state.mu.Lock()
-        p.processMessages(messages)
-        if p.atMaxInflight() {
-            fmt.Println("Reaching max inflight messages from puller")
-            p.state.mu.Unlock()
-            break
+        p.pulled += len(messages)
+        if p.heartbeat != nil {
+            p.heartbeat.Received(messages)
         }
-        if p.atTimeout() {
-            fmt.Println("Reaching time limit from puller")
+        kept, duplicates := p.processMessages(messages)
+        overflow := p.takeOverflow(ctx, kept)
+        stop := false
+        if !p.streaming() && p.atMaxInflight() {
+            p.logger.DebugContext(ctx, "Reaching max inflight messages from puller")
+            p.reachedMaxInflight = true
+            stop = true
+        } else if p.atTimeout() {
+            p.logger.DebugContext(ctx, "Reaching time limit from puller")
             p.timedOut = true
-            p.state.mu.Unlock()
+            stop = true
+        }
+        if p.streaming() {
+            p.stream(ctx, duplicates, overflow)
+        }
+        if stop {
             break
         }
-        p.state.mu.Unlock()
     }
 }
 
 
-func (p *Puller) Start() {
+func (p *Puller) Start(ctx context.Context) {
     p.wg.Add(1)
     go func() {
         defer p.wg.Done()
-        p.getMessagesUntilMaxInflight()
+        p.getMessagesUntilMaxInflight(ctx)
     }()
 }
 
@@ -117,6 +315,49 @@ func (p *Puller) TimedOut() bool {
 }
 
 
+func (p *Puller) PullFailed() bool {
+    return p.pullFailed
+}
+
+
+// Streams duplicates to deleteChannel and keep messages over max
+// inflight to moveChannel while pulling, instead of leaving them in state.
+func (p *Puller) SetStreamChannels(deleteChannel chan string, moveChannel chan QueueMessage) {
+    p.deleteChannel = deleteChannel
+    p.moveChannel = moveChannel
+}
+
+
+func (p *Puller) SetLogger(logger *slog.Logger) {
+    p.logger = WithRunID(logger)
+}
+
+
+func (p *Puller) MessagesPulled() int {
+    return p.pulled
+}
+
+
+func (p *Puller) MessagesSuspected() int {
+    return p.suspected
+}
+
+
+func (p *Puller) OrphansFound() int {
+    return p.orphans
+}
+
+
+func (p *Puller) DuplicatesUnresolved() int {
+    return p.unresolved
+}
+
+
+func (p *Puller) ReachedMaxInflight() bool {
+    return p.reachedMaxInflight
+}
+
+
 func NewPuller(queue Queue, state *SharedState, messagesExist bool, timedOut bool, maxInflight int, timeLimitInSeconds int, wg *sync.WaitGroup) *Puller {
     return &Puller{
         queue: queue,
@@ -126,5 +367,6 @@ func NewPuller(queue Queue, state *SharedState, messagesExist bool, timedOut boo
         timedOut: timedOut,
         timeLimitInSeconds: timeLimitInSeconds,
         wg: wg,
+        logger: WithRunID(nil),
     }
 }
@@ -2,6 +2,8 @@ package dedup_test
 
 
 import (
+    "context"
+    "errors"
     "sync"
     "time"
     "testing"
@@ -38,8 +40,8 @@ func TestPullerAllUnique(t *testing.T) {
         60,
         wg,
     )
-    puller1.Start()
-    puller2.Start()
+    puller1.Start(context.Background())
+    puller2.Start(context.Background())
     wg.Wait()
     if state.KeepMessagesLen() != 203 {
         t.Errorf("Unexpected unique messages to keep %d", state.KeepMessagesLen())
@@ -83,8 +85,8 @@ func TestPullerHalfDuplicates(t *testing.T) {
         60,
         wg,
     )
-    puller1.Start()
-    puller2.Start()
+    puller1.Start(context.Background())
+    puller2.Start(context.Background())
     wg.Wait()
     if state.KeepMessagesLen() != 203 {
         t.Errorf("Unexpected unique messages to keep %d", state.KeepMessagesLen())
@@ -123,8 +125,8 @@ func TestPullerAllDuplicates(t *testing.T) {
         60,
         wg,
     )
-    puller1.Start()
-    puller2.Start()
+    puller1.Start(context.Background())
+    puller2.Start(context.Background())
     wg.Wait()
     if state.KeepMessagesLen() != 1 {
         t.Errorf("Unexpected unique messages to keep %d", state.KeepMessagesLen())
@@ -163,8 +165,8 @@ func TestPullerMaxInflight(t *testing.T) {
         60,
         wg,
     )
-    puller1.Start()
-    puller2.Start()
+    puller1.Start(context.Background())
+    puller2.Start(context.Background())
     wg.Wait()
     if state.KeepMessagesLen() != 1 {
         t.Errorf("Unexpected unique messages to keep %d", state.KeepMessagesLen())
@@ -207,8 +209,8 @@ func TestPullerTimedOut(t *testing.T) {
         wg,
     )
     time.Sleep(1 * time.Second)
-    puller1.Start()
-    puller2.Start()
+    puller1.Start(context.Background())
+    puller2.Start(context.Background())
     wg.Wait()
     if state.KeepMessagesLen() != 1 {
         t.Errorf("Unexpected unique messages to keep %d", state.KeepMessagesLen())
@@ -220,3 +222,110 @@ func TestPullerTimedOut(t *testing.T) {
         t.Errorf("Expected workers to have timed out")
     }
 }
+
+
+func TestPullerCancelled(t *testing.T) {
+    inMemoryQueue := memory.NewInMemoryQueue(10)
+    generatedMessages := memory.GenerateInMemoryMessages(100)
+    inMemoryQueue.AddMessages(generatedMessages)
+    state := dedup.NewSharedState(
+        make(map[string]dedup.QueueMessage),
+        make(map[string]struct{}),
+        make(map[string]dedup.QueueMessage),
+    )
+    wg := &sync.WaitGroup{}
+    puller := dedup.NewPuller(
+        inMemoryQueue,
+        state,
+        true,
+        false,
+        1000,
+        60,
+        wg,
+    )
+    ctx, cancel := context.WithCancel(context.Background())
+    cancel()
+    puller.Start(ctx)
+    wg.Wait()
+    if state.KeepMessagesLen() != 0 {
+        t.Errorf("Unexpected unique messages to keep %d", state.KeepMessagesLen())
+    }
+    if inMemoryQueue.MessagesLen() != 100 {
+        t.Errorf("Expected 100 messages on queue, got %d", inMemoryQueue.MessagesLen())
+    }
+    if !puller.MessagesExist() {
+        t.Errorf("Expected messages to exist on cancelled puller")
+    }
+}
+
+
+type failingPullQueue struct {
+    *memory.InMemoryQueue
+}
+
+
+func (q *failingPullQueue) PullMessagesBatch(ctx context.Context) ([]dedup.QueueMessage, error) {
+    return nil, errors.New("throttled")
+}
+
+
+func TestPullerPullFailed(t *testing.T) {
+    inMemoryQueue := memory.NewInMemoryQueue(10)
+    inMemoryQueue.AddMessages(memory.GenerateInMemoryMessages(100))
+    state := dedup.NewSharedState(
+        make(map[string]dedup.QueueMessage),
+        make(map[string]struct{}),
+        make(map[string]dedup.QueueMessage),
+    )
+    wg := &sync.WaitGroup{}
+    puller := dedup.NewPuller(
+        &failingPullQueue{inMemoryQueue},
+        state,
+        true,
+        false,
+        1000,
+        60,
+        wg,
+    )
+    puller.Start(context.Background())
+    wg.Wait()
+    if !puller.PullFailed() {
+        t.Error("Expected pull to have failed")
+    }
+    if !puller.MessagesExist() {
+        t.Error("Expected messages to still exist after failed pull")
+    }
+}
+
+
+// Receives only unparseable messages the first poisonBatches times.
+type poisonBatchesQueue struct {
+    *memory.InMemoryQueue
+    poisonBatches int
+}
+
+
+func (q *poisonBatchesQueue) PullMessagesBatch(ctx context.Context) ([]dedup.QueueMessage, error) {
+    if q.poisonBatches > 0 {
+        q.poisonBatches--
+        return nil, dedup.ErrOnlyPoisonMessages
+    }
+    return q.InMemoryQueue.PullMessagesBatch(ctx)
+}
+
+
+func TestPullerKeepsPullingPastPoisonBatches(t *testing.T) {
+    inMemoryQueue := memory.NewInMemoryQueue(10)
+    inMemoryQueue.AddMessages(memory.GenerateInMemoryMessages(30))
+    state := dedup.NewShardedSharedState(1)
+    wg := &sync.WaitGroup{}
+    puller := dedup.NewPuller(&poisonBatchesQueue{InMemoryQueue: inMemoryQueue, poisonBatches: 3}, state, true, false, 1000, 60, wg)
+    puller.Start(context.Background())
+    wg.Wait()
+    if puller.MessagesPulled() != 30 || state.KeepMessagesLen() != 30 {
+        t.Errorf("Expected all 30 messages pulled after poison batches, got %d", puller.MessagesPulled())
+    }
+    if puller.MessagesExist() || puller.PullFailed() {
+        t.Error("Expected queue drained without pull failure")
+    }
+}
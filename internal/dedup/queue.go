@@ -1,9 +1,101 @@
 package dedup
 
 
+import (
+    "context"
+    "errors"
+    "time"
+)
+
+
+type BatchEntryFailure struct {
+    ReceiptHandle string `json:"receiptHandle"`
+    Code string `json:"code"`
+    Message string `json:"message"`
+    SenderFault bool `json:"senderFault"` // Retrying won't help.
+}
+
+
+// Entries are identified by receipt handle. For PutMessagesBatch that
+// is the receipt handle of the message being put.
+type BatchResult struct {
+    Succeeded []string
+    Failed []BatchEntryFailure
+}
+
+
+// Returned by PullMessagesBatch when every message received failed to
+// parse, so no messages are returned but the queue isn't empty.
+var ErrOnlyPoisonMessages = errors.New("received only messages that could not be parsed")
+
+
+// Batch methods return an error only if the whole request failed,
+// otherwise failures of individual entries are listed in BatchResult.
 type Queue interface {
-    PullMessagesBatch() ([]QueueMessage, error)
-    DeleteMessagesBatch(receiptHandles []string)
-    ResetVisibilityBatch(receiptHandles []string)
-    PutMessagesBatch(messages []QueueMessage) error
+    PullMessagesBatch(ctx context.Context) ([]QueueMessage, error)
+    DeleteMessagesBatch(ctx context.Context, receiptHandles []string) (BatchResult, error)
+    ResetVisibilityBatch(ctx context.Context, receiptHandles []string) (BatchResult, error)
+    ChangeVisibilityBatch(ctx context.Context, receiptHandles []string, visibilityTimeout time.Duration) (BatchResult, error)
+    PutMessagesBatch(ctx context.Context, messages []QueueMessage) (BatchResult, error)
+}
+
+
+type RetryStats struct {
+    Calls int64 `json:"calls"`
+    Retries int64 `json:"retries"`
+    Throttled int64 `json:"throttled"`
+    Exhausted int64 `json:"exhausted"` // Calls or entries that still failed after all attempts.
+}
+
+
+func (s RetryStats) Sub(other RetryStats) RetryStats {
+    return RetryStats{
+        Calls: s.Calls - other.Calls,
+        Retries: s.Retries - other.Retries,
+        Throttled: s.Throttled - other.Throttled,
+        Exhausted: s.Exhausted - other.Exhausted,
+    }
+}
+
+
+// Optionally implemented by queues that retry requests internally,
+// counters are cumulative over the lifetime of the queue.
+type RetryStatsReporter interface {
+    RetryStats() RetryStats
+}
+
+
+// Counts of messages that could not be parsed, by how they were handled.
+type PoisonStats struct {
+    DeadLettered int64 `json:"deadLettered"`
+    Reset int64 `json:"reset"`
+    Ignored int64 `json:"ignored"`
+    Failed int64 `json:"failed"` // Could not be dead-lettered or reset.
+}
+
+
+func (s PoisonStats) Add(other PoisonStats) PoisonStats {
+    return PoisonStats{
+        DeadLettered: s.DeadLettered + other.DeadLettered,
+        Reset: s.Reset + other.Reset,
+        Ignored: s.Ignored + other.Ignored,
+        Failed: s.Failed + other.Failed,
+    }
+}
+
+
+func (s PoisonStats) Sub(other PoisonStats) PoisonStats {
+    return PoisonStats{
+        DeadLettered: s.DeadLettered - other.DeadLettered,
+        Reset: s.Reset - other.Reset,
+        Ignored: s.Ignored - other.Ignored,
+        Failed: s.Failed - other.Failed,
+    }
+}
+
+
+// Optionally implemented by queues that handle messages they can't parse,
+// counters are cumulative over the lifetime of the queue.
+type PoisonStatsReporter interface {
+    PoisonStats() PoisonStats
 }
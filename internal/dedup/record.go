@@ -0,0 +1,66 @@
+package dedup
+
+
+import (
+    "context"
+    "sync"
+    "time"
+)
+
+
+// Stands in for Queue in dry run so that Deleters and flush Movers
+// record what they would delete or put instead of doing it.
+type recordingQueue struct {
+    mu sync.Mutex
+    deleted []string
+    put []QueueMessage
+}
+
+
+func (r *recordingQueue) PullMessagesBatch(ctx context.Context) ([]QueueMessage, error) {
+    return nil, nil
+}
+
+
+func (r *recordingQueue) DeleteMessagesBatch(ctx context.Context, receiptHandles []string) (BatchResult, error) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    r.deleted = append(r.deleted, receiptHandles...)
+    return BatchResult{Succeeded: receiptHandles}, nil
+}
+
+
+func (r *recordingQueue) ResetVisibilityBatch(ctx context.Context, receiptHandles []string) (BatchResult, error) {
+    return BatchResult{Succeeded: receiptHandles}, nil
+}
+
+
+func (r *recordingQueue) ChangeVisibilityBatch(ctx context.Context, receiptHandles []string, visibilityTimeout time.Duration) (BatchResult, error) {
+    return BatchResult{Succeeded: receiptHandles}, nil
+}
+
+
+func (r *recordingQueue) PutMessagesBatch(ctx context.Context, messages []QueueMessage) (BatchResult, error) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    var result BatchResult
+    for _, message := range messages {
+        result.Succeeded = append(result.Succeeded, message.ReceiptHandle())
+    }
+    r.put = append(r.put, messages...)
+    return result, nil
+}
+
+
+func (r *recordingQueue) deletedReceiptHandles() []string {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    return append([]string(nil), r.deleted...)
+}
+
+
+func (r *recordingQueue) putMessages() []QueueMessage {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    return append([]QueueMessage(nil), r.put...)
+}
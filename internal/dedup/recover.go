@@ -0,0 +1,98 @@
+package dedup
+
+
+import (
+    "context"
+)
+
+
+// What reconciling a run that died midway repaired, from its journal.
+type RecoveryReport struct {
+    RunID string `json:"runID"` // Of the unfinished run.
+    Phase string `json:"phase"` // Last phase it started.
+    DeletedFromQueue int `json:"deletedFromQueue"` // Flushed to storage but still on queue.
+    RemovedFromStorage int `json:"removedFromStorage"` // Restored to queue but still in storage.
+    Failed int `json:"failed"` // Copies that could not be removed, left to deduplication.
+    Unknown int `json:"unknown"` // Put may or may not have happened, left to deduplication.
+}
+
+
+// Finishes the moves an unfinished run left on both queue and storage, by
+// deleting the source copy with the receipt handle the run journaled. A
+// copy that can't be removed that way is caught by deduplication once the
+// stored copy is restored.
+func (d *Deduplicator) reconcileUnfinishedRun(ctx context.Context) {
+    run, err := d.config.Journal.unfinishedRun()
+    if err != nil {
+        d.logger.ErrorContext(ctx, "Error reading journal", "error", err)
+        return
+    }
+    if run == nil {
+        return
+    }
+    if d.config.DryRun {
+        d.logger.WarnContext(ctx, "Skipping reconciling unfinished run in dry run", "unfinished_run_id", run.runID, "phase", run.phase)
+        return
+    }
+    d.logger.WarnContext(ctx, "Reconciling unfinished run", "unfinished_run_id", run.runID, "phase", run.phase, "batches", len(run.batches))
+    report := &RecoveryReport{RunID: run.runID, Phase: run.phase}
+    storage := d.storage()
+    for _, batch := range run.batches {
+        if batch.put == nil {
+            d.logger.WarnContext(
+                ctx,
+                "Unfinished run died while putting batch, leaving it to deduplication",
+                "batch", batch.id,
+                "flush", batch.flush,
+                "message_ids", batch.messageIDsOf(batch.receiptHandles),
+            )
+            report.Unknown += len(batch.receiptHandles)
+            continue
+        }
+        receiptHandles := batch.onBoth()
+        if len(receiptHandles) == 0 {
+            continue
+        }
+        result := sendBatch(receiptHandles, identity, func(receiptHandles []string) (BatchResult, error) {
+            if batch.flush {
+                return d.config.Queue.DeleteMessagesBatch(ctx, receiptHandles)
+            }
+            return storage.RemoveMessagesBatch(ctx, receiptHandles)
+        })
+        if len(result.Succeeded) > 0 {
+            message := "Removed restored messages still in storage"
+            if batch.flush {
+                message = "Deleted flushed messages still on queue"
+                report.DeletedFromQueue += len(result.Succeeded)
+            } else {
+                report.RemovedFromStorage += len(result.Succeeded)
+            }
+            d.logger.InfoContext(ctx, message, "batch", batch.id, "message_ids", batch.messageIDsOf(result.Succeeded))
+        }
+        if len(result.Failed) > 0 {
+            var failed []string
+            for _, failure := range result.Failed {
+                failed = append(failed, failure.ReceiptHandle)
+            }
+            d.logger.WarnContext(
+                ctx,
+                "Could not remove copies left by unfinished run, leaving them to deduplication",
+                "batch", batch.id,
+                "flush", batch.flush,
+                "message_ids", batch.messageIDsOf(failed),
+                "error", result.Failed[0].Message,
+            )
+            report.Failed += len(result.Failed)
+        }
+    }
+    d.logger.InfoContext(
+        ctx,
+        "Reconciled unfinished run",
+        "unfinished_run_id", run.runID,
+        "deleted_from_queue", report.DeletedFromQueue,
+        "removed_from_storage", report.RemovedFromStorage,
+        "failed", report.Failed,
+        "unknown", report.Unknown,
+    )
+    d.report.Recovery = report
+}
@@ -0,0 +1,100 @@
+package dedup
+
+
+import (
+    "time"
+)
+
+
+// Durations are encoded in JSON as nanoseconds.
+// Pull, Delete and Flush run at the same time, Delete and Flush
+// measure from start of pulling until the last delete or flush finished.
+type PhaseDurations struct {
+    PreRestore time.Duration `json:"preRestore"`
+    Pull time.Duration `json:"pull"`
+    Delete time.Duration `json:"delete"`
+    Flush time.Duration `json:"flush"`
+    PostRestore time.Duration `json:"postRestore"`
+    Reset time.Duration `json:"reset"`
+    Total time.Duration `json:"total"`
+}
+
+
+type DryRunReport struct {
+    WouldDelete int `json:"wouldDelete"`
+    WouldFlushToStorage int `json:"wouldFlushToStorage"`
+    DuplicateReceiptHandles []string `json:"duplicateReceiptHandles,omitempty"`
+    FlushedMessageIDs []string `json:"flushedMessageIDs,omitempty"`
+}
+
+
+// Estimated bytes held by deduplicator state at end of pulling. Stored
+// messages only take a fingerprint of their unique and message IDs.
+type MemoryReport struct {
+    KeepBytes int64 `json:"keepBytes"`
+    DeleteBytes int64 `json:"deleteBytes"`
+    StoredBytes int64 `json:"storedBytes"`
+    PeakStateBytes int64 `json:"peakStateBytes"`
+    HeapInuseBytes uint64 `json:"heapInuseBytes"` // Of the whole process, for comparison with the estimates.
+}
+
+
+type RunReport struct {
+    RunID string `json:"runID"` // Logged as run_id on every line of the run.
+    MessagesPulled int `json:"messagesPulled"`
+    UniqueKept int `json:"uniqueKept"`
+    DuplicatesDeleted int `json:"duplicatesDeleted"`
+    SuspectedDuplicates int `json:"suspectedDuplicates"` // Copies of messages the stored filter reported as stored, held until restoring confirmed them.
+    UnconfirmedSuspects int `json:"unconfirmedSuspects"` // Suspects kept because restoring never confirmed them.
+    OrphansReconciled int `json:"orphansReconciled"` // Copies left by half-completed moves, recognised by move token. Ones deleted while pulling also count as duplicates deleted.
+    UnresolvedDuplicates int `json:"unresolvedDuplicates"` // Deleted without applying the resolution policy, the copy kept was already flushed to storage, where it's never replaced.
+    UntokenedMoves int `json:"untokenedMoves"` // Messages moved without a move token, their message attributes left no room for it.
+    MessagesFlushedToStorage int `json:"messagesFlushedToStorage"`
+    MessagesRestoredFromStorage int `json:"messagesRestoredFromStorage"`
+    StorageDuplicatesRemoved int `json:"storageDuplicatesRemoved"` // Removed from storage instead of restored, a copy was already on queue.
+    MessagesReset int `json:"messagesReset"`
+    DeleteFailures int `json:"deleteFailures"`
+    ResetFailures int `json:"resetFailures"`
+    PutFailures int `json:"putFailures"`
+    ExtendFailures int `json:"extendFailures"`
+    MessagesExtended int `json:"messagesExtended"`
+    ExpiredReceiptHandles int `json:"expiredReceiptHandles"` // Held messages whose visibility expired anyway.
+    FailedEntries []FailedEntry `json:"failedEntries"`
+    Durations PhaseDurations `json:"durations"`
+    TimeLimitReached bool `json:"timeLimitReached"`
+    MaxInflightReached bool `json:"maxInflightReached"`
+    Iterations int `json:"iterations"` // Passes of pulling, always 1 since duplicates and overflow are streamed.
+    Cancelled bool `json:"cancelled"`
+    PullFailed bool `json:"pullFailed"`
+    QueueRetries RetryStats `json:"queueRetries"`
+    StorageQueueRetries RetryStats `json:"storageQueueRetries"`
+    PoisonMessages PoisonStats `json:"poisonMessages"` // Messages that could not be parsed, from both queues.
+    Memory MemoryReport `json:"memory"`
+    Recovery *RecoveryReport `json:"recovery,omitempty"` // Set if the journal showed the last run never finished.
+    DryRun *DryRunReport `json:"dryRun,omitempty"`
+}
+
+
+// Times a phase and adds its duration to total.
+func timePhase(total *time.Duration, phase func()) {
+    start := time.Now()
+    phase()
+    *total += time.Since(start)
+}
+
+
+func (r *RunReport) addFailures(failures []FailedEntry) {
+    for _, failure := range failures {
+        switch failure.Operation {
+        case "delete":
+            r.DeleteFailures++
+        case "reset":
+            r.ResetFailures++
+        case "put":
+            r.PutFailures++
+        case "extend":
+            r.ExtendFailures++
+        }
+    }
+    r.FailedEntries = append(r.FailedEntries, failures...)
+}
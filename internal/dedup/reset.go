@@ -2,6 +2,7 @@ package dedup
 
 
 import (
+    "context"
     "sync"
 )
 
@@ -10,6 +11,8 @@ type Reseter struct {
     queue Queue
     keepChannel chan string
     wg *sync.WaitGroup
+    reset int
+    failures []FailedEntry
 }
 
 
@@ -27,24 +30,38 @@ func (r *Reseter) getBatchOfMessagesToKeep() []string {
 }
 
 
-func (r *Reseter) resetMessages() {
+func (r *Reseter) resetMessages(ctx context.Context) {
     receiptHandles := r.getBatchOfMessagesToKeep()
     for len(receiptHandles) > 0 {
-        r.queue.ResetVisibilityBatch(receiptHandles)
+        result := sendBatch(receiptHandles, identity, func(receiptHandles []string) (BatchResult, error) {
+            return r.queue.ResetVisibilityBatch(ctx, receiptHandles)
+        })
+        r.reset += len(result.Succeeded)
+        r.failures = append(r.failures, withOperation("reset", result.Failed)...)
         receiptHandles = r.getBatchOfMessagesToKeep()
     }
 }
 
 
-func (r *Reseter) Start() {
+func (r *Reseter) Start(ctx context.Context) {
     r.wg.Add(1)
     go func() {
         defer r.wg.Done()
-        r.resetMessages()
+        r.resetMessages(ctx)
     }()
 }
 
 
+func (r *Reseter) MessagesReset() int {
+    return r.reset
+}
+
+
+func (r *Reseter) Failures() []FailedEntry {
+    return r.failures
+}
+
+
 func NewReseter(queue Queue, keepChannel chan string, wg *sync.WaitGroup) *Reseter {
     return &Reseter{
         queue: queue,
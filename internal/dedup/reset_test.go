@@ -1,6 +1,7 @@
 package dedup_test
 
 import (
+    "context"
     "sync"
     "testing"
     "github.com/IGVF-DACC/go-sqs-deduplication/internal/memory"
@@ -17,7 +18,7 @@ func TestReseter(t *testing.T) {
     }
     keepChannel := make(chan string, 100)
     for i := 0; i < 3; i++ {
-        pulledMessages, _ := inMemoryQueue.PullMessagesBatch()
+        pulledMessages, _ := inMemoryQueue.PullMessagesBatch(context.Background())
         for _, pulledMessage := range pulledMessages {
             keepChannel <- pulledMessage.ReceiptHandle()
         }
@@ -25,7 +26,7 @@ func TestReseter(t *testing.T) {
     close(keepChannel)
     wg := &sync.WaitGroup{}
     reseter := dedup.NewReseter(inMemoryQueue, keepChannel, wg)
-    reseter.Start()
+    reseter.Start(context.Background())
     wg.Wait()
     if len(inMemoryQueue.GetResetMessages()) != 30 {
         t.Errorf("Expected 30 messages to be reset, got %d", len(inMemoryQueue.GetResetMessages()))
@@ -0,0 +1,68 @@
+package dedup
+
+
+// Decides which of two messages with the same UniqueID to keep.
+type ResolutionPolicy interface {
+    // Replace returns true if candidate should be kept and kept deleted.
+    Replace(candidate QueueMessage, kept QueueMessage) bool
+}
+
+
+// Keeps whichever message was pulled first.
+type FirstSeenPolicy struct{}
+
+
+// Whether policy may ever replace a kept message.
+func replacesKept(policy ResolutionPolicy) bool {
+    _, firstSeen := policy.(FirstSeenPolicy)
+    return policy != nil && !firstSeen
+}
+
+
+func (FirstSeenPolicy) Replace(candidate QueueMessage, kept QueueMessage) bool {
+    return false
+}
+
+
+// Keeps the message sent earliest, preserving queue age.
+type OldestSentPolicy struct{}
+
+
+func (OldestSentPolicy) Replace(candidate QueueMessage, kept QueueMessage) bool {
+    if candidate.SentTime().IsZero() || kept.SentTime().IsZero() {
+        return false
+    }
+    return candidate.SentTime().Before(kept.SentTime())
+}
+
+
+// Keeps the message sent most recently, preserving the latest payload.
+type NewestSentPolicy struct{}
+
+
+func (NewestSentPolicy) Replace(candidate QueueMessage, kept QueueMessage) bool {
+    if candidate.SentTime().IsZero() || kept.SentTime().IsZero() {
+        return false
+    }
+    return candidate.SentTime().After(kept.SentTime())
+}
+
+
+// Keeps the message with the highest value, messages without
+// a value never replace messages with one.
+type HighestNumericFieldPolicy struct {
+    Value func(QueueMessage) (float64, bool)
+}
+
+
+func (p HighestNumericFieldPolicy) Replace(candidate QueueMessage, kept QueueMessage) bool {
+    candidateValue, ok := p.Value(candidate)
+    if !ok {
+        return false
+    }
+    keptValue, ok := p.Value(kept)
+    if !ok {
+        return true
+    }
+    return candidateValue > keptValue
+}
@@ -0,0 +1,128 @@
+package dedup_test
+
+
+import (
+    "context"
+    "fmt"
+    "strconv"
+    "testing"
+    "time"
+    "github.com/IGVF-DACC/go-sqs-deduplication/internal/memory"
+    "github.com/IGVF-DACC/go-sqs-deduplication/internal/dedup"
+)
+
+
+func runWithResolutionPolicy(messages []dedup.QueueMessage, policy dedup.ResolutionPolicy) *memory.InMemoryQueue {
+    inMemoryQueue := memory.NewInMemoryQueue(10)
+    inMemoryQueue.AddMessages(messages)
+    config := &dedup.DeduplicatorConfig{
+        Queue: inMemoryQueue,
+        StorageQueue: memory.NewInMemoryQueue(10),
+        NumWorkers: 3,
+        MaxInflight: 10000,
+        TimeLimitInSeconds: 240,
+        ResolutionPolicy: policy,
+    }
+    dedup.NewDeduplicator(config).Run(context.Background())
+    return inMemoryQueue
+}
+
+
+func TestResolutionPolicies(t *testing.T) {
+    now := time.Now()
+    var messages []dedup.QueueMessage
+    for i := 0; i < 50; i++ {
+        // Sent times and xids are shuffled relative to queue order.
+        offset := (i * 17) % 50
+        messages = append(messages, memory.NewInMemoryMessage(
+            "abc",
+            "",
+            now.Add(time.Duration(offset) * time.Second),
+            map[string]string{"xid": strconv.Itoa((offset * 7) % 50)},
+            nil,
+        ))
+    }
+    findMessage := func(match func(dedup.QueueMessage) bool) dedup.QueueMessage {
+        for _, message := range messages {
+            if match(message) {
+                return message
+            }
+        }
+        return nil
+    }
+    oldest := findMessage(func(m dedup.QueueMessage) bool { return m.SentTime().Equal(now) })
+    newest := findMessage(func(m dedup.QueueMessage) bool { return m.SentTime().Equal(now.Add(49 * time.Second)) })
+    highest := findMessage(func(m dedup.QueueMessage) bool { return m.Attributes()["xid"] == "49" })
+    xid := func(m dedup.QueueMessage) (float64, bool) {
+        value, err := strconv.ParseFloat(m.Attributes()["xid"], 64)
+        return value, err == nil
+    }
+    cases := []struct {
+        name string
+        policy dedup.ResolutionPolicy
+        expected dedup.QueueMessage
+    }{
+        {"oldest-sent", dedup.OldestSentPolicy{}, oldest},
+        {"newest-sent", dedup.NewestSentPolicy{}, newest},
+        {"highest-field", dedup.HighestNumericFieldPolicy{Value: xid}, highest},
+    }
+    for _, c := range cases {
+        inMemoryQueue := runWithResolutionPolicy(messages, c.policy)
+        if len(inMemoryQueue.GetDeletedMessages()) != 49 {
+            t.Errorf("%s: expected 49 messages to be deleted, got %d", c.name, len(inMemoryQueue.GetDeletedMessages()))
+        }
+        resetMessages := inMemoryQueue.GetResetMessages()
+        if len(resetMessages) != 1 || resetMessages[0] != c.expected.ReceiptHandle() {
+            t.Errorf("%s: expected %s to be kept, got %v", c.name, c.expected.ReceiptHandle(), resetMessages)
+        }
+    }
+}
+
+
+func TestResolutionPolicyReportsFlushedCopiesNeverReplaced(t *testing.T) {
+    now := time.Now()
+    var messages []dedup.QueueMessage
+    for i := 0; i < 50; i++ {
+        messages = append(messages, memory.NewInMemoryMessage(fmt.Sprintf("uuid-%d", i), "", now, nil, nil))
+    }
+    // Newer copies pulled once the older ones have been kept.
+    for i := 0; i < 50; i++ {
+        messages = append(messages, memory.NewInMemoryMessage(fmt.Sprintf("uuid-%d", i), "", now.Add(time.Second), nil, nil))
+    }
+    // With a single puller every kept copy is flushed before the newer ones are pulled.
+    for maxInflight, unresolved := range map[int]int{10: 50, 1000: 0} {
+        queue := memory.NewInMemoryQueue(10)
+        queue.AddMessages(messages)
+        config := &dedup.DeduplicatorConfig{
+            Queue: queue,
+            StorageQueue: memory.NewInMemoryQueue(10),
+            NumWorkers: 1,
+            MaxInflight: maxInflight,
+            TimeLimitInSeconds: 240,
+            ResolutionPolicy: dedup.NewestSentPolicy{},
+        }
+        report, err := dedup.NewDeduplicator(config).Run(context.Background())
+        if err != nil {
+            t.Fatal(err)
+        }
+        if report.UnresolvedDuplicates != unresolved {
+            t.Errorf("maxInflight %d: expected %d unresolved duplicates, got %d with %d flushed", maxInflight, unresolved, report.UnresolvedDuplicates, report.MessagesFlushedToStorage)
+        }
+        if report.UniqueKept != 50 || report.DuplicatesDeleted != 50 {
+            t.Errorf("maxInflight %d: expected 50 kept and 50 deleted, got %+v", maxInflight, report)
+        }
+    }
+}
+
+
+func TestFirstSeenPolicyNeverReplaces(t *testing.T) {
+    older := memory.NewInMemoryMessage("abc", "", time.Now(), nil, nil)
+    newer := memory.NewInMemoryMessage("abc", "", time.Now().Add(time.Second), nil, nil)
+    if (dedup.FirstSeenPolicy{}).Replace(newer, older) || (dedup.FirstSeenPolicy{}).Replace(older, newer) {
+        t.Error("Expected first seen policy to never replace")
+    }
+    unknown := memory.NewInMemoryMessage("abc", "", time.Time{}, nil, nil)
+    if (dedup.NewestSentPolicy{}).Replace(unknown, older) || (dedup.OldestSentPolicy{}).Replace(unknown, newer) {
+        t.Error("Expected messages without sent time to never replace")
+    }
+}
@@ -2,54 +2,614 @@ package dedup
 
 
 import (
+    "hash/maphash"
+    "runtime"
     "sync"
+    "sync/atomic"
     "time"
 )
 
 
+const DefaultStateShards = 64
+
+
+// Part of SharedState with its own lock. Keep, moving and stored messages
+// are keyed and sharded by fingerprint of unique ID, so all copies of a
+// message land in the same shard, delete messages are sharded by receipt handle.
+type stateShard struct {
+    mu sync.Mutex
+    keepMessages map[keyFingerprint]*keptMessage
+    movingMessages map[keyFingerprint]*keptMessage // Keep messages handed to flush movers but not yet stored.
+    storedMessages map[keyFingerprint]uint64 // Hash of source message ID of the copy persisted to storage queue.
+    restoredMessages map[keyFingerprint]restoredMessage // Copy restored to queue this run.
+    storedFilter *bloomFilter // Used instead of storedMessages if not nil.
+    suspectMessages map[keyFingerprint]*keptMessage // Probable copies of stored messages, held until restoring from storage confirms them.
+    deleteMessages map[string]struct{} // Duplicates not yet deleted, keyed by receipt handle.
+    // Counts of the maps above, updated while holding mu and read without it.
+    keepCount atomic.Int64
+    deleteCount atomic.Int64
+    movingCount atomic.Int64
+    storedCount atomic.Int64
+    restoredCount atomic.Int64
+    suspectCount atomic.Int64
+    keepBytes atomic.Int64 // Estimated size of keep, moving and suspect messages.
+    deleteBytes atomic.Int64
+}
+
+
+func newStateShard(storedFilter *bloomFilter) *stateShard {
+    return &stateShard{
+        keepMessages: make(map[keyFingerprint]*keptMessage),
+        movingMessages: make(map[keyFingerprint]*keptMessage),
+        storedMessages: make(map[keyFingerprint]uint64),
+        restoredMessages: make(map[keyFingerprint]restoredMessage),
+        storedFilter: storedFilter,
+        suspectMessages: make(map[keyFingerprint]*keptMessage),
+        deleteMessages: make(map[string]struct{}),
+    }
+}
+
+
+// Hashes of source message ID and of message ID of a copy on queue. For
+// restored copies the message ID is the one of the message in storage.
+type restoredMessage struct {
+    source uint64
+    messageID uint64
+}
+
+
+// Counts are kept per shard and summed when read, so workers
+// changing state in different shards never share a counter.
 type SharedState struct {
-    keepMessages map[string]QueueMessage
-    deleteMessages map[string]struct{}
-    storedMessages map[string]QueueMessage
+    shards []*stateShard
+    seed maphash.Seed
+    hasher keyHasher
+    peakBytes atomic.Int64
+    flushing atomic.Bool // Keep messages are streamed to storage once keep count reaches max inflight.
+    drainMu sync.Mutex
+    drained *sync.Cond // Signalled when delete or moving count shrinks.
+    waiters atomic.Int32 // Workers in waitUntil, signalDrained is skipped if none.
     startTime time.Time
-    mu sync.Mutex
+    expectedStored int // Per shard, stored messages are tracked in Bloom filters if not zero.
+    falsePositiveRate float64
+}
+
+
+func (s *SharedState) shardFor(key keyFingerprint) *stateShard {
+    return s.shards[key.hi % uint64(len(s.shards))]
+}
+
+
+func (s *SharedState) deleteShardFor(receiptHandle string) *stateShard {
+    return s.shards[maphash.String(s.seed, receiptHandle) % uint64(len(s.shards))]
+}
+
+
+// Sums count across shards.
+func (s *SharedState) sum(count func(*stateShard) *atomic.Int64) int64 {
+    var total int64
+    for _, shard := range s.shards {
+        total += count(shard).Load()
+    }
+    return total
 }
 
 
 func (s *SharedState) KeepMessagesLen() int {
-    s.mu.Lock()
-    defer s.mu.Unlock()
-    return len(s.keepMessages)
+    return int(s.sum(func(shard *stateShard) *atomic.Int64 { return &shard.keepCount }))
 }
 
 
 func (s *SharedState) DeleteMessagesLen() int {
-    s.mu.Lock()
-    defer s.mu.Unlock()
-    return len(s.deleteMessages)
+    return int(s.sum(func(shard *stateShard) *atomic.Int64 { return &shard.deleteCount }))
+}
+
+
+func (s *SharedState) MovingMessagesLen() int {
+    return int(s.sum(func(shard *stateShard) *atomic.Int64 { return &shard.movingCount }))
 }
 
 
+// Approximate when stored messages are tracked in Bloom filters.
 func (s *SharedState) StoredMessagesLen() int {
-    s.mu.Lock()
-    defer s.mu.Unlock()
-    return len(s.storedMessages)
+    return int(s.sum(func(shard *stateShard) *atomic.Int64 { return &shard.storedCount }))
+}
+
+
+func (s *SharedState) SuspectMessagesLen() int {
+    return int(s.sum(func(shard *stateShard) *atomic.Int64 { return &shard.suspectCount }))
+}
+
+
+func (s *SharedState) keepBytes() int64 {
+    return s.sum(func(shard *stateShard) *atomic.Int64 { return &shard.keepBytes })
+}
+
+
+func (s *SharedState) deleteBytes() int64 {
+    return s.sum(func(shard *stateShard) *atomic.Int64 { return &shard.deleteBytes })
+}
+
+
+func (s *SharedState) storedBytes() int64 {
+    restoredBytes := s.sum(func(shard *stateShard) *atomic.Int64 { return &shard.restoredCount }) * storedEntryBytes
+    if s.expectedStored > 0 {
+        return int64(len(s.shards)) * s.shards[0].storedFilter.size() + restoredBytes
+    }
+    return int64(s.StoredMessagesLen()) * storedEntryBytes + restoredBytes
+}
+
+
+// Estimated bytes held by state, excluding fixed overhead of empty maps.
+func (s *SharedState) EstimatedBytes() int64 {
+    return s.keepBytes() + s.deleteBytes() + s.storedBytes()
+}
+
+
+// State only peaks right before it shrinks, so this is called
+// before removing messages rather than on every addition.
+func (s *SharedState) recordPeakBytes() {
+    current := s.EstimatedBytes()
+    for {
+        peak := s.peakBytes.Load()
+        if current <= peak || s.peakBytes.CompareAndSwap(peak, current) {
+            return
+        }
+    }
+}
+
+
+// Only call once workers have finished.
+func (s *SharedState) memoryReport() MemoryReport {
+    s.recordPeakBytes()
+    var memStats runtime.MemStats
+    runtime.ReadMemStats(&memStats)
+    return MemoryReport{
+        KeepBytes: s.keepBytes(),
+        DeleteBytes: s.deleteBytes(),
+        StoredBytes: s.storedBytes(),
+        PeakStateBytes: s.peakBytes.Load(),
+        HeapInuseBytes: memStats.HeapInuse,
+    }
+}
+
+
+func (s *SharedState) NumShards() int {
+    return len(s.shards)
 }
 
 
+func (s *SharedState) inflight() int {
+    return s.held() + s.MovingMessagesLen()
+}
+
+
+// Keep, delete and suspect messages, summed in one pass over shards.
+func (s *SharedState) held() int {
+    var total int64
+    for _, shard := range s.shards {
+        total += shard.keepCount.Load() + shard.deleteCount.Load() + shard.suspectCount.Load()
+    }
+    return int(total)
+}
+
+
+func (s *SharedState) signalDrained() {
+    // Waiters register before checking done, so one registering
+    // after this load already sees the change being signalled.
+    if s.waiters.Load() == 0 {
+        return
+    }
+    s.drainMu.Lock()
+    s.drained.Broadcast()
+    s.drainMu.Unlock()
+}
+
+
+// Blocks until done returns true, done is checked whenever delete or
+// moving messages shrink or signalDrained is called.
+func (s *SharedState) waitUntil(done func() bool) {
+    s.drainMu.Lock()
+    defer s.drainMu.Unlock()
+    s.waiters.Add(1)
+    defer s.waiters.Add(-1)
+    for !done() {
+        s.drained.Wait()
+    }
+}
+
+
+func (s *SharedState) addDeletes(receiptHandles []string) {
+    for _, receiptHandle := range receiptHandles {
+        shard := s.deleteShardFor(receiptHandle)
+        shard.mu.Lock()
+        if _, ok := shard.deleteMessages[receiptHandle]; !ok {
+            shard.deleteMessages[receiptHandle] = struct{}{}
+            shard.deleteCount.Add(1)
+            shard.deleteBytes.Add(deleteEntryBytes(receiptHandle))
+        }
+        shard.mu.Unlock()
+    }
+}
+
+
+func (s *SharedState) markDeleted(receiptHandles []string) {
+    s.recordPeakBytes()
+    for _, receiptHandle := range receiptHandles {
+        shard := s.deleteShardFor(receiptHandle)
+        shard.mu.Lock()
+        if _, ok := shard.deleteMessages[receiptHandle]; ok {
+            delete(shard.deleteMessages, receiptHandle)
+            shard.deleteCount.Add(-1)
+            shard.deleteBytes.Add(-deleteEntryBytes(receiptHandle))
+        }
+        shard.mu.Unlock()
+    }
+    s.signalDrained()
+}
+
+
+// Moves message from keep to moving if it's still the one kept for its unique ID.
+func (s *SharedState) startMoving(message QueueMessage) bool {
+    key := s.hasher.key(message.UniqueID())
+    shard := s.shardFor(key)
+    shard.mu.Lock()
+    defer shard.mu.Unlock()
+    keepMessage, ok := shard.keepMessages[key]
+    if !ok || keepMessage.MessageID() != message.MessageID() {
+        return false
+    }
+    delete(shard.keepMessages, key)
+    shard.keepCount.Add(-1)
+    shard.movingMessages[key] = keepMessage
+    shard.movingCount.Add(1)
+    return true
+}
+
+
+// Records messages as persisted to storage queue, keeping
+// only fingerprints of their unique and message IDs.
+func (s *SharedState) markStored(messages []QueueMessage) {
+    s.recordPeakBytes()
+    for _, message := range messages {
+        key := s.hasher.key(message.UniqueID())
+        shard := s.shardFor(key)
+        shard.mu.Lock()
+        if shard.storedFilter != nil {
+            if !shard.storedFilter.mayContain(key) {
+                shard.storedCount.Add(1)
+            }
+            shard.storedFilter.add(key)
+        } else {
+            if _, ok := shard.storedMessages[key]; !ok {
+                shard.storedCount.Add(1)
+            }
+            shard.storedMessages[key] = s.hasher.messageID(sourceMessageID(message))
+        }
+        if keepMessage, ok := shard.keepMessages[key]; ok {
+            delete(shard.keepMessages, key)
+            shard.keepCount.Add(-1)
+            shard.keepBytes.Add(-keepMessage.size())
+        }
+        if movingMessage, ok := shard.movingMessages[key]; ok {
+            delete(shard.movingMessages, key)
+            shard.movingCount.Add(-1)
+            shard.keepBytes.Add(-movingMessage.size())
+        }
+        shard.mu.Unlock()
+    }
+    s.signalDrained()
+}
+
+
+// Puts messages handed to flush movers back into keepMessages,
+// so ones that never made it to storage get their visibility reset.
+func (s *SharedState) returnToKeep(messages []QueueMessage) {
+    for _, message := range messages {
+        key := s.hasher.key(message.UniqueID())
+        shard := s.shardFor(key)
+        shard.mu.Lock()
+        if moving, ok := shard.movingMessages[key]; ok && moving.MessageID() == message.MessageID() {
+            delete(shard.movingMessages, key)
+            shard.movingCount.Add(-1)
+            shard.keepMessages[key] = moving
+            shard.keepCount.Add(1)
+        }
+        shard.mu.Unlock()
+    }
+    s.signalDrained()
+}
+
+
+func (s *SharedState) returnAllMovingToKeep() {
+    for _, shard := range s.shards {
+        shard.mu.Lock()
+        for key, message := range shard.movingMessages {
+            shard.keepMessages[key] = message
+            shard.keepCount.Add(1)
+        }
+        shard.movingCount.Add(-int64(len(shard.movingMessages)))
+        shard.movingMessages = make(map[keyFingerprint]*keptMessage)
+        shard.mu.Unlock()
+    }
+    s.signalDrained()
+}
+
+
+func (s *SharedState) keepMessagesSnapshot() []QueueMessage {
+    var messages []QueueMessage
+    for _, shard := range s.shards {
+        shard.mu.Lock()
+        for _, message := range shard.keepMessages {
+            messages = append(messages, message)
+        }
+        shard.mu.Unlock()
+    }
+    return messages
+}
+
+
+// Removes and returns all keep messages.
+func (s *SharedState) takeKeepMessages() []QueueMessage {
+    s.recordPeakBytes()
+    var messages []QueueMessage
+    for _, shard := range s.shards {
+        shard.mu.Lock()
+        for _, message := range shard.keepMessages {
+            messages = append(messages, message)
+            shard.keepBytes.Add(-message.size())
+        }
+        shard.keepCount.Add(-int64(len(shard.keepMessages)))
+        shard.keepMessages = make(map[keyFingerprint]*keptMessage)
+        shard.mu.Unlock()
+    }
+    return messages
+}
+
+
+// Marks suspect messages with the same unique ID as messages restored
+// from storage for deletion, they are confirmed copies of stored messages.
+// Returns how many confirmed suspects were copies left by half-completed
+// moves rather than duplicates.
+func (s *SharedState) confirmSuspects(restored []QueueMessage) int {
+    s.recordPeakBytes()
+    var confirmed []string
+    orphans := 0
+    for _, message := range restored {
+        key := s.hasher.key(message.UniqueID())
+        shard := s.shardFor(key)
+        shard.mu.Lock()
+        if suspect, ok := shard.suspectMessages[key]; ok {
+            delete(shard.suspectMessages, key)
+            shard.suspectCount.Add(-1)
+            shard.keepBytes.Add(-suspect.size())
+            confirmed = append(confirmed, suspect.ReceiptHandle())
+            if sourceMessageID(suspect) == sourceMessageID(message) {
+                orphans++
+            }
+        }
+        shard.mu.Unlock()
+    }
+    s.addDeletes(confirmed)
+    return orphans
+}
+
+
+// Classifies messages loaded from storage like pullers classify pulled
+// ones. Returns messages to restore, copies left by half-completed moves,
+// and duplicates of messages already restored this run or kept on queue,
+// which are removed from storage instead of restored. The copy already
+// on queue is always the one kept, whatever the resolution policy.
+// Messages to restore are recorded as restored right away, so movers
+// restoring at the same time never restore two copies.
+func (s *SharedState) classifyRestored(messages []QueueMessage) ([]QueueMessage, []QueueMessage, []QueueMessage) {
+    var restore, orphans, duplicates []QueueMessage
+    for _, message := range messages {
+        key := s.hasher.key(message.UniqueID())
+        restored := restoredMessage{
+            source: s.hasher.messageID(sourceMessageID(message)),
+            messageID: s.hasher.messageID(message.MessageID()),
+        }
+        existing, exists := s.restoreUnlessOnQueue(key, restored)
+        switch {
+        case !exists:
+            restore = append(restore, message)
+        case existing.messageID == restored.messageID:
+            // The message being restored delivered again, it's left to the
+            // mover restoring it, which only deletes it once it's restored.
+        case existing.source == restored.source:
+            orphans = append(orphans, message)
+        default:
+            duplicates = append(duplicates, message)
+        }
+    }
+    return restore, orphans, duplicates
+}
+
+
+// Returns the copy of key on queue, restored or kept,
+// otherwise records restored as restored.
+func (s *SharedState) restoreUnlessOnQueue(key keyFingerprint, restored restoredMessage) (restoredMessage, bool) {
+    shard := s.shardFor(key)
+    shard.mu.Lock()
+    defer shard.mu.Unlock()
+    if existing, ok := shard.restoredMessages[key]; ok {
+        return existing, true
+    }
+    if kept, ok := shard.keepMessages[key]; ok {
+        return restoredMessage{
+            source: s.hasher.messageID(sourceMessageID(kept)),
+            messageID: s.hasher.messageID(kept.MessageID()),
+        }, true
+    }
+    shard.restoredMessages[key] = restored
+    shard.restoredCount.Add(1)
+    return restoredMessage{}, false
+}
+
+
+// Copies restored before pulling may have since been flushed or deleted,
+// so each restore phase only goes by its own restores and keep messages.
+func (s *SharedState) forgetRestored() {
+    s.recordPeakBytes()
+    for _, shard := range s.shards {
+        shard.mu.Lock()
+        shard.restoredCount.Add(-int64(len(shard.restoredMessages)))
+        shard.restoredMessages = make(map[keyFingerprint]restoredMessage)
+        shard.mu.Unlock()
+    }
+}
+
+
+// Forgets messages that failed to restore, they're still in storage.
+func (s *SharedState) returnToStorage(messages []QueueMessage) {
+    s.recordPeakBytes()
+    for _, message := range messages {
+        key := s.hasher.key(message.UniqueID())
+        shard := s.shardFor(key)
+        shard.mu.Lock()
+        if restored, ok := shard.restoredMessages[key]; ok && restored.messageID == s.hasher.messageID(message.MessageID()) {
+            delete(shard.restoredMessages, key)
+            shard.restoredCount.Add(-1)
+        }
+        shard.mu.Unlock()
+    }
+}
+
+
+// Keeps suspect messages never confirmed, either false positives of
+// the stored filter or copies of messages that failed to restore.
+func (s *SharedState) returnSuspectsToKeep() int {
+    returned := 0
+    for _, shard := range s.shards {
+        shard.mu.Lock()
+        for key, message := range shard.suspectMessages {
+            shard.keepMessages[key] = message
+            shard.keepCount.Add(1)
+        }
+        returned += len(shard.suspectMessages)
+        shard.suspectCount.Add(-int64(len(shard.suspectMessages)))
+        shard.suspectMessages = make(map[keyFingerprint]*keptMessage)
+        shard.mu.Unlock()
+    }
+    return returned
+}
+
+
+func (s *SharedState) pendingDeletes() []string {
+    var receiptHandles []string
+    for _, shard := range s.shards {
+        shard.mu.Lock()
+        for receiptHandle := range shard.deleteMessages {
+            receiptHandles = append(receiptHandles, receiptHandle)
+        }
+        shard.mu.Unlock()
+    }
+    return receiptHandles
+}
+
+
+// Receipt handles of keep, delete, moving and suspect messages, which are all still inflight.
+func (s *SharedState) heldReceiptHandles() []string {
+    var receiptHandles []string
+    for _, shard := range s.shards {
+        shard.mu.Lock()
+        for _, message := range shard.keepMessages {
+            receiptHandles = append(receiptHandles, message.ReceiptHandle())
+        }
+        for receiptHandle := range shard.deleteMessages {
+            receiptHandles = append(receiptHandles, receiptHandle)
+        }
+        for _, message := range shard.movingMessages {
+            receiptHandles = append(receiptHandles, message.ReceiptHandle())
+        }
+        for _, message := range shard.suspectMessages {
+            receiptHandles = append(receiptHandles, message.ReceiptHandle())
+        }
+        shard.mu.Unlock()
+    }
+    return receiptHandles
+}
+
+
+// Not safe to call while workers are running.
 func (s *SharedState) Reset() {
-    s.keepMessages = make(map[string]QueueMessage)
-    s.deleteMessages = make(map[string]struct{})
-    s.storedMessages = make(map[string]QueueMessage)
+    s.initShards()
+    s.peakBytes.Store(0)
+    s.flushing.Store(false)
     s.startTime = time.Now()
 }
 
 
-func NewSharedState(keepMessages map[string]QueueMessage, deleteMessages map[string]struct{}, storedMessages map[string]QueueMessage) *SharedState {
-    return &SharedState{
-        keepMessages: keepMessages,
-        deleteMessages: deleteMessages,
-        storedMessages: storedMessages,
+func (s *SharedState) initShards() {
+    for i := range s.shards {
+        var storedFilter *bloomFilter
+        if s.expectedStored > 0 {
+            storedFilter = newBloomFilter(s.expectedStored, s.falsePositiveRate)
+        }
+        s.shards[i] = newStateShard(storedFilter)
+    }
+}
+
+
+func newSharedState(numShards int, expectedStored int, falsePositiveRate float64) *SharedState {
+    if numShards <= 0 {
+        numShards = DefaultStateShards
+    }
+    s := &SharedState{
+        shards: make([]*stateShard, numShards),
+        seed: maphash.MakeSeed(),
+        hasher: newKeyHasher(),
         startTime: time.Now(),
+        falsePositiveRate: falsePositiveRate,
+    }
+    if expectedStored > 0 {
+        s.expectedStored = (expectedStored + numShards - 1) / numShards
+    }
+    s.drained = sync.NewCond(&s.drainMu)
+    s.initShards()
+    return s
+}
+
+
+func NewShardedSharedState(numShards int) *SharedState {
+    return newSharedState(numShards, 0, 0)
+}
+
+
+// Tracks stored messages in Bloom filters sized for expectedStored
+// messages instead of exactly. Copies of messages the filters report
+// as stored are held as suspects, and only deleted once restoring
+// from storage confirms them, so false positives are never deleted.
+func NewFilteredSharedState(numShards int, expectedStored int, falsePositiveRate float64) *SharedState {
+    if expectedStored <= 0 {
+        expectedStored = 1
+    }
+    return newSharedState(numShards, expectedStored, falsePositiveRate)
+}
+
+
+func NewSharedState(keepMessages map[string]QueueMessage, deleteMessages map[string]struct{}, storedMessages map[string]QueueMessage) *SharedState {
+    s := NewShardedSharedState(DefaultStateShards)
+    for uniqueID, message := range keepMessages {
+        key := s.hasher.key(uniqueID)
+        kept := compactMessage(message, true)
+        shard := s.shardFor(key)
+        shard.keepMessages[key] = kept
+        shard.keepCount.Add(1)
+        shard.keepBytes.Add(kept.size())
+    }
+    for receiptHandle := range deleteMessages {
+        shard := s.deleteShardFor(receiptHandle)
+        shard.deleteMessages[receiptHandle] = struct{}{}
+        shard.deleteCount.Add(1)
+        shard.deleteBytes.Add(deleteEntryBytes(receiptHandle))
+    }
+    for uniqueID, message := range storedMessages {
+        key := s.hasher.key(uniqueID)
+        shard := s.shardFor(key)
+        shard.storedMessages[key] = s.hasher.messageID(sourceMessageID(message))
+        shard.storedCount.Add(1)
     }
+    return s
 }
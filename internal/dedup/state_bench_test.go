@@ -0,0 +1,88 @@
+package dedup_test
+
+
+import (
+    "context"
+    "fmt"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "github.com/IGVF-DACC/go-sqs-deduplication/internal/memory"
+    "github.com/IGVF-DACC/go-sqs-deduplication/internal/dedup"
+)
+
+
+// Hands out pre-generated messages without locking,
+// so benchmarks measure contention on SharedState.
+type generatedQueue struct {
+    *memory.InMemoryQueue
+    messages []dedup.QueueMessage
+    next atomic.Int64
+}
+
+
+func (q *generatedQueue) PullMessagesBatch(ctx context.Context) ([]dedup.QueueMessage, error) {
+    end := int(q.next.Add(10))
+    start := end - 10
+    if start >= len(q.messages) {
+        return nil, nil
+    }
+    if end > len(q.messages) {
+        end = len(q.messages)
+    }
+    return q.messages[start:end], nil
+}
+
+
+func newGeneratedQueue(numMessages int) *generatedQueue {
+    // Half of the messages are copies of the other half.
+    messages := memory.GenerateInMemoryMessages(numMessages / 2)
+    for _, message := range memory.GenerateInMemoryMessages(numMessages / 2) {
+        messages = append(messages, message)
+    }
+    shuffled := make([]dedup.QueueMessage, 0, len(messages))
+    for i := 0; i < len(messages) / 2; i++ {
+        shuffled = append(shuffled, messages[i], messages[i + len(messages) / 2])
+    }
+    return &generatedQueue{
+        InMemoryQueue: memory.NewInMemoryQueue(10),
+        messages: shuffled,
+    }
+}
+
+
+func benchmarkPullers(b *testing.B, numShards int, numWorkers int) {
+    const numMessages = 100000
+    b.ReportAllocs()
+    for i := 0; i < b.N; i++ {
+        b.StopTimer()
+        queue := newGeneratedQueue(numMessages)
+        state := dedup.NewShardedSharedState(numShards)
+        wg := &sync.WaitGroup{}
+        b.StartTimer()
+        for w := 0; w < numWorkers; w++ {
+            dedup.NewPuller(queue, state, true, false, numMessages * 2, 600, wg).Start(context.Background())
+        }
+        wg.Wait()
+        if state.KeepMessagesLen() != numMessages / 2 {
+            b.Fatalf("Unexpected unique messages to keep %d", state.KeepMessagesLen())
+        }
+    }
+    b.ReportMetric(float64(numMessages) * float64(b.N) / b.Elapsed().Seconds(), "msgs/s")
+}
+
+
+// Counts live in each shard, so a single shard is the design before
+// sharding, one global lock around every map and count. Run with -cpu
+// to see the gain grow with cores, e.g.
+// go test -bench=SharedState -cpu=1,4,16 ./internal/dedup
+func BenchmarkSharedStatePullers(b *testing.B) {
+    b.Run("global-lock", func(b *testing.B) {
+        benchmarkPullers(b, 1, 100)
+    })
+    for _, numShards := range []int{16, dedup.DefaultStateShards, 256} {
+        b.Run(fmt.Sprintf("shards=%d", numShards), func(b *testing.B) {
+            benchmarkPullers(b, numShards, 100)
+        })
+    }
+}
@@ -0,0 +1,120 @@
+package dedup_test
+
+
+import (
+    "context"
+    "fmt"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+    "github.com/IGVF-DACC/go-sqs-deduplication/internal/memory"
+    "github.com/IGVF-DACC/go-sqs-deduplication/internal/dedup"
+)
+
+
+func TestSharedStateStoresFingerprintsOnly(t *testing.T) {
+    fromQueue := memory.NewInMemoryQueue(10)
+    toQueue := memory.NewInMemoryQueue(10)
+    generatedMessages := memory.GenerateInMemoryMessages(100)
+    fromQueue.AddMessages(generatedMessages)
+    keepMessages := make(map[string]dedup.QueueMessage)
+    for _, message := range generatedMessages {
+        keepMessages[message.UniqueID()] = message
+    }
+    state := dedup.NewSharedState(
+        keepMessages,
+        make(map[string]struct{}),
+        make(map[string]dedup.QueueMessage),
+    )
+    keepBytes := state.EstimatedBytes()
+    if keepBytes < int64(100 * len(generatedMessages[0].RawBody())) {
+        t.Errorf("Expected estimate to include message bodies, got %d", keepBytes)
+    }
+    wg := &sync.WaitGroup{}
+    moveChannel := make(chan dedup.QueueMessage, 100)
+    for _, message := range generatedMessages {
+        moveChannel <- message
+    }
+    close(moveChannel)
+    dedup.NewMover(fromQueue, toQueue, moveChannel, state, true, wg).Start(context.Background())
+    wg.Wait()
+    if state.StoredMessagesLen() != 100 {
+        t.Fatalf("Expected 100 stored messages, got %d", state.StoredMessagesLen())
+    }
+    if state.EstimatedBytes() * 2 > keepBytes {
+        t.Errorf("Expected stored fingerprints to take well under %d bytes, got %d", keepBytes, state.EstimatedBytes())
+    }
+    // Copies of stored messages are still recognized from fingerprints.
+    duplicateQueue := memory.NewInMemoryQueue(10)
+    duplicateQueue.AddMessages(memory.GenerateInMemoryMessages(100))
+    puller := dedup.NewPuller(duplicateQueue, state, true, false, 1000, 60, wg)
+    puller.Start(context.Background())
+    wg.Wait()
+    if state.KeepMessagesLen() != 0 {
+        t.Errorf("Expected no messages to keep, got %d", state.KeepMessagesLen())
+    }
+    if state.DeleteMessagesLen() != 100 {
+        t.Errorf("Expected 100 copies of stored messages to delete, got %d", state.DeleteMessagesLen())
+    }
+}
+
+
+func TestDeduplicatorMemoryReport(t *testing.T) {
+    inMemoryQueue := memory.NewInMemoryQueue(10)
+    inMemoryQueue.AddMessages(memory.GenerateInMemoryMessages(300))
+    inMemoryQueue.AddMessages(memory.GenerateInMemoryMessages(300))
+    config := &dedup.DeduplicatorConfig{
+        Queue: inMemoryQueue,
+        StorageQueue: memory.NewInMemoryQueue(10),
+        NumWorkers: 3,
+        MaxInflight: 100,
+        TimeLimitInSeconds: 240,
+    }
+    report, err := dedup.NewDeduplicator(config).Run(context.Background())
+    if err != nil {
+        t.Fatal(err)
+    }
+    if report.Memory.StoredBytes == 0 {
+        t.Error("Expected stored messages to be accounted for")
+    }
+    if report.Memory.PeakStateBytes < report.Memory.KeepBytes + report.Memory.DeleteBytes + report.Memory.StoredBytes {
+        t.Errorf("Expected peak to be at least state at end of pulling, got %+v", report.Memory)
+    }
+    if report.Memory.HeapInuseBytes == 0 {
+        t.Error("Expected heap in use to be reported")
+    }
+}
+
+
+func TestDeduplicatorCompactsKeptMessagesWithFirstSeenPolicy(t *testing.T) {
+    var messages []dedup.QueueMessage
+    for i := 0; i < 100; i++ {
+        attributes := map[string]string{"SenderId": strings.Repeat("x", 1000)}
+        messages = append(messages, memory.NewInMemoryMessage(fmt.Sprintf("uuid-%d", i), "", time.Now(), attributes, nil))
+    }
+    peakBytes := func(policy dedup.ResolutionPolicy) int64 {
+        queue := memory.NewInMemoryQueue(10)
+        queue.AddMessages(messages)
+        config := &dedup.DeduplicatorConfig{
+            Queue: queue,
+            StorageQueue: memory.NewInMemoryQueue(10),
+            NumWorkers: 1,
+            MaxInflight: 1000,
+            TimeLimitInSeconds: 240,
+            ResolutionPolicy: policy,
+        }
+        report, err := dedup.NewDeduplicator(config).Run(context.Background())
+        if err != nil {
+            t.Fatal(err)
+        }
+        return report.Memory.PeakStateBytes
+    }
+    compacted := peakBytes(nil)
+    if firstSeen := peakBytes(dedup.FirstSeenPolicy{}); firstSeen != compacted {
+        t.Errorf("Expected kept messages compacted with first seen policy, got %d bytes instead of %d", firstSeen, compacted)
+    }
+    if newestSent := peakBytes(dedup.NewestSentPolicy{}); newestSent < compacted + 100 * 1000 {
+        t.Errorf("Expected kept messages to keep all attributes with newest sent policy, got %d bytes", newestSent)
+    }
+}
@@ -0,0 +1,45 @@
+package dedup
+
+
+import (
+    "context"
+)
+
+
+// Holds messages flushed out of Queue until they are restored. Loaded
+// messages are identified by their receipt handle, and only removed
+// once they're back on Queue, so a message is never lost in between.
+// Batch methods follow the same error convention as Queue.
+type Storage interface {
+    StoreMessagesBatch(ctx context.Context, messages []QueueMessage) (BatchResult, error)
+    LoadMessagesBatch(ctx context.Context) ([]QueueMessage, error) // Empty once nothing is left to load.
+    RemoveMessagesBatch(ctx context.Context, receiptHandles []string) (BatchResult, error)
+}
+
+
+// Storage backed by a second queue.
+type QueueStorage struct {
+    queue Queue
+}
+
+
+func (s *QueueStorage) StoreMessagesBatch(ctx context.Context, messages []QueueMessage) (BatchResult, error) {
+    return s.queue.PutMessagesBatch(ctx, messages)
+}
+
+
+func (s *QueueStorage) LoadMessagesBatch(ctx context.Context) ([]QueueMessage, error) {
+    return s.queue.PullMessagesBatch(ctx)
+}
+
+
+func (s *QueueStorage) RemoveMessagesBatch(ctx context.Context, receiptHandles []string) (BatchResult, error) {
+    return s.queue.DeleteMessagesBatch(ctx, receiptHandles)
+}
+
+
+func NewQueueStorage(queue Queue) *QueueStorage {
+    return &QueueStorage{
+        queue: queue,
+    }
+}
@@ -0,0 +1,102 @@
+package dedup
+
+
+import (
+    "strings"
+)
+
+
+// Message attribute every Mover tags the messages it puts with, holding
+// the run that moved the message and the ID the message had on its source
+// queue before it was first moved. Copies left behind by a move that was
+// never completed share that ID, so they can be told apart from duplicates
+// that were sent separately.
+const MoveTokenAttribute = "DedupMoveToken"
+
+
+// SQS allows at most 10 message attributes per message.
+const MaxMessageAttributes = 10
+
+
+// Message attribute holding when a message was first sent, added by queues
+// whose sent time doesn't survive a move, e.g. sqs.Queue when putting.
+const OriginalSentTimestampAttribute = "DedupOriginalSentTimestamp"
+
+
+// Attributes a move will still add besides the move token. The original
+// sent timestamp goes first, so room for the token is what's left after it.
+func reservedMessageAttributes(message QueueMessage) int {
+    if _, ok := message.MessageAttributes()[OriginalSentTimestampAttribute]; ok || message.SentTime().IsZero() {
+        return 0
+    }
+    return 1
+}
+
+
+type MoveToken struct {
+    RunID string
+    SourceMessageID string
+}
+
+
+func (t MoveToken) String() string {
+    return t.RunID + ":" + t.SourceMessageID
+}
+
+
+// Run IDs never contain a colon, message IDs may.
+func ParseMoveToken(value string) (MoveToken, bool) {
+    runID, sourceMessageID, ok := strings.Cut(value, ":")
+    if !ok || sourceMessageID == "" {
+        return MoveToken{}, false
+    }
+    return MoveToken{RunID: runID, SourceMessageID: sourceMessageID}, true
+}
+
+
+func MoveTokenOf(message QueueMessage) (MoveToken, bool) {
+    attribute, ok := message.MessageAttributes()[MoveTokenAttribute]
+    if !ok {
+        return MoveToken{}, false
+    }
+    return ParseMoveToken(attribute.StringValue)
+}
+
+
+// ID of message before it was first moved, its own ID if it never was.
+func sourceMessageID(message QueueMessage) string {
+    if token, ok := MoveTokenOf(message); ok {
+        return token.SourceMessageID
+    }
+    return message.MessageID()
+}
+
+
+// Message as put by a Mover, with its move token.
+type tokenedMessage struct {
+    QueueMessage
+    messageAttributes map[string]MessageAttribute
+}
+
+
+func (m tokenedMessage) MessageAttributes() map[string]MessageAttribute {
+    return m.messageAttributes
+}
+
+
+// Tags message with a move token of runID, keeping the source message ID
+// of an earlier token. Returns false, with message untagged, if there's no
+// room for the attribute next to the original sent timestamp.
+func withMoveToken(message QueueMessage, runID string) (QueueMessage, bool) {
+    original := message.MessageAttributes()
+    if _, ok := original[MoveTokenAttribute]; !ok && len(original) + reservedMessageAttributes(message) >= MaxMessageAttributes {
+        return message, false
+    }
+    messageAttributes := make(map[string]MessageAttribute, len(original) + 1)
+    for name, value := range original {
+        messageAttributes[name] = value
+    }
+    token := MoveToken{RunID: runID, SourceMessageID: sourceMessageID(message)}
+    messageAttributes[MoveTokenAttribute] = MessageAttribute{DataType: "String", StringValue: token.String()}
+    return tokenedMessage{QueueMessage: message, messageAttributes: messageAttributes}, true
+}
@@ -0,0 +1,135 @@
+package dedup_test
+
+
+import (
+    "context"
+    "fmt"
+    "sync"
+    "testing"
+    "time"
+    "github.com/IGVF-DACC/go-sqs-deduplication/internal/memory"
+    "github.com/IGVF-DACC/go-sqs-deduplication/internal/dedup"
+)
+
+
+func moveTokenAttributes(runID string, sourceMessageID string) map[string]dedup.MessageAttribute {
+    token := dedup.MoveToken{RunID: runID, SourceMessageID: sourceMessageID}
+    return map[string]dedup.MessageAttribute{
+        dedup.MoveTokenAttribute: {DataType: "String", StringValue: token.String()},
+    }
+}
+
+
+func TestMoverTagsMessagesWithMoveToken(t *testing.T) {
+    queue := memory.NewInMemoryQueue(10)
+    storageQueue := memory.NewInMemoryQueue(10)
+    generatedMessages := memory.GenerateInMemoryMessages(20)
+    sourceMessageIDs := make(map[string]string)
+    moveChannel := make(chan dedup.QueueMessage, len(generatedMessages))
+    for _, message := range generatedMessages {
+        sourceMessageIDs[message.UniqueID()] = message.MessageID()
+        moveChannel <- message
+    }
+    close(moveChannel)
+    wg := &sync.WaitGroup{}
+    ctx := dedup.ContextWithRunID(context.Background(), "flushrun")
+    dedup.NewMover(queue, storageQueue, moveChannel, dedup.NewShardedSharedState(1), true, wg).Start(ctx)
+    wg.Wait()
+    ctx = dedup.ContextWithRunID(context.Background(), "restorerun")
+    dedup.NewMover(storageQueue, queue, nil, nil, false, wg).Start(ctx)
+    wg.Wait()
+    restored := 0
+    for {
+        messages, _ := queue.PullMessagesBatch(context.Background())
+        if len(messages) == 0 {
+            break
+        }
+        for _, message := range messages {
+            restored++
+            token, ok := dedup.MoveTokenOf(message)
+            if !ok {
+                t.Fatalf("Expected move token on %s", message.UniqueID())
+            }
+            if token.RunID != "restorerun" {
+                t.Errorf("Expected token of last move, got %s", token.RunID)
+            }
+            if token.SourceMessageID != sourceMessageIDs[message.UniqueID()] {
+                t.Errorf("Expected source message ID %s kept across moves, got %s", sourceMessageIDs[message.UniqueID()], token.SourceMessageID)
+            }
+        }
+    }
+    if restored != 20 {
+        t.Errorf("Expected 20 restored messages, got %d", restored)
+    }
+}
+
+
+func TestDeduplicatorReconcilesOrphanCopies(t *testing.T) {
+    queue := memory.NewInMemoryQueue(10)
+    storageQueue := memory.NewInMemoryQueue(10)
+    for i := 0; i < 10; i++ {
+        // Original left on queue by a failed delete, next to the copy restored from storage.
+        uniqueID := fmt.Sprintf("left-%d", i)
+        original := memory.NewInMemoryMessage(uniqueID, "", time.Now(), nil, nil)
+        orphan := memory.NewInMemoryMessage(uniqueID, "", time.Now(), nil, moveTokenAttributes("crashed", original.MessageID()))
+        queue.AddMessages([]dedup.QueueMessage{original, orphan})
+    }
+    for i := 0; i < 5; i++ {
+        // Stored twice by a put that was retried after succeeding.
+        uniqueID := fmt.Sprintf("stored-%d", i)
+        for j := 0; j < 2; j++ {
+            storageQueue.AddMessages([]dedup.QueueMessage{
+                memory.NewInMemoryMessage(uniqueID, "", time.Now(), nil, moveTokenAttributes("crashed", fmt.Sprintf("source-%d", i))),
+            })
+        }
+    }
+    // Separately sent duplicates are still resolved as duplicates.
+    queue.AddMessages(memory.MakeDuplicateInMemoryMessages("duplicate", 3))
+    config := &dedup.DeduplicatorConfig{
+        Queue: queue,
+        StorageQueue: storageQueue,
+        NumWorkers: 2,
+        MaxInflight: 100,
+        TimeLimitInSeconds: 240,
+        ResolutionPolicy: dedup.NewestSentPolicy{},
+    }
+    report, _ := dedup.NewDeduplicator(config).Run(context.Background())
+    if report.OrphansReconciled != 15 {
+        t.Errorf("Expected 15 orphan copies reconciled, got %d", report.OrphansReconciled)
+    }
+    if report.UniqueKept != 16 {
+        t.Errorf("Expected 16 unique messages kept, got %d", report.UniqueKept)
+    }
+    // Stored copies are dropped while restoring, or deleted once pulled if
+    // restored by different movers, along with the copies left on queue.
+    deletedOrphans := 10 + report.MessagesRestoredFromStorage - 5
+    if report.DuplicatesDeleted - deletedOrphans != 2 {
+        t.Errorf("Expected 2 separate duplicates deleted, got %d", report.DuplicatesDeleted - deletedOrphans)
+    }
+}
+
+
+func TestPullerDeletesOriginalsOfStoredCopies(t *testing.T) {
+    queue := memory.NewInMemoryQueue(10)
+    generatedMessages := memory.GenerateInMemoryMessages(20)
+    moveChannel := make(chan dedup.QueueMessage, len(generatedMessages))
+    for _, message := range generatedMessages {
+        moveChannel <- message
+    }
+    close(moveChannel)
+    state := dedup.NewShardedSharedState(1)
+    wg := &sync.WaitGroup{}
+    dedup.NewMover(queue, memory.NewInMemoryQueue(10), moveChannel, state, true, wg).Start(context.Background())
+    wg.Wait()
+    // Originals delivered again after their delete failed, storage has them.
+    queue.AddMessages(generatedMessages)
+    puller := dedup.NewPuller(queue, state, true, false, 1000, 60, wg)
+    puller.Start(context.Background())
+    wg.Wait()
+    if state.KeepMessagesLen() != 0 || state.DeleteMessagesLen() != 20 {
+        t.Errorf("Expected 20 originals to delete, got %d kept and %d to delete", state.KeepMessagesLen(), state.DeleteMessagesLen())
+    }
+    if puller.OrphansFound() != 0 {
+        t.Errorf("Expected originals not counted as orphans, got %d", puller.OrphansFound())
+    }
+}
@@ -0,0 +1,78 @@
+package disk
+
+
+import (
+    "time"
+    "github.com/IGVF-DACC/go-sqs-deduplication/internal/dedup"
+)
+
+
+// Everything needed to put a message back on its queue.
+type record struct {
+    UniqueID string `json:"uniqueID"`
+    MessageID string `json:"messageID"`
+    Body string `json:"body"`
+    SentTimestamp int64 `json:"sentTimestamp,omitempty"` // Epoch milliseconds, zero if unknown.
+    Attributes map[string]string `json:"attributes,omitempty"`
+    MessageAttributes map[string]dedup.MessageAttribute `json:"messageAttributes,omitempty"`
+}
+
+
+func newRecord(message dedup.QueueMessage) record {
+    r := record{
+        UniqueID: message.UniqueID(),
+        MessageID: message.MessageID(),
+        Body: message.RawBody(),
+        Attributes: message.Attributes(),
+        MessageAttributes: message.MessageAttributes(),
+    }
+    if !message.SentTime().IsZero() {
+        r.SentTimestamp = message.SentTime().UnixMilli()
+    }
+    return r
+}
+
+
+// Message loaded from disk, its receipt handle identifies the record.
+type Message struct {
+    record record
+    receiptHandle string
+}
+
+
+func (m Message) UniqueID() string {
+    return m.record.UniqueID
+}
+
+
+func (m Message) MessageID() string {
+    return m.record.MessageID
+}
+
+
+func (m Message) ReceiptHandle() string {
+    return m.receiptHandle
+}
+
+
+func (m Message) RawBody() string {
+    return m.record.Body
+}
+
+
+func (m Message) SentTime() time.Time {
+    if m.record.SentTimestamp == 0 {
+        return time.Time{}
+    }
+    return time.UnixMilli(m.record.SentTimestamp)
+}
+
+
+func (m Message) Attributes() map[string]string {
+    return m.record.Attributes
+}
+
+
+func (m Message) MessageAttributes() map[string]dedup.MessageAttribute {
+    return m.record.MessageAttributes
+}
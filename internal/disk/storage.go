@@ -0,0 +1,511 @@
+package disk
+
+
+import (
+    "bufio"
+    "context"
+    "encoding/binary"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "hash/crc32"
+    "io"
+    "log/slog"
+    "os"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+    "github.com/IGVF-DACC/go-sqs-deduplication/internal/dedup"
+)
+
+
+// Records are a little-endian length and CRC-32C of the payload, followed by the payload.
+const headerLength = 8
+
+
+// Far above the largest SQS message, anything longer is corruption.
+const maxRecordLength = 16 << 20
+
+
+const segmentSuffix = ".log"
+
+
+const acksSuffix = ".acks"
+
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+
+// Segment ends with a partial record, left by a crash while appending.
+var errTornRecord = errors.New("torn record")
+
+
+type StorageConfig struct {
+    Dir string
+    VisibilityTimeout time.Duration // Loaded records not removed within this are loaded again, defaults to 15 minutes.
+    Logger *slog.Logger
+}
+
+
+// Tracks removal of records in a segment. Offsets of removed records
+// are appended to an acks file next to the segment, and both files are
+// deleted once every record in the segment has been removed.
+type segment struct {
+    seq int64
+    acked map[int64]struct{}
+    acks *os.File // Opened on first removal.
+    records int // Valid records in segment, -1 until it's been read to the end.
+    corrupt bool // Kept for inspection instead of deleted.
+}
+
+
+// Position of a pass of loads through all segments sealed when it started.
+type loadPass struct {
+    seqs []int64
+    current int
+    file *os.File
+    reader *bufio.Reader
+    offset int64
+    records int
+}
+
+
+// Storage that appends messages to segment files in a local directory.
+// Every batch is fsynced before it's reported stored, and records are
+// checksummed, so after a crash the next load skips torn or corrupt
+// writes and never loads records that were already removed. Only one
+// Storage may use a directory at a time.
+type Storage struct {
+    dir string
+    visibilityTimeout time.Duration
+    logger *slog.Logger
+    mu sync.Mutex
+    writer *os.File // Segment new records are appended to, nil until next store.
+    nextSeq int64
+    segments map[int64]*segment
+    pass *loadPass // Nil between passes.
+    inflight map[string]time.Time // Loaded but not yet removed, by receipt handle.
+}
+
+
+func segmentPath(dir string, seq int64) string {
+    return filepath.Join(dir, fmt.Sprintf("segment-%020d%s", seq, segmentSuffix))
+}
+
+
+func acksPath(dir string, seq int64) string {
+    return filepath.Join(dir, fmt.Sprintf("segment-%020d%s", seq, acksSuffix))
+}
+
+
+func receiptHandle(seq int64, offset int64) string {
+    return fmt.Sprintf("%d:%d", seq, offset)
+}
+
+
+func parseReceiptHandle(receiptHandle string) (int64, int64, error) {
+    seqString, offsetString, found := strings.Cut(receiptHandle, ":")
+    if !found {
+        return 0, 0, fmt.Errorf("invalid receipt handle %q", receiptHandle)
+    }
+    seq, err := strconv.ParseInt(seqString, 10, 64)
+    if err != nil {
+        return 0, 0, fmt.Errorf("invalid receipt handle %q: %w", receiptHandle, err)
+    }
+    offset, err := strconv.ParseInt(offsetString, 10, 64)
+    if err != nil {
+        return 0, 0, fmt.Errorf("invalid receipt handle %q: %w", receiptHandle, err)
+    }
+    return seq, offset, nil
+}
+
+
+// Makes creation and removal of files in dir durable.
+func syncDir(dir string) error {
+    d, err := os.Open(dir)
+    if err != nil {
+        return err
+    }
+    defer d.Close()
+    return d.Sync()
+}
+
+
+func (s *Storage) listSegments() ([]int64, error) {
+    entries, err := os.ReadDir(s.dir)
+    if err != nil {
+        return nil, err
+    }
+    var seqs []int64
+    for _, entry := range entries {
+        name := entry.Name()
+        if !strings.HasPrefix(name, "segment-") || !strings.HasSuffix(name, segmentSuffix) {
+            continue
+        }
+        seq, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(name, "segment-"), segmentSuffix), 10, 64)
+        if err != nil {
+            continue
+        }
+        seqs = append(seqs, seq)
+    }
+    sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+    return seqs, nil
+}
+
+
+// Only call with mutex locked.
+func (s *Storage) openWriter() error {
+    path := segmentPath(s.dir, s.nextSeq)
+    file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_APPEND, 0o600)
+    if err != nil {
+        return err
+    }
+    if err := syncDir(s.dir); err != nil {
+        file.Close()
+        return err
+    }
+    s.writer = file
+    s.nextSeq++
+    return nil
+}
+
+
+// Only call with mutex locked. Later stores go to a new segment.
+func (s *Storage) sealWriter() {
+    if s.writer == nil {
+        return
+    }
+    s.writer.Close()
+    s.writer = nil
+}
+
+
+func encodeRecord(buffer []byte, message dedup.QueueMessage) ([]byte, error) {
+    payload, err := json.Marshal(newRecord(message))
+    if err != nil {
+        return buffer, err
+    }
+    header := make([]byte, headerLength)
+    binary.LittleEndian.PutUint32(header[0:4], uint32(len(payload)))
+    binary.LittleEndian.PutUint32(header[4:8], crc32.Checksum(payload, castagnoli))
+    buffer = append(buffer, header...)
+    return append(buffer, payload...), nil
+}
+
+
+// Appends all messages as one write and fsyncs, the whole batch fails
+// or succeeds together.
+func (s *Storage) StoreMessagesBatch(ctx context.Context, messages []dedup.QueueMessage) (dedup.BatchResult, error) {
+    var buffer []byte
+    var err error
+    for _, message := range messages {
+        buffer, err = encodeRecord(buffer, message)
+        if err != nil {
+            return dedup.BatchResult{}, fmt.Errorf("error encoding message %s: %w", message.MessageID(), err)
+        }
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.writer == nil {
+        if err := s.openWriter(); err != nil {
+            return dedup.BatchResult{}, fmt.Errorf("error creating segment: %w", err)
+        }
+    }
+    _, err = s.writer.Write(buffer)
+    if err == nil {
+        err = s.writer.Sync()
+    }
+    if err != nil {
+        // Possibly torn write, never append after it.
+        s.sealWriter()
+        return dedup.BatchResult{}, fmt.Errorf("error writing segment: %w", err)
+    }
+    var result dedup.BatchResult
+    for _, message := range messages {
+        result.Succeeded = append(result.Succeeded, message.ReceiptHandle())
+    }
+    return result, nil
+}
+
+
+// Only call with mutex locked.
+func (s *Storage) segment(seq int64) (*segment, error) {
+    if seg, ok := s.segments[seq]; ok {
+        return seg, nil
+    }
+    seg := &segment{seq: seq, acked: make(map[int64]struct{}), records: -1}
+    data, err := os.ReadFile(acksPath(s.dir, seq))
+    if err != nil && !errors.Is(err, os.ErrNotExist) {
+        return nil, err
+    }
+    // A torn trailing offset was never fsynced, so its record wasn't reported removed.
+    for i := 0; i + 8 <= len(data); i += 8 {
+        seg.acked[int64(binary.LittleEndian.Uint64(data[i:i + 8]))] = struct{}{}
+    }
+    s.segments[seq] = seg
+    return seg, nil
+}
+
+
+// Only call with mutex locked. Deletes segment once all its records are removed.
+func (s *Storage) deleteIfRemoved(seg *segment) {
+    if seg.corrupt || seg.records < 0 || len(seg.acked) < seg.records {
+        return
+    }
+    if seg.acks != nil {
+        seg.acks.Close()
+    }
+    delete(s.segments, seg.seq)
+    // Segment goes first, acks without a segment are harmless.
+    if err := os.Remove(segmentPath(s.dir, seg.seq)); err != nil && !errors.Is(err, os.ErrNotExist) {
+        s.logger.Warn("Error deleting segment", "seq", seg.seq, "error", err)
+        return
+    }
+    if err := os.Remove(acksPath(s.dir, seg.seq)); err != nil && !errors.Is(err, os.ErrNotExist) {
+        s.logger.Warn("Error deleting segment acks", "seq", seg.seq, "error", err)
+    }
+    syncDir(s.dir)
+}
+
+
+// Only call with mutex locked. Returns next valid record of pass,
+// or nil once every segment has been read.
+func (s *Storage) nextRecord(ctx context.Context) (*Message, error) {
+    pass := s.pass
+    for pass.current < len(pass.seqs) {
+        seq := pass.seqs[pass.current]
+        if pass.file == nil {
+            file, err := os.Open(segmentPath(s.dir, seq))
+            if errors.Is(err, os.ErrNotExist) {
+                pass.current++
+                continue
+            }
+            if err != nil {
+                return nil, err
+            }
+            pass.file, pass.reader, pass.offset, pass.records = file, bufio.NewReader(file), 0, 0
+        }
+        seg, err := s.segment(seq)
+        if err != nil {
+            return nil, err
+        }
+        offset := pass.offset
+        payload, err := readRecord(pass.reader)
+        if err != nil {
+            if errors.Is(err, errTornRecord) {
+                s.logger.WarnContext(ctx, "Ignoring torn record at end of segment", "seq", seq, "offset", offset)
+            } else if !errors.Is(err, io.EOF) {
+                // Can't find the next record once a length can't be trusted.
+                s.logger.ErrorContext(ctx, "Segment is corrupt, keeping it and skipping records after offset", "seq", seq, "offset", offset, "error", err)
+                seg.corrupt = true
+            }
+            pass.file.Close()
+            pass.file = nil
+            pass.current++
+            seg.records = pass.records
+            s.deleteIfRemoved(seg)
+            continue
+        }
+        pass.offset += int64(headerLength + len(payload))
+        pass.records++
+        if _, ok := seg.acked[offset]; ok {
+            continue
+        }
+        handle := receiptHandle(seq, offset)
+        if loadedAt, ok := s.inflight[handle]; ok && time.Since(loadedAt) < s.visibilityTimeout {
+            continue
+        }
+        var r record
+        if err := json.Unmarshal(payload, &r); err != nil {
+            s.logger.WarnContext(ctx, "Skipping record that can't be decoded", "seq", seq, "offset", offset, "error", err)
+            continue
+        }
+        s.inflight[handle] = time.Now()
+        return &Message{record: r, receiptHandle: handle}, nil
+    }
+    return nil, nil
+}
+
+
+// Returns payload of next record, io.EOF at a clean end of segment.
+func readRecord(reader *bufio.Reader) ([]byte, error) {
+    header := make([]byte, headerLength)
+    if _, err := io.ReadFull(reader, header); err != nil {
+        if errors.Is(err, io.ErrUnexpectedEOF) {
+            return nil, errTornRecord
+        }
+        return nil, err
+    }
+    length := binary.LittleEndian.Uint32(header[0:4])
+    if length > maxRecordLength {
+        return nil, fmt.Errorf("record length %d too long", length)
+    }
+    payload := make([]byte, length)
+    if _, err := io.ReadFull(reader, payload); err != nil {
+        return nil, errTornRecord
+    }
+    if crc32.Checksum(payload, castagnoli) != binary.LittleEndian.Uint32(header[4:8]) {
+        return nil, errors.New("checksum mismatch")
+    }
+    return payload, nil
+}
+
+
+// Loads up to 10 records not yet removed, from segments written before
+// the current pass of loads started. Records loaded by an earlier pass
+// are skipped until their visibility timeout expires.
+func (s *Storage) LoadMessagesBatch(ctx context.Context) ([]dedup.QueueMessage, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.pass == nil {
+        s.sealWriter()
+        seqs, err := s.listSegments()
+        if err != nil {
+            return nil, fmt.Errorf("error listing segments: %w", err)
+        }
+        if len(seqs) == 0 {
+            return nil, nil
+        }
+        s.logger.DebugContext(ctx, "Loading messages from disk storage", "segments", len(seqs))
+        s.pass = &loadPass{seqs: seqs}
+    }
+    var messages []dedup.QueueMessage
+    for len(messages) < 10 {
+        message, err := s.nextRecord(ctx)
+        if err != nil {
+            return messages, fmt.Errorf("error reading segment: %w", err)
+        }
+        if message == nil {
+            s.pass = nil
+            break
+        }
+        messages = append(messages, *message)
+    }
+    return messages, nil
+}
+
+
+// Appends offsets of records to acks files and fsyncs them before
+// reporting records removed.
+func (s *Storage) RemoveMessagesBatch(ctx context.Context, receiptHandles []string) (dedup.BatchResult, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    var result dedup.BatchResult
+    offsets := make(map[*segment][]int64)
+    handles := make(map[*segment][]string)
+    for _, handle := range receiptHandles {
+        seq, offset, err := parseReceiptHandle(handle)
+        var seg *segment
+        if err == nil {
+            seg, err = s.segment(seq)
+        }
+        if err != nil {
+            result.Failed = append(result.Failed, dedup.BatchEntryFailure{
+                ReceiptHandle: handle,
+                Code: "InvalidReceiptHandle",
+                Message: err.Error(),
+                SenderFault: true,
+            })
+            continue
+        }
+        offsets[seg] = append(offsets[seg], offset)
+        handles[seg] = append(handles[seg], handle)
+    }
+    for seg, segOffsets := range offsets {
+        err := s.appendAcks(seg, segOffsets)
+        for _, handle := range handles[seg] {
+            if err != nil {
+                result.Failed = append(result.Failed, dedup.BatchEntryFailure{
+                    ReceiptHandle: handle,
+                    Code: "AckFailed",
+                    Message: err.Error(),
+                })
+                continue
+            }
+            delete(s.inflight, handle)
+            result.Succeeded = append(result.Succeeded, handle)
+        }
+        if err == nil {
+            s.deleteIfRemoved(seg)
+        }
+    }
+    return result, nil
+}
+
+
+// Only call with mutex locked.
+func (s *Storage) appendAcks(seg *segment, offsets []int64) error {
+    if seg.acks == nil {
+        file, err := os.OpenFile(acksPath(s.dir, seg.seq), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+        if err != nil {
+            return err
+        }
+        if err := syncDir(s.dir); err != nil {
+            file.Close()
+            return err
+        }
+        seg.acks = file
+    }
+    buffer := make([]byte, 0, 8 * len(offsets))
+    for _, offset := range offsets {
+        buffer = binary.LittleEndian.AppendUint64(buffer, uint64(offset))
+    }
+    if _, err := seg.acks.Write(buffer); err != nil {
+        return err
+    }
+    if err := seg.acks.Sync(); err != nil {
+        return err
+    }
+    for _, offset := range offsets {
+        seg.acked[offset] = struct{}{}
+    }
+    return nil
+}
+
+
+func (s *Storage) Close() error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.sealWriter()
+    if s.pass != nil && s.pass.file != nil {
+        s.pass.file.Close()
+    }
+    s.pass = nil
+    for _, seg := range s.segments {
+        if seg.acks != nil {
+            seg.acks.Close()
+            seg.acks = nil
+        }
+    }
+    return nil
+}
+
+
+func NewStorage(config *StorageConfig) (*Storage, error) {
+    if err := os.MkdirAll(config.Dir, 0o700); err != nil {
+        return nil, fmt.Errorf("error creating storage directory: %w", err)
+    }
+    visibilityTimeout := config.VisibilityTimeout
+    if visibilityTimeout <= 0 {
+        visibilityTimeout = 15 * time.Minute
+    }
+    s := &Storage{
+        dir: config.Dir,
+        visibilityTimeout: visibilityTimeout,
+        logger: dedup.WithRunID(config.Logger).With("storage_dir", config.Dir),
+        segments: make(map[int64]*segment),
+        inflight: make(map[string]time.Time),
+    }
+    seqs, err := s.listSegments()
+    if err != nil {
+        return nil, fmt.Errorf("error listing segments: %w", err)
+    }
+    if len(seqs) > 0 {
+        s.nextSeq = seqs[len(seqs) - 1] + 1
+        s.logger.Info("Found segments from previous run, restoring them on next load", "segments", len(seqs))
+    }
+    return s, nil
+}
@@ -0,0 +1,219 @@
+package disk
+
+
+import (
+    "context"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+    "github.com/IGVF-DACC/go-sqs-deduplication/internal/dedup"
+    "github.com/IGVF-DACC/go-sqs-deduplication/internal/memory"
+)
+
+
+func newTestStorage(t *testing.T, dir string) *Storage {
+    storage, err := NewStorage(&StorageConfig{Dir: dir})
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { storage.Close() })
+    return storage
+}
+
+
+func loadAll(t *testing.T, storage *Storage) []dedup.QueueMessage {
+    var loaded []dedup.QueueMessage
+    for {
+        messages, err := storage.LoadMessagesBatch(context.Background())
+        if err != nil {
+            t.Fatal(err)
+        }
+        if len(messages) == 0 {
+            return loaded
+        }
+        loaded = append(loaded, messages...)
+    }
+}
+
+
+func removeAll(t *testing.T, storage *Storage, messages []dedup.QueueMessage) {
+    var receiptHandles []string
+    for _, message := range messages {
+        receiptHandles = append(receiptHandles, message.ReceiptHandle())
+    }
+    result, err := storage.RemoveMessagesBatch(context.Background(), receiptHandles)
+    if err != nil || len(result.Failed) > 0 {
+        t.Fatalf("Unexpected remove failure %v %v", err, result.Failed)
+    }
+}
+
+
+func segmentFiles(t *testing.T, dir string) []string {
+    matches, err := filepath.Glob(filepath.Join(dir, "segment-*"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    return matches
+}
+
+
+func TestStorageRoundTrip(t *testing.T) {
+    dir := t.TempDir()
+    storage := newTestStorage(t, dir)
+    sentTime := time.UnixMilli(1700000000123)
+    message := memory.NewInMemoryMessage(
+        "abc",
+        `{"data": {"uuid": "abc"}}`,
+        sentTime,
+        map[string]string{"AWSTraceHeader": "Root=1-abc"},
+        map[string]dedup.MessageAttribute{"kind": {DataType: "String", StringValue: "invalidation"}},
+    )
+    result, err := storage.StoreMessagesBatch(context.Background(), []dedup.QueueMessage{message})
+    if err != nil || len(result.Succeeded) != 1 {
+        t.Fatalf("Unexpected store result %v %v", result, err)
+    }
+    loaded := loadAll(t, storage)
+    if len(loaded) != 1 {
+        t.Fatalf("Expected 1 message to be loaded, got %d", len(loaded))
+    }
+    restored := loaded[0]
+    if restored.UniqueID() != "abc" || restored.MessageID() != message.MessageID() || restored.RawBody() != message.RawBody() {
+        t.Errorf("Unexpected restored message %+v", restored)
+    }
+    if !restored.SentTime().Equal(sentTime) {
+        t.Errorf("Expected sent time %v, got %v", sentTime, restored.SentTime())
+    }
+    if restored.Attributes()["AWSTraceHeader"] != "Root=1-abc" || restored.MessageAttributes()["kind"].StringValue != "invalidation" {
+        t.Errorf("Expected attributes to be preserved, got %v %v", restored.Attributes(), restored.MessageAttributes())
+    }
+    if len(loadAll(t, storage)) != 0 {
+        t.Error("Expected loaded message not to be loaded again before it's removed")
+    }
+    removeAll(t, storage, loaded)
+    if files := segmentFiles(t, dir); len(files) != 0 {
+        t.Errorf("Expected segment to be deleted once all records were removed, got %v", files)
+    }
+}
+
+
+func TestStorageRecoversAfterCrash(t *testing.T) {
+    dir := t.TempDir()
+    storage := newTestStorage(t, dir)
+    messages := memory.GenerateInMemoryMessages(30)
+    for i := 0; i < len(messages); i += 10 {
+        if _, err := storage.StoreMessagesBatch(context.Background(), messages[i:i + 10]); err != nil {
+            t.Fatal(err)
+        }
+    }
+    loaded, err := storage.LoadMessagesBatch(context.Background())
+    if err != nil || len(loaded) != 10 {
+        t.Fatalf("Expected 10 messages to be loaded, got %d %v", len(loaded), err)
+    }
+    removeAll(t, storage, loaded)
+    storage.Close()
+    // Crash while appending the next batch leaves a partial record behind.
+    files, _ := filepath.Glob(filepath.Join(dir, "segment-*.log"))
+    segment, err := os.OpenFile(files[0], os.O_WRONLY|os.O_APPEND, 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    segment.Write([]byte{200, 0, 0, 0, 1, 2, 3, 4, '{', '"'})
+    segment.Close()
+    recovered := newTestStorage(t, dir)
+    reloaded := loadAll(t, recovered)
+    if len(reloaded) != 20 {
+        t.Fatalf("Expected 20 messages not yet removed to be loaded, got %d", len(reloaded))
+    }
+    for _, message := range reloaded {
+        for _, removed := range loaded {
+            if message.MessageID() == removed.MessageID() {
+                t.Errorf("Removed message %s loaded again", message.MessageID())
+            }
+        }
+    }
+    removeAll(t, recovered, reloaded)
+    if files := segmentFiles(t, dir); len(files) != 0 {
+        t.Errorf("Expected segment with torn record to be deleted once all records were removed, got %v", files)
+    }
+}
+
+
+func TestStorageKeepsCorruptSegment(t *testing.T) {
+    dir := t.TempDir()
+    storage := newTestStorage(t, dir)
+    if _, err := storage.StoreMessagesBatch(context.Background(), memory.GenerateInMemoryMessages(3)); err != nil {
+        t.Fatal(err)
+    }
+    storage.Close()
+    files, _ := filepath.Glob(filepath.Join(dir, "segment-*.log"))
+    data, err := os.ReadFile(files[0])
+    if err != nil {
+        t.Fatal(err)
+    }
+    // Flip a byte in the payload of the last record.
+    data[len(data) - 2] ^= 0xff
+    if err := os.WriteFile(files[0], data, 0o600); err != nil {
+        t.Fatal(err)
+    }
+    recovered := newTestStorage(t, dir)
+    loaded := loadAll(t, recovered)
+    if len(loaded) != 2 {
+        t.Fatalf("Expected 2 valid messages to be loaded, got %d", len(loaded))
+    }
+    removeAll(t, recovered, loaded)
+    if _, err := os.Stat(files[0]); err != nil {
+        t.Errorf("Expected corrupt segment to be kept, got %v", err)
+    }
+}
+
+
+func TestStorageReloadsAfterVisibilityTimeout(t *testing.T) {
+    storage, err := NewStorage(&StorageConfig{Dir: t.TempDir(), VisibilityTimeout: time.Millisecond})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer storage.Close()
+    if _, err := storage.StoreMessagesBatch(context.Background(), memory.GenerateInMemoryMessages(5)); err != nil {
+        t.Fatal(err)
+    }
+    if len(loadAll(t, storage)) != 5 {
+        t.Fatal("Expected 5 messages to be loaded")
+    }
+    time.Sleep(5 * time.Millisecond)
+    if len(loadAll(t, storage)) != 5 {
+        t.Error("Expected messages never removed to be loaded again")
+    }
+}
+
+
+func TestDeduplicatorWithDiskStorage(t *testing.T) {
+    dir := t.TempDir()
+    storage := newTestStorage(t, dir)
+    inMemoryQueue := memory.NewInMemoryQueue(10)
+    inMemoryQueue.AddMessages(memory.GenerateInMemoryMessages(3000))
+    inMemoryQueue.AddMessages(memory.MakeDuplicateInMemoryMessages("abc", 5000))
+    config := &dedup.DeduplicatorConfig{
+        Queue: inMemoryQueue,
+        Storage: storage,
+        NumWorkers: 30,
+        MaxInflight: 500,
+        TimeLimitInSeconds: 240,
+    }
+    report, err := dedup.NewDeduplicator(config).Run(context.Background())
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(inMemoryQueue.GetDeletedMessages()) != 8000 {
+        t.Errorf("Expected 8000 messages to be deleted, got %d", len(inMemoryQueue.GetDeletedMessages()))
+    }
+    if inMemoryQueue.MessagesLen() != 3001 {
+        t.Errorf("Expected 3001 messages to be on queue, got %d", inMemoryQueue.MessagesLen())
+    }
+    if report.MessagesRestoredFromStorage != 3001 {
+        t.Errorf("Expected 3001 messages to be restored, got %d", report.MessagesRestoredFromStorage)
+    }
+    if files := segmentFiles(t, dir); len(files) != 0 {
+        t.Errorf("Expected no segments left after restoring, got %v", files)
+    }
+}
@@ -0,0 +1,267 @@
+package fault
+
+
+import (
+    "context"
+    "errors"
+    "math/rand"
+    "sync"
+    "time"
+    "github.com/IGVF-DACC/go-sqs-deduplication/internal/dedup"
+)
+
+
+type Operation string
+
+
+const (
+    Receive Operation = "receive"
+    Delete Operation = "delete"
+    Reset Operation = "reset"
+    ChangeVisibility Operation = "change"
+    Put Operation = "put"
+)
+
+
+// Returned by calls failed by a fault without an Error of its own.
+var ErrInjected = errors.New("injected fault")
+
+
+// Most recently received messages kept around for duplicate deliveries.
+const maxRedeliverable = 100
+
+
+// Fault injected into one call, counted per operation from 1.
+type Fault struct {
+    Operation Operation
+    Call int
+    Error error // Whole call fails with this if not nil.
+    FailEntries int // First entries of a batch that fail, the rest go through.
+    Latency time.Duration
+    Empty bool // Receive returns no messages, whether or not any exist.
+    Duplicate bool // Receive also returns a message it returned before.
+}
+
+
+// Faults by probability apply to every call on top of scripted ones.
+type Config struct {
+    Seed int64
+    ReceiveErrorRate float64
+    EmptyReceiveRate float64
+    DuplicateDeliveryRate float64 // Per receive, of returning a message received before again.
+    EntryFailureRate float64 // Per entry of delete, reset, change visibility and put batches.
+    MaxLatency time.Duration // Each call is delayed up to this long.
+    Script []Fault
+}
+
+
+// Counts of injected faults.
+type Stats struct {
+    ReceiveErrors int
+    EmptyReceives int
+    DuplicateDeliveries int
+    FailedEntries int
+    FailedCalls int
+}
+
+
+// Queue decorator injecting the ways SQS misbehaves. Failed entries are
+// never passed on, so they really didn't happen, and fail without sender
+// fault so they're retried like throttled entries.
+type Queue struct {
+    queue dedup.Queue
+    config Config
+    mu sync.Mutex
+    random *rand.Rand
+    calls map[Operation]int
+    received []dedup.QueueMessage
+    stats Stats
+}
+
+
+func NewQueue(queue dedup.Queue, config *Config) *Queue {
+    return &Queue{
+        queue: queue,
+        config: *config,
+        random: rand.New(rand.NewSource(config.Seed)),
+        calls: make(map[Operation]int),
+    }
+}
+
+
+// Scripted fault of this call, merged with faults by probability.
+func (q *Queue) nextFault(operation Operation) Fault {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    q.calls[operation]++
+    fault := Fault{Operation: operation, Call: q.calls[operation]}
+    for _, scripted := range q.config.Script {
+        if scripted.Operation == operation && scripted.Call == fault.Call {
+            fault = scripted
+        }
+    }
+    if q.config.MaxLatency > 0 {
+        fault.Latency += time.Duration(q.random.Int63n(int64(q.config.MaxLatency)))
+    }
+    if operation == Receive {
+        if fault.Error == nil && q.random.Float64() < q.config.ReceiveErrorRate {
+            fault.Error = ErrInjected
+        }
+        fault.Empty = fault.Empty || q.random.Float64() < q.config.EmptyReceiveRate
+        fault.Duplicate = fault.Duplicate || q.random.Float64() < q.config.DuplicateDeliveryRate
+    }
+    return fault
+}
+
+
+func (q *Queue) delay(ctx context.Context, fault Fault) error {
+    if fault.Latency <= 0 {
+        return nil
+    }
+    select {
+    case <-time.After(fault.Latency):
+        return nil
+    case <-ctx.Done():
+        return ctx.Err()
+    }
+}
+
+
+// Splits entries into ones passed on and ones failed by fault.
+func (q *Queue) failEntries(fault Fault, size int) []bool {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    failed := make([]bool, size)
+    for i := range failed {
+        failed[i] = i < fault.FailEntries || q.random.Float64() < q.config.EntryFailureRate
+        if failed[i] {
+            q.stats.FailedEntries++
+        }
+    }
+    return failed
+}
+
+
+func injectedFailure(receiptHandle string) dedup.BatchEntryFailure {
+    return dedup.BatchEntryFailure{
+        ReceiptHandle: receiptHandle,
+        Code: "InternalError",
+        Message: ErrInjected.Error(),
+    }
+}
+
+
+func (q *Queue) failCall(fault Fault) error {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    q.stats.FailedCalls++
+    return fault.Error
+}
+
+
+func (q *Queue) PullMessagesBatch(ctx context.Context) ([]dedup.QueueMessage, error) {
+    fault := q.nextFault(Receive)
+    if err := q.delay(ctx, fault); err != nil {
+        return nil, err
+    }
+    if fault.Error != nil {
+        q.mu.Lock()
+        q.stats.ReceiveErrors++
+        q.mu.Unlock()
+        return nil, fault.Error
+    }
+    var messages []dedup.QueueMessage
+    if fault.Empty {
+        q.mu.Lock()
+        q.stats.EmptyReceives++
+        q.mu.Unlock()
+    } else {
+        var err error
+        messages, err = q.queue.PullMessagesBatch(ctx)
+        if err != nil {
+            return nil, err
+        }
+    }
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    if fault.Duplicate && len(q.received) > 0 {
+        messages = append(messages, q.received[q.random.Intn(len(q.received))])
+        q.stats.DuplicateDeliveries++
+    }
+    q.received = append(q.received, messages...)
+    if len(q.received) > maxRedeliverable {
+        q.received = q.received[len(q.received) - maxRedeliverable:]
+    }
+    return messages, nil
+}
+
+
+// Passes entries not failed by fault on to call.
+func batchWithFaults[T any](q *Queue, ctx context.Context, operation Operation, entries []T, receiptHandle func(T) string, call func([]T) (dedup.BatchResult, error)) (dedup.BatchResult, error) {
+    fault := q.nextFault(operation)
+    if err := q.delay(ctx, fault); err != nil {
+        return dedup.BatchResult{}, err
+    }
+    if fault.Error != nil {
+        return dedup.BatchResult{}, q.failCall(fault)
+    }
+    var passed []T
+    var result dedup.BatchResult
+    for i, failed := range q.failEntries(fault, len(entries)) {
+        if failed {
+            result.Failed = append(result.Failed, injectedFailure(receiptHandle(entries[i])))
+        } else {
+            passed = append(passed, entries[i])
+        }
+    }
+    if len(passed) == 0 {
+        return result, nil
+    }
+    passedResult, err := call(passed)
+    if err != nil {
+        return dedup.BatchResult{}, err
+    }
+    result.Succeeded = append(result.Succeeded, passedResult.Succeeded...)
+    result.Failed = append(result.Failed, passedResult.Failed...)
+    return result, nil
+}
+
+
+func identity(receiptHandle string) string {
+    return receiptHandle
+}
+
+
+func (q *Queue) DeleteMessagesBatch(ctx context.Context, receiptHandles []string) (dedup.BatchResult, error) {
+    return batchWithFaults(q, ctx, Delete, receiptHandles, identity, func(receiptHandles []string) (dedup.BatchResult, error) {
+        return q.queue.DeleteMessagesBatch(ctx, receiptHandles)
+    })
+}
+
+
+func (q *Queue) ResetVisibilityBatch(ctx context.Context, receiptHandles []string) (dedup.BatchResult, error) {
+    return batchWithFaults(q, ctx, Reset, receiptHandles, identity, func(receiptHandles []string) (dedup.BatchResult, error) {
+        return q.queue.ResetVisibilityBatch(ctx, receiptHandles)
+    })
+}
+
+
+func (q *Queue) ChangeVisibilityBatch(ctx context.Context, receiptHandles []string, visibilityTimeout time.Duration) (dedup.BatchResult, error) {
+    return batchWithFaults(q, ctx, ChangeVisibility, receiptHandles, identity, func(receiptHandles []string) (dedup.BatchResult, error) {
+        return q.queue.ChangeVisibilityBatch(ctx, receiptHandles, visibilityTimeout)
+    })
+}
+
+
+func (q *Queue) PutMessagesBatch(ctx context.Context, messages []dedup.QueueMessage) (dedup.BatchResult, error) {
+    return batchWithFaults(q, ctx, Put, messages, dedup.QueueMessage.ReceiptHandle, func(messages []dedup.QueueMessage) (dedup.BatchResult, error) {
+        return q.queue.PutMessagesBatch(ctx, messages)
+    })
+}
+
+
+func (q *Queue) Stats() Stats {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    return q.stats
+}
@@ -0,0 +1,60 @@
+package fault
+
+
+import (
+    "context"
+    "testing"
+    "time"
+    "github.com/IGVF-DACC/go-sqs-deduplication/internal/memory"
+)
+
+
+func TestQueueInjectsScriptedFaults(t *testing.T) {
+    queue := memory.NewSimulatedQueue(&memory.SimulatedQueueConfig{Clock: memory.NewManualClock(time.Now())})
+    queue.AddMessages(memory.GenerateInMemoryMessages(30))
+    faulty := NewQueue(queue, &Config{
+        Script: []Fault{
+            {Operation: Receive, Call: 1, Error: ErrInjected},
+            {Operation: Receive, Call: 2, Empty: true},
+            {Operation: Receive, Call: 4, Duplicate: true},
+            {Operation: Delete, Call: 1, FailEntries: 3},
+        },
+    })
+    ctx := context.Background()
+    if _, err := faulty.PullMessagesBatch(ctx); err != ErrInjected {
+        t.Errorf("Expected injected receive error, got %v", err)
+    }
+    if messages, _ := faulty.PullMessagesBatch(ctx); len(messages) != 0 {
+        t.Errorf("Expected empty receive, got %d messages", len(messages))
+    }
+    first, _ := faulty.PullMessagesBatch(ctx)
+    second, _ := faulty.PullMessagesBatch(ctx)
+    if len(first) != 10 || len(second) != 11 {
+        t.Fatalf("Expected 10 messages and 10 plus a duplicate, got %d and %d", len(first), len(second))
+    }
+    seen := make(map[string]struct{})
+    for _, message := range first {
+        seen[message.MessageID()] = struct{}{}
+    }
+    if _, ok := seen[second[10].MessageID()]; !ok {
+        t.Error("Expected duplicate delivery of a message received before")
+    }
+    var receiptHandles []string
+    for _, message := range first {
+        receiptHandles = append(receiptHandles, message.ReceiptHandle())
+    }
+    result, err := faulty.DeleteMessagesBatch(ctx, receiptHandles)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(result.Failed) != 3 || len(result.Succeeded) != 7 {
+        t.Errorf("Expected 3 failed and 7 deleted, got %d and %d", len(result.Failed), len(result.Succeeded))
+    }
+    if len(queue.GetDeletedMessages()) != 7 {
+        t.Errorf("Expected failed entries not to be passed on, got %d deleted", len(queue.GetDeletedMessages()))
+    }
+    stats := faulty.Stats()
+    if stats.ReceiveErrors != 1 || stats.EmptyReceives != 1 || stats.DuplicateDeliveries != 1 || stats.FailedEntries != 3 {
+        t.Errorf("Unexpected stats %+v", stats)
+    }
+}
@@ -4,6 +4,7 @@ package memory
 import (
     "fmt"
     "math/rand"
+    "time"
     "github.com/IGVF-DACC/go-sqs-deduplication/internal/dedup"
 )
 
@@ -13,6 +14,9 @@ type InMemoryQueueMessage struct {
     messageID     string
     receiptHandle string
     rawBody string
+    sentTime time.Time
+    attributes map[string]string
+    messageAttributes map[string]dedup.MessageAttribute
 }
 
 
@@ -36,6 +40,34 @@ func (m InMemoryQueueMessage) RawBody() string {
 }
 
 
+func (m InMemoryQueueMessage) SentTime() time.Time {
+    return m.sentTime
+}
+
+
+func (m InMemoryQueueMessage) Attributes() map[string]string {
+    return m.attributes
+}
+
+
+func (m InMemoryQueueMessage) MessageAttributes() map[string]dedup.MessageAttribute {
+    return m.messageAttributes
+}
+
+
+func NewInMemoryMessage(uniqueID string, rawBody string, sentTime time.Time, attributes map[string]string, messageAttributes map[string]dedup.MessageAttribute) dedup.QueueMessage {
+    return InMemoryQueueMessage{
+        uniqueID:      uniqueID,
+        messageID:     fmt.Sprintf("msg-%d", rand.Int()),
+        receiptHandle: fmt.Sprintf("receipt-%d", rand.Int()),
+        rawBody: rawBody,
+        sentTime: sentTime,
+        attributes: attributes,
+        messageAttributes: messageAttributes,
+    }
+}
+
+
 func GenerateInMemoryMessages(numMessages int) []dedup.QueueMessage {
     var messages []dedup.QueueMessage
     for i := 1; i <= numMessages; i++ {
@@ -48,6 +80,7 @@ func GenerateInMemoryMessages(numMessages int) []dedup.QueueMessage {
             messageID:     messageID,
             receiptHandle: receiptHandle,
             rawBody: rawBody,
+            sentTime: time.Now(),
         }
         messages = append(messages, message)
     }
@@ -66,6 +99,7 @@ func MakeDuplicateInMemoryMessages(uniqueID string, numMessages int) []dedup.Que
             messageID:     messageID,
             receiptHandle: receiptHandle,
             rawBody: rawBody,
+            sentTime: time.Now(),
         }
         messages = append(messages, message)
     }
@@ -2,7 +2,9 @@ package memory
 
 
 import (
+    "context"
     "sync"
+    "time"
     "github.com/IGVF-DACC/go-sqs-deduplication/internal/dedup"
 )
 
@@ -12,6 +14,7 @@ type InMemoryQueue struct {
     messages []dedup.QueueMessage
     deletedMessages []string
     resetMessages []string
+    extendedMessages []string
     mu sync.Mutex
     nextID int
     maxBatchSize int
@@ -35,7 +38,7 @@ func (q *InMemoryQueue) AddMessages(messages []dedup.QueueMessage) {
 }
 
 
-func (q *InMemoryQueue) PullMessagesBatch() ([]dedup.QueueMessage, error) {
+func (q *InMemoryQueue) PullMessagesBatch(ctx context.Context) ([]dedup.QueueMessage, error) {
     q.mu.Lock()
     defer q.mu.Unlock()
     var batch []dedup.QueueMessage
@@ -48,7 +51,7 @@ func (q *InMemoryQueue) PullMessagesBatch() ([]dedup.QueueMessage, error) {
 }
 
 
-func (q *InMemoryQueue) DeleteMessagesBatch(receiptHandles []string) {
+func (q *InMemoryQueue) DeleteMessagesBatch(ctx context.Context, receiptHandles []string) (dedup.BatchResult, error) {
     q.mu.Lock()
     defer q.mu.Unlock()
     receiptHandleSet := make(map[string]struct{})
@@ -63,21 +66,35 @@ func (q *InMemoryQueue) DeleteMessagesBatch(receiptHandles []string) {
         }
     }
     q.messages = filteredMessages
+    return dedup.BatchResult{Succeeded: receiptHandles}, nil
 }
 
 
-func (q *InMemoryQueue) ResetVisibilityBatch(receiptHandles []string) {
+func (q *InMemoryQueue) ResetVisibilityBatch(ctx context.Context, receiptHandles []string) (dedup.BatchResult, error) {
     q.mu.Lock()
     defer q.mu.Unlock()
     q.resetMessages = append(q.resetMessages, receiptHandles...)
+    return dedup.BatchResult{Succeeded: receiptHandles}, nil
 }
 
 
-func (q *InMemoryQueue) PutMessagesBatch(messages []dedup.QueueMessage) error {
+func (q *InMemoryQueue) ChangeVisibilityBatch(ctx context.Context, receiptHandles []string, visibilityTimeout time.Duration) (dedup.BatchResult, error) {
     q.mu.Lock()
     defer q.mu.Unlock()
+    q.extendedMessages = append(q.extendedMessages, receiptHandles...)
+    return dedup.BatchResult{Succeeded: receiptHandles}, nil
+}
+
+
+func (q *InMemoryQueue) PutMessagesBatch(ctx context.Context, messages []dedup.QueueMessage) (dedup.BatchResult, error) {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    var result dedup.BatchResult
+    for _, message := range messages {
+        result.Succeeded = append(result.Succeeded, message.ReceiptHandle())
+    }
     q.messages = append(q.messages, messages...)
-    return nil
+    return result, nil
 }
 
 
@@ -95,6 +112,13 @@ func (q *InMemoryQueue) GetResetMessages() []string {
 }
 
 
+func (q *InMemoryQueue) GetExtendedMessages() []string {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    return q.extendedMessages
+}
+
+
 func (q *InMemoryQueue) MessagesLen() int {
     q.mu.Lock()
     defer q.mu.Unlock()
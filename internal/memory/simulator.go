@@ -0,0 +1,438 @@
+package memory
+
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "math/rand"
+    "strconv"
+    "sync"
+    "time"
+    "github.com/IGVF-DACC/go-sqs-deduplication/internal/dedup"
+)
+
+
+// Limits of a standard SQS queue.
+const (
+    DefaultSimulatedVisibilityTimeout = 30 * time.Second
+    DefaultSimulatedMaxInflight = 120000
+    maxSimulatedBatchSize = 10
+    maxSimulatedVisibilityTimeout = 12 * time.Hour
+)
+
+
+// Returned by PullMessagesBatch once MaxInflight messages are inflight, like SQS's OverLimit.
+var ErrOverLimit = errors.New("OverLimit: too many messages inflight")
+
+
+var errEmptyBatch = errors.New("EmptyBatchRequest: batch request doesn't contain any entries")
+
+
+var errTooManyEntries = errors.New("TooManyEntriesInBatchRequest: batch request contains more than 10 entries")
+
+
+type Clock interface {
+    Now() time.Time
+}
+
+
+type realClock struct{}
+
+
+func (realClock) Now() time.Time {
+    return time.Now()
+}
+
+
+// Clock that only moves when told to, so tests control when visibility expires.
+type ManualClock struct {
+    mu sync.Mutex
+    now time.Time
+}
+
+
+func (c *ManualClock) Now() time.Time {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return c.now
+}
+
+
+func (c *ManualClock) Advance(d time.Duration) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.now = c.now.Add(d)
+}
+
+
+func NewManualClock(now time.Time) *ManualClock {
+    return &ManualClock{now: now}
+}
+
+
+type SimulatedQueueConfig struct {
+    Clock Clock // Uses real time if nil.
+    VisibilityTimeout time.Duration // Of received messages, uses DefaultSimulatedVisibilityTimeout if zero.
+    MaxBatchSize int // Messages returned per receive, at most 10.
+    MaxInflight int // Receives fail with ErrOverLimit at this many inflight messages, uses DefaultSimulatedMaxInflight if zero.
+    RedeliveryRate float64 // Fraction of receives that leave the message visible, so it's delivered again.
+    Seed int64 // Of the order messages and batch results are returned in.
+}
+
+
+type simulatedMessage struct {
+    message InMemoryQueueMessage
+    visibleAt time.Time
+    receiptHandle string // Of the latest receive, earlier ones are stale.
+    receiveCount int
+}
+
+
+// Queue with the semantics of a standard SQS queue that matter to the
+// deduplicator. Received messages are hidden for the visibility timeout
+// and then delivered again with a new receipt handle, receives return
+// messages in no particular order and fail once too many are inflight,
+// and batch results are shuffled. Deleting with a stale receipt handle
+// succeeds without deleting the message, changing visibility with one
+// fails. Put messages get a new message ID but keep their sent time,
+// like sqs.Queue does through a message attribute.
+type SimulatedQueue struct {
+    mu sync.Mutex
+    config SimulatedQueueConfig
+    clock Clock
+    random *rand.Rand
+    messages []*simulatedMessage
+    index map[string]int // Position in messages by message ID.
+    receiptHandles map[string]string // Message ID of every receipt handle ever handed out.
+    deletedMessages []string
+    resetMessages []string
+    extendedMessages []string
+    nextID int
+    peakInflight int
+}
+
+
+func NewSimulatedQueue(config *SimulatedQueueConfig) *SimulatedQueue {
+    q := &SimulatedQueue{
+        config: *config,
+        clock: config.Clock,
+        random: rand.New(rand.NewSource(config.Seed)),
+        index: make(map[string]int),
+        receiptHandles: make(map[string]string),
+    }
+    if q.clock == nil {
+        q.clock = realClock{}
+    }
+    if q.config.VisibilityTimeout <= 0 {
+        q.config.VisibilityTimeout = DefaultSimulatedVisibilityTimeout
+    }
+    if q.config.MaxBatchSize <= 0 || q.config.MaxBatchSize > maxSimulatedBatchSize {
+        q.config.MaxBatchSize = maxSimulatedBatchSize
+    }
+    if q.config.MaxInflight <= 0 {
+        q.config.MaxInflight = DefaultSimulatedMaxInflight
+    }
+    return q
+}
+
+
+// Only call with lock held.
+func (q *SimulatedQueue) add(message InMemoryQueueMessage) {
+    message.receiptHandle = ""
+    q.index[message.messageID] = len(q.messages)
+    q.messages = append(q.messages, &simulatedMessage{message: message})
+}
+
+
+// Adds messages as they are, keeping their message IDs.
+func (q *SimulatedQueue) AddMessages(messages []dedup.QueueMessage) {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    for _, message := range messages {
+        q.add(toInMemoryMessage(message, message.MessageID()))
+    }
+}
+
+
+func toInMemoryMessage(message dedup.QueueMessage, messageID string) InMemoryQueueMessage {
+    return InMemoryQueueMessage{
+        uniqueID: message.UniqueID(),
+        messageID: messageID,
+        rawBody: message.RawBody(),
+        sentTime: message.SentTime(),
+        attributes: message.Attributes(),
+        messageAttributes: message.MessageAttributes(),
+    }
+}
+
+
+// Only call with lock held.
+func (q *SimulatedQueue) remove(messageID string) {
+    i := q.index[messageID]
+    last := len(q.messages) - 1
+    q.messages[i] = q.messages[last]
+    q.index[q.messages[i].message.messageID] = i
+    q.messages = q.messages[:last]
+    delete(q.index, messageID)
+}
+
+
+// Only call with lock held.
+func (q *SimulatedQueue) inflightLen(now time.Time) int {
+    inflight := 0
+    for _, message := range q.messages {
+        if message.visibleAt.After(now) {
+            inflight++
+        }
+    }
+    return inflight
+}
+
+
+func (q *SimulatedQueue) PullMessagesBatch(ctx context.Context) ([]dedup.QueueMessage, error) {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    now := q.clock.Now()
+    inflight := q.inflightLen(now)
+    if inflight >= q.config.MaxInflight {
+        return nil, ErrOverLimit
+    }
+    var batch []dedup.QueueMessage
+    if len(q.messages) == 0 {
+        return batch, nil
+    }
+    // Visible messages from a random starting point, then shuffled.
+    start := q.random.Intn(len(q.messages))
+    for i := 0; i < len(q.messages) && len(batch) < q.config.MaxBatchSize && inflight < q.config.MaxInflight; i++ {
+        message := q.messages[(start + i) % len(q.messages)]
+        if message.visibleAt.After(now) {
+            continue
+        }
+        q.nextID++
+        message.receiptHandle = fmt.Sprintf("%s-receipt-%d", message.message.messageID, q.nextID)
+        message.receiveCount++
+        q.receiptHandles[message.receiptHandle] = message.message.messageID
+        if q.random.Float64() >= q.config.RedeliveryRate {
+            message.visibleAt = now.Add(q.config.VisibilityTimeout)
+            inflight++
+        }
+        received := message.message
+        received.receiptHandle = message.receiptHandle
+        received.attributes = make(map[string]string, len(message.message.attributes) + 1)
+        for name, value := range message.message.attributes {
+            received.attributes[name] = value
+        }
+        received.attributes["ApproximateReceiveCount"] = strconv.Itoa(message.receiveCount)
+        batch = append(batch, received)
+    }
+    q.random.Shuffle(len(batch), func(i, j int) {
+        batch[i], batch[j] = batch[j], batch[i]
+    })
+    q.peakInflight = max(q.peakInflight, inflight)
+    return batch, nil
+}
+
+
+func checkBatchSize(size int) error {
+    if size == 0 {
+        return errEmptyBatch
+    }
+    if size > maxSimulatedBatchSize {
+        return errTooManyEntries
+    }
+    return nil
+}
+
+
+func invalidReceiptHandle(receiptHandle string, code string) dedup.BatchEntryFailure {
+    return dedup.BatchEntryFailure{
+        ReceiptHandle: receiptHandle,
+        Code: code,
+        Message: "The receipt handle provided is not valid",
+        SenderFault: true,
+    }
+}
+
+
+// Only call with lock held.
+func (q *SimulatedQueue) shuffle(result dedup.BatchResult) dedup.BatchResult {
+    q.random.Shuffle(len(result.Succeeded), func(i, j int) {
+        result.Succeeded[i], result.Succeeded[j] = result.Succeeded[j], result.Succeeded[i]
+    })
+    q.random.Shuffle(len(result.Failed), func(i, j int) {
+        result.Failed[i], result.Failed[j] = result.Failed[j], result.Failed[i]
+    })
+    return result
+}
+
+
+func (q *SimulatedQueue) DeleteMessagesBatch(ctx context.Context, receiptHandles []string) (dedup.BatchResult, error) {
+    if err := checkBatchSize(len(receiptHandles)); err != nil {
+        return dedup.BatchResult{}, err
+    }
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    var result dedup.BatchResult
+    for _, receiptHandle := range receiptHandles {
+        messageID, ok := q.receiptHandles[receiptHandle]
+        if !ok {
+            result.Failed = append(result.Failed, invalidReceiptHandle(receiptHandle, "ReceiptHandleIsInvalid"))
+            continue
+        }
+        // Deleting an already deleted message, or with a stale receipt handle, still succeeds.
+        if i, exists := q.index[messageID]; exists && q.messages[i].receiptHandle == receiptHandle {
+            q.remove(messageID)
+            q.deletedMessages = append(q.deletedMessages, receiptHandle)
+        }
+        result.Succeeded = append(result.Succeeded, receiptHandle)
+    }
+    return q.shuffle(result), nil
+}
+
+
+func (q *SimulatedQueue) changeVisibility(receiptHandles []string, visibilityTimeout time.Duration) (dedup.BatchResult, error) {
+    if err := checkBatchSize(len(receiptHandles)); err != nil {
+        return dedup.BatchResult{}, err
+    }
+    if visibilityTimeout < 0 || visibilityTimeout > maxSimulatedVisibilityTimeout {
+        return dedup.BatchResult{}, fmt.Errorf("InvalidParameterValue: visibility timeout %s out of range", visibilityTimeout)
+    }
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    now := q.clock.Now()
+    var result dedup.BatchResult
+    for _, receiptHandle := range receiptHandles {
+        messageID, ok := q.receiptHandles[receiptHandle]
+        i, exists := q.index[messageID]
+        switch {
+        case !ok || !exists || q.messages[i].receiptHandle != receiptHandle:
+            result.Failed = append(result.Failed, invalidReceiptHandle(receiptHandle, "ReceiptHandleIsInvalid"))
+        case !q.messages[i].visibleAt.After(now):
+            result.Failed = append(result.Failed, invalidReceiptHandle(receiptHandle, "MessageNotInflight"))
+        default:
+            q.messages[i].visibleAt = now.Add(visibilityTimeout)
+            result.Succeeded = append(result.Succeeded, receiptHandle)
+        }
+    }
+    return q.shuffle(result), nil
+}
+
+
+func (q *SimulatedQueue) ChangeVisibilityBatch(ctx context.Context, receiptHandles []string, visibilityTimeout time.Duration) (dedup.BatchResult, error) {
+    result, err := q.changeVisibility(receiptHandles, visibilityTimeout)
+    q.mu.Lock()
+    q.extendedMessages = append(q.extendedMessages, result.Succeeded...)
+    q.mu.Unlock()
+    return result, err
+}
+
+
+func (q *SimulatedQueue) ResetVisibilityBatch(ctx context.Context, receiptHandles []string) (dedup.BatchResult, error) {
+    result, err := q.changeVisibility(receiptHandles, 0)
+    q.mu.Lock()
+    q.resetMessages = append(q.resetMessages, result.Succeeded...)
+    q.mu.Unlock()
+    return result, err
+}
+
+
+func (q *SimulatedQueue) PutMessagesBatch(ctx context.Context, messages []dedup.QueueMessage) (dedup.BatchResult, error) {
+    if err := checkBatchSize(len(messages)); err != nil {
+        return dedup.BatchResult{}, err
+    }
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    var result dedup.BatchResult
+    for _, message := range messages {
+        q.nextID++
+        put := toInMemoryMessage(message, fmt.Sprintf("simulated-%d", q.nextID))
+        if put.sentTime.IsZero() {
+            put.sentTime = q.clock.Now()
+        }
+        q.add(put)
+        result.Succeeded = append(result.Succeeded, message.ReceiptHandle())
+    }
+    return q.shuffle(result), nil
+}
+
+
+// Messages not yet deleted, visible or inflight.
+func (q *SimulatedQueue) MessagesLen() int {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    return len(q.messages)
+}
+
+
+func (q *SimulatedQueue) VisibleLen() int {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    return len(q.messages) - q.inflightLen(q.clock.Now())
+}
+
+
+func (q *SimulatedQueue) InflightLen() int {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    return q.inflightLen(q.clock.Now())
+}
+
+
+// Latest receipt handles of messages still inflight.
+func (q *SimulatedQueue) InflightReceiptHandles() []string {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    now := q.clock.Now()
+    var receiptHandles []string
+    for _, message := range q.messages {
+        if message.visibleAt.After(now) {
+            receiptHandles = append(receiptHandles, message.receiptHandle)
+        }
+    }
+    return receiptHandles
+}
+
+
+// Most messages inflight at once, as of the end of a receive.
+func (q *SimulatedQueue) PeakInflight() int {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    return q.peakInflight
+}
+
+
+// Copies left on queue of every unique ID.
+func (q *SimulatedQueue) UniqueIDCounts() map[string]int {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    counts := make(map[string]int)
+    for _, message := range q.messages {
+        counts[message.message.uniqueID]++
+    }
+    return counts
+}
+
+
+// Receipt handles that deleted a message.
+func (q *SimulatedQueue) GetDeletedMessages() []string {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    return q.deletedMessages
+}
+
+
+// Receipt handles whose visibility was reset.
+func (q *SimulatedQueue) GetResetMessages() []string {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    return q.resetMessages
+}
+
+
+// Receipt handles whose visibility was changed.
+func (q *SimulatedQueue) GetExtendedMessages() []string {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    return q.extendedMessages
+}
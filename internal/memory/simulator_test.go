@@ -0,0 +1,136 @@
+package memory
+
+
+import (
+    "context"
+    "errors"
+    "testing"
+    "time"
+    "github.com/IGVF-DACC/go-sqs-deduplication/internal/dedup"
+)
+
+
+func newTestSimulatedQueue(config *SimulatedQueueConfig) (*SimulatedQueue, *ManualClock) {
+    clock := NewManualClock(time.Now())
+    config.Clock = clock
+    return NewSimulatedQueue(config), clock
+}
+
+
+func receiptHandles(messages []dedup.QueueMessage) []string {
+    var receiptHandles []string
+    for _, message := range messages {
+        receiptHandles = append(receiptHandles, message.ReceiptHandle())
+    }
+    return receiptHandles
+}
+
+
+func TestSimulatedQueueDeliversAgainOnceVisibilityExpires(t *testing.T) {
+    queue, clock := newTestSimulatedQueue(&SimulatedQueueConfig{})
+    queue.AddMessages(GenerateInMemoryMessages(5))
+    ctx := context.Background()
+    first, _ := queue.PullMessagesBatch(ctx)
+    if len(first) != 5 || queue.InflightLen() != 5 || queue.VisibleLen() != 0 {
+        t.Fatalf("Expected 5 messages received and inflight, got %d received and %d inflight", len(first), queue.InflightLen())
+    }
+    clock.Advance(DefaultSimulatedVisibilityTimeout - time.Second)
+    if messages, _ := queue.PullMessagesBatch(ctx); len(messages) != 0 {
+        t.Errorf("Expected no messages before visibility expires, got %d", len(messages))
+    }
+    clock.Advance(time.Second)
+    if queue.InflightLen() != 0 {
+        t.Errorf("Expected nothing inflight once visibility expires, got %d", queue.InflightLen())
+    }
+    second, _ := queue.PullMessagesBatch(ctx)
+    if len(second) != 5 {
+        t.Fatalf("Expected 5 messages delivered again, got %d", len(second))
+    }
+    stale := make(map[string]struct{})
+    for _, receiptHandle := range receiptHandles(first) {
+        stale[receiptHandle] = struct{}{}
+    }
+    for _, message := range second {
+        if _, ok := stale[message.ReceiptHandle()]; ok {
+            t.Errorf("Expected new receipt handle, got %s again", message.ReceiptHandle())
+        }
+        if message.Attributes()["ApproximateReceiveCount"] != "2" {
+            t.Errorf("Expected receive count of 2, got %s", message.Attributes()["ApproximateReceiveCount"])
+        }
+    }
+}
+
+
+func TestSimulatedQueueStaleReceiptHandles(t *testing.T) {
+    queue, clock := newTestSimulatedQueue(&SimulatedQueueConfig{})
+    queue.AddMessages(GenerateInMemoryMessages(1))
+    ctx := context.Background()
+    first, _ := queue.PullMessagesBatch(ctx)
+    clock.Advance(DefaultSimulatedVisibilityTimeout)
+    second, _ := queue.PullMessagesBatch(ctx)
+    if len(first) != 1 || len(second) != 1 {
+        t.Fatalf("Expected message received twice, got %d and %d", len(first), len(second))
+    }
+    stale := receiptHandles(first)
+    // Like SQS, deleting with a stale receipt handle succeeds but deletes nothing.
+    result, err := queue.DeleteMessagesBatch(ctx, stale)
+    if err != nil || len(result.Succeeded) != 1 {
+        t.Errorf("Expected delete with stale receipt handle to succeed, got %+v, %v", result, err)
+    }
+    if queue.MessagesLen() != 1 || len(queue.GetDeletedMessages()) != 0 {
+        t.Errorf("Expected message not deleted by stale receipt handle, got %d left", queue.MessagesLen())
+    }
+    for name, change := range map[string]func(context.Context, []string) (dedup.BatchResult, error){
+        "reset": queue.ResetVisibilityBatch,
+        "extend": func(ctx context.Context, receiptHandles []string) (dedup.BatchResult, error) {
+            return queue.ChangeVisibilityBatch(ctx, receiptHandles, time.Minute)
+        },
+    } {
+        result, err := change(ctx, stale)
+        if err != nil || len(result.Failed) != 1 || result.Failed[0].Code != "ReceiptHandleIsInvalid" || !result.Failed[0].SenderFault {
+            t.Errorf("Expected %s with stale receipt handle to fail as sender fault, got %+v, %v", name, result, err)
+        }
+    }
+    if queue.InflightLen() != 1 {
+        t.Errorf("Expected message still inflight, got %d", queue.InflightLen())
+    }
+    result, _ = queue.DeleteMessagesBatch(ctx, []string{"unknown"})
+    if len(result.Failed) != 1 || result.Failed[0].Code != "ReceiptHandleIsInvalid" {
+        t.Errorf("Expected unknown receipt handle to fail, got %+v", result)
+    }
+    result, _ = queue.ResetVisibilityBatch(ctx, receiptHandles(second))
+    if len(result.Succeeded) != 1 {
+        t.Errorf("Expected reset with latest receipt handle to succeed, got %+v", result)
+    }
+    result, _ = queue.ResetVisibilityBatch(ctx, receiptHandles(second))
+    if len(result.Failed) != 1 || result.Failed[0].Code != "MessageNotInflight" {
+        t.Errorf("Expected reset of visible message to fail, got %+v", result)
+    }
+    queue.DeleteMessagesBatch(ctx, receiptHandles(second))
+    if queue.MessagesLen() != 0 {
+        t.Errorf("Expected message deleted by latest receipt handle, got %d left", queue.MessagesLen())
+    }
+}
+
+
+func TestSimulatedQueueOverLimit(t *testing.T) {
+    queue, _ := newTestSimulatedQueue(&SimulatedQueueConfig{MaxInflight: 15})
+    queue.AddMessages(GenerateInMemoryMessages(30))
+    ctx := context.Background()
+    first, _ := queue.PullMessagesBatch(ctx)
+    second, _ := queue.PullMessagesBatch(ctx)
+    if len(first) != 10 || len(second) != 5 {
+        t.Fatalf("Expected receives to stop at max inflight, got %d and %d", len(first), len(second))
+    }
+    if _, err := queue.PullMessagesBatch(ctx); !errors.Is(err, ErrOverLimit) {
+        t.Errorf("Expected ErrOverLimit at max inflight, got %v", err)
+    }
+    if queue.PeakInflight() != 15 {
+        t.Errorf("Expected peak of 15 inflight, got %d", queue.PeakInflight())
+    }
+    queue.DeleteMessagesBatch(ctx, receiptHandles(first[:2]))
+    third, err := queue.PullMessagesBatch(ctx)
+    if err != nil || len(third) != 2 {
+        t.Errorf("Expected 2 messages once deletes free room, got %d, %v", len(third), err)
+    }
+}
@@ -0,0 +1,184 @@
+package metrics
+
+
+import (
+    "context"
+    "errors"
+    "log/slog"
+    "net/http"
+    "time"
+    "github.com/prometheus/client_golang/prometheus"
+    "github.com/prometheus/client_golang/prometheus/promhttp"
+    "github.com/IGVF-DACC/go-sqs-deduplication/internal/dedup"
+)
+
+
+const namespace = "sqs_dedup"
+
+
+// Prometheus metrics for a deduplicator, registered on their own registry.
+type Metrics struct {
+    registry *prometheus.Registry
+    messages *prometheus.CounterVec
+    lastRunMessages *prometheus.GaugeVec
+    runs *prometheus.CounterVec
+    runDuration prometheus.Histogram
+    lastSuccessfulRun prometheus.Gauge
+    queueCalls *prometheus.CounterVec
+    queueFailures *prometheus.CounterVec
+    batchLatency *prometheus.HistogramVec
+}
+
+
+func NewMetrics() *Metrics {
+    m := &Metrics{
+        registry: prometheus.NewRegistry(),
+        messages: prometheus.NewCounterVec(prometheus.CounterOpts{
+            Namespace: namespace,
+            Name: "messages_total",
+            Help: "Messages handled by the deduplicator, by outcome.",
+        }, []string{"outcome"}),
+        lastRunMessages: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+            Namespace: namespace,
+            Name: "last_run_messages",
+            Help: "Messages handled in the last completed run, by outcome.",
+        }, []string{"outcome"}),
+        runs: prometheus.NewCounterVec(prometheus.CounterOpts{
+            Namespace: namespace,
+            Name: "runs_total",
+            Help: "Completed runs, by status.",
+        }, []string{"status"}),
+        runDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+            Namespace: namespace,
+            Name: "run_duration_seconds",
+            Help: "Duration of runs.",
+            Buckets: prometheus.ExponentialBuckets(1, 2, 12),
+        }),
+        lastSuccessfulRun: prometheus.NewGauge(prometheus.GaugeOpts{
+            Namespace: namespace,
+            Name: "last_successful_run_timestamp_seconds",
+            Help: "Unix time the last successful run completed.",
+        }),
+        queueCalls: prometheus.NewCounterVec(prometheus.CounterOpts{
+            Namespace: namespace,
+            Name: "queue_calls_total",
+            Help: "Batch calls made to queues, by queue and operation.",
+        }, []string{"queue", "operation"}),
+        queueFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+            Namespace: namespace,
+            Name: "queue_failures_total",
+            Help: "Failed batch calls and failed batch entries, by queue and operation.",
+        }, []string{"queue", "operation"}),
+        batchLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+            Namespace: namespace,
+            Name: "queue_batch_duration_seconds",
+            Help: "Latency of batch calls made to queues, including retries.",
+            Buckets: prometheus.ExponentialBuckets(0.01, 2, 12),
+        }, []string{"queue", "operation"}),
+    }
+    m.registry.MustRegister(
+        m.messages,
+        m.lastRunMessages,
+        m.runs,
+        m.runDuration,
+        m.lastSuccessfulRun,
+        m.queueCalls,
+        m.queueFailures,
+        m.batchLatency,
+    )
+    return m
+}
+
+
+func runStatus(report dedup.RunReport, err error) string {
+    switch {
+    case err != nil || report.Cancelled:
+        return "cancelled"
+    case report.PullFailed:
+        return "pull_failed"
+    }
+    return "success"
+}
+
+
+// Records a completed run, usable as DeduplicatorConfig.RunReportHandler.
+func (m *Metrics) ObserveRun(report dedup.RunReport, err error) {
+    outcomes := map[string]int{
+        "pulled": report.MessagesPulled,
+        "kept": report.UniqueKept,
+        "deleted": report.DuplicatesDeleted,
+        "stored": report.MessagesFlushedToStorage,
+        "restored": report.MessagesRestoredFromStorage,
+        "reset": report.MessagesReset,
+        "extended": report.MessagesExtended,
+        "expired": report.ExpiredReceiptHandles,
+        "orphaned": report.OrphansReconciled,
+        "untokened": report.UntokenedMoves,
+        "storage_duplicates": report.StorageDuplicatesRemoved,
+        "poison": int(report.PoisonMessages.DeadLettered + report.PoisonMessages.Reset + report.PoisonMessages.Ignored + report.PoisonMessages.Failed),
+    }
+    for outcome, count := range outcomes {
+        m.messages.WithLabelValues(outcome).Add(float64(count))
+        m.lastRunMessages.WithLabelValues(outcome).Set(float64(count))
+    }
+    status := runStatus(report, err)
+    m.runs.WithLabelValues(status).Inc()
+    m.runDuration.Observe(report.Durations.Total.Seconds())
+    if status == "success" {
+        m.lastSuccessfulRun.SetToCurrentTime()
+    }
+}
+
+
+// Exposes current size of state maps, read on every scrape.
+func (m *Metrics) ObserveState(state *dedup.SharedState) {
+    sizes := map[string]func() int{
+        "keep": state.KeepMessagesLen,
+        "delete": state.DeleteMessagesLen,
+        "stored": state.StoredMessagesLen,
+        "suspect": state.SuspectMessagesLen,
+    }
+    for name, size := range sizes {
+        size := size
+        m.registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+            Namespace: namespace,
+            Name: "state_messages",
+            Help: "Messages currently held in deduplicator state, by map.",
+            ConstLabels: prometheus.Labels{"map": name},
+        }, func() float64 {
+            return float64(size())
+        }))
+    }
+    m.registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+        Namespace: namespace,
+        Name: "state_estimated_bytes",
+        Help: "Estimated bytes currently held in deduplicator state.",
+    }, func() float64 {
+        return float64(state.EstimatedBytes())
+    }))
+}
+
+
+func (m *Metrics) Handler() http.Handler {
+    return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+
+// Serves /metrics on addr until ctx is cancelled.
+func (m *Metrics) Serve(ctx context.Context, addr string) error {
+    mux := http.NewServeMux()
+    mux.Handle("/metrics", m.Handler())
+    server := &http.Server{Addr: addr, Handler: mux}
+    go func() {
+        <-ctx.Done()
+        shutdownCtx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+        defer cancel()
+        server.Shutdown(shutdownCtx)
+    }()
+    slog.InfoContext(ctx, "Serving metrics", "addr", addr)
+    err := server.ListenAndServe()
+    if errors.Is(err, http.ErrServerClosed) {
+        return nil
+    }
+    return err
+}
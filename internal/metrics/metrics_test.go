@@ -0,0 +1,119 @@
+package metrics
+
+
+import (
+    "context"
+    "errors"
+    "io"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "github.com/prometheus/client_golang/prometheus/testutil"
+    "github.com/IGVF-DACC/go-sqs-deduplication/internal/dedup"
+    "github.com/IGVF-DACC/go-sqs-deduplication/internal/memory"
+)
+
+
+func TestMetricsObserveDeduplicatorRun(t *testing.T) {
+    m := NewMetrics()
+    inMemoryQueue := memory.NewInMemoryQueue(10)
+    inMemoryQueue.AddMessages(memory.GenerateInMemoryMessages(100))
+    inMemoryQueue.AddMessages(memory.MakeDuplicateInMemoryMessages("abc", 50))
+    config := &dedup.DeduplicatorConfig{
+        Queue: m.InstrumentQueue("queue", inMemoryQueue),
+        StorageQueue: m.InstrumentQueue("storage", memory.NewInMemoryQueue(10)),
+        NumWorkers: 5,
+        MaxInflight: 1000,
+        TimeLimitInSeconds: 240,
+    }
+    deduplicator := dedup.NewDeduplicator(config)
+    m.ObserveState(deduplicator.State())
+    report, err := deduplicator.Run(context.Background())
+    m.ObserveRun(report, err)
+    if got := testutil.ToFloat64(m.messages.WithLabelValues("pulled")); got != 150 {
+        t.Errorf("Expected 150 pulled messages, got %v", got)
+    }
+    if got := testutil.ToFloat64(m.messages.WithLabelValues("deleted")); got != 49 {
+        t.Errorf("Expected 49 deleted messages, got %v", got)
+    }
+    if got := testutil.ToFloat64(m.runs.WithLabelValues("success")); got != 1 {
+        t.Errorf("Expected 1 successful run, got %v", got)
+    }
+    if testutil.ToFloat64(m.lastSuccessfulRun) == 0 {
+        t.Error("Expected last successful run timestamp to be set")
+    }
+    if testutil.ToFloat64(m.queueCalls.WithLabelValues("queue", "pull")) == 0 {
+        t.Error("Expected pull calls to be counted")
+    }
+    if got := testutil.ToFloat64(m.queueFailures.WithLabelValues("queue", "delete")); got != 0 {
+        t.Errorf("Expected no delete failures, got %v", got)
+    }
+    if got := testutil.CollectAndCount(m.batchLatency); got == 0 {
+        t.Error("Expected batch latency to be observed")
+    }
+    recorder := httptest.NewRecorder()
+    m.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+    body, _ := io.ReadAll(recorder.Body)
+    if !strings.Contains(string(body), `sqs_dedup_state_messages{map="keep"}`) {
+        t.Errorf("Expected state size in exposition, got:\n%s", body)
+    }
+    if !strings.Contains(string(body), "sqs_dedup_state_estimated_bytes") {
+        t.Errorf("Expected state bytes in exposition, got:\n%s", body)
+    }
+}
+
+
+func TestMetricsCancelledRunNotSuccessful(t *testing.T) {
+    m := NewMetrics()
+    m.ObserveRun(dedup.RunReport{Cancelled: true}, context.Canceled)
+    m.ObserveRun(dedup.RunReport{PullFailed: true}, nil)
+    if testutil.ToFloat64(m.lastSuccessfulRun) != 0 {
+        t.Error("Expected last successful run timestamp to be unset")
+    }
+    if got := testutil.ToFloat64(m.runs.WithLabelValues("cancelled")); got != 1 {
+        t.Errorf("Expected 1 cancelled run, got %v", got)
+    }
+    if got := testutil.ToFloat64(m.runs.WithLabelValues("pull_failed")); got != 1 {
+        t.Errorf("Expected 1 pull failed run, got %v", got)
+    }
+}
+
+
+type failingQueue struct {
+    dedup.Queue
+}
+
+
+func (q failingQueue) DeleteMessagesBatch(ctx context.Context, receiptHandles []string) (dedup.BatchResult, error) {
+    return dedup.BatchResult{}, errors.New("boom")
+}
+
+
+func (q failingQueue) PullMessagesBatch(ctx context.Context) ([]dedup.QueueMessage, error) {
+    return nil, dedup.ErrOnlyPoisonMessages
+}
+
+
+func TestInstrumentedQueueCountsFailures(t *testing.T) {
+    m := NewMetrics()
+    queue := m.InstrumentQueue("queue", failingQueue{memory.NewInMemoryQueue(10)})
+    queue.DeleteMessagesBatch(context.Background(), []string{"a"})
+    if got := testutil.ToFloat64(m.queueFailures.WithLabelValues("queue", "delete")); got != 1 {
+        t.Errorf("Expected 1 delete failure, got %v", got)
+    }
+}
+
+
+func TestInstrumentedQueueBatchOfOnlyPoisonMessagesIsNotFailure(t *testing.T) {
+    m := NewMetrics()
+    queue := m.InstrumentQueue("queue", failingQueue{memory.NewInMemoryQueue(10)})
+    if _, err := queue.PullMessagesBatch(context.Background()); !errors.Is(err, dedup.ErrOnlyPoisonMessages) {
+        t.Errorf("Expected error to be passed on to the puller, got %v", err)
+    }
+    if got := testutil.ToFloat64(m.queueCalls.WithLabelValues("queue", "pull")); got != 1 {
+        t.Errorf("Expected 1 pull, got %v", got)
+    }
+    if got := testutil.ToFloat64(m.queueFailures.WithLabelValues("queue", "pull")); got != 0 {
+        t.Errorf("Expected no pull failures, got %v", got)
+    }
+}
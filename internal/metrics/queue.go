@@ -0,0 +1,96 @@
+package metrics
+
+
+import (
+    "context"
+    "errors"
+    "time"
+    "github.com/IGVF-DACC/go-sqs-deduplication/internal/dedup"
+)
+
+
+// Queue decorator that counts calls, failures, and latency by operation.
+type instrumentedQueue struct {
+    queue dedup.Queue
+    name string
+    metrics *Metrics
+}
+
+
+// Wraps queue so its batch calls are recorded under name.
+func (m *Metrics) InstrumentQueue(name string, queue dedup.Queue) dedup.Queue {
+    return &instrumentedQueue{queue: queue, name: name, metrics: m}
+}
+
+
+func (q *instrumentedQueue) observe(operation string, start time.Time, failedEntries int, err error) {
+    q.metrics.queueCalls.WithLabelValues(q.name, operation).Inc()
+    q.metrics.batchLatency.WithLabelValues(q.name, operation).Observe(time.Since(start).Seconds())
+    failures := failedEntries
+    if err != nil {
+        failures++
+    }
+    q.metrics.queueFailures.WithLabelValues(q.name, operation).Add(float64(failures))
+}
+
+
+func (q *instrumentedQueue) PullMessagesBatch(ctx context.Context) ([]dedup.QueueMessage, error) {
+    start := time.Now()
+    messages, err := q.queue.PullMessagesBatch(ctx)
+    observed := err
+    if errors.Is(err, dedup.ErrOnlyPoisonMessages) {
+        // Receive worked, poison messages are counted in run outcomes instead.
+        observed = nil
+    }
+    q.observe("pull", start, 0, observed)
+    return messages, err
+}
+
+
+func (q *instrumentedQueue) DeleteMessagesBatch(ctx context.Context, receiptHandles []string) (dedup.BatchResult, error) {
+    start := time.Now()
+    result, err := q.queue.DeleteMessagesBatch(ctx, receiptHandles)
+    q.observe("delete", start, len(result.Failed), err)
+    return result, err
+}
+
+
+func (q *instrumentedQueue) ResetVisibilityBatch(ctx context.Context, receiptHandles []string) (dedup.BatchResult, error) {
+    start := time.Now()
+    result, err := q.queue.ResetVisibilityBatch(ctx, receiptHandles)
+    q.observe("reset", start, len(result.Failed), err)
+    return result, err
+}
+
+
+func (q *instrumentedQueue) ChangeVisibilityBatch(ctx context.Context, receiptHandles []string, visibilityTimeout time.Duration) (dedup.BatchResult, error) {
+    start := time.Now()
+    result, err := q.queue.ChangeVisibilityBatch(ctx, receiptHandles, visibilityTimeout)
+    q.observe("extend", start, len(result.Failed), err)
+    return result, err
+}
+
+
+func (q *instrumentedQueue) PutMessagesBatch(ctx context.Context, messages []dedup.QueueMessage) (dedup.BatchResult, error) {
+    start := time.Now()
+    result, err := q.queue.PutMessagesBatch(ctx, messages)
+    q.observe("put", start, len(result.Failed), err)
+    return result, err
+}
+
+
+// Forwarded so the run report still sees stats of the wrapped queue.
+func (q *instrumentedQueue) RetryStats() dedup.RetryStats {
+    if reporter, ok := q.queue.(dedup.RetryStatsReporter); ok {
+        return reporter.RetryStats()
+    }
+    return dedup.RetryStats{}
+}
+
+
+func (q *instrumentedQueue) PoisonStats() dedup.PoisonStats {
+    if reporter, ok := q.queue.(dedup.PoisonStatsReporter); ok {
+        return reporter.PoisonStats()
+    }
+    return dedup.PoisonStats{}
+}
@@ -0,0 +1,96 @@
+package sqs
+
+
+import (
+    "strconv"
+    "time"
+    "github.com/aws/aws-sdk-go-v2/aws"
+    "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+    "github.com/IGVF-DACC/go-sqs-deduplication/internal/dedup"
+)
+
+
+// Message attribute holding SentTimestamp of the message when it was
+// first sent, so age survives moving through the storage queue.
+const OriginalSentTimestampAttribute = dedup.OriginalSentTimestampAttribute
+
+
+func fromSQSMessageAttributes(attributes map[string]types.MessageAttributeValue) map[string]dedup.MessageAttribute {
+    if len(attributes) == 0 {
+        return nil
+    }
+    converted := make(map[string]dedup.MessageAttribute, len(attributes))
+    for name, value := range attributes {
+        converted[name] = dedup.MessageAttribute{
+            DataType: aws.ToString(value.DataType),
+            StringValue: aws.ToString(value.StringValue),
+            BinaryValue: value.BinaryValue,
+        }
+    }
+    return converted
+}
+
+
+func toSQSMessageAttributes(attributes map[string]dedup.MessageAttribute) map[string]types.MessageAttributeValue {
+    if len(attributes) == 0 {
+        return nil
+    }
+    converted := make(map[string]types.MessageAttributeValue, len(attributes))
+    for name, value := range attributes {
+        attribute := types.MessageAttributeValue{DataType: aws.String(value.DataType)}
+        if value.BinaryValue != nil {
+            attribute.BinaryValue = value.BinaryValue
+        } else {
+            attribute.StringValue = aws.String(value.StringValue)
+        }
+        converted[name] = attribute
+    }
+    return converted
+}
+
+
+// Prefers OriginalSentTimestampAttribute over SentTimestamp,
+// both are epoch milliseconds. Returns zero time if missing.
+func sentTime(attributes map[string]string, messageAttributes map[string]dedup.MessageAttribute) time.Time {
+    sentTimestamp := attributes[string(types.MessageSystemAttributeNameSentTimestamp)]
+    if original, ok := messageAttributes[OriginalSentTimestampAttribute]; ok {
+        sentTimestamp = original.StringValue
+    }
+    milliseconds, err := strconv.ParseInt(sentTimestamp, 10, 64)
+    if err != nil {
+        return time.Time{}
+    }
+    return time.UnixMilli(milliseconds)
+}
+
+
+// Builds entry reproducing body, message attributes and AWSTraceHeader
+// of message, and records its original sent time if there is room.
+func sendMessageEntry(id string, message dedup.QueueMessage) types.SendMessageBatchRequestEntry {
+    entry := types.SendMessageBatchRequestEntry{
+        Id: aws.String(id),
+        MessageBody: aws.String(message.RawBody()),
+    }
+    messageAttributes := toSQSMessageAttributes(message.MessageAttributes())
+    _, hasOriginalSentTimestamp := messageAttributes[OriginalSentTimestampAttribute]
+    if !hasOriginalSentTimestamp && !message.SentTime().IsZero() && len(messageAttributes) < dedup.MaxMessageAttributes {
+        if messageAttributes == nil {
+            messageAttributes = make(map[string]types.MessageAttributeValue)
+        }
+        messageAttributes[OriginalSentTimestampAttribute] = types.MessageAttributeValue{
+            DataType: aws.String("Number"),
+            StringValue: aws.String(strconv.FormatInt(message.SentTime().UnixMilli(), 10)),
+        }
+    }
+    entry.MessageAttributes = messageAttributes
+    traceHeaderName := string(types.MessageSystemAttributeNameAWSTraceHeader)
+    if traceHeader, ok := message.Attributes()[traceHeaderName]; ok {
+        entry.MessageSystemAttributes = map[string]types.MessageSystemAttributeValue{
+            traceHeaderName: {
+                DataType: aws.String("String"),
+                StringValue: aws.String(traceHeader),
+            },
+        }
+    }
+    return entry
+}
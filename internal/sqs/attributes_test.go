@@ -0,0 +1,107 @@
+package sqs
+
+
+import (
+    "bytes"
+    "strconv"
+    "testing"
+    "time"
+    "github.com/aws/aws-sdk-go-v2/aws"
+    "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+    "github.com/IGVF-DACC/go-sqs-deduplication/internal/dedup"
+)
+
+
+// Simulates SQS delivering a message that was sent with entry at sentAt.
+func deliver(entry types.SendMessageBatchRequestEntry, sentAt time.Time) types.Message {
+    attributes := map[string]string{
+        "SentTimestamp": strconv.FormatInt(sentAt.UnixMilli(), 10),
+    }
+    if traceHeader, ok := entry.MessageSystemAttributes["AWSTraceHeader"]; ok {
+        attributes["AWSTraceHeader"] = aws.ToString(traceHeader.StringValue)
+    }
+    id := strconv.FormatInt(sentAt.UnixNano(), 10)
+    return types.Message{
+        Body: entry.MessageBody,
+        MessageId: aws.String("msg-" + id),
+        ReceiptHandle: aws.String("receipt-" + id),
+        Attributes: attributes,
+        MessageAttributes: entry.MessageAttributes,
+    }
+}
+
+
+func TestStorageRoundTripPreservesAttributes(t *testing.T) {
+    originalSentAt := time.UnixMilli(1700000000123)
+    original := types.Message{
+        Body: aws.String(`{"data": {"uuid": "abc"}}`),
+        MessageId: aws.String("msg-original"),
+        ReceiptHandle: aws.String("receipt-original"),
+        Attributes: map[string]string{
+            "SentTimestamp": strconv.FormatInt(originalSentAt.UnixMilli(), 10),
+            "AWSTraceHeader": "Root=1-5759e988-bd862e3fe1be46a994272793",
+        },
+        MessageAttributes: map[string]types.MessageAttributeValue{
+            "source": {DataType: aws.String("String"), StringValue: aws.String("indexer")},
+            "priority": {DataType: aws.String("Number.int"), StringValue: aws.String("5")},
+            "payload": {DataType: aws.String("Binary"), BinaryValue: []byte{0, 1, 2}},
+        },
+    }
+    message, err := InvalidationQueueMessageParser(original)
+    if err != nil {
+        t.Fatal(err)
+    }
+    // Flush to storage and restore back to queue.
+    stored, err := InvalidationQueueMessageParser(deliver(sendMessageEntry("message_0", message), originalSentAt.Add(time.Minute)))
+    if err != nil {
+        t.Fatal(err)
+    }
+    restored, err := InvalidationQueueMessageParser(deliver(sendMessageEntry("message_0", stored), originalSentAt.Add(2 * time.Minute)))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if restored.RawBody() != *original.Body {
+        t.Errorf("Expected body %s, got %s", *original.Body, restored.RawBody())
+    }
+    if !restored.SentTime().Equal(originalSentAt) {
+        t.Errorf("Expected sent time %v, got %v", originalSentAt, restored.SentTime())
+    }
+    if restored.Attributes()["AWSTraceHeader"] != original.Attributes["AWSTraceHeader"] {
+        t.Errorf("Expected trace header to be preserved, got %q", restored.Attributes()["AWSTraceHeader"])
+    }
+    restoredAttributes := restored.MessageAttributes()
+    if len(restoredAttributes) != len(original.MessageAttributes) + 1 {
+        t.Errorf("Expected original message attributes plus original sent timestamp, got %v", restoredAttributes)
+    }
+    for name, value := range original.MessageAttributes {
+        got := restoredAttributes[name]
+        if got.DataType != aws.ToString(value.DataType) || got.StringValue != aws.ToString(value.StringValue) || !bytes.Equal(got.BinaryValue, value.BinaryValue) {
+            t.Errorf("Expected attribute %s to be preserved, got %+v", name, got)
+        }
+    }
+    if restoredAttributes[OriginalSentTimestampAttribute].StringValue != "1700000000123" {
+        t.Errorf("Unexpected original sent timestamp %+v", restoredAttributes[OriginalSentTimestampAttribute])
+    }
+}
+
+
+func TestSendMessageEntrySkipsSentTimestampWhenAttributesFull(t *testing.T) {
+    messageAttributes := make(map[string]types.MessageAttributeValue)
+    for i := 0; i < dedup.MaxMessageAttributes; i++ {
+        messageAttributes["attribute" + strconv.Itoa(i)] = types.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String("value")}
+    }
+    message, err := InvalidationQueueMessageParser(types.Message{
+        Body: aws.String(`{"data": {"uuid": "abc"}}`),
+        MessageId: aws.String("msg-1"),
+        ReceiptHandle: aws.String("receipt-1"),
+        Attributes: map[string]string{"SentTimestamp": "1700000000123"},
+        MessageAttributes: messageAttributes,
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    entry := sendMessageEntry("message_0", message)
+    if len(entry.MessageAttributes) != dedup.MaxMessageAttributes {
+        t.Errorf("Expected %d message attributes, got %d", dedup.MaxMessageAttributes, len(entry.MessageAttributes))
+    }
+}
@@ -0,0 +1,187 @@
+package sqs
+
+
+import (
+    "encoding/json"
+    "fmt"
+    "strings"
+    "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+    "github.com/IGVF-DACC/go-sqs-deduplication/internal/dedup"
+)
+
+
+// Envelope a message body arrives in when the queue is subscribed to
+// an SNS topic or an EventBridge rule rather than sent to directly.
+type Envelope string
+
+
+const (
+    // Body is the payload itself.
+    EnvelopeNone Envelope = "none"
+    // Payload is the string in Message of an SNS notification.
+    EnvelopeSNS Envelope = "sns"
+    // Payload is the JSON in detail of an EventBridge event.
+    EnvelopeEventBridge Envelope = "eventbridge"
+    // Unwraps SNS and EventBridge envelopes, nested ones too, if detected.
+    EnvelopeAuto Envelope = "auto"
+)
+
+
+// Most envelopes auto unwraps, e.g. an EventBridge event sent on by SNS.
+const maxAutoEnvelopes = 4
+
+
+// Envelopes unwrapped in order, outermost first.
+type Envelopes []Envelope
+
+
+// Parses comma separated envelopes, e.g. "sns,eventbridge".
+func ParseEnvelopes(envelopes string) (Envelopes, error) {
+    var parsed Envelopes
+    for _, name := range strings.Split(envelopes, ",") {
+        switch envelope := Envelope(strings.TrimSpace(name)); envelope {
+        case "", EnvelopeNone:
+        case EnvelopeSNS, EnvelopeEventBridge, EnvelopeAuto:
+            parsed = append(parsed, envelope)
+        default:
+            return nil, fmt.Errorf("unknown envelope %q, expected none, sns, eventbridge, or auto", name)
+        }
+    }
+    return parsed, nil
+}
+
+
+// Fields of a body that may be an envelope, nil if it isn't a JSON object.
+func envelopeFields(body string) map[string]json.RawMessage {
+    var fields map[string]json.RawMessage
+    if err := json.Unmarshal([]byte(body), &fields); err != nil {
+        return nil
+    }
+    return fields
+}
+
+
+func stringField(fields map[string]json.RawMessage, name string) (string, bool) {
+    var value string
+    if err := json.Unmarshal(fields[name], &value); err != nil {
+        return "", false
+    }
+    return value, true
+}
+
+
+// SNS notifications delivered without raw message delivery.
+func snsPayload(fields map[string]json.RawMessage) (string, bool) {
+    if notificationType, _ := stringField(fields, "Type"); notificationType != "Notification" {
+        return "", false
+    }
+    if _, ok := fields["TopicArn"]; !ok {
+        return "", false
+    }
+    return stringField(fields, "Message")
+}
+
+
+func eventBridgePayload(fields map[string]json.RawMessage) (string, bool) {
+    _, hasDetailType := fields["detail-type"]
+    _, hasSource := fields["source"]
+    detail, hasDetail := fields["detail"]
+    if !hasDetailType || !hasSource || !hasDetail {
+        return "", false
+    }
+    // Detail is kept as sent, so values read from it are byte for byte the same.
+    return string(detail), true
+}
+
+
+// Detects an SNS or EventBridge envelope around body.
+func detectPayload(body string) (string, bool) {
+    fields := envelopeFields(body)
+    if fields == nil {
+        return "", false
+    }
+    if payload, ok := snsPayload(fields); ok {
+        return payload, true
+    }
+    return eventBridgePayload(fields)
+}
+
+
+func (e Envelope) unwrap(body string) (string, error) {
+    switch e {
+    case EnvelopeSNS, EnvelopeEventBridge:
+        fields := envelopeFields(body)
+        if fields == nil {
+            return "", fmt.Errorf("expected %s envelope, body isn't a JSON object", e)
+        }
+        var payload string
+        var ok bool
+        if e == EnvelopeSNS {
+            payload, ok = snsPayload(fields)
+        } else {
+            payload, ok = eventBridgePayload(fields)
+        }
+        if !ok {
+            return "", fmt.Errorf("expected %s envelope, body has no %s fields", e, e)
+        }
+        return payload, nil
+    case EnvelopeAuto:
+        for i := 0; i < maxAutoEnvelopes; i++ {
+            payload, ok := detectPayload(body)
+            if !ok {
+                break
+            }
+            body = payload
+        }
+        return body, nil
+    }
+    return body, nil
+}
+
+
+// Payload inside every envelope around body.
+func (e Envelopes) Unwrap(body string) (string, error) {
+    for _, envelope := range e {
+        var err error
+        body, err = envelope.unwrap(body)
+        if err != nil {
+            return "", err
+        }
+    }
+    return body, nil
+}
+
+
+// Message parsed from the payload of an envelope, with the full
+// body kept as RawBody so moves and restores are byte-identical.
+type envelopedMessage struct {
+    dedup.QueueMessage
+    rawBody string
+}
+
+
+func (m envelopedMessage) RawBody() string {
+    return m.rawBody
+}
+
+
+// Parser running parser on the payload inside envelopes. Bodies that
+// aren't in the expected envelopes fail to parse like any poison message.
+func WithEnvelopes(parser MessageParser, envelopes Envelopes) MessageParser {
+    if len(envelopes) == 0 {
+        return parser
+    }
+    return func(rawMessage types.Message) (dedup.QueueMessage, error) {
+        payload, err := envelopes.Unwrap(*rawMessage.Body)
+        if err != nil {
+            return ParsedQueueMessage{}, fmt.Errorf("error unwrapping message: %w", err)
+        }
+        unwrapped := rawMessage
+        unwrapped.Body = &payload
+        message, err := parser(unwrapped)
+        if err != nil {
+            return message, err
+        }
+        return envelopedMessage{QueueMessage: message, rawBody: *rawMessage.Body}, nil
+    }
+}
@@ -0,0 +1,91 @@
+package sqs
+
+
+import (
+    "encoding/json"
+    "testing"
+)
+
+
+const invalidation = `{"data": {"uuid": "abc"}, "metadata": {"xid": 42}}`
+
+
+func snsNotification(message string) string {
+    encoded, _ := json.Marshal(map[string]string{
+        "Type": "Notification",
+        "MessageId": "sns-1",
+        "TopicArn": "arn:aws:sns:us-west-2:000000000000:invalidations",
+        "Message": message,
+    })
+    return string(encoded)
+}
+
+
+func eventBridgeEvent(detail string) string {
+    return `{"version": "0", "id": "event-1", "detail-type": "invalidation", "source": "app", "detail": ` + detail + `}`
+}
+
+
+func TestParseEnvelopes(t *testing.T) {
+    envelopes, err := ParseEnvelopes("sns, eventbridge")
+    if err != nil || len(envelopes) != 2 || envelopes[0] != EnvelopeSNS || envelopes[1] != EnvelopeEventBridge {
+        t.Errorf("Expected sns then eventbridge, got %v, %v", envelopes, err)
+    }
+    for _, none := range []string{"", "none"} {
+        if envelopes, err := ParseEnvelopes(none); err != nil || len(envelopes) != 0 {
+            t.Errorf("Expected no envelopes for %q, got %v, %v", none, envelopes, err)
+        }
+    }
+    if _, err := ParseEnvelopes("sqs"); err == nil {
+        t.Error("Expected unknown envelope to fail")
+    }
+}
+
+
+func TestWithEnvelopes(t *testing.T) {
+    cases := map[string]struct {
+        envelopes Envelopes
+        body string
+    }{
+        "sns": {Envelopes{EnvelopeSNS}, snsNotification(invalidation)},
+        "eventbridge": {Envelopes{EnvelopeEventBridge}, eventBridgeEvent(invalidation)},
+        "eventbridge through sns": {Envelopes{EnvelopeSNS, EnvelopeEventBridge}, snsNotification(eventBridgeEvent(invalidation))},
+        "auto sns": {Envelopes{EnvelopeAuto}, snsNotification(invalidation)},
+        "auto nested": {Envelopes{EnvelopeAuto}, snsNotification(eventBridgeEvent(invalidation))},
+        "auto without envelope": {Envelopes{EnvelopeAuto}, invalidation},
+    }
+    for name, c := range cases {
+        parser := WithEnvelopes(InvalidationQueueMessageParser, c.envelopes)
+        message, err := parser(rawMessage(c.body))
+        if err != nil {
+            t.Errorf("Expected %s to parse, got %v", name, err)
+            continue
+        }
+        if message.UniqueID() != "abc" || message.MessageID() != "msg-1" || message.ReceiptHandle() != "receipt-1" {
+            t.Errorf("Expected %s to parse payload, got %+v", name, message)
+        }
+        if message.RawBody() != c.body {
+            t.Errorf("Expected %s to keep full body, got %s", name, message.RawBody())
+        }
+    }
+    parser := WithEnvelopes(InvalidationQueueMessageParser, Envelopes{EnvelopeSNS})
+    for _, body := range []string{invalidation, eventBridgeEvent(invalidation), "not json"} {
+        if _, err := parser(rawMessage(body)); err == nil {
+            t.Errorf("Expected %s without SNS envelope to fail", body)
+        }
+    }
+}
+
+
+func TestEnvelopedNumericFieldValue(t *testing.T) {
+    path, err := ParseJSONPath("$.metadata.xid")
+    if err != nil {
+        t.Fatal(err)
+    }
+    value := EnvelopedNumericFieldValue(path, Envelopes{EnvelopeAuto})
+    for _, body := range []string{invalidation, snsNotification(eventBridgeEvent(invalidation))} {
+        if got, ok := value(ParsedQueueMessage{rawBody: body}); !ok || got != 42 {
+            t.Errorf("Expected 42 in %s, got (%v, %v)", body, got, ok)
+        }
+    }
+}
@@ -0,0 +1,239 @@
+package sqs
+
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "strconv"
+    "strings"
+    "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+    "github.com/IGVF-DACC/go-sqs-deduplication/internal/dedup"
+)
+
+
+// One step of a JSON path, either an object key or an array index.
+type pathStep struct {
+    key string
+    index int
+    isIndex bool
+}
+
+
+// JSONPath supports dot notation with array indices, e.g. $.data.items[0].uuid
+type JSONPath struct {
+    expression string
+    steps []pathStep
+}
+
+
+func ParseJSONPath(expression string) (JSONPath, error) {
+    path := JSONPath{expression: expression}
+    rest, ok := strings.CutPrefix(strings.TrimSpace(expression), "$")
+    if !ok {
+        return path, fmt.Errorf("JSON path %q must start with $", expression)
+    }
+    for len(rest) > 0 {
+        switch rest[0] {
+        case '.':
+            end := strings.IndexAny(rest[1:], ".[")
+            if end == -1 {
+                end = len(rest) - 1
+            }
+            key := rest[1:end + 1]
+            if key == "" {
+                return path, fmt.Errorf("JSON path %q has empty key", expression)
+            }
+            path.steps = append(path.steps, pathStep{key: key})
+            rest = rest[end + 1:]
+        case '[':
+            end := strings.IndexByte(rest, ']')
+            if end == -1 {
+                return path, fmt.Errorf("JSON path %q has unclosed [", expression)
+            }
+            index, err := strconv.Atoi(rest[1:end])
+            if err != nil || index < 0 {
+                return path, fmt.Errorf("JSON path %q has invalid index %q", expression, rest[1:end])
+            }
+            path.steps = append(path.steps, pathStep{index: index, isIndex: true})
+            rest = rest[end + 1:]
+        default:
+            return path, fmt.Errorf("JSON path %q has unexpected character %q", expression, rest[0])
+        }
+    }
+    return path, nil
+}
+
+
+func (p JSONPath) String() string {
+    return p.expression
+}
+
+
+// Returns false if path doesn't exist or value is null.
+func (p JSONPath) lookup(document any) (any, bool) {
+    current := document
+    for _, step := range p.steps {
+        if step.isIndex {
+            array, ok := current.([]any)
+            if !ok || step.index >= len(array) {
+                return nil, false
+            }
+            current = array[step.index]
+        } else {
+            object, ok := current.(map[string]any)
+            if !ok {
+                return nil, false
+            }
+            current, ok = object[step.key]
+            if !ok {
+                return nil, false
+            }
+        }
+    }
+    return current, current != nil
+}
+
+
+func valueToString(value any) (string, error) {
+    switch v := value.(type) {
+    case string:
+        return v, nil
+    case json.Number:
+        return v.String(), nil
+    case bool:
+        return strconv.FormatBool(v), nil
+    default:
+        encoded, err := json.Marshal(v)
+        return string(encoded), err
+    }
+}
+
+
+type JSONPathParserConfig struct {
+    // Each key is a chain of fallback paths, the first path with a value is used.
+    // Values of all keys are joined with Separator to make UniqueID.
+    Keys [][]JSONPath
+    Separator string
+    LowerCase bool
+    TrimSpace bool
+}
+
+
+// ParseJSONPathKeys parses keys separated by commas, each a chain of
+// fallback paths separated by |, e.g. "$.data.uuid|$.uuid,$.metadata.tid"
+func ParseJSONPathKeys(keys string) ([][]JSONPath, error) {
+    var parsed [][]JSONPath
+    for _, key := range strings.Split(keys, ",") {
+        var fallbacks []JSONPath
+        for _, expression := range strings.Split(key, "|") {
+            path, err := ParseJSONPath(expression)
+            if err != nil {
+                return nil, err
+            }
+            fallbacks = append(fallbacks, path)
+        }
+        parsed = append(parsed, fallbacks)
+    }
+    return parsed, nil
+}
+
+
+func decodeJSONDocument(body string) (any, error) {
+    decoder := json.NewDecoder(bytes.NewReader([]byte(body)))
+    decoder.UseNumber()
+    var document any
+    if err := decoder.Decode(&document); err != nil {
+        return nil, fmt.Errorf("error unmarshaling message from JSON: %w", err)
+    }
+    return document, nil
+}
+
+
+func (c *JSONPathParserConfig) uniqueID(body string) (string, error) {
+    document, err := decodeJSONDocument(body)
+    if err != nil {
+        return "", err
+    }
+    var parts []string
+    for _, fallbacks := range c.Keys {
+        found := false
+        for _, path := range fallbacks {
+            value, ok := path.lookup(document)
+            if !ok {
+                continue
+            }
+            part, err := valueToString(value)
+            if err != nil {
+                return "", err
+            }
+            if c.TrimSpace {
+                part = strings.TrimSpace(part)
+            }
+            if c.LowerCase {
+                part = strings.ToLower(part)
+            }
+            parts = append(parts, part)
+            found = true
+            break
+        }
+        if !found {
+            return "", fmt.Errorf("no value found in message for any of %v", fallbacks)
+        }
+    }
+    if strings.Join(parts, "") == "" {
+        return "", fmt.Errorf("values found in message for %v are all empty", c.Keys)
+    }
+    return strings.Join(parts, c.Separator), nil
+}
+
+
+func NewJSONPathMessageParser(config *JSONPathParserConfig) (MessageParser, error) {
+    if len(config.Keys) == 0 {
+        return nil, fmt.Errorf("at least one JSON path key is required")
+    }
+    return func(rawMessage types.Message) (dedup.QueueMessage, error) {
+        uniqueID, err := config.uniqueID(*rawMessage.Body)
+        if err != nil {
+            return ParsedQueueMessage{}, fmt.Errorf("error extracting unique ID from message: %w", err)
+        }
+        return NewParsedQueueMessage(rawMessage, uniqueID), nil
+    }, nil
+}
+
+
+// NumericFieldValue returns a function reading a number, or a string
+// holding a number, at path in the body of a message.
+func NumericFieldValue(path JSONPath) func(dedup.QueueMessage) (float64, bool) {
+    return EnvelopedNumericFieldValue(path, nil)
+}
+
+
+// Like NumericFieldValue with path in the payload inside envelopes.
+func EnvelopedNumericFieldValue(path JSONPath, envelopes Envelopes) func(dedup.QueueMessage) (float64, bool) {
+    return func(message dedup.QueueMessage) (float64, bool) {
+        payload, err := envelopes.Unwrap(message.RawBody())
+        if err != nil {
+            return 0, false
+        }
+        document, err := decodeJSONDocument(payload)
+        if err != nil {
+            return 0, false
+        }
+        value, ok := path.lookup(document)
+        if !ok {
+            return 0, false
+        }
+        var number string
+        switch v := value.(type) {
+        case json.Number:
+            number = v.String()
+        case string:
+            number = strings.TrimSpace(v)
+        default:
+            return 0, false
+        }
+        parsed, err := strconv.ParseFloat(number, 64)
+        return parsed, err == nil
+    }
+}
@@ -0,0 +1,104 @@
+package sqs
+
+
+import (
+    "testing"
+    "github.com/aws/aws-sdk-go-v2/aws"
+    "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+
+func rawMessage(body string) types.Message {
+    return types.Message{
+        Body: aws.String(body),
+        MessageId: aws.String("msg-1"),
+        ReceiptHandle: aws.String("receipt-1"),
+    }
+}
+
+
+func TestParseJSONPath(t *testing.T) {
+    for _, expression := range []string{"$", "$.data.uuid", "$.items[2].id", "$[0]"} {
+        if _, err := ParseJSONPath(expression); err != nil {
+            t.Errorf("Expected %q to parse, got %v", expression, err)
+        }
+    }
+    for _, expression := range []string{"data.uuid", "$.data..uuid", "$.data.", "$.items[x]", "$.items[0"} {
+        if _, err := ParseJSONPath(expression); err == nil {
+            t.Errorf("Expected %q to fail to parse", expression)
+        }
+    }
+}
+
+
+func TestJSONPathMessageParser(t *testing.T) {
+    keys, err := ParseJSONPathKeys("$.data.uuid|$.uuid,$.metadata.xid")
+    if err != nil {
+        t.Fatal(err)
+    }
+    parser, err := NewJSONPathMessageParser(&JSONPathParserConfig{
+        Keys: keys,
+        Separator: ":",
+        LowerCase: true,
+        TrimSpace: true,
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    cases := []struct {
+        body string
+        uniqueID string
+    }{
+        {`{"data": {"uuid": " ABC "}, "metadata": {"xid": 123}}`, "abc:123"},
+        {`{"uuid": "def", "metadata": {"xid": "456"}}`, "def:456"},
+        {`{"data": {"uuid": null}, "uuid": "ghi", "metadata": {"xid": true}}`, "ghi:true"},
+    }
+    for _, c := range cases {
+        message, err := parser(rawMessage(c.body))
+        if err != nil {
+            t.Errorf("Unexpected error parsing %s: %v", c.body, err)
+            continue
+        }
+        if message.UniqueID() != c.uniqueID {
+            t.Errorf("Expected unique ID %q, got %q", c.uniqueID, message.UniqueID())
+        }
+        if message.RawBody() != c.body || message.MessageID() != "msg-1" || message.ReceiptHandle() != "receipt-1" {
+            t.Errorf("Unexpected message fields %+v", message)
+        }
+    }
+    if _, err := parser(rawMessage(`{"data": {}, "metadata": {"xid": 1}}`)); err == nil {
+        t.Error("Expected error when no fallback path has a value")
+    }
+    if _, err := parser(rawMessage(`{"uuid": " ", "metadata": {"xid": ""}}`)); err == nil {
+        t.Error("Expected error when the unique ID is empty")
+    }
+    if _, err := parser(rawMessage(`not json`)); err == nil {
+        t.Error("Expected error for invalid JSON")
+    }
+}
+
+
+func TestNumericFieldValue(t *testing.T) {
+    path, err := ParseJSONPath("$.metadata.xid")
+    if err != nil {
+        t.Fatal(err)
+    }
+    value := NumericFieldValue(path)
+    cases := []struct {
+        body string
+        expected float64
+        ok bool
+    }{
+        {`{"metadata": {"xid": 3860392}}`, 3860392, true},
+        {`{"metadata": {"xid": "3860392"}}`, 3860392, true},
+        {`{"metadata": {"xid": "abc"}}`, 0, false},
+        {`{"metadata": {}}`, 0, false},
+    }
+    for _, c := range cases {
+        message := ParsedQueueMessage{rawBody: c.body}
+        got, ok := value(message)
+        if ok != c.ok || got != c.expected {
+            t.Errorf("Expected (%v, %v) for %s, got (%v, %v)", c.expected, c.ok, c.body, got, ok)
+        }
+    }
+}
@@ -4,6 +4,7 @@ package sqs
 import (
     "fmt"
     "encoding/json"
+    "time"
     "github.com/aws/aws-sdk-go-v2/service/sqs/types"
     "github.com/IGVF-DACC/go-sqs-deduplication/internal/dedup"
 )
@@ -19,6 +20,9 @@ type InvalidationQueueMessage struct {
     messageID string
     receiptHandle string
     rawBody string
+    sentTime time.Time
+    attributes map[string]string
+    messageAttributes map[string]dedup.MessageAttribute
 }
 
 
@@ -42,18 +46,101 @@ func (m InvalidationQueueMessage) RawBody() string {
 }
 
 
-type messageParser func(rawMessage types.Message) (dedup.QueueMessage, error)
+func (m InvalidationQueueMessage) SentTime() time.Time {
+    return m.sentTime
+}
+
+
+func (m InvalidationQueueMessage) Attributes() map[string]string {
+    return m.attributes
+}
+
+
+func (m InvalidationQueueMessage) MessageAttributes() map[string]dedup.MessageAttribute {
+    return m.messageAttributes
+}
+
+
+// Message of parsers that only work out its unique ID, body and
+// attributes are kept as received.
+type ParsedQueueMessage struct {
+    uniqueID string
+    messageID string
+    receiptHandle string
+    rawBody string
+    sentTime time.Time
+    attributes map[string]string
+    messageAttributes map[string]dedup.MessageAttribute
+}
+
+
+func (m ParsedQueueMessage) UniqueID() string {
+    return m.uniqueID
+}
+
+
+func (m ParsedQueueMessage) MessageID() string {
+    return m.messageID
+}
+
+
+func (m ParsedQueueMessage) ReceiptHandle() string {
+    return m.receiptHandle
+}
+
+
+func (m ParsedQueueMessage) RawBody() string {
+    return m.rawBody
+}
+
+
+func (m ParsedQueueMessage) SentTime() time.Time {
+    return m.sentTime
+}
+
+
+func (m ParsedQueueMessage) Attributes() map[string]string {
+    return m.attributes
+}
+
+
+func (m ParsedQueueMessage) MessageAttributes() map[string]dedup.MessageAttribute {
+    return m.messageAttributes
+}
+
+
+func NewParsedQueueMessage(rawMessage types.Message, uniqueID string) ParsedQueueMessage {
+    message := ParsedQueueMessage{
+        uniqueID: uniqueID,
+        receiptHandle: *rawMessage.ReceiptHandle,
+        messageID: *rawMessage.MessageId,
+        rawBody: *rawMessage.Body,
+        attributes: rawMessage.Attributes,
+        messageAttributes: fromSQSMessageAttributes(rawMessage.MessageAttributes),
+    }
+    message.sentTime = sentTime(message.attributes, message.messageAttributes)
+    return message
+}
+
+
+type MessageParser func(rawMessage types.Message) (dedup.QueueMessage, error)
 
 
 func InvalidationQueueMessageParser(rawMessage types.Message) (dedup.QueueMessage, error) {
     var message InvalidationQueueMessage
     err := json.Unmarshal([]byte(*rawMessage.Body), &message)
     if err != nil {
-        fmt.Println("Error unmarshaling message from JSON", err)
-        return message, err
+        return message, fmt.Errorf("error unmarshaling message from JSON: %w", err)
+    }
+    if message.Data.UUID == "" {
+        // Would otherwise share one unique ID with every other message without it.
+        return message, fmt.Errorf("message has no data.uuid")
     }
     message.receiptHandle = *rawMessage.ReceiptHandle
     message.messageID = *rawMessage.MessageId
     message.rawBody = *rawMessage.Body
+    message.attributes = rawMessage.Attributes
+    message.messageAttributes = fromSQSMessageAttributes(rawMessage.MessageAttributes)
+    message.sentTime = sentTime(message.attributes, message.messageAttributes)
     return message, err
 }
@@ -0,0 +1,275 @@
+package sqs
+
+
+import (
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+    "github.com/IGVF-DACC/go-sqs-deduplication/internal/dedup"
+)
+
+
+// Options of a parser by name, e.g. from -parserOption name=value flags.
+type ParserOptions map[string]string
+
+
+func (o ParserOptions) String(name string, defaultValue string) string {
+    if value, ok := o[name]; ok {
+        return value
+    }
+    return defaultValue
+}
+
+
+func (o ParserOptions) Required(name string) (string, error) {
+    value, ok := o[name]
+    if !ok || value == "" {
+        return "", fmt.Errorf("option %s is required", name)
+    }
+    return value, nil
+}
+
+
+// False if the option isn't set.
+func (o ParserOptions) Bool(name string) (bool, error) {
+    value, ok := o[name]
+    if !ok {
+        return false, nil
+    }
+    parsed, err := strconv.ParseBool(value)
+    if err != nil {
+        return false, fmt.Errorf("option %s must be true or false, got %q", name, value)
+    }
+    return parsed, nil
+}
+
+
+// Parses an option in the form name=value.
+func ParseParserOption(option string) (string, string, error) {
+    name, value, ok := strings.Cut(option, "=")
+    if !ok || name == "" {
+        return "", "", fmt.Errorf("parser option %q must be in the form name=value", option)
+    }
+    return name, value, nil
+}
+
+
+// Named message parser that can be selected with -parser.
+type ParserDefinition struct {
+    Name string
+    Description string
+    Options map[string]string // Description of every option the parser takes, by name.
+    New func(options ParserOptions) (MessageParser, error)
+}
+
+
+var parserRegistry = struct {
+    mu sync.RWMutex
+    parsers map[string]ParserDefinition
+}{parsers: make(map[string]ParserDefinition)}
+
+
+// Makes parser selectable by its name. The package is internal, so parsers
+// are registered from within this module, in init before flags are parsed.
+// Names of registered parsers can't be reused.
+func RegisterParser(definition ParserDefinition) error {
+    if definition.Name == "" || definition.New == nil {
+        return fmt.Errorf("parser needs a name and a constructor")
+    }
+    parserRegistry.mu.Lock()
+    defer parserRegistry.mu.Unlock()
+    if _, ok := parserRegistry.parsers[definition.Name]; ok {
+        return fmt.Errorf("parser %q is already registered", definition.Name)
+    }
+    parserRegistry.parsers[definition.Name] = definition
+    return nil
+}
+
+
+func mustRegisterParser(definition ParserDefinition) {
+    if err := RegisterParser(definition); err != nil {
+        panic(err)
+    }
+}
+
+
+// Registered parsers sorted by name.
+func Parsers() []ParserDefinition {
+    parserRegistry.mu.RLock()
+    defer parserRegistry.mu.RUnlock()
+    var definitions []ParserDefinition
+    for _, definition := range parserRegistry.parsers {
+        definitions = append(definitions, definition)
+    }
+    sort.Slice(definitions, func(i, j int) bool {
+        return definitions[i].Name < definitions[j].Name
+    })
+    return definitions
+}
+
+
+// Creates parser registered as name, rejecting options it doesn't take.
+func NewParser(name string, options ParserOptions) (MessageParser, error) {
+    parserRegistry.mu.RLock()
+    definition, ok := parserRegistry.parsers[name]
+    parserRegistry.mu.RUnlock()
+    if !ok {
+        var names []string
+        for _, definition := range Parsers() {
+            names = append(names, definition.Name)
+        }
+        return nil, fmt.Errorf("unknown parser %q, expected one of %s", name, strings.Join(names, ", "))
+    }
+    for option := range options {
+        if _, ok := definition.Options[option]; !ok {
+            return nil, fmt.Errorf("parser %s doesn't take option %s", name, option)
+        }
+    }
+    parser, err := definition.New(options)
+    if err != nil {
+        return nil, fmt.Errorf("error creating parser %s: %w", name, err)
+    }
+    return parser, nil
+}
+
+
+const (
+    InvalidationParserName = "invalidation"
+    JSONPathParserName = "json-path"
+    RawBodyHashParserName = "raw-body-hash"
+    MessageAttributeParserName = "message-attribute"
+)
+
+
+func init() {
+    mustRegisterParser(ParserDefinition{
+        Name: InvalidationParserName,
+        Description: "Unique ID is data.uuid of the JSON body",
+        New: func(options ParserOptions) (MessageParser, error) {
+            return InvalidationQueueMessageParser, nil
+        },
+    })
+    mustRegisterParser(ParserDefinition{
+        Name: JSONPathParserName,
+        Description: "Unique ID joins values at JSON paths of the body",
+        Options: map[string]string{
+            "keys": "JSON paths, comma separated, with | separated fallbacks, e.g. '$.data.uuid|$.uuid,$.metadata.tid' (required)",
+            "separator": "Separator used to join values of keys (default \":\")",
+            "lowerCase": "Lower-case values of keys",
+            "trimSpace": "Trim whitespace from values of keys",
+        },
+        New: newJSONPathParserFromOptions,
+    })
+    mustRegisterParser(ParserDefinition{
+        Name: RawBodyHashParserName,
+        Description: "Unique ID is the SHA-256 of the body, so only identical bodies are duplicates",
+        Options: map[string]string{
+            "canonicalJSON": "Hash the body as JSON with sorted keys and no whitespace, unparseable bodies are poison messages",
+        },
+        New: newRawBodyHashParser,
+    })
+    mustRegisterParser(ParserDefinition{
+        Name: MessageAttributeParserName,
+        Description: "Unique ID is the value of a message attribute",
+        Options: map[string]string{
+            "name": "Name of the message attribute (required)",
+            "lowerCase": "Lower-case the value",
+            "trimSpace": "Trim whitespace from the value",
+        },
+        New: newMessageAttributeParser,
+    })
+}
+
+
+func newJSONPathParserFromOptions(options ParserOptions) (MessageParser, error) {
+    keys, err := options.Required("keys")
+    if err != nil {
+        return nil, err
+    }
+    parsedKeys, err := ParseJSONPathKeys(keys)
+    if err != nil {
+        return nil, err
+    }
+    lowerCase, err := options.Bool("lowerCase")
+    if err != nil {
+        return nil, err
+    }
+    trimSpace, err := options.Bool("trimSpace")
+    if err != nil {
+        return nil, err
+    }
+    return NewJSONPathMessageParser(&JSONPathParserConfig{
+        Keys: parsedKeys,
+        Separator: options.String("separator", ":"),
+        LowerCase: lowerCase,
+        TrimSpace: trimSpace,
+    })
+}
+
+
+func newRawBodyHashParser(options ParserOptions) (MessageParser, error) {
+    canonicalJSON, err := options.Bool("canonicalJSON")
+    if err != nil {
+        return nil, err
+    }
+    return func(rawMessage types.Message) (dedup.QueueMessage, error) {
+        body := []byte(*rawMessage.Body)
+        if canonicalJSON {
+            document, err := decodeJSONDocument(*rawMessage.Body)
+            if err != nil {
+                return ParsedQueueMessage{}, err
+            }
+            // Keys of decoded objects are sorted when encoded again.
+            body, err = json.Marshal(document)
+            if err != nil {
+                return ParsedQueueMessage{}, fmt.Errorf("error encoding canonical JSON: %w", err)
+            }
+        }
+        sum := sha256.Sum256(body)
+        return NewParsedQueueMessage(rawMessage, hex.EncodeToString(sum[:])), nil
+    }, nil
+}
+
+
+func newMessageAttributeParser(options ParserOptions) (MessageParser, error) {
+    name, err := options.Required("name")
+    if err != nil {
+        return nil, err
+    }
+    lowerCase, err := options.Bool("lowerCase")
+    if err != nil {
+        return nil, err
+    }
+    trimSpace, err := options.Bool("trimSpace")
+    if err != nil {
+        return nil, err
+    }
+    return func(rawMessage types.Message) (dedup.QueueMessage, error) {
+        attribute, ok := rawMessage.MessageAttributes[name]
+        if !ok {
+            return ParsedQueueMessage{}, fmt.Errorf("message has no message attribute %s", name)
+        }
+        var uniqueID string
+        if attribute.BinaryValue != nil {
+            uniqueID = hex.EncodeToString(attribute.BinaryValue)
+        } else if attribute.StringValue != nil {
+            uniqueID = *attribute.StringValue
+        }
+        if trimSpace {
+            uniqueID = strings.TrimSpace(uniqueID)
+        }
+        if lowerCase {
+            uniqueID = strings.ToLower(uniqueID)
+        }
+        if uniqueID == "" {
+            return ParsedQueueMessage{}, fmt.Errorf("message attribute %s is empty", name)
+        }
+        return NewParsedQueueMessage(rawMessage, uniqueID), nil
+    }, nil
+}
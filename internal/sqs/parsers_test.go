@@ -0,0 +1,118 @@
+package sqs
+
+
+import (
+    "strconv"
+    "strings"
+    "testing"
+    "github.com/aws/aws-sdk-go-v2/aws"
+    "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+    "github.com/IGVF-DACC/go-sqs-deduplication/internal/dedup"
+)
+
+
+func TestParserRegistry(t *testing.T) {
+    // Registry is global, so every run of the test registers a new name.
+    name := "test-body-prefix-" + strconv.Itoa(len(Parsers()))
+    definition := ParserDefinition{
+        Name: name,
+        Options: map[string]string{"length": "Characters of the body used as unique ID"},
+        New: func(options ParserOptions) (MessageParser, error) {
+            length, err := strconv.Atoi(options.String("length", "1"))
+            if err != nil {
+                return nil, err
+            }
+            return func(rawMessage types.Message) (dedup.QueueMessage, error) {
+                return NewParsedQueueMessage(rawMessage, aws.ToString(rawMessage.Body)[:length]), nil
+            }, nil
+        },
+    }
+    if err := RegisterParser(definition); err != nil {
+        t.Fatal(err)
+    }
+    if err := RegisterParser(definition); err == nil {
+        t.Error("Expected registering a name twice to fail")
+    }
+    parser, err := NewParser(name, ParserOptions{"length": "3"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    message, err := parser(rawMessage("abcdef"))
+    if err != nil || message.UniqueID() != "abc" || message.RawBody() != "abcdef" {
+        t.Errorf("Expected unique ID from registered parser, got %v, %v", message, err)
+    }
+    found := false
+    for _, definition := range Parsers() {
+        found = found || definition.Name == name
+    }
+    if !found {
+        t.Error("Expected registered parser to be listed")
+    }
+    cases := map[string]struct {
+        name string
+        options ParserOptions
+    }{
+        "unknown parser": {"missing", nil},
+        "unknown option": {InvalidationParserName, ParserOptions{"keys": "$.uuid"}},
+        "missing required option": {JSONPathParserName, nil},
+        "invalid bool option": {JSONPathParserName, ParserOptions{"keys": "$.uuid", "lowerCase": "maybe"}},
+    }
+    for name, c := range cases {
+        if _, err := NewParser(c.name, c.options); err == nil {
+            t.Errorf("Expected %s to fail", name)
+        }
+    }
+}
+
+
+func TestParseParserOption(t *testing.T) {
+    name, value, err := ParseParserOption("keys=$.data.uuid|$.uuid,$.tid")
+    if err != nil || name != "keys" || value != "$.data.uuid|$.uuid,$.tid" {
+        t.Errorf("Expected value kept whole, got %s=%s, %v", name, value, err)
+    }
+    for _, option := range []string{"keys", "=value"} {
+        if _, _, err := ParseParserOption(option); err == nil {
+            t.Errorf("Expected %q to fail to parse", option)
+        }
+    }
+}
+
+
+func TestRawBodyHashParser(t *testing.T) {
+    exact, _ := NewParser(RawBodyHashParserName, nil)
+    canonical, _ := NewParser(RawBodyHashParserName, ParserOptions{"canonicalJSON": "true"})
+    first := rawMessage(`{"a": 1, "b": [1, 2]}`)
+    second := rawMessage(`{"b":[1,2],"a":1}`)
+    exactFirst, _ := exact(first)
+    exactSecond, _ := exact(second)
+    if exactFirst.UniqueID() == exactSecond.UniqueID() {
+        t.Error("Expected different bodies to hash differently")
+    }
+    canonicalFirst, _ := canonical(first)
+    canonicalSecond, _ := canonical(second)
+    if canonicalFirst.UniqueID() != canonicalSecond.UniqueID() {
+        t.Error("Expected same JSON to hash the same with canonicalJSON")
+    }
+    if _, err := canonical(rawMessage("not json")); err == nil {
+        t.Error("Expected error hashing canonical JSON of invalid body")
+    }
+}
+
+
+func TestMessageAttributeParser(t *testing.T) {
+    parser, err := NewParser(MessageAttributeParserName, ParserOptions{"name": "key", "lowerCase": "true", "trimSpace": "true"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    message := rawMessage("{}")
+    message.MessageAttributes = map[string]types.MessageAttributeValue{
+        "key": {DataType: aws.String("String"), StringValue: aws.String(" ABC ")},
+    }
+    parsed, err := parser(message)
+    if err != nil || parsed.UniqueID() != "abc" {
+        t.Errorf("Expected unique ID abc, got %v, %v", parsed, err)
+    }
+    if _, err := parser(rawMessage("{}")); err == nil || !strings.Contains(err.Error(), "key") {
+        t.Errorf("Expected error naming missing attribute, got %v", err)
+    }
+}
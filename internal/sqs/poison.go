@@ -0,0 +1,209 @@
+package sqs
+
+
+import (
+    "context"
+    "fmt"
+    "sync"
+    "sync/atomic"
+    "time"
+    "github.com/aws/aws-sdk-go-v2/aws"
+    "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+    "github.com/IGVF-DACC/go-sqs-deduplication/internal/dedup"
+)
+
+
+// What to do with messages that MessageParser fails on.
+type PoisonAction string
+
+
+const (
+    // Leave message invisible until its visibility timeout expires.
+    PoisonIgnore PoisonAction = "ignore"
+    // Make message visible again for other consumers.
+    PoisonReset PoisonAction = "reset"
+    // Move message to DeadLetterQueueUrl with the parse error attached.
+    PoisonDeadLetter PoisonAction = "dead-letter"
+)
+
+
+func ParsePoisonAction(action string) (PoisonAction, error) {
+    switch PoisonAction(action) {
+    case PoisonIgnore, PoisonReset, PoisonDeadLetter:
+        return PoisonAction(action), nil
+    }
+    return "", fmt.Errorf("unknown poison message action %q", action)
+}
+
+
+// Message attribute holding the error from parsing a dead-lettered message.
+const ParseErrorAttribute = "DedupParseError"
+
+
+const maxParseErrorLength = 256
+
+
+// Message that failed to parse, wrapped so it can be put on another queue.
+type unparsedMessage struct {
+    rawMessage types.Message
+    messageAttributes map[string]dedup.MessageAttribute
+}
+
+
+func newUnparsedMessage(rawMessage types.Message, parseErr error) unparsedMessage {
+    messageAttributes := fromSQSMessageAttributes(rawMessage.MessageAttributes)
+    if len(messageAttributes) < dedup.MaxMessageAttributes {
+        if messageAttributes == nil {
+            messageAttributes = make(map[string]dedup.MessageAttribute)
+        }
+        parseError := parseErr.Error()
+        if len(parseError) > maxParseErrorLength {
+            parseError = parseError[:maxParseErrorLength]
+        }
+        messageAttributes[ParseErrorAttribute] = dedup.MessageAttribute{DataType: "String", StringValue: parseError}
+    }
+    return unparsedMessage{rawMessage: rawMessage, messageAttributes: messageAttributes}
+}
+
+
+func (m unparsedMessage) UniqueID() string {
+    return ""
+}
+
+
+func (m unparsedMessage) MessageID() string {
+    return aws.ToString(m.rawMessage.MessageId)
+}
+
+
+func (m unparsedMessage) ReceiptHandle() string {
+    return aws.ToString(m.rawMessage.ReceiptHandle)
+}
+
+
+func (m unparsedMessage) RawBody() string {
+    return aws.ToString(m.rawMessage.Body)
+}
+
+
+func (m unparsedMessage) SentTime() time.Time {
+    return sentTime(m.rawMessage.Attributes, m.messageAttributes)
+}
+
+
+func (m unparsedMessage) Attributes() map[string]string {
+    return m.rawMessage.Attributes
+}
+
+
+func (m unparsedMessage) MessageAttributes() map[string]dedup.MessageAttribute {
+    return m.messageAttributes
+}
+
+
+type poisonCounters struct {
+    deadLettered atomic.Int64
+    reset atomic.Int64
+    ignored atomic.Int64
+    failed atomic.Int64
+}
+
+
+func (c *poisonCounters) stats() dedup.PoisonStats {
+    return dedup.PoisonStats{
+        DeadLettered: c.deadLettered.Load(),
+        Reset: c.reset.Load(),
+        Ignored: c.ignored.Load(),
+        Failed: c.failed.Load(),
+    }
+}
+
+
+// Tracks when poison messages were last reset. A reset message is
+// received again a few seconds later, so it is only reset once per
+// visibility timeout to avoid pulling it over and over in one run.
+type resetTracker struct {
+    mu sync.Mutex
+    lastReset map[string]time.Time
+}
+
+
+func (r *resetTracker) shouldReset(messageID string, now time.Time, window time.Duration) bool {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    for id, resetAt := range r.lastReset {
+        if now.Sub(resetAt) > window {
+            delete(r.lastReset, id)
+        }
+    }
+    if _, ok := r.lastReset[messageID]; ok {
+        return false
+    }
+    r.lastReset[messageID] = now
+    return true
+}
+
+
+func (q *Queue) handlePoisonMessages(ctx context.Context, messages []unparsedMessage) {
+    if len(messages) == 0 {
+        return
+    }
+    switch q.config.PoisonMessageAction {
+    case PoisonDeadLetter:
+        q.deadLetterPoisonMessages(ctx, messages)
+    case PoisonReset:
+        q.resetPoisonMessages(ctx, messages)
+    default:
+        q.poison.ignored.Add(int64(len(messages)))
+    }
+}
+
+
+func (q *Queue) resetPoisonMessages(ctx context.Context, messages []unparsedMessage) {
+    var receiptHandles []string
+    now := time.Now()
+    for _, message := range messages {
+        if q.poisonResets.shouldReset(message.MessageID(), now, q.visibilityTimeout()) {
+            receiptHandles = append(receiptHandles, message.ReceiptHandle())
+        } else {
+            q.poison.ignored.Add(1)
+        }
+    }
+    if len(receiptHandles) == 0 {
+        return
+    }
+    result, err := q.ResetVisibilityBatch(ctx, receiptHandles)
+    if err != nil {
+        q.logger.ErrorContext(ctx, "Error resetting poison messages", "error", err)
+        q.poison.failed.Add(int64(len(receiptHandles)))
+        return
+    }
+    q.poison.reset.Add(int64(len(result.Succeeded)))
+    q.poison.failed.Add(int64(len(result.Failed)))
+}
+
+
+func (q *Queue) deadLetterPoisonMessages(ctx context.Context, messages []unparsedMessage) {
+    var queueMessages []dedup.QueueMessage
+    for _, message := range messages {
+        queueMessages = append(queueMessages, message)
+    }
+    putResult, err := q.deadLetterQueue.PutMessagesBatch(ctx, queueMessages)
+    if err != nil {
+        q.logger.ErrorContext(ctx, "Error sending poison messages to dead-letter queue", "error", err)
+        q.poison.failed.Add(int64(len(messages)))
+        return
+    }
+    q.poison.failed.Add(int64(len(putResult.Failed)))
+    if len(putResult.Succeeded) == 0 {
+        return
+    }
+    deleteResult, err := q.DeleteMessagesBatch(ctx, putResult.Succeeded)
+    if err != nil {
+        q.logger.ErrorContext(ctx, "Error deleting dead-lettered poison messages", "error", err)
+        q.poison.failed.Add(int64(len(putResult.Succeeded)))
+        return
+    }
+    q.poison.deadLettered.Add(int64(len(deleteResult.Succeeded)))
+    q.poison.failed.Add(int64(len(deleteResult.Failed)))
+}
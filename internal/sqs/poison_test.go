@@ -0,0 +1,98 @@
+package sqs
+
+
+import (
+    "errors"
+    "strings"
+    "testing"
+    "time"
+    "github.com/aws/aws-sdk-go-v2/aws"
+    "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+
+func TestDeadLetterEntryKeepsBodyAndAddsParseError(t *testing.T) {
+    rawMessage := types.Message{
+        Body: aws.String("not json"),
+        MessageId: aws.String("msg-1"),
+        ReceiptHandle: aws.String("receipt-1"),
+        MessageAttributes: map[string]types.MessageAttributeValue{
+            "source": {DataType: aws.String("String"), StringValue: aws.String("indexer")},
+        },
+    }
+    _, parseErr := InvalidationQueueMessageParser(rawMessage)
+    if parseErr == nil {
+        t.Fatal("Expected parse error")
+    }
+    message := newUnparsedMessage(rawMessage, parseErr)
+    if message.ReceiptHandle() != "receipt-1" {
+        t.Errorf("Expected receipt handle of raw message, got %s", message.ReceiptHandle())
+    }
+    entry := sendMessageEntry("message_0", message)
+    if aws.ToString(entry.MessageBody) != "not json" {
+        t.Errorf("Expected original body, got %s", aws.ToString(entry.MessageBody))
+    }
+    if aws.ToString(entry.MessageAttributes["source"].StringValue) != "indexer" {
+        t.Error("Expected original message attributes to be kept")
+    }
+    parseError := aws.ToString(entry.MessageAttributes[ParseErrorAttribute].StringValue)
+    if parseError != parseErr.Error() {
+        t.Errorf("Expected parse error attribute %q, got %q", parseErr.Error(), parseError)
+    }
+}
+
+
+func TestDeadLetterParseErrorTruncated(t *testing.T) {
+    rawMessage := types.Message{Body: aws.String("{}"), ReceiptHandle: aws.String("receipt-1")}
+    message := newUnparsedMessage(rawMessage, errors.New(strings.Repeat("x", 1000)))
+    if len(message.MessageAttributes()[ParseErrorAttribute].StringValue) != maxParseErrorLength {
+        t.Error("Expected parse error to be truncated")
+    }
+}
+
+
+func TestResetTrackerResetsOncePerWindow(t *testing.T) {
+    tracker := &resetTracker{lastReset: make(map[string]time.Time)}
+    now := time.Now()
+    window := time.Minute
+    if !tracker.shouldReset("msg-1", now, window) {
+        t.Error("Expected first sighting to be reset")
+    }
+    if tracker.shouldReset("msg-1", now.Add(time.Second), window) {
+        t.Error("Expected message reset within window to be left alone")
+    }
+    if !tracker.shouldReset("msg-2", now.Add(time.Second), window) {
+        t.Error("Expected other message to be reset")
+    }
+    if !tracker.shouldReset("msg-1", now.Add(2 * window), window) {
+        t.Error("Expected message to be reset again after window")
+    }
+}
+
+
+func TestParsePoisonAction(t *testing.T) {
+    for _, action := range []string{"ignore", "reset", "dead-letter"} {
+        if _, err := ParsePoisonAction(action); err != nil {
+            t.Errorf("Expected %s to be valid: %v", action, err)
+        }
+    }
+    if _, err := ParsePoisonAction("drop"); err == nil {
+        t.Error("Expected error for unknown action")
+    }
+}
+
+
+func TestInvalidationParserRejectsMissingUUID(t *testing.T) {
+    // SNS notification parsed without unwrapping its envelope.
+    notification := `{"Type": "Notification", "TopicArn": "arn:aws:sns:us-west-2:000000000000:invalidations", "Message": "{\"data\": {\"uuid\": \"abc\"}}"}`
+    for _, body := range []string{`{"data": {}}`, `{"data": {"uuid": ""}}`, notification} {
+        _, err := InvalidationQueueMessageParser(types.Message{
+            Body: aws.String(body),
+            MessageId: aws.String("msg-1"),
+            ReceiptHandle: aws.String("receipt-1"),
+        })
+        if err == nil {
+            t.Errorf("Expected error parsing message without data.uuid %s", body)
+        }
+    }
+}
@@ -4,7 +4,9 @@ package sqs
 import (
     "fmt"
     "context"
+    "log/slog"
     "os"
+    "time"
     "github.com/aws/aws-sdk-go-v2/aws"
     _sqs "github.com/aws/aws-sdk-go-v2/service/sqs"
     "github.com/aws/aws-sdk-go-v2/service/sqs/types"
@@ -13,21 +15,25 @@ import (
 )
 
 
-func getClient(profileName string) *_sqs.Client {
+func getClient(queueConfig *QueueConfig, logger *slog.Logger) *_sqs.Client {
     config, err := config.LoadDefaultConfig(
         context.TODO(),
-        config.WithSharedConfigProfile(profileName),
+        config.WithSharedConfigProfile(queueConfig.ProfileName),
     )
     if err != nil {
-        fmt.Println("error creating SQS client", err)
+        logger.Error("Error creating SQS client", "error", err)
         os.Exit(1)
     }
     return _sqs.NewFromConfig(
         config,
         func (o *_sqs.Options) {
-            if localstackURL := os.Getenv("LOCALSTACK_ENDPOINT_URL"); localstackURL != "" {
+            if queueConfig.EndpointURL != "" {
+                o.BaseEndpoint = aws.String(queueConfig.EndpointURL)
+            } else if localstackURL := os.Getenv("LOCALSTACK_ENDPOINT_URL"); localstackURL != "" {
                 o.BaseEndpoint = aws.String(localstackURL)
             }
+            // Retries are handled by Queue using RetryPolicy.
+            o.Retryer = aws.NopRetryer{}
         },
     )
 }
@@ -36,115 +42,278 @@ func getClient(profileName string) *_sqs.Client {
 type QueueConfig struct {
     QueueUrl *string
     ProfileName string
-    MessageParser messageParser
+    EndpointURL string // Of SQS-compatible service, uses LOCALSTACK_ENDPOINT_URL or AWS if empty.
+    MessageParser MessageParser
+    Envelopes Envelopes // Unwrapped from bodies before MessageParser, RawBody stays the full body.
+    RetryPolicy *RetryPolicy // Uses DefaultRetryPolicy if nil.
+    VisibilityTimeout time.Duration // Of received messages, uses DefaultVisibilityTimeout if zero.
+    PoisonMessageAction PoisonAction // For messages MessageParser fails on, PoisonIgnore if empty.
+    DeadLetterQueueUrl *string // Required for PoisonDeadLetter.
+    Logger *slog.Logger // Uses slog.Default if nil.
 }
 
 
+const DefaultVisibilityTimeout = 900 * time.Second
+
+
+const resetVisibilityTimeout = 3 * time.Second
+
+
 func NewQueue(queueConfig *QueueConfig) *Queue {
-    client := getClient(queueConfig.ProfileName)
-    return &Queue{
+    logger := dedup.WithRunID(queueConfig.Logger).With("queue", aws.ToString(queueConfig.QueueUrl))
+    client := getClient(queueConfig, logger)
+    retryPolicy := queueConfig.RetryPolicy
+    if retryPolicy == nil {
+        retryPolicy = DefaultRetryPolicy()
+    }
+    queue := &Queue{
         client: client,
         config: queueConfig,
+        messageParser: WithEnvelopes(queueConfig.MessageParser, queueConfig.Envelopes),
+        retryPolicy: retryPolicy,
+        counters: &retryCounters{},
+        logger: logger,
+        poison: &poisonCounters{},
+        poisonResets: &resetTracker{lastReset: make(map[string]time.Time)},
+    }
+    if queueConfig.PoisonMessageAction == PoisonDeadLetter {
+        if queueConfig.DeadLetterQueueUrl == nil {
+            logger.Error("Dead-letter queue URL required for poison message action", "action", PoisonDeadLetter)
+            os.Exit(1)
+        }
+        // Shares client and retry counters with source queue.
+        queue.deadLetterQueue = &Queue{
+            client: client,
+            config: &QueueConfig{QueueUrl: queueConfig.DeadLetterQueueUrl},
+            retryPolicy: retryPolicy,
+            counters: queue.counters,
+            logger: logger.With("dead_letter_queue", aws.ToString(queueConfig.DeadLetterQueueUrl)),
+        }
     }
+    return queue
 }
 
 
 type Queue struct {
     client *_sqs.Client
     config *QueueConfig
+    messageParser MessageParser
+    retryPolicy *RetryPolicy
+    counters *retryCounters
+    logger *slog.Logger
+    poison *poisonCounters
+    poisonResets *resetTracker
+    deadLetterQueue *Queue
+}
+
+
+func (q *Queue) visibilityTimeout() time.Duration {
+    if q.config.VisibilityTimeout == 0 {
+        return DefaultVisibilityTimeout
+    }
+    return q.config.VisibilityTimeout
+}
+
+
+func (q *Queue) RetryStats() dedup.RetryStats {
+    return q.counters.stats()
+}
+
+
+func (q *Queue) PoisonStats() dedup.PoisonStats {
+    return q.poison.stats()
 }
 
 
-func (q *Queue) PullMessagesBatch() ([]dedup.QueueMessage, error) {
+func (q *Queue) PullMessagesBatch(ctx context.Context) ([]dedup.QueueMessage, error) {
     var messages []dedup.QueueMessage
-    result, err := q.client.ReceiveMessage(context.TODO(), &_sqs.ReceiveMessageInput{
-        QueueUrl: q.config.QueueUrl,
-        MaxNumberOfMessages: 10,
-        WaitTimeSeconds: 10,
-        VisibilityTimeout: 900,
+    var result *_sqs.ReceiveMessageOutput
+    err := q.withRetry(ctx, func() error {
+        var err error
+        result, err = q.client.ReceiveMessage(ctx, &_sqs.ReceiveMessageInput{
+            QueueUrl: q.config.QueueUrl,
+            MaxNumberOfMessages: 10,
+            WaitTimeSeconds: 10,
+            VisibilityTimeout: int32(q.visibilityTimeout().Seconds()),
+            AttributeNames: []types.QueueAttributeName{types.QueueAttributeNameAll},
+            MessageAttributeNames: []string{"All"},
+        })
+        return err
     })
     if err != nil {
         return messages, err
     }
+    var poisonMessages []unparsedMessage
     for _, rawMessage := range result.Messages {
-        message, err := q.config.MessageParser(rawMessage)
+        message, err := q.messageParser(rawMessage)
         if err != nil {
-            fmt.Println("Error parsing message", err)
+            q.logger.WarnContext(ctx, "Error parsing message", "message_id", aws.ToString(rawMessage.MessageId), "error", err)
+            poisonMessages = append(poisonMessages, newUnparsedMessage(rawMessage, err))
             continue
         }
         messages = append(messages, message)
     }
-    return messages, err
+    // Finish handling poison messages even if pulling was cancelled.
+    q.handlePoisonMessages(context.WithoutCancel(ctx), poisonMessages)
+    if len(messages) == 0 && len(poisonMessages) > 0 {
+        return messages, dedup.ErrOnlyPoisonMessages
+    }
+    return messages, nil
+}
+
+
+func (q *Queue) logBatchEntryFailure(ctx context.Context, msg string, fail types.BatchResultErrorEntry) {
+    q.logger.WarnContext(
+        ctx,
+        msg,
+        "id", aws.ToString(fail.Id),
+        "code", aws.ToString(fail.Code),
+        "error", aws.ToString(fail.Message),
+        "sender_fault", fail.SenderFault,
+    )
 }
 
 
-func (q *Queue) DeleteMessagesBatch(receiptHandles []string) {
+func entryID(i int) string {
+    return fmt.Sprintf("message_%d", i)
+}
+
+
+func toBatchResult(receiptHandles []string, successful []string, failed []types.BatchResultErrorEntry) dedup.BatchResult {
+    var result dedup.BatchResult
+    receiptHandleByID := make(map[string]string)
+    for i, receiptHandle := range receiptHandles {
+        receiptHandleByID[entryID(i)] = receiptHandle
+    }
+    for _, id := range successful {
+        result.Succeeded = append(result.Succeeded, receiptHandleByID[id])
+    }
+    for _, fail := range failed {
+        result.Failed = append(result.Failed, dedup.BatchEntryFailure{
+            ReceiptHandle: receiptHandleByID[aws.ToString(fail.Id)],
+            Code: aws.ToString(fail.Code),
+            Message: aws.ToString(fail.Message),
+            SenderFault: fail.SenderFault,
+        })
+    }
+    return result
+}
+
+
+func (q *Queue) DeleteMessagesBatch(ctx context.Context, receiptHandles []string) (dedup.BatchResult, error) {
     var entries []types.DeleteMessageBatchRequestEntry
     for i, receiptHandle := range receiptHandles {
         entries = append(entries, types.DeleteMessageBatchRequestEntry{
-            Id: aws.String(fmt.Sprintf("message_%d", i)),
+            Id: aws.String(entryID(i)),
             ReceiptHandle: aws.String(receiptHandle),
         })
     }
-    input := _sqs.DeleteMessageBatchInput{
-        Entries:  entries,
-        QueueUrl: q.config.QueueUrl,
-    }
-    result, err := q.client.DeleteMessageBatch(context.TODO(), &input)
+    successful, failed, err := sendBatchWithRetry(
+        ctx,
+        q,
+        entries,
+        func(entry types.DeleteMessageBatchRequestEntry) string { return aws.ToString(entry.Id) },
+        func(entries []types.DeleteMessageBatchRequestEntry) ([]string, []types.BatchResultErrorEntry, error) {
+            result, err := q.client.DeleteMessageBatch(ctx, &_sqs.DeleteMessageBatchInput{
+                Entries:  entries,
+                QueueUrl: q.config.QueueUrl,
+            })
+            if err != nil {
+                return nil, nil, err
+            }
+            var successful []string
+            for _, success := range result.Successful {
+                successful = append(successful, aws.ToString(success.Id))
+            }
+            return successful, result.Failed, nil
+        },
+    )
     if err != nil {
-        fmt.Println("Error deleting batch", err)
+        return dedup.BatchResult{}, fmt.Errorf("error deleting message batch: %w", err)
     }
-    for _, failure := range result.Failed {
-        fmt.Printf("Failed to delete message: ID %s. Error code: %s, Error message: %s\n", *failure.Id, *failure.Code, *failure.Message)
+    for _, fail := range failed {
+        q.logBatchEntryFailure(ctx, "Failed to delete message", fail)
     }
+    return toBatchResult(receiptHandles, successful, failed), nil
 }
 
 
-func (q *Queue) ResetVisibilityBatch(receiptHandles []string) {
+func (q *Queue) ResetVisibilityBatch(ctx context.Context, receiptHandles []string) (dedup.BatchResult, error) {
+    return q.ChangeVisibilityBatch(ctx, receiptHandles, resetVisibilityTimeout)
+}
+
+
+func (q *Queue) ChangeVisibilityBatch(ctx context.Context, receiptHandles []string, visibilityTimeout time.Duration) (dedup.BatchResult, error) {
     var entries []types.ChangeMessageVisibilityBatchRequestEntry
     for i, receiptHandle := range receiptHandles {
         entries = append(entries, types.ChangeMessageVisibilityBatchRequestEntry{
-            Id: aws.String(fmt.Sprintf("message_%d", i)),
+            Id: aws.String(entryID(i)),
             ReceiptHandle: aws.String(receiptHandle),
-            VisibilityTimeout: 3,
+            VisibilityTimeout: int32(visibilityTimeout.Seconds()),
         })
     }
-    input := _sqs.ChangeMessageVisibilityBatchInput{
-        Entries: entries,
-        QueueUrl: q.config.QueueUrl,
-    }
-    result, err := q.client.ChangeMessageVisibilityBatch(context.TODO(), &input)
+    successful, failed, err := sendBatchWithRetry(
+        ctx,
+        q,
+        entries,
+        func(entry types.ChangeMessageVisibilityBatchRequestEntry) string { return aws.ToString(entry.Id) },
+        func(entries []types.ChangeMessageVisibilityBatchRequestEntry) ([]string, []types.BatchResultErrorEntry, error) {
+            result, err := q.client.ChangeMessageVisibilityBatch(ctx, &_sqs.ChangeMessageVisibilityBatchInput{
+                Entries: entries,
+                QueueUrl: q.config.QueueUrl,
+            })
+            if err != nil {
+                return nil, nil, err
+            }
+            var successful []string
+            for _, success := range result.Successful {
+                successful = append(successful, aws.ToString(success.Id))
+            }
+            return successful, result.Failed, nil
+        },
+    )
     if err != nil {
-        fmt.Println("Error reseting visibility batch", err)
+        return dedup.BatchResult{}, fmt.Errorf("error changing visibility batch: %w", err)
     }
-    for _, fail := range result.Failed {
-        fmt.Printf("Failed ID: %s, Code: %s, Message: %s\n", *fail.Id, *fail.Code, *fail.Message)
+    for _, fail := range failed {
+        q.logBatchEntryFailure(ctx, "Failed to change message visibility", fail)
     }
+    return toBatchResult(receiptHandles, successful, failed), nil
 }
 
 
-func (q *Queue) PutMessagesBatch(messages []dedup.QueueMessage) error {
+func (q *Queue) PutMessagesBatch(ctx context.Context, messages []dedup.QueueMessage) (dedup.BatchResult, error) {
     var entries []types.SendMessageBatchRequestEntry
+    var receiptHandles []string
     for i, message := range messages {
-        entries = append(entries, types.SendMessageBatchRequestEntry{
-            Id: aws.String(fmt.Sprintf("message_%d", i)),
-            MessageBody: aws.String(message.RawBody()),
-        })
+        entries = append(entries, sendMessageEntry(entryID(i), message))
+        receiptHandles = append(receiptHandles, message.ReceiptHandle())
     }
-    input := _sqs.SendMessageBatchInput{
-        Entries: entries,
-        QueueUrl: q.config.QueueUrl,
-    }
-    result, err := q.client.SendMessageBatch(context.TODO(), &input)
+    successful, failed, err := sendBatchWithRetry(
+        ctx,
+        q,
+        entries,
+        func(entry types.SendMessageBatchRequestEntry) string { return aws.ToString(entry.Id) },
+        func(entries []types.SendMessageBatchRequestEntry) ([]string, []types.BatchResultErrorEntry, error) {
+            result, err := q.client.SendMessageBatch(ctx, &_sqs.SendMessageBatchInput{
+                Entries: entries,
+                QueueUrl: q.config.QueueUrl,
+            })
+            if err != nil {
+                return nil, nil, err
+            }
+            var successful []string
+            for _, success := range result.Successful {
+                successful = append(successful, aws.ToString(success.Id))
+            }
+            return successful, result.Failed, nil
+        },
+    )
     if err != nil {
-        return fmt.Errorf("error sending message batch: %w", err)
+        return dedup.BatchResult{}, fmt.Errorf("error sending message batch: %w", err)
     }
-    if len(result.Failed) > 0 {
-        for _, fail := range result.Failed {
-            fmt.Printf("Failed to send message: ID %s. Error code: %s, Error message: %s\n",
-                       *fail.Id, *fail.Code, *fail.Message)
-        }
-        return fmt.Errorf("some messages failed to send")
+    for _, fail := range failed {
+        q.logBatchEntryFailure(ctx, "Failed to send message", fail)
     }
-    return nil
+    return toBatchResult(receiptHandles, successful, failed), nil
 }
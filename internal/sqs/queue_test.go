@@ -0,0 +1,255 @@
+package sqs
+
+
+import (
+    "context"
+    "errors"
+    "path/filepath"
+    "strconv"
+    "sync"
+    "testing"
+    "time"
+    "github.com/aws/aws-sdk-go-v2/aws"
+    "github.com/IGVF-DACC/go-sqs-deduplication/internal/dedup"
+    "github.com/IGVF-DACC/go-sqs-deduplication/internal/memory"
+    "github.com/IGVF-DACC/go-sqs-deduplication/internal/sqsfake"
+)
+
+
+// Points the SDK at fake credentials, so nothing is read from the environment.
+func useFakeCredentials(t *testing.T) {
+    t.Setenv("AWS_ACCESS_KEY_ID", "test")
+    t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+    t.Setenv("AWS_REGION", sqsfake.Region)
+    t.Setenv("AWS_CONFIG_FILE", filepath.Join(t.TempDir(), "config"))
+    t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(t.TempDir(), "credentials"))
+    t.Setenv("LOCALSTACK_ENDPOINT_URL", "")
+}
+
+
+func newFakeQueue(t *testing.T, server *sqsfake.Server, queueURL string, config *QueueConfig) *Queue {
+    config.QueueUrl = aws.String(queueURL)
+    config.EndpointURL = server.URL()
+    if config.MessageParser == nil {
+        config.MessageParser = InvalidationQueueMessageParser
+    }
+    config.RetryPolicy = &RetryPolicy{MaxAttempts: 1, IsRetryable: IsRetryableError}
+    return NewQueue(config)
+}
+
+
+func invalidationBody(uuid string) string {
+    return `{"data": {"uuid": "` + uuid + `"}}`
+}
+
+
+func TestQueueMovesMessagesThroughFake(t *testing.T) {
+    useFakeCredentials(t)
+    server := sqsfake.NewServer(&sqsfake.ServerConfig{})
+    defer server.Close()
+    queueURL := server.CreateQueue("queue")
+    storageQueueURL := server.CreateQueue("storage")
+    messageAttributes := map[string]dedup.MessageAttribute{
+        "source": {DataType: "String", StringValue: "indexer"},
+        "checksum": {DataType: "Binary", BinaryValue: []byte{0, 1, 2}},
+    }
+    for i := 0; i < 15; i++ {
+        if _, err := server.SendMessage(queueURL, invalidationBody(strconv.Itoa(i)), messageAttributes); err != nil {
+            t.Fatal(err)
+        }
+    }
+    queue := newFakeQueue(t, server, queueURL, &QueueConfig{})
+    storageQueue := newFakeQueue(t, server, storageQueueURL, &QueueConfig{})
+    ctx := context.Background()
+    var pulled []dedup.QueueMessage
+    for {
+        messages, err := queue.PullMessagesBatch(ctx)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if len(messages) == 0 {
+            break
+        }
+        pulled = append(pulled, messages...)
+    }
+    if len(pulled) != 15 {
+        t.Fatalf("Expected 15 messages pulled, got %d", len(pulled))
+    }
+    for _, message := range pulled {
+        if message.RawBody() != invalidationBody(message.UniqueID()) {
+            t.Errorf("Expected body of %s kept, got %s", message.UniqueID(), message.RawBody())
+        }
+        if message.SentTime().IsZero() {
+            t.Error("Expected sent time from SentTimestamp")
+        }
+        if string(message.MessageAttributes()["checksum"].BinaryValue) != "\x00\x01\x02" {
+            t.Errorf("Expected binary message attribute, got %+v", message.MessageAttributes()["checksum"])
+        }
+    }
+    for _, batch := range [][]dedup.QueueMessage{pulled[:10], pulled[10:]} {
+        result, err := storageQueue.PutMessagesBatch(ctx, batch)
+        if err != nil || len(result.Succeeded) != len(batch) {
+            t.Fatalf("Expected batch put, got %+v, %v", result, err)
+        }
+        var receiptHandles []string
+        for _, message := range batch {
+            receiptHandles = append(receiptHandles, message.ReceiptHandle())
+        }
+        result, err = queue.DeleteMessagesBatch(ctx, receiptHandles)
+        if err != nil || len(result.Succeeded) != len(batch) {
+            t.Fatalf("Expected batch deleted, got %+v, %v", result, err)
+        }
+    }
+    if len(server.Messages(queueURL)) != 0 {
+        t.Errorf("Expected queue to be empty, got %d messages", len(server.Messages(queueURL)))
+    }
+    stored := server.Messages(storageQueueURL)
+    if len(stored) != 15 {
+        t.Fatalf("Expected 15 stored messages, got %d", len(stored))
+    }
+    for _, message := range stored {
+        if message.MessageAttributes["source"].StringValue != "indexer" {
+            t.Errorf("Expected message attributes kept, got %+v", message.MessageAttributes)
+        }
+        if _, ok := message.MessageAttributes[OriginalSentTimestampAttribute]; !ok {
+            t.Error("Expected original sent timestamp recorded")
+        }
+    }
+}
+
+
+func TestQueueReportsFailedEntriesFromFake(t *testing.T) {
+    useFakeCredentials(t)
+    clock := memory.NewManualClock(time.Now())
+    server := sqsfake.NewServer(&sqsfake.ServerConfig{Clock: clock})
+    defer server.Close()
+    queueURL := server.CreateQueue("queue")
+    server.SendMessage(queueURL, invalidationBody("abc"), nil)
+    queue := newFakeQueue(t, server, queueURL, &QueueConfig{VisibilityTimeout: time.Minute})
+    ctx := context.Background()
+    messages, err := queue.PullMessagesBatch(ctx)
+    if err != nil || len(messages) != 1 {
+        t.Fatalf("Expected one message, got %d, %v", len(messages), err)
+    }
+    staleReceiptHandle := messages[0].ReceiptHandle()
+    clock.Advance(time.Minute)
+    messages, _ = queue.PullMessagesBatch(ctx)
+    if len(messages) != 1 {
+        t.Fatalf("Expected message delivered again once visibility expired, got %d", len(messages))
+    }
+    result, err := queue.ChangeVisibilityBatch(ctx, []string{staleReceiptHandle, messages[0].ReceiptHandle()}, time.Minute)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(result.Succeeded) != 1 || len(result.Failed) != 1 {
+        t.Fatalf("Expected stale receipt handle to fail, got %+v", result)
+    }
+    failure := result.Failed[0]
+    if failure.ReceiptHandle != staleReceiptHandle || failure.Code != "ReceiptHandleIsInvalid" || !failure.SenderFault {
+        t.Errorf("Unexpected failure %+v", failure)
+    }
+    result, err = queue.DeleteMessagesBatch(ctx, []string{"unknown"})
+    if err != nil || len(result.Failed) != 1 || result.Failed[0].ReceiptHandle != "unknown" {
+        t.Errorf("Expected unknown receipt handle to fail, got %+v, %v", result, err)
+    }
+    missingQueue := newFakeQueue(t, server, server.URL() + "/" + sqsfake.AccountID + "/missing", &QueueConfig{})
+    if _, err := missingQueue.PullMessagesBatch(ctx); err == nil {
+        t.Error("Expected error pulling from missing queue")
+    }
+}
+
+
+func TestQueueDeadLettersPoisonMessagesToFake(t *testing.T) {
+    useFakeCredentials(t)
+    server := sqsfake.NewServer(&sqsfake.ServerConfig{})
+    defer server.Close()
+    queueURL := server.CreateQueue("queue")
+    deadLetterQueueURL := server.CreateQueue("dead-letter")
+    server.SendMessage(queueURL, "not json", nil)
+    server.SendMessage(queueURL, invalidationBody("abc"), nil)
+    queue := newFakeQueue(t, server, queueURL, &QueueConfig{
+        PoisonMessageAction: PoisonDeadLetter,
+        DeadLetterQueueUrl: aws.String(deadLetterQueueURL),
+    })
+    messages, err := queue.PullMessagesBatch(context.Background())
+    if err != nil || len(messages) != 1 {
+        t.Fatalf("Expected one parsed message, got %d, %v", len(messages), err)
+    }
+    deadLettered := server.Messages(deadLetterQueueURL)
+    if len(deadLettered) != 1 || deadLettered[0].Body != "not json" {
+        t.Fatalf("Expected poison message dead-lettered, got %+v", deadLettered)
+    }
+    if _, ok := deadLettered[0].MessageAttributes[ParseErrorAttribute]; !ok {
+        t.Error("Expected parse error attached")
+    }
+    if len(server.Messages(queueURL)) != 1 {
+        t.Errorf("Expected poison message deleted from queue, got %d messages", len(server.Messages(queueURL)))
+    }
+}
+
+
+func TestQueueReportsBatchOfOnlyPoisonMessages(t *testing.T) {
+    useFakeCredentials(t)
+    server := sqsfake.NewServer(&sqsfake.ServerConfig{})
+    defer server.Close()
+    queueURL := server.CreateQueue("queue")
+    for i := 0; i < 10; i++ {
+        server.SendMessage(queueURL, "not json", nil)
+    }
+    server.SendMessage(queueURL, invalidationBody("abc"), nil)
+    queue := newFakeQueue(t, server, queueURL, &QueueConfig{PoisonMessageAction: PoisonIgnore})
+    messages, err := queue.PullMessagesBatch(context.Background())
+    if !errors.Is(err, dedup.ErrOnlyPoisonMessages) || len(messages) != 0 {
+        t.Fatalf("Expected only poison messages reported, got %d, %v", len(messages), err)
+    }
+    messages, err = queue.PullMessagesBatch(context.Background())
+    if err != nil || len(messages) != 1 {
+        t.Errorf("Expected parsed message behind poison messages, got %d, %v", len(messages), err)
+    }
+    if queue.PoisonStats().Ignored != 10 {
+        t.Errorf("Expected 10 ignored poison messages, got %+v", queue.PoisonStats())
+    }
+}
+
+
+func TestMoverKeepsSentTimestampBeforeMoveToken(t *testing.T) {
+    useFakeCredentials(t)
+    server := sqsfake.NewServer(&sqsfake.ServerConfig{})
+    defer server.Close()
+    queueURL := server.CreateQueue("queue")
+    storageQueueURL := server.CreateQueue("storage")
+    for _, count := range []int{8, 9} {
+        messageAttributes := make(map[string]dedup.MessageAttribute)
+        for i := 0; i < count; i++ {
+            messageAttributes["attribute" + strconv.Itoa(i)] = dedup.MessageAttribute{DataType: "String", StringValue: "value"}
+        }
+        server.SendMessage(queueURL, invalidationBody(strconv.Itoa(count)), messageAttributes)
+    }
+    queue := newFakeQueue(t, server, queueURL, &QueueConfig{})
+    messages, err := queue.PullMessagesBatch(context.Background())
+    if err != nil || len(messages) != 2 {
+        t.Fatalf("Expected 2 messages, got %d, %v", len(messages), err)
+    }
+    moveChannel := make(chan dedup.QueueMessage, len(messages))
+    for _, message := range messages {
+        moveChannel <- message
+    }
+    close(moveChannel)
+    wg := &sync.WaitGroup{}
+    mover := dedup.NewMover(queue, newFakeQueue(t, server, storageQueueURL, &QueueConfig{}), moveChannel, dedup.NewShardedSharedState(1), true, wg)
+    mover.Start(context.Background())
+    wg.Wait()
+    if mover.MessagesMoved() != 2 || mover.MessagesUntokened() != 1 {
+        t.Errorf("Expected 2 moved and 1 without move token, got %d and %d", mover.MessagesMoved(), mover.MessagesUntokened())
+    }
+    for _, message := range server.Messages(storageQueueURL) {
+        _, hasSentTimestamp := message.MessageAttributes[OriginalSentTimestampAttribute]
+        _, hasMoveToken := message.MessageAttributes[dedup.MoveTokenAttribute]
+        if !hasSentTimestamp {
+            t.Errorf("Expected original sent timestamp kept on %s", message.Body)
+        }
+        if hasMoveToken != (message.Body == invalidationBody("8")) {
+            t.Errorf("Expected move token only with room for it, got %v on %s", hasMoveToken, message.Body)
+        }
+    }
+}
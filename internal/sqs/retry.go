@@ -0,0 +1,240 @@
+package sqs
+
+
+import (
+    "context"
+    "errors"
+    "math/rand"
+    "net"
+    "sync/atomic"
+    "time"
+    "github.com/aws/aws-sdk-go-v2/aws"
+    "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+    "github.com/aws/smithy-go"
+    "github.com/IGVF-DACC/go-sqs-deduplication/internal/dedup"
+)
+
+
+var throttlingErrorCodes = map[string]struct{}{
+    "RequestThrottled": {},
+    "AWS.SimpleQueueService.RequestThrottled": {},
+    "ThrottlingException": {},
+    "Throttling": {},
+    "OverLimit": {},
+    "KmsThrottled": {},
+}
+
+
+var transientErrorCodes = map[string]struct{}{
+    "InternalError": {},
+    "InternalFailure": {},
+    "ServiceUnavailable": {},
+    "RequestTimeout": {},
+}
+
+
+func isThrottlingCode(code string) bool {
+    _, ok := throttlingErrorCodes[code]
+    return ok
+}
+
+
+func isThrottlingError(err error) bool {
+    var apiErr smithy.APIError
+    return errors.As(err, &apiErr) && isThrottlingCode(apiErr.ErrorCode())
+}
+
+
+// IsRetryableError retries throttling, transient and 5xx errors
+// and network failures, but never cancellation.
+func IsRetryableError(err error) bool {
+    if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+        return false
+    }
+    var apiErr smithy.APIError
+    if errors.As(err, &apiErr) {
+        code := apiErr.ErrorCode()
+        if _, ok := transientErrorCodes[code]; ok || isThrottlingCode(code) {
+            return true
+        }
+    }
+    var statusErr interface{ HTTPStatusCode() int }
+    if errors.As(err, &statusErr) && statusErr.HTTPStatusCode() >= 500 {
+        return true
+    }
+    var netErr net.Error
+    return errors.As(err, &netErr)
+}
+
+
+type RetryPolicy struct {
+    MaxAttempts int // Including the first attempt.
+    BaseDelay time.Duration
+    MaxDelay time.Duration
+    Jitter float64 // Fraction of each delay that is randomized, between 0 and 1.
+    IsRetryable func(error) bool
+}
+
+
+func DefaultRetryPolicy() *RetryPolicy {
+    return &RetryPolicy{
+        MaxAttempts: 5,
+        BaseDelay: 100 * time.Millisecond,
+        MaxDelay: 5 * time.Second,
+        Jitter: 0.5,
+        IsRetryable: IsRetryableError,
+    }
+}
+
+
+// Exponential backoff capped at MaxDelay with the last Jitter
+// fraction randomized, attempt starts at 1.
+func (p *RetryPolicy) delay(attempt int) time.Duration {
+    delay := p.BaseDelay
+    for i := 1; i < attempt && delay < p.MaxDelay; i++ {
+        delay *= 2
+    }
+    if delay > p.MaxDelay {
+        delay = p.MaxDelay
+    }
+    jitter := p.Jitter * float64(delay)
+    return delay - time.Duration(jitter) + time.Duration(rand.Float64() * jitter)
+}
+
+
+func (p *RetryPolicy) isRetryable(err error) bool {
+    if p.IsRetryable == nil {
+        return IsRetryableError(err)
+    }
+    return p.IsRetryable(err)
+}
+
+
+type retryCounters struct {
+    calls atomic.Int64
+    retries atomic.Int64
+    throttled atomic.Int64
+    exhausted atomic.Int64
+}
+
+
+func (c *retryCounters) stats() dedup.RetryStats {
+    return dedup.RetryStats{
+        Calls: c.calls.Load(),
+        Retries: c.retries.Load(),
+        Throttled: c.throttled.Load(),
+        Exhausted: c.exhausted.Load(),
+    }
+}
+
+
+func sleepContext(ctx context.Context, delay time.Duration) error {
+    timer := time.NewTimer(delay)
+    defer timer.Stop()
+    select {
+    case <-ctx.Done():
+        return ctx.Err()
+    case <-timer.C:
+        return nil
+    }
+}
+
+
+// Calls call until it succeeds, fails with a non-retryable error,
+// or runs out of attempts.
+func (q *Queue) withRetry(ctx context.Context, call func() error) error {
+    policy := q.retryPolicy
+    for attempt := 1; ; attempt++ {
+        q.counters.calls.Add(1)
+        err := call()
+        if err == nil {
+            return nil
+        }
+        if isThrottlingError(err) {
+            q.counters.throttled.Add(1)
+        }
+        if attempt >= policy.MaxAttempts || !policy.isRetryable(err) {
+            if policy.isRetryable(err) {
+                q.counters.exhausted.Add(1)
+            }
+            return err
+        }
+        q.counters.retries.Add(1)
+        delay := policy.delay(attempt)
+        q.logger.DebugContext(ctx, "Retrying SQS request", "attempt", attempt, "delay", delay, "error", err)
+        if sleepErr := sleepContext(ctx, delay); sleepErr != nil {
+            return err
+        }
+    }
+}
+
+
+// Sends entries with send, then resends only entries that failed without
+// sender fault. Failed requests and failed entries use up the same attempts,
+// so an entry is sent at most MaxAttempts times. Returns an error only if
+// no attempt reached SQS at all.
+func sendBatchWithRetry[E any](ctx context.Context, q *Queue, entries []E, idOf func(E) string, send func([]E) ([]string, []types.BatchResultErrorEntry, error)) ([]string, []types.BatchResultErrorEntry, error) {
+    policy := q.retryPolicy
+    var successful []string
+    var failed []types.BatchResultErrorEntry
+    pending := entries
+    reachedSQS := false
+    for attempt := 1; len(pending) > 0; attempt++ {
+        q.counters.calls.Add(1)
+        attemptSuccessful, attemptFailed, err := send(pending)
+        lastAttempt := attempt >= policy.MaxAttempts || ctx.Err() != nil
+        var retryEntries []E
+        if err != nil {
+            if isThrottlingError(err) {
+                q.counters.throttled.Add(1)
+            }
+            if lastAttempt || !policy.isRetryable(err) {
+                if policy.isRetryable(err) {
+                    q.counters.exhausted.Add(1)
+                }
+                if !reachedSQS {
+                    return nil, nil, err
+                }
+                for _, entry := range pending {
+                    failed = append(failed, types.BatchResultErrorEntry{
+                        Id: aws.String(idOf(entry)),
+                        Code: aws.String("RequestFailed"),
+                        Message: aws.String(err.Error()),
+                    })
+                }
+                break
+            }
+            retryEntries = pending
+        } else {
+            reachedSQS = true
+            successful = append(successful, attemptSuccessful...)
+            retryIDs := make(map[string]struct{})
+            for _, fail := range attemptFailed {
+                if isThrottlingCode(aws.ToString(fail.Code)) {
+                    q.counters.throttled.Add(1)
+                }
+                if fail.SenderFault || lastAttempt {
+                    if !fail.SenderFault {
+                        q.counters.exhausted.Add(1)
+                    }
+                    failed = append(failed, fail)
+                    continue
+                }
+                retryIDs[aws.ToString(fail.Id)] = struct{}{}
+            }
+            for _, entry := range pending {
+                if _, ok := retryIDs[idOf(entry)]; ok {
+                    retryEntries = append(retryEntries, entry)
+                }
+            }
+        }
+        pending = retryEntries
+        if len(pending) > 0 {
+            q.counters.retries.Add(1)
+            delay := policy.delay(attempt)
+            q.logger.DebugContext(ctx, "Retrying batch entries", "attempt", attempt, "delay", delay, "entries", len(pending))
+            sleepContext(ctx, delay)
+        }
+    }
+    return successful, failed, nil
+}
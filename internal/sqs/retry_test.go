@@ -0,0 +1,133 @@
+package sqs
+
+
+import (
+    "context"
+    "errors"
+    "log/slog"
+    "testing"
+    "time"
+    "github.com/aws/aws-sdk-go-v2/aws"
+    "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+    "github.com/aws/smithy-go"
+)
+
+
+func TestRetryPolicyDelay(t *testing.T) {
+    policy := &RetryPolicy{
+        MaxAttempts: 10,
+        BaseDelay: 100 * time.Millisecond,
+        MaxDelay: time.Second,
+        Jitter: 0,
+    }
+    expected := []time.Duration{
+        100 * time.Millisecond,
+        200 * time.Millisecond,
+        400 * time.Millisecond,
+        800 * time.Millisecond,
+        time.Second,
+        time.Second,
+    }
+    for i, want := range expected {
+        if got := policy.delay(i + 1); got != want {
+            t.Errorf("Attempt %d: expected delay %v, got %v", i + 1, want, got)
+        }
+    }
+    policy.Jitter = 0.5
+    for i := 0; i < 100; i++ {
+        got := policy.delay(2)
+        if got < 100 * time.Millisecond || got > 200 * time.Millisecond {
+            t.Errorf("Jittered delay out of range %v", got)
+        }
+    }
+}
+
+
+func TestIsRetryableError(t *testing.T) {
+    cases := []struct {
+        err error
+        retryable bool
+    }{
+        {&smithy.GenericAPIError{Code: "RequestThrottled"}, true},
+        {&smithy.GenericAPIError{Code: "OverLimit"}, true},
+        {&smithy.GenericAPIError{Code: "InternalError"}, true},
+        {&smithy.GenericAPIError{Code: "ReceiptHandleIsInvalid"}, false},
+        {context.Canceled, false},
+        {errors.New("unknown"), false},
+    }
+    for _, c := range cases {
+        if got := IsRetryableError(c.err); got != c.retryable {
+            t.Errorf("Expected IsRetryableError(%v) to be %v", c.err, c.retryable)
+        }
+    }
+}
+
+
+func TestWithRetry(t *testing.T) {
+    queue := &Queue{
+        retryPolicy: &RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond},
+        counters: &retryCounters{},
+        logger: slog.Default(),
+    }
+    calls := 0
+    err := queue.withRetry(context.Background(), func() error {
+        calls++
+        return &smithy.GenericAPIError{Code: "RequestThrottled"}
+    })
+    if err == nil {
+        t.Error("Expected error after exhausting attempts")
+    }
+    if calls != 3 {
+        t.Errorf("Expected 3 calls, got %d", calls)
+    }
+    stats := queue.RetryStats()
+    if stats.Calls != 3 || stats.Retries != 2 || stats.Throttled != 3 || stats.Exhausted != 1 {
+        t.Errorf("Unexpected retry stats %+v", stats)
+    }
+}
+
+
+func TestSendBatchWithRetrySharesAttempts(t *testing.T) {
+    queue := &Queue{
+        retryPolicy: &RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond},
+        counters: &retryCounters{},
+        logger: slog.Default(),
+    }
+    calls := 0
+    successful, failed, err := sendBatchWithRetry(
+        context.Background(),
+        queue,
+        []string{"a", "b"},
+        func(id string) string { return id },
+        func(ids []string) ([]string, []types.BatchResultErrorEntry, error) {
+            calls++
+            if calls == 1 {
+                return nil, nil, &smithy.GenericAPIError{Code: "RequestThrottled"}
+            }
+            var successful []string
+            var failed []types.BatchResultErrorEntry
+            for _, id := range ids {
+                if id == "b" {
+                    failed = append(failed, types.BatchResultErrorEntry{Id: aws.String(id), Code: aws.String("InternalError")})
+                } else {
+                    successful = append(successful, id)
+                }
+            }
+            return successful, failed, nil
+        },
+    )
+    if err != nil {
+        t.Fatal(err)
+    }
+    // A failed request and failed entries count against the same 3 attempts.
+    if calls != 3 {
+        t.Errorf("Expected 3 calls, got %d", calls)
+    }
+    if len(successful) != 1 || len(failed) != 1 || aws.ToString(failed[0].Id) != "b" {
+        t.Errorf("Expected a to succeed and b to fail, got %v and %+v", successful, failed)
+    }
+    stats := queue.RetryStats()
+    if stats.Calls != 3 || stats.Retries != 2 || stats.Throttled != 1 || stats.Exhausted != 1 {
+        t.Errorf("Unexpected retry stats %+v", stats)
+    }
+}
@@ -0,0 +1,47 @@
+package sqsfake
+
+
+import (
+    "encoding/json"
+    "errors"
+    "net/http"
+)
+
+
+const jsonContentType = "application/x-amz-json-1.0"
+
+
+// Serves the AWS JSON 1.0 protocol, action named by the X-Amz-Target header.
+func (s *Server) serveJSON(w http.ResponseWriter, r *http.Request, action string) {
+    decode := func(request any) error {
+        if err := json.NewDecoder(r.Body).Decode(request); err != nil {
+            return invalidParameterValue("Error parsing request: %s", err)
+        }
+        return nil
+    }
+    response, err := s.call(r.Context(), action, decode)
+    w.Header().Set("Content-Type", jsonContentType)
+    if err != nil {
+        writeJSONError(w, err)
+        return
+    }
+    json.NewEncoder(w).Encode(response)
+}
+
+
+func writeJSONError(w http.ResponseWriter, err error) {
+    var apiErr *apiError
+    if !errors.As(err, &apiErr) {
+        w.WriteHeader(http.StatusInternalServerError)
+        json.NewEncoder(w).Encode(map[string]string{"__type": "InternalError", "message": err.Error()})
+        return
+    }
+    // Clients of the JSON protocol compatible with the query protocol
+    // take the error code from this header.
+    w.Header().Set("x-amzn-query-error", apiErr.queryCode + ";Sender")
+    w.WriteHeader(http.StatusBadRequest)
+    json.NewEncoder(w).Encode(map[string]string{
+        "__type": "com.amazonaws.sqs#" + apiErr.code,
+        "message": apiErr.message,
+    })
+}
@@ -0,0 +1,287 @@
+package sqsfake
+
+
+import (
+    "encoding/base64"
+    "encoding/xml"
+    "errors"
+    "fmt"
+    "net/http"
+    "net/url"
+    "sort"
+    "strconv"
+)
+
+
+const queryNamespace = "http://queue.amazonaws.com/doc/2012-11-05/"
+
+
+// Serves the query protocol, a form with the action in its Action field.
+func (s *Server) serveQuery(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "text/xml")
+    if err := r.ParseForm(); err != nil {
+        writeQueryError(w, invalidParameterValue("Error parsing request: %s", err))
+        return
+    }
+    action := r.Form.Get("Action")
+    response, err := s.call(r.Context(), action, queryDecoder(action, r.Form))
+    if err != nil {
+        writeQueryError(w, err)
+        return
+    }
+    s.mu.Lock()
+    s.nextID++
+    requestID := fmt.Sprintf("request-%d", s.nextID)
+    s.mu.Unlock()
+    body, err := xml.Marshal(queryResponse{
+        XMLName: xml.Name{Local: action + "Response"},
+        Namespace: queryNamespace,
+        Result: toQueryResult(action, response),
+        RequestID: requestID,
+    })
+    if err != nil {
+        writeQueryError(w, err)
+        return
+    }
+    w.Write([]byte(xml.Header))
+    w.Write(body)
+}
+
+
+// Values of numbered form fields prefix.1, prefix.2, ... until one is missing.
+func queryList(form url.Values, prefix string) []string {
+    var values []string
+    for i := 1; form.Has(fmt.Sprintf("%s.%d", prefix, i)); i++ {
+        values = append(values, form.Get(fmt.Sprintf("%s.%d", prefix, i)))
+    }
+    return values
+}
+
+
+func queryInt(form url.Values, name string) (int, error) {
+    if !form.Has(name) {
+        return 0, nil
+    }
+    value, err := strconv.Atoi(form.Get(name))
+    if err != nil {
+        return 0, invalidParameterValue("Value %s for parameter %s is invalid.", form.Get(name), name)
+    }
+    return value, nil
+}
+
+
+// Attributes in fields prefix.N.Name and prefix.N.Value.DataType, StringValue, BinaryValue.
+func queryMessageAttributes(form url.Values, prefix string) (map[string]messageAttributeValue, error) {
+    var attributes map[string]messageAttributeValue
+    for i := 1; form.Has(fmt.Sprintf("%s.%d.Name", prefix, i)); i++ {
+        field := fmt.Sprintf("%s.%d.", prefix, i)
+        value := messageAttributeValue{DataType: form.Get(field + "Value.DataType")}
+        if form.Has(field + "Value.BinaryValue") {
+            binaryValue, err := base64.StdEncoding.DecodeString(form.Get(field + "Value.BinaryValue"))
+            if err != nil {
+                return nil, invalidParameterValue("Value for parameter %sValue.BinaryValue is invalid.", field)
+            }
+            value.BinaryValue = binaryValue
+        } else {
+            stringValue := form.Get(field + "Value.StringValue")
+            value.StringValue = &stringValue
+        }
+        if attributes == nil {
+            attributes = make(map[string]messageAttributeValue)
+        }
+        attributes[form.Get(field + "Name")] = value
+    }
+    return attributes, nil
+}
+
+
+func queryDecoder(action string, form url.Values) decoder {
+    return func(request any) error {
+        var err error
+        switch request := request.(type) {
+        case *receiveRequest:
+            request.QueueUrl = form.Get("QueueUrl")
+            request.AttributeNames = queryList(form, "AttributeName")
+            request.MessageSystemAttributeNames = queryList(form, "MessageSystemAttributeName")
+            request.MessageAttributeNames = queryList(form, "MessageAttributeName")
+            if request.MaxNumberOfMessages, err = queryInt(form, "MaxNumberOfMessages"); err != nil {
+                return err
+            }
+            if request.VisibilityTimeout, err = queryInt(form, "VisibilityTimeout"); err != nil {
+                return err
+            }
+            request.WaitTimeSeconds, err = queryInt(form, "WaitTimeSeconds")
+            return err
+        case *batchRequest:
+            request.QueueUrl = form.Get("QueueUrl")
+            prefix := action + "RequestEntry"
+            for i := 1; form.Has(fmt.Sprintf("%s.%d.Id", prefix, i)); i++ {
+                field := fmt.Sprintf("%s.%d.", prefix, i)
+                entry := batchEntry{
+                    Id: form.Get(field + "Id"),
+                    ReceiptHandle: form.Get(field + "ReceiptHandle"),
+                    MessageBody: form.Get(field + "MessageBody"),
+                }
+                if entry.VisibilityTimeout, err = queryInt(form, field + "VisibilityTimeout"); err != nil {
+                    return err
+                }
+                if entry.DelaySeconds, err = queryInt(form, field + "DelaySeconds"); err != nil {
+                    return err
+                }
+                if entry.MessageAttributes, err = queryMessageAttributes(form, field + "MessageAttribute"); err != nil {
+                    return err
+                }
+                if entry.MessageSystemAttributes, err = queryMessageAttributes(form, field + "MessageSystemAttribute"); err != nil {
+                    return err
+                }
+                request.Entries = append(request.Entries, entry)
+            }
+        case *attributesRequest:
+            request.QueueUrl = form.Get("QueueUrl")
+            request.AttributeNames = queryList(form, "AttributeName")
+        }
+        return nil
+    }
+}
+
+
+type queryResponse struct {
+    XMLName xml.Name
+    Namespace string `xml:"xmlns,attr"`
+    Result queryResult
+    RequestID string `xml:"ResponseMetadata>RequestId"`
+}
+
+
+type queryResult struct {
+    XMLName xml.Name
+    Messages []queryMessage `xml:"Message"`
+    Successful []queryResultEntry
+    Failed []errorEntry `xml:"BatchResultErrorEntry"`
+    Attributes []queryAttribute `xml:"Attribute"`
+}
+
+
+type queryAttribute struct {
+    Name string
+    Value string
+}
+
+
+type queryMessageAttribute struct {
+    Name string
+    Value queryMessageAttributeValue
+}
+
+
+type queryMessageAttributeValue struct {
+    DataType string
+    StringValue *string `xml:",omitempty"`
+    BinaryValue string `xml:",omitempty"`
+}
+
+
+type queryMessage struct {
+    MessageId string
+    ReceiptHandle string
+    MD5OfBody string
+    Body string
+    Attributes []queryAttribute `xml:"Attribute"`
+    MD5OfMessageAttributes string `xml:",omitempty"`
+    MessageAttributes []queryMessageAttribute `xml:"MessageAttribute"`
+}
+
+
+type queryResultEntry struct {
+    XMLName xml.Name
+    Id string
+    MessageId string `xml:",omitempty"`
+    MD5OfMessageBody string `xml:",omitempty"`
+    MD5OfMessageAttributes string `xml:",omitempty"`
+}
+
+
+// Query protocol lists maps as Name and Value pairs, sorted here for stable output.
+func toQueryAttributes(attributes map[string]string) []queryAttribute {
+    var queryAttributes []queryAttribute
+    for name, value := range attributes {
+        queryAttributes = append(queryAttributes, queryAttribute{Name: name, Value: value})
+    }
+    sort.Slice(queryAttributes, func(i, j int) bool {
+        return queryAttributes[i].Name < queryAttributes[j].Name
+    })
+    return queryAttributes
+}
+
+
+func toQueryMessage(message receivedMessage) queryMessage {
+    converted := queryMessage{
+        MessageId: message.MessageId,
+        ReceiptHandle: message.ReceiptHandle,
+        MD5OfBody: message.MD5OfBody,
+        Body: message.Body,
+        Attributes: toQueryAttributes(message.Attributes),
+        MD5OfMessageAttributes: message.MD5OfMessageAttributes,
+    }
+    for name, value := range message.MessageAttributes {
+        attribute := queryMessageAttribute{
+            Name: name,
+            Value: queryMessageAttributeValue{DataType: value.DataType, StringValue: value.StringValue},
+        }
+        if value.BinaryValue != nil {
+            attribute.Value.BinaryValue = base64.StdEncoding.EncodeToString(value.BinaryValue)
+        }
+        converted.MessageAttributes = append(converted.MessageAttributes, attribute)
+    }
+    sort.Slice(converted.MessageAttributes, func(i, j int) bool {
+        return converted.MessageAttributes[i].Name < converted.MessageAttributes[j].Name
+    })
+    return converted
+}
+
+
+func toQueryResult(action string, response any) queryResult {
+    result := queryResult{XMLName: xml.Name{Local: action + "Result"}}
+    switch response := response.(type) {
+    case *receiveResponse:
+        for _, message := range response.Messages {
+            result.Messages = append(result.Messages, toQueryMessage(message))
+        }
+    case *batchResponse:
+        for _, entry := range response.Successful {
+            result.Successful = append(result.Successful, queryResultEntry{
+                XMLName: xml.Name{Local: action + "ResultEntry"},
+                Id: entry.Id,
+                MessageId: entry.MessageId,
+                MD5OfMessageBody: entry.MD5OfMessageBody,
+                MD5OfMessageAttributes: entry.MD5OfMessageAttributes,
+            })
+        }
+        result.Failed = response.Failed
+    case *attributesResponse:
+        result.Attributes = toQueryAttributes(response.Attributes)
+    }
+    return result
+}
+
+
+type queryError struct {
+    XMLName xml.Name `xml:"ErrorResponse"`
+    Type string `xml:"Error>Type"`
+    Code string `xml:"Error>Code"`
+    Message string `xml:"Error>Message"`
+}
+
+
+func writeQueryError(w http.ResponseWriter, err error) {
+    var apiErr *apiError
+    if !errors.As(err, &apiErr) {
+        w.WriteHeader(http.StatusInternalServerError)
+        body, _ := xml.Marshal(queryError{Type: "Receiver", Code: "InternalError", Message: err.Error()})
+        w.Write(body)
+        return
+    }
+    w.WriteHeader(http.StatusBadRequest)
+    body, _ := xml.Marshal(queryError{Type: "Sender", Code: apiErr.queryCode, Message: apiErr.message})
+    w.Write(body)
+}
@@ -0,0 +1,766 @@
+package sqsfake
+
+
+import (
+    "context"
+    "crypto/md5"
+    "encoding/binary"
+    "encoding/hex"
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "path"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+    "github.com/IGVF-DACC/go-sqs-deduplication/internal/dedup"
+    "github.com/IGVF-DACC/go-sqs-deduplication/internal/memory"
+)
+
+
+// Region and account of queue URLs and ARNs handed out by Server.
+const (
+    Region = "us-east-1"
+    AccountID = "000000000000"
+)
+
+
+// Limits of a standard SQS queue.
+const (
+    DefaultVisibilityTimeout = 30 * time.Second
+    maxBatchSize = 10
+    maxVisibilityTimeout = 12 * time.Hour
+    maxMessageAttributes = 10
+    maxWaitTimeSeconds = 20
+)
+
+
+// How often a long polling receive checks for messages.
+const pollInterval = 10 * time.Millisecond
+
+
+type ServerConfig struct {
+    Clock memory.Clock // Uses real time if nil.
+    MaxWait time.Duration // Longest a receive long polls for, receives return right away if zero.
+}
+
+
+// Message on a queue of Server, as seen by tests.
+type Message struct {
+    MessageID string
+    Body string
+    Attributes map[string]string
+    MessageAttributes map[string]dedup.MessageAttribute
+    Visible bool
+}
+
+
+type message struct {
+    id string
+    body string
+    sentTime time.Time
+    traceHeader string
+    messageAttributes map[string]dedup.MessageAttribute
+    visibleAt time.Time
+    receiptHandle string // Of the latest receive, earlier ones are stale.
+    receiveCount int
+    firstReceiveTime time.Time
+    deleted bool
+}
+
+
+type queue struct {
+    name string
+    created time.Time
+    messages []*message
+    receiptHandles map[string]*message // Every receipt handle ever handed out.
+}
+
+
+// Only call with lock held.
+func (q *queue) live() []*message {
+    var messages []*message
+    for _, message := range q.messages {
+        if !message.deleted {
+            messages = append(messages, message)
+        }
+    }
+    q.messages = messages
+    return messages
+}
+
+
+// SQS-compatible HTTP server running in process, so sqs.Queue and the
+// deduplicator binary can be tested without AWS, Docker, or network.
+// Speaks the JSON protocol used by current SDKs and the query protocol
+// used by older ones, for ReceiveMessage, DeleteMessageBatch,
+// ChangeMessageVisibilityBatch, SendMessageBatch, and GetQueueAttributes.
+// Queues behave like standard queues: received messages are hidden for
+// their visibility timeout and every receive hands out a new receipt
+// handle. Deleting with a stale receipt handle succeeds without deleting
+// the message, changing visibility with one fails.
+type Server struct {
+    mu sync.Mutex
+    config ServerConfig
+    clock memory.Clock
+    queues map[string]*queue
+    requests map[string]int
+    nextID int
+    server *httptest.Server
+}
+
+
+func NewServer(config *ServerConfig) *Server {
+    s := &Server{
+        config: *config,
+        clock: config.Clock,
+        queues: make(map[string]*queue),
+        requests: make(map[string]int),
+    }
+    if s.clock == nil {
+        s.clock = realClock{}
+    }
+    s.server = httptest.NewServer(s)
+    return s
+}
+
+
+type realClock struct{}
+
+
+func (realClock) Now() time.Time {
+    return time.Now()
+}
+
+
+// Endpoint to point SDK clients at.
+func (s *Server) URL() string {
+    return s.server.URL
+}
+
+
+func (s *Server) Close() {
+    s.server.Close()
+}
+
+
+// Returns URL of the new queue, or of the existing one with that name.
+func (s *Server) CreateQueue(name string) string {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if _, ok := s.queues[name]; !ok {
+        s.queues[name] = &queue{
+            name: name,
+            created: s.clock.Now(),
+            receiptHandles: make(map[string]*message),
+        }
+    }
+    return s.queueURL(name)
+}
+
+
+func (s *Server) queueURL(name string) string {
+    return s.server.URL + "/" + AccountID + "/" + name
+}
+
+
+// Finds queue by the last path element of its URL, whatever the host.
+// Only call with lock held.
+func (s *Server) queue(queueURL string) (*queue, error) {
+    parsed, err := url.Parse(queueURL)
+    if err != nil || parsed.Path == "" {
+        return nil, errQueueDoesNotExist
+    }
+    queue, ok := s.queues[path.Base(parsed.Path)]
+    if !ok {
+        return nil, errQueueDoesNotExist
+    }
+    return queue, nil
+}
+
+
+// Sends message like a producer would, returns its message ID.
+func (s *Server) SendMessage(queueURL string, body string, messageAttributes map[string]dedup.MessageAttribute) (string, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    queue, err := s.queue(queueURL)
+    if err != nil {
+        return "", err
+    }
+    return s.send(queue, body, messageAttributes, "", 0), nil
+}
+
+
+// Only call with lock held.
+func (s *Server) send(queue *queue, body string, messageAttributes map[string]dedup.MessageAttribute, traceHeader string, delay time.Duration) string {
+    s.nextID++
+    now := s.clock.Now()
+    message := &message{
+        id: fmt.Sprintf("fake-%d", s.nextID),
+        body: body,
+        sentTime: now,
+        traceHeader: traceHeader,
+        messageAttributes: messageAttributes,
+        visibleAt: now.Add(delay),
+    }
+    queue.messages = append(queue.messages, message)
+    return message.id
+}
+
+
+// Messages on queue not yet deleted, in the order they were sent.
+func (s *Server) Messages(queueURL string) []Message {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    queue, err := s.queue(queueURL)
+    if err != nil {
+        return nil
+    }
+    now := s.clock.Now()
+    var messages []Message
+    for _, message := range queue.live() {
+        messages = append(messages, Message{
+            MessageID: message.id,
+            Body: message.body,
+            Attributes: message.attributes(),
+            MessageAttributes: message.messageAttributes,
+            Visible: !message.visibleAt.After(now),
+        })
+    }
+    return messages
+}
+
+
+// Requests served for action, e.g. ReceiveMessage, whatever the protocol.
+func (s *Server) Requests(action string) int {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.requests[action]
+}
+
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    if target := r.Header.Get("X-Amz-Target"); target != "" {
+        s.serveJSON(w, r, strings.TrimPrefix(target, "AmazonSQS."))
+        return
+    }
+    s.serveQuery(w, r)
+}
+
+
+type apiError struct {
+    code string // Error type of the JSON protocol.
+    queryCode string // Error code of the query protocol.
+    message string
+}
+
+
+func (e *apiError) Error() string {
+    return e.code + ": " + e.message
+}
+
+
+var errQueueDoesNotExist = &apiError{
+    code: "QueueDoesNotExist",
+    queryCode: "AWS.SimpleQueueService.NonExistentQueue",
+    message: "The specified queue does not exist.",
+}
+
+
+var errEmptyBatch = &apiError{
+    code: "EmptyBatchRequest",
+    queryCode: "AWS.SimpleQueueService.EmptyBatchRequest",
+    message: "There should be at least one entry in the request.",
+}
+
+
+var errTooManyEntries = &apiError{
+    code: "TooManyEntriesInBatchRequest",
+    queryCode: "AWS.SimpleQueueService.TooManyEntriesInBatchRequest",
+    message: "Maximum number of entries per request are 10.",
+}
+
+
+var errEntryIDsNotDistinct = &apiError{
+    code: "BatchEntryIdsNotDistinct",
+    queryCode: "AWS.SimpleQueueService.BatchEntryIdsNotDistinct",
+    message: "Two or more batch entries in the request have the same Id.",
+}
+
+
+func invalidParameterValue(format string, args ...any) *apiError {
+    return &apiError{
+        code: "InvalidParameterValue",
+        queryCode: "InvalidParameterValue",
+        message: fmt.Sprintf(format, args...),
+    }
+}
+
+
+func invalidAction(action string) *apiError {
+    return &apiError{
+        code: "InvalidAction",
+        queryCode: "InvalidAction",
+        message: fmt.Sprintf("The action %s is not valid for this endpoint.", action),
+    }
+}
+
+
+// Requests and responses of both protocols, named like the JSON protocol.
+
+
+type messageAttributeValue struct {
+    DataType string
+    StringValue *string `json:",omitempty"`
+    BinaryValue []byte `json:",omitempty"`
+}
+
+
+type receiveRequest struct {
+    QueueUrl string
+    MaxNumberOfMessages int
+    VisibilityTimeout int
+    WaitTimeSeconds int
+    AttributeNames []string
+    MessageSystemAttributeNames []string
+    MessageAttributeNames []string
+}
+
+
+type receivedMessage struct {
+    MessageId string
+    ReceiptHandle string
+    MD5OfBody string
+    Body string
+    Attributes map[string]string `json:",omitempty"`
+    MD5OfMessageAttributes string `json:",omitempty"`
+    MessageAttributes map[string]messageAttributeValue `json:",omitempty"`
+}
+
+
+type receiveResponse struct {
+    Messages []receivedMessage `json:",omitempty"`
+}
+
+
+// Entry of any batch action, each uses only some fields.
+type batchEntry struct {
+    Id string
+    ReceiptHandle string
+    VisibilityTimeout int
+    MessageBody string
+    DelaySeconds int
+    MessageAttributes map[string]messageAttributeValue
+    MessageSystemAttributes map[string]messageAttributeValue
+}
+
+
+type batchRequest struct {
+    QueueUrl string
+    Entries []batchEntry
+}
+
+
+type resultEntry struct {
+    Id string
+    MessageId string `json:",omitempty"`
+    MD5OfMessageBody string `json:",omitempty"`
+    MD5OfMessageAttributes string `json:",omitempty"`
+}
+
+
+type errorEntry struct {
+    Id string
+    Code string
+    Message string
+    SenderFault bool
+}
+
+
+type batchResponse struct {
+    Successful []resultEntry
+    Failed []errorEntry
+}
+
+
+type attributesRequest struct {
+    QueueUrl string
+    AttributeNames []string
+}
+
+
+type attributesResponse struct {
+    Attributes map[string]string
+}
+
+
+// Decodes request of action with the protocol it came in.
+type decoder func(request any) error
+
+
+func (s *Server) call(ctx context.Context, action string, decode decoder) (any, error) {
+    s.mu.Lock()
+    s.requests[action]++
+    s.mu.Unlock()
+    switch action {
+    case "ReceiveMessage":
+        var request receiveRequest
+        if err := decode(&request); err != nil {
+            return nil, err
+        }
+        return s.receiveMessage(ctx, &request)
+    case "DeleteMessageBatch":
+        var request batchRequest
+        if err := decode(&request); err != nil {
+            return nil, err
+        }
+        return s.batch(&request, s.deleteEntry)
+    case "ChangeMessageVisibilityBatch":
+        var request batchRequest
+        if err := decode(&request); err != nil {
+            return nil, err
+        }
+        return s.batch(&request, s.changeVisibilityEntry)
+    case "SendMessageBatch":
+        var request batchRequest
+        if err := decode(&request); err != nil {
+            return nil, err
+        }
+        return s.batch(&request, s.sendEntry)
+    case "GetQueueAttributes":
+        var request attributesRequest
+        if err := decode(&request); err != nil {
+            return nil, err
+        }
+        return s.getQueueAttributes(&request)
+    }
+    return nil, invalidAction(action)
+}
+
+
+func (s *Server) receiveMessage(ctx context.Context, request *receiveRequest) (*receiveResponse, error) {
+    if request.MaxNumberOfMessages == 0 {
+        request.MaxNumberOfMessages = 1
+    }
+    if request.MaxNumberOfMessages < 1 || request.MaxNumberOfMessages > maxBatchSize {
+        return nil, invalidParameterValue("Value %d for parameter MaxNumberOfMessages is invalid. Reason: Must be between 1 and 10.", request.MaxNumberOfMessages)
+    }
+    if request.WaitTimeSeconds < 0 || request.WaitTimeSeconds > maxWaitTimeSeconds {
+        return nil, invalidParameterValue("Value %d for parameter WaitTimeSeconds is invalid. Reason: Must be >= 0 and <= 20.", request.WaitTimeSeconds)
+    }
+    visibilityTimeout := DefaultVisibilityTimeout
+    if request.VisibilityTimeout != 0 {
+        visibilityTimeout = time.Duration(request.VisibilityTimeout) * time.Second
+    }
+    if visibilityTimeout < 0 || visibilityTimeout > maxVisibilityTimeout {
+        return nil, invalidParameterValue("Value %d for parameter VisibilityTimeout is invalid.", request.VisibilityTimeout)
+    }
+    wait := min(time.Duration(request.WaitTimeSeconds) * time.Second, s.config.MaxWait)
+    deadline := time.Now().Add(wait)
+    for {
+        response, err := s.receive(request, visibilityTimeout)
+        if err != nil || len(response.Messages) > 0 || !time.Now().Before(deadline) {
+            return response, err
+        }
+        select {
+        case <-time.After(pollInterval):
+        case <-ctx.Done():
+            return response, nil
+        }
+    }
+}
+
+
+func (s *Server) receive(request *receiveRequest, visibilityTimeout time.Duration) (*receiveResponse, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    queue, err := s.queue(request.QueueUrl)
+    if err != nil {
+        return nil, err
+    }
+    now := s.clock.Now()
+    response := &receiveResponse{}
+    for _, message := range queue.live() {
+        if len(response.Messages) == request.MaxNumberOfMessages {
+            break
+        }
+        if message.visibleAt.After(now) {
+            continue
+        }
+        s.nextID++
+        message.receiptHandle = fmt.Sprintf("%s-receipt-%d", message.id, s.nextID)
+        queue.receiptHandles[message.receiptHandle] = message
+        message.receiveCount++
+        if message.firstReceiveTime.IsZero() {
+            message.firstReceiveTime = now
+        }
+        message.visibleAt = now.Add(visibilityTimeout)
+        response.Messages = append(response.Messages, message.received(request))
+    }
+    return response, nil
+}
+
+
+func md5Hex(value []byte) string {
+    sum := md5.Sum(value)
+    return hex.EncodeToString(sum[:])
+}
+
+
+// Digest SQS computes over message attributes: every attribute sorted by
+// name, with its name, data type, and value, each prefixed by its length.
+func md5OfMessageAttributes(messageAttributes map[string]dedup.MessageAttribute) string {
+    if len(messageAttributes) == 0 {
+        return ""
+    }
+    var names []string
+    for name := range messageAttributes {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    var buffer []byte
+    appendValue := func(value []byte) {
+        buffer = binary.BigEndian.AppendUint32(buffer, uint32(len(value)))
+        buffer = append(buffer, value...)
+    }
+    for _, name := range names {
+        attribute := messageAttributes[name]
+        appendValue([]byte(name))
+        appendValue([]byte(attribute.DataType))
+        if attribute.BinaryValue != nil {
+            buffer = append(buffer, 2)
+            appendValue(attribute.BinaryValue)
+        } else {
+            buffer = append(buffer, 1)
+            appendValue([]byte(attribute.StringValue))
+        }
+    }
+    return md5Hex(buffer)
+}
+
+
+func (m *message) attributes() map[string]string {
+    attributes := map[string]string{
+        "SenderId": AccountID,
+        "SentTimestamp": strconv.FormatInt(m.sentTime.UnixMilli(), 10),
+        "ApproximateReceiveCount": strconv.Itoa(m.receiveCount),
+    }
+    if !m.firstReceiveTime.IsZero() {
+        attributes["ApproximateFirstReceiveTimestamp"] = strconv.FormatInt(m.firstReceiveTime.UnixMilli(), 10)
+    }
+    if m.traceHeader != "" {
+        attributes["AWSTraceHeader"] = m.traceHeader
+    }
+    return attributes
+}
+
+
+func requested(names []string, name string) bool {
+    for _, requestedName := range names {
+        if requestedName == "All" || requestedName == ".*" || requestedName == name {
+            return true
+        }
+        if prefix, ok := strings.CutSuffix(requestedName, ".*"); ok && strings.HasPrefix(name, prefix + ".") {
+            return true
+        }
+    }
+    return false
+}
+
+
+func (m *message) received(request *receiveRequest) receivedMessage {
+    received := receivedMessage{
+        MessageId: m.id,
+        ReceiptHandle: m.receiptHandle,
+        MD5OfBody: md5Hex([]byte(m.body)),
+        Body: m.body,
+    }
+    attributeNames := append(request.AttributeNames, request.MessageSystemAttributeNames...)
+    for name, value := range m.attributes() {
+        if requested(attributeNames, name) {
+            if received.Attributes == nil {
+                received.Attributes = make(map[string]string)
+            }
+            received.Attributes[name] = value
+        }
+    }
+    messageAttributes := make(map[string]dedup.MessageAttribute)
+    for name, attribute := range m.messageAttributes {
+        if requested(request.MessageAttributeNames, name) {
+            messageAttributes[name] = attribute
+        }
+    }
+    if len(messageAttributes) > 0 {
+        received.MD5OfMessageAttributes = md5OfMessageAttributes(messageAttributes)
+        received.MessageAttributes = toMessageAttributeValues(messageAttributes)
+    }
+    return received
+}
+
+
+func toMessageAttributeValues(messageAttributes map[string]dedup.MessageAttribute) map[string]messageAttributeValue {
+    values := make(map[string]messageAttributeValue, len(messageAttributes))
+    for name, attribute := range messageAttributes {
+        value := messageAttributeValue{DataType: attribute.DataType, BinaryValue: attribute.BinaryValue}
+        if attribute.BinaryValue == nil {
+            stringValue := attribute.StringValue
+            value.StringValue = &stringValue
+        }
+        values[name] = value
+    }
+    return values
+}
+
+
+func fromMessageAttributeValues(values map[string]messageAttributeValue) map[string]dedup.MessageAttribute {
+    if len(values) == 0 {
+        return nil
+    }
+    messageAttributes := make(map[string]dedup.MessageAttribute, len(values))
+    for name, value := range values {
+        attribute := dedup.MessageAttribute{DataType: value.DataType, BinaryValue: value.BinaryValue}
+        if value.StringValue != nil {
+            attribute.StringValue = *value.StringValue
+        }
+        messageAttributes[name] = attribute
+    }
+    return messageAttributes
+}
+
+
+func failedEntry(id string, code string, message string) *errorEntry {
+    return &errorEntry{Id: id, Code: code, Message: message, SenderFault: true}
+}
+
+
+// Runs entries of a batch one by one, only call with lock held.
+type entryHandler func(queue *queue, entry batchEntry, now time.Time) (resultEntry, *errorEntry)
+
+
+func (s *Server) batch(request *batchRequest, handle entryHandler) (*batchResponse, error) {
+    if len(request.Entries) == 0 {
+        return nil, errEmptyBatch
+    }
+    if len(request.Entries) > maxBatchSize {
+        return nil, errTooManyEntries
+    }
+    ids := make(map[string]struct{})
+    for _, entry := range request.Entries {
+        if _, ok := ids[entry.Id]; ok {
+            return nil, errEntryIDsNotDistinct
+        }
+        ids[entry.Id] = struct{}{}
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    queue, err := s.queue(request.QueueUrl)
+    if err != nil {
+        return nil, err
+    }
+    now := s.clock.Now()
+    response := &batchResponse{}
+    for _, entry := range request.Entries {
+        result, failed := handle(queue, entry, now)
+        if failed != nil {
+            response.Failed = append(response.Failed, *failed)
+            continue
+        }
+        response.Successful = append(response.Successful, result)
+    }
+    return response, nil
+}
+
+
+func (s *Server) deleteEntry(queue *queue, entry batchEntry, now time.Time) (resultEntry, *errorEntry) {
+    message, ok := queue.receiptHandles[entry.ReceiptHandle]
+    if !ok {
+        return resultEntry{}, failedEntry(entry.Id, "ReceiptHandleIsInvalid", "The input receipt handle is invalid.")
+    }
+    // Deleting an already deleted message, or with a stale receipt handle, still succeeds.
+    if message.receiptHandle == entry.ReceiptHandle {
+        message.deleted = true
+    }
+    return resultEntry{Id: entry.Id}, nil
+}
+
+
+func (s *Server) changeVisibilityEntry(queue *queue, entry batchEntry, now time.Time) (resultEntry, *errorEntry) {
+    visibilityTimeout := time.Duration(entry.VisibilityTimeout) * time.Second
+    if visibilityTimeout < 0 || visibilityTimeout > maxVisibilityTimeout {
+        return resultEntry{}, failedEntry(entry.Id, "InvalidParameterValue", fmt.Sprintf("Value %d for parameter VisibilityTimeout is invalid.", entry.VisibilityTimeout))
+    }
+    message, ok := queue.receiptHandles[entry.ReceiptHandle]
+    if !ok || message.deleted || message.receiptHandle != entry.ReceiptHandle {
+        return resultEntry{}, failedEntry(entry.Id, "ReceiptHandleIsInvalid", "The input receipt handle is invalid.")
+    }
+    if !message.visibleAt.After(now) {
+        return resultEntry{}, failedEntry(entry.Id, "MessageNotInflight", "The message referred to isn't in flight.")
+    }
+    message.visibleAt = now.Add(visibilityTimeout)
+    return resultEntry{Id: entry.Id}, nil
+}
+
+
+func (s *Server) sendEntry(queue *queue, entry batchEntry, now time.Time) (resultEntry, *errorEntry) {
+    if entry.MessageBody == "" {
+        return resultEntry{}, failedEntry(entry.Id, "MissingParameter", "The request must contain the parameter MessageBody.")
+    }
+    if len(entry.MessageAttributes) > maxMessageAttributes {
+        return resultEntry{}, failedEntry(entry.Id, "InvalidParameterValue", "Number of message attributes exceeds the allowed maximum of 10.")
+    }
+    var traceHeader string
+    for name, value := range entry.MessageSystemAttributes {
+        if name != "AWSTraceHeader" || value.StringValue == nil {
+            return resultEntry{}, failedEntry(entry.Id, "InvalidParameterValue", fmt.Sprintf("Message system attribute %s is not supported.", name))
+        }
+        traceHeader = *value.StringValue
+    }
+    messageAttributes := fromMessageAttributeValues(entry.MessageAttributes)
+    messageID := s.send(queue, entry.MessageBody, messageAttributes, traceHeader, time.Duration(entry.DelaySeconds) * time.Second)
+    return resultEntry{
+        Id: entry.Id,
+        MessageId: messageID,
+        MD5OfMessageBody: md5Hex([]byte(entry.MessageBody)),
+        MD5OfMessageAttributes: md5OfMessageAttributes(messageAttributes),
+    }, nil
+}
+
+
+func (s *Server) getQueueAttributes(request *attributesRequest) (*attributesResponse, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    queue, err := s.queue(request.QueueUrl)
+    if err != nil {
+        return nil, err
+    }
+    now := s.clock.Now()
+    visible, notVisible, delayed := 0, 0, 0
+    for _, message := range queue.live() {
+        switch {
+        case !message.visibleAt.After(now):
+            visible++
+        case message.receiveCount == 0:
+            delayed++
+        default:
+            notVisible++
+        }
+    }
+    attributes := map[string]string{
+        "ApproximateNumberOfMessages": strconv.Itoa(visible),
+        "ApproximateNumberOfMessagesNotVisible": strconv.Itoa(notVisible),
+        "ApproximateNumberOfMessagesDelayed": strconv.Itoa(delayed),
+        "VisibilityTimeout": strconv.Itoa(int(DefaultVisibilityTimeout.Seconds())),
+        "CreatedTimestamp": strconv.FormatInt(queue.created.Unix(), 10),
+        "QueueArn": "arn:aws:sqs:" + Region + ":" + AccountID + ":" + queue.name,
+    }
+    response := &attributesResponse{Attributes: make(map[string]string)}
+    for name, value := range attributes {
+        if requested(request.AttributeNames, name) {
+            response.Attributes[name] = value
+        }
+    }
+    return response, nil
+}
@@ -0,0 +1,136 @@
+package sqsfake
+
+
+import (
+    "encoding/xml"
+    "io"
+    "net/http"
+    "net/url"
+    "strings"
+    "testing"
+    "time"
+    "github.com/IGVF-DACC/go-sqs-deduplication/internal/dedup"
+    "github.com/IGVF-DACC/go-sqs-deduplication/internal/memory"
+)
+
+
+func postQuery(t *testing.T, server *Server, form url.Values) (int, string) {
+    response, err := http.PostForm(server.URL(), form)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer response.Body.Close()
+    body, err := io.ReadAll(response.Body)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return response.StatusCode, string(body)
+}
+
+
+type queryReceiveResponse struct {
+    Messages []queryMessage `xml:"ReceiveMessageResult>Message"`
+}
+
+
+func TestServerSpeaksQueryProtocol(t *testing.T) {
+    clock := memory.NewManualClock(time.Now())
+    server := NewServer(&ServerConfig{Clock: clock})
+    defer server.Close()
+    queueURL := server.CreateQueue("queue")
+    status, body := postQuery(t, server, url.Values{
+        "Action": {"SendMessageBatch"},
+        "QueueUrl": {queueURL},
+        "SendMessageBatchRequestEntry.1.Id": {"first"},
+        "SendMessageBatchRequestEntry.1.MessageBody": {"one"},
+        "SendMessageBatchRequestEntry.1.MessageAttribute.1.Name": {"source"},
+        "SendMessageBatchRequestEntry.1.MessageAttribute.1.Value.DataType": {"String"},
+        "SendMessageBatchRequestEntry.1.MessageAttribute.1.Value.StringValue": {"indexer"},
+        "SendMessageBatchRequestEntry.2.Id": {"second"},
+        "SendMessageBatchRequestEntry.2.MessageBody": {"two"},
+        "SendMessageBatchRequestEntry.3.Id": {"empty"},
+    })
+    if status != http.StatusOK || strings.Count(body, "<SendMessageBatchResultEntry>") != 2 || strings.Count(body, "<BatchResultErrorEntry>") != 1 {
+        t.Fatalf("Expected two messages sent and the empty one failed, got %d %s", status, body)
+    }
+    status, body = postQuery(t, server, url.Values{
+        "Action": {"ReceiveMessage"},
+        "QueueUrl": {queueURL},
+        "MaxNumberOfMessages": {"10"},
+        "VisibilityTimeout": {"60"},
+        "AttributeName.1": {"All"},
+        "MessageAttributeName.1": {"All"},
+    })
+    var received queryReceiveResponse
+    if err := xml.Unmarshal([]byte(body), &received); err != nil || status != http.StatusOK {
+        t.Fatalf("Expected receive response, got %d %s", status, body)
+    }
+    if len(received.Messages) != 2 {
+        t.Fatalf("Expected two messages, got %d", len(received.Messages))
+    }
+    first := received.Messages[0]
+    if first.Body != "one" || first.MD5OfBody != md5Hex([]byte("one")) {
+        t.Errorf("Unexpected message %+v", first)
+    }
+    if len(first.MessageAttributes) != 1 || *first.MessageAttributes[0].Value.StringValue != "indexer" {
+        t.Errorf("Expected message attribute, got %+v", first.MessageAttributes)
+    }
+    if first.MD5OfMessageAttributes != md5OfMessageAttributes(map[string]dedup.MessageAttribute{"source": {DataType: "String", StringValue: "indexer"}}) {
+        t.Errorf("Unexpected message attributes digest %s", first.MD5OfMessageAttributes)
+    }
+    status, body = postQuery(t, server, url.Values{
+        "Action": {"DeleteMessageBatch"},
+        "QueueUrl": {queueURL},
+        "DeleteMessageBatchRequestEntry.1.Id": {"first"},
+        "DeleteMessageBatchRequestEntry.1.ReceiptHandle": {first.ReceiptHandle},
+    })
+    if status != http.StatusOK || !strings.Contains(body, "<DeleteMessageBatchResultEntry><Id>first</Id>") {
+        t.Fatalf("Expected message deleted, got %d %s", status, body)
+    }
+    status, body = postQuery(t, server, url.Values{
+        "Action": {"ChangeMessageVisibilityBatch"},
+        "QueueUrl": {queueURL},
+        "ChangeMessageVisibilityBatchRequestEntry.1.Id": {"first"},
+        "ChangeMessageVisibilityBatchRequestEntry.1.ReceiptHandle": {first.ReceiptHandle},
+        "ChangeMessageVisibilityBatchRequestEntry.2.Id": {"second"},
+        "ChangeMessageVisibilityBatchRequestEntry.2.ReceiptHandle": {received.Messages[1].ReceiptHandle},
+        "ChangeMessageVisibilityBatchRequestEntry.2.VisibilityTimeout": {"0"},
+    })
+    if status != http.StatusOK || !strings.Contains(body, "<Code>ReceiptHandleIsInvalid</Code>") || !strings.Contains(body, "<Id>second</Id>") {
+        t.Fatalf("Expected deleted message to fail and the other reset, got %d %s", status, body)
+    }
+    status, body = postQuery(t, server, url.Values{
+        "Action": {"GetQueueAttributes"},
+        "QueueUrl": {queueURL},
+        "AttributeName.1": {"ApproximateNumberOfMessages"},
+        "AttributeName.2": {"ApproximateNumberOfMessagesNotVisible"},
+    })
+    if !strings.Contains(body, "<Name>ApproximateNumberOfMessages</Name><Value>1</Value>") || !strings.Contains(body, "<Name>ApproximateNumberOfMessagesNotVisible</Name><Value>0</Value>") {
+        t.Errorf("Expected one visible message, got %d %s", status, body)
+    }
+}
+
+
+func TestServerReturnsQueryErrors(t *testing.T) {
+    server := NewServer(&ServerConfig{})
+    defer server.Close()
+    queueURL := server.CreateQueue("queue")
+    cases := map[string]url.Values{
+        "AWS.SimpleQueueService.NonExistentQueue": {"Action": {"ReceiveMessage"}, "QueueUrl": {server.URL() + "/" + AccountID + "/missing"}},
+        "AWS.SimpleQueueService.EmptyBatchRequest": {"Action": {"DeleteMessageBatch"}, "QueueUrl": {queueURL}},
+        "AWS.SimpleQueueService.BatchEntryIdsNotDistinct": {
+            "Action": {"DeleteMessageBatch"},
+            "QueueUrl": {queueURL},
+            "DeleteMessageBatchRequestEntry.1.Id": {"same"},
+            "DeleteMessageBatchRequestEntry.2.Id": {"same"},
+        },
+        "InvalidParameterValue": {"Action": {"ReceiveMessage"}, "QueueUrl": {queueURL}, "MaxNumberOfMessages": {"11"}},
+        "InvalidAction": {"Action": {"PurgeQueue"}, "QueueUrl": {queueURL}},
+    }
+    for code, form := range cases {
+        status, body := postQuery(t, server, form)
+        if status != http.StatusBadRequest || !strings.Contains(body, "<Code>" + code + "</Code>") {
+            t.Errorf("Expected %s, got %d %s", code, status, body)
+        }
+    }
+}